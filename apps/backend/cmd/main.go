@@ -1,30 +1,74 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"simple-relay/backend/internal/logging"
 	"simple-relay/backend/internal/messages"
+	"simple-relay/backend/internal/metrics"
 	"simple-relay/backend/internal/services"
 	"simple-relay/backend/internal/services/upstream"
 	"simple-relay/shared/database"
+	"simple-relay/shared/timewindow"
 
 	"cloud.google.com/go/compute/metadata"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const (
 	oauthBetaFlag = "oauth-2025-04-20"
+
+	// Remaining-token header Anthropic returns on successful responses, and when that budget refills
+	tokensRemainingHeader = "anthropic-ratelimit-tokens-remaining"
+	tokensResetHeader     = "anthropic-ratelimit-tokens-reset"
+
+	// Latency reported to billing: TTFB as a header, total duration as a trailer sent after the stream ends
+	upstreamTTFBHeader       = "X-Upstream-TTFB-Ms"
+	upstreamTotalTimeTrailer = "X-Upstream-Total-Ms"
+
+	// Status code of the response forwarded to billing, which records error responses without usage
+	upstreamStatusHeader = "X-Upstream-Status"
+
+	// Client IP resolved from the trusted forwarding headers, stored by billing on the usage record
+	clientIPHeader = "X-Client-IP"
+
+	// Client header lowering the per-request cost ceiling (USD); never forwarded upstream
+	maxRequestCostHeader = "X-Max-Request-Cost"
+
+	// Client header carrying a signed daily limit override from POST /admin/limit-overrides; never forwarded upstream
+	limitOverrideHeader = "X-Limit-Override"
+
+	// Longest lifetime an issued limit override may have
+	maxLimitOverrideTTL = 7 * 24 * time.Hour
 )
 
+// closerFunc adapts a function to io.Closer
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
 // writeError writes an HTTP error response without adding extra newlines
 // We use this custom function instead of http.Error() because http.Error()
 // automatically appends a newline (\n) to the response body, which causes
@@ -36,6 +80,25 @@ func writeError(w http.ResponseWriter, message string, statusCode int) {
 	w.Write([]byte(message))
 }
 
+// writeRetryAfterError is writeError for rejections that lift at a known time: Retry-After tells the
+// client when, and X-Should-Retry is left out so the client may retry then
+func writeRetryAfterError(w http.ResponseWriter, message string, statusCode int, wait time.Duration) {
+	w.Header().Set("Retry-After", retryAfterSeconds(wait))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(statusCode)
+	w.Write([]byte(message))
+}
+
+// writeLimitExceeded rejects a request over a points limit until the limit's window ends
+func writeLimitExceeded(w http.ResponseWriter, message string, window timewindow.Window, now time.Time) {
+	writeRetryAfterError(w, message, http.StatusTooManyRequests, window.End.Sub(now))
+}
+
+// retryAfterSeconds formats wait as Retry-After seconds, rounded up and at least 1
+func retryAfterSeconds(wait time.Duration) string {
+	return strconv.Itoa(max(1, int(math.Ceil(wait.Seconds()))))
+}
+
 // getIdentityToken retrieves an identity token for service-to-service authentication
 func getIdentityToken(audience string) (string, error) {
 	// Use Google's official metadata library
@@ -43,11 +106,100 @@ func getIdentityToken(audience string) (string, error) {
 }
 
 type Config struct {
-	APIKey            string
-	OfficialTarget    *url.URL
-	BillingServiceURL string
-	ProjectID         string
-	DatabaseName      string
+	APIKey             string
+	OfficialTarget     *url.URL
+	BillingServiceURL  string
+	ProjectID          string
+	DatabaseName       string
+	MinTokenBudget     int                   // Accounts reporting fewer remaining tokens are deprioritized (0 disables)
+	StrictModelMode    bool                  // Reject requests for models without a pricing entry before proxying
+	ModelPointsLimits  bool                  // Enforce per-model daily limits from daily_points_limits/{user}/models
+	DevMode            bool                  // Local testing only: allows plain-http upstreams
+	InjectOAuthBeta    bool                  // Add the OAuth beta flag to anthropic-beta (can only be disabled in dev mode)
+	MaskedErrorClasses map[int]bool          // Upstream status classes (4 for 4xx, 5 for 5xx) whose bodies are replaced with generic errors
+	MaxRequestCost     float64               // Streams projected to cost more than this (USD) are cut off (0 disables)
+	OrgErrorPatterns   []string              // Upstream error types/messages meaning the account's org is gone (empty disables the fallback)
+	MessagePrefix      string                // Product name shown in front of client-facing error messages
+	MessagesFile       string                // Optional JSON file with per-language message overrides
+	LogFormat          string                // "text" for key=value logs; JSON for Cloud Logging otherwise
+	MaintenanceForced  bool                  // Keep maintenance mode on regardless of the app_config flag
+	MaintenanceRefresh int                   // Seconds between maintenance flag refreshes from app_config
+	SelectionChain     string                // Ordered account selection strategies, e.g. "org,model-pool,cost,random"
+	ModelPools         string                // Accounts per model pattern for the model-pool strategy, e.g. "opus=uuid1|uuid2"
+	ExpiryMargin       int                   // Seconds subtracted from a refreshed token's expires_in before storing it
+	ClockCheckURL      string                // Trusted HTTPS endpoint whose Date header is compared with local time at startup (empty disables)
+	ClockSkewWarn      int                   // Seconds of clock skew that trigger a startup warning
+	IPRateLimit        float64               // Requests per second allowed per client IP before authentication (0 disables)
+	IPRateBurst        int                   // Requests a client IP may burst above IPRateLimit
+	MaxConcurrent      int                   // Requests a user may have in flight at once; more are rejected with 429 (0 disables)
+	TrustedProxyHops   int                   // Proxies in front of the service that append to X-Forwarded-For (0 uses the peer address)
+	UsageCacheSize     int                   // Users whose daily points check results are cached
+	ModelAliases       services.ModelAliases // Requested model -> model sent upstream
+	RewriteModelAlias  bool                  // Show clients the model they asked for instead of the upstream model
+	MaxHistoryMessages int                   // Requests with more messages are rejected with 413 (0 disables)
+	MaxHistoryBytes    int                   // Requests whose messages array is larger than this many bytes are rejected with 413 (0 disables)
+	MaxBodyBytes       int                   // Request bodies larger than this are rejected with 413 before reaching upstream (0 disables)
+	PlaintextAPIKeys   bool                  // Accept bindings stored under the plaintext key while migrating to hashed keys
+	PathRewrites       services.PathRewrites // Client paths mapped to the upstream provider's paths, e.g. /v1/messages to an invoke path
+	DisabledPoll       int                   // Seconds between polls for accounts disabled by other instances, whose cached bindings are then migrated (0 disables)
+	RateLimitSweep     int                   // Seconds between sweeps clearing saved 429 headers whose reset time has passed (0 disables)
+	PricingReload      int                   // Minutes between reloads of model_pricing into the model catalog (0 uses the built-in prices only)
+	BindingTTL         int                   // Minutes a cached user binding is reused before its account's health is re-checked
+	RetryRateLimited   bool                  // Replay a request that got a 429 once on another upstream account before returning 529
+	RefreshLookahead   int                   // Minutes before expiry that OAuth tokens are refreshed in the background (0 disables)
+	RefreshInterval    int                   // Seconds between checks for OAuth tokens nearing expiry
+	RefreshLockTimeout int                   // Seconds after which another worker's unfinished token refresh is treated as abandoned
+	ShutdownTimeout    int                   // Seconds SIGTERM waits for in-flight requests and their billing forwards
+	BillingTimeout     time.Duration         // How long the billing service may take to answer a fully sent payload
+	BreakerFailures    int                   // Consecutive failed billing requests that stop forwarding for BreakerCooldown (0 disables)
+	BreakerCooldown    time.Duration         // How long billing payloads are dropped once the breaker opens
+	OAuthClient        upstream.OAuthClient  // Token endpoint and client ID used to refresh upstream OAuth tokens
+}
+
+// getEnvInt reads an integer environment variable, returning defaultValue when unset or invalid
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using default %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+// getEnvFloat reads a float environment variable, returning defaultValue when unset or invalid
+func getEnvFloat(key string, defaultValue float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using default %v", key, value, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+// getEnvDuration reads a duration environment variable such as "30s"; a bare number is taken as
+// seconds. Returns defaultValue when unset or invalid.
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		log.Printf("Invalid value for %s: %q, using default %s", key, value, defaultValue)
+		return defaultValue
+	}
+	return parsed
 }
 
 func loadConfig() *Config {
@@ -71,6 +223,18 @@ func loadConfig() *Config {
 		}
 	}
 
+	// Dev mode allows pointing OFFICIAL_BASE_URL at a local http mock; never allowed in production
+	devMode := os.Getenv("UPSTREAM_DEV_MODE") == "true"
+	if devMode && os.Getenv("DEPLOYMENT_ENV") == "production" {
+		log.Fatal("UPSTREAM_DEV_MODE must not be enabled in production")
+	}
+	if officialTarget != nil {
+		if err := validateUpstreamURL(officialTarget, devMode); err != nil {
+			log.Fatal("Invalid official target URL: ", err)
+		}
+	}
+	injectOAuthBeta := !(devMode && os.Getenv("SKIP_OAUTH_BETA_HEADER") == "true")
+
 	// Get billing service URL (required)
 	billingServiceURL := os.Getenv("BILLING_SERVICE_URL")
 	if billingServiceURL == "" {
@@ -87,15 +251,175 @@ func loadConfig() *Config {
 		log.Fatal("FIRESTORE_DATABASE_NAME environment variable is required")
 	}
 
+	// An explicitly empty prefix removes the product name from messages
+	messagePrefix, ok := os.LookupEnv("ERROR_MESSAGE_PREFIX")
+	if !ok {
+		messagePrefix = messages.DefaultPrefix
+	}
+
+	// Clock skew is checked against the upstream by default; "none" disables the check
+	clockCheckURL := os.Getenv("CLOCK_CHECK_URL")
+	switch clockCheckURL {
+	case "":
+		clockCheckURL = officialTarget.String()
+	case "none":
+		clockCheckURL = ""
+	}
+
+	pathRewrites, err := services.ParsePathRewrites(os.Getenv("UPSTREAM_PATH_REWRITES"))
+	if err != nil {
+		log.Fatalf("Invalid UPSTREAM_PATH_REWRITES: %v", err)
+	}
+
+	oauthClient, err := loadOAuthClient(devMode)
+	if err != nil {
+		log.Fatalf("Invalid OAUTH_TOKEN_ENDPOINT: %v", err)
+	}
+
 	return &Config{
-		APIKey:            apiKey,
-		OfficialTarget:    officialTarget,
-		BillingServiceURL: billingServiceURL,
-		ProjectID:         projectID,
-		DatabaseName:      databaseName,
+		APIKey:             apiKey,
+		OfficialTarget:     officialTarget,
+		BillingServiceURL:  billingServiceURL,
+		ProjectID:          projectID,
+		DatabaseName:       databaseName,
+		MinTokenBudget:     getEnvInt("MIN_UPSTREAM_TOKEN_BUDGET", 20000),
+		StrictModelMode:    os.Getenv("STRICT_MODEL_MODE") == "true",
+		ModelPointsLimits:  os.Getenv("MODEL_POINTS_LIMITS") == "true",
+		DevMode:            devMode,
+		InjectOAuthBeta:    injectOAuthBeta,
+		MaskedErrorClasses: parseErrorClasses(os.Getenv("MASK_UPSTREAM_ERRORS")),
+		MaxRequestCost:     getEnvFloat("MAX_REQUEST_COST_USD", 0),
+		OrgErrorPatterns:   parseOrgErrorPatterns(os.Getenv("ORG_UNAVAILABLE_ERRORS")),
+		MessagePrefix:      messagePrefix,
+		MessagesFile:       os.Getenv("ERROR_MESSAGES_FILE"),
+		LogFormat:          os.Getenv("LOG_FORMAT"),
+		MaintenanceForced:  os.Getenv("MAINTENANCE_MODE") == "true",
+		MaintenanceRefresh: getEnvInt("MAINTENANCE_REFRESH_SECONDS", 15),
+		SelectionChain:     os.Getenv("ACCOUNT_SELECTION_CHAIN"),
+		ModelPools:         os.Getenv("ACCOUNT_MODEL_POOLS"),
+		ExpiryMargin:       getEnvInt("OAUTH_EXPIRY_MARGIN_SECONDS", int(upstream.DefaultExpirySafetyMargin/time.Second)),
+		ClockCheckURL:      clockCheckURL,
+		ClockSkewWarn:      getEnvInt("CLOCK_SKEW_WARN_SECONDS", 30),
+		IPRateLimit:        getEnvFloat("IP_RATE_LIMIT_RPS", 0),
+		IPRateBurst:        getEnvInt("IP_RATE_LIMIT_BURST", 20),
+		MaxConcurrent:      getEnvInt("MAX_CONCURRENT_REQUESTS_PER_USER", 0),
+		TrustedProxyHops:   getEnvInt("TRUSTED_PROXY_HOPS", 1),
+		UsageCacheSize:     getEnvInt("USAGE_CACHE_SIZE", services.DefaultUsageCacheSize),
+		ModelAliases:       services.ParseModelAliases(os.Getenv("MODEL_ALIASES")),
+		RewriteModelAlias:  os.Getenv("MODEL_ALIAS_REWRITE_RESPONSE") == "true",
+		MaxHistoryMessages: getEnvInt("MAX_HISTORY_MESSAGES", 0),
+		MaxHistoryBytes:    getEnvInt("MAX_HISTORY_BYTES", 0),
+		MaxBodyBytes:       getEnvInt("MAX_REQUEST_BODY_BYTES", defaultMaxBodyBytes),
+		PlaintextAPIKeys:   os.Getenv("DISABLE_PLAINTEXT_API_KEYS") != "true",
+		PathRewrites:       pathRewrites,
+		DisabledPoll:       getEnvInt("DISABLED_ACCOUNT_POLL_SECONDS", 30),
+		RateLimitSweep:     getEnvInt("RATE_LIMIT_SWEEP_SECONDS", 300),
+		PricingReload:      getEnvInt("MODEL_PRICING_RELOAD_MINUTES", 5),
+		BindingTTL:         getEnvInt("USER_BINDING_TTL_MINUTES", int(upstream.DefaultBindingTTL/time.Minute)),
+		RetryRateLimited:   os.Getenv("DISABLE_RATE_LIMIT_RETRY") != "true",
+		RefreshLookahead:   getEnvInt("OAUTH_REFRESH_LOOKAHEAD_MINUTES", int(upstream.DefaultRefreshLookahead/time.Minute)),
+		RefreshInterval:    getEnvInt("OAUTH_REFRESH_CHECK_SECONDS", 60),
+		RefreshLockTimeout: getEnvInt("OAUTH_REFRESH_LOCK_TIMEOUT_SECONDS", int(upstream.DefaultRefreshLockTimeout/time.Second)),
+		ShutdownTimeout:    getEnvInt("SHUTDOWN_TIMEOUT_SECONDS", 10),
+		BillingTimeout:     getEnvDuration("BILLING_CLIENT_TIMEOUT", services.DefaultBillingTimeout),
+		BreakerFailures:    getEnvInt("BILLING_BREAKER_FAILURES", 5),
+		BreakerCooldown:    getEnvDuration("BILLING_BREAKER_COOLDOWN", 30*time.Second),
+		OAuthClient:        oauthClient,
 	}
 }
 
+// checkClockSkew logs a warning when local time differs from the trusted source by more than threshold
+func checkClockSkew(url string, threshold, expiryMargin time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	skew, err := upstream.MeasureClockSkew(ctx, &http.Client{}, url)
+	if err != nil {
+		log.Printf("[CLOCK] Could not check clock skew against %s: %v", url, err)
+		return
+	}
+	if skew.Abs() <= threshold {
+		log.Printf("[CLOCK] Local clock is within %s of %s (skew %s)", threshold, url, skew.Round(time.Second))
+		return
+	}
+	log.Printf("[CLOCK] WARNING: local clock differs from %s by %s; tokens may be used after upstream expires them",
+		url, skew.Round(time.Second))
+	if skew > expiryMargin {
+		log.Printf("[CLOCK] WARNING: skew exceeds the %s token expiry margin; raise OAUTH_EXPIRY_MARGIN_SECONDS or fix NTP", expiryMargin)
+	}
+}
+
+// parseOrgErrorPatterns parses a comma-separated list of org-level error patterns.
+// Unset uses the built-in defaults; "none" disables the org fallback.
+func parseOrgErrorPatterns(value string) []string {
+	value = strings.TrimSpace(value)
+	switch value {
+	case "":
+		return upstream.DefaultOrgUnavailablePatterns
+	case "none":
+		return nil
+	}
+	var patterns []string
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			patterns = append(patterns, part)
+		}
+	}
+	return patterns
+}
+
+// parseErrorClasses parses a comma-separated list of status classes such as "4xx,5xx"
+func parseErrorClasses(value string) map[int]bool {
+	classes := make(map[int]bool)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if part == "" {
+			continue
+		}
+		if len(part) != 3 || !strings.HasSuffix(part, "xx") || (part[0] != '4' && part[0] != '5') {
+			log.Printf("Ignoring invalid status class in MASK_UPSTREAM_ERRORS: %q", part)
+			continue
+		}
+		classes[int(part[0]-'0')] = true
+	}
+	return classes
+}
+
+// validateUpstreamURL ensures the upstream uses HTTPS unless dev mode is enabled
+func validateUpstreamURL(target *url.URL, devMode bool) error {
+	switch target.Scheme {
+	case "https":
+		return nil
+	case "http":
+		if devMode {
+			return nil
+		}
+		return fmt.Errorf("plain-http upstream %s requires UPSTREAM_DEV_MODE=true", target.Host)
+	default:
+		return fmt.Errorf("unsupported upstream scheme %q", target.Scheme)
+	}
+}
+
+// loadOAuthClient reads OAUTH_TOKEN_ENDPOINT and OAUTH_CLIENT_ID, defaulting to Claude Code's OAuth
+// app. Like the upstream, the token endpoint must use HTTPS outside dev mode.
+func loadOAuthClient(devMode bool) (upstream.OAuthClient, error) {
+	client := upstream.DefaultOAuthClient
+	if endpoint := os.Getenv("OAUTH_TOKEN_ENDPOINT"); endpoint != "" {
+		target, err := url.Parse(endpoint)
+		if err != nil {
+			return client, err
+		}
+		if err := validateUpstreamURL(target, devMode); err != nil {
+			return client, err
+		}
+		client.TokenEndpoint = endpoint
+	}
+	if clientID := os.Getenv("OAUTH_CLIENT_ID"); clientID != "" {
+		client.ClientID = clientID
+	}
+	return client, nil
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -105,6 +429,11 @@ func min(a, b int) int {
 
 func main() {
 	config := loadConfig()
+	logging.Setup(os.Stderr, config.LogFormat)
+
+	if err := messages.Configure(config.MessagePrefix, config.MessagesFile); err != nil {
+		log.Fatalf("Failed to load error messages: %v", err)
+	}
 
 	// Initialize database service for OAuth
 	dbService, err := database.NewService(config.ProjectID, config.DatabaseName)
@@ -115,66 +444,374 @@ func main() {
 
 	// Initialize OAuth store
 	oauthStore := upstream.NewOAuthStore(dbService)
+	oauthStore.SetMinTokenBudget(config.MinTokenBudget)
+	selectionChain, err := upstream.ParseSelectionChain(config.SelectionChain, config.ModelPools, oauthStore)
+	if err != nil {
+		log.Fatalf("Invalid ACCOUNT_SELECTION_CHAIN: %v", err)
+	}
+	oauthStore.SetSelectionChain(selectionChain)
+	oauthStore.SetExpirySafetyMargin(time.Duration(config.ExpiryMargin) * time.Second)
+	oauthStore.SetRefreshLockTimeout(time.Duration(config.RefreshLockTimeout) * time.Second)
+	oauthStore.SetOAuthClient(config.OAuthClient)
+	oauthStore.SetBindingTTL(time.Duration(config.BindingTTL) * time.Minute)
+
+	// Skewed clocks make tokens look valid after upstream has expired them; checked in the background
+	if config.ClockCheckURL != "" {
+		go checkClockSkew(config.ClockCheckURL, time.Duration(config.ClockSkewWarn)*time.Second, time.Duration(config.ExpiryMargin)*time.Second)
+	}
+
+	// Accounts disabled by other instances only leave this instance's binding cache when polled
+	if config.DisabledPoll > 0 {
+		go oauthStore.WatchDisabledAccounts(context.Background(), time.Duration(config.DisabledPoll)*time.Second)
+	}
+
+	// Selection only clears expired 429 headers of accounts it looks at; the sweep covers the rest
+	if config.RateLimitSweep > 0 {
+		go oauthStore.WatchExpiredRateLimits(context.Background(), time.Duration(config.RateLimitSweep)*time.Second)
+	}
+
+	// Tokens nearing expiry are refreshed in the background so requests rarely refresh inline; a Firestore
+	// lease keeps the refreshes on one instance at a time
+	if config.RefreshLookahead > 0 && config.RefreshInterval > 0 {
+		scheduler := upstream.NewTokenRefreshScheduler(oauthStore, time.Duration(config.RefreshLookahead)*time.Minute)
+		go scheduler.Run(context.Background(), time.Duration(config.RefreshInterval)*time.Second)
+	}
 
 	// Initialize API key service
 	apiKeyService := services.NewApiKeyService(dbService.Client())
+	apiKeyService.SetPlaintextFallback(config.PlaintextAPIKeys)
 
 	// Initialize usage checker
 	usageChecker := services.NewUsageChecker(dbService.Client())
+	usageChecker.SetCacheSize(config.UsageCacheSize)
+
+	// Initialize throttle checker for users flagged by billing
+	throttleChecker := services.NewThrottleChecker(dbService.Client())
+
+	// Initialize per-user request cost ceilings, applied on top of MAX_REQUEST_COST_USD
+	costCeilingChecker := services.NewCostCeilingChecker(dbService.Client())
+
+	// Initialize model access checker for users restricted to certain models
+	modelAccessChecker := services.NewModelAccessChecker(dbService.Client())
+
+	// Initialize model catalog for strict model validation and cost ceilings; prices added in
+	// model_pricing are picked up on the next reload
+	modelCatalog := services.NewModelCatalog()
+	if config.PricingReload > 0 {
+		modelCatalog.SetPricingSource(dbService.Client())
+		if err := modelCatalog.ReloadPricing(context.Background()); err != nil {
+			log.Printf("Failed to load model pricing, using built-in prices: %v", err)
+		}
+		go modelCatalog.WatchPricing(context.Background(), time.Duration(config.PricingReload)*time.Minute)
+	}
+
+	// Initialize billing forwarder; identity tokens are cached and retried so metadata
+	// server hiccups don't drop usage, and payloads are queued if no token is available
+	var identityTokens *services.IdentityTokenSource
+	if os.Getenv("DISABLE_IDENTITY_TOKEN") != "true" {
+		identityTokens = services.NewIdentityTokenSource(getIdentityToken)
+	}
+	billingForwarder := services.NewBillingForwarder(config.BillingServiceURL, identityTokens)
+	billingForwarder.SetTimeout(config.BillingTimeout)
+	billingForwarder.SetCircuitBreaker(config.BreakerFailures, config.BreakerCooldown)
+	billingForwarder.StartRetryLoop(30 * time.Second)
+	defer billingForwarder.Stop()
+
+	// Maintenance mode pauses all proxied traffic; toggled via app_config without redeploying
+	maintenance := services.NewMaintenanceMode(dbService.Client(), config.MaintenanceForced)
+	maintenance.Start(time.Duration(config.MaintenanceRefresh) * time.Second)
+	defer maintenance.Stop()
+
+	// Per-IP token bucket rejecting floods before any API key lookup
+	var ipLimiter *services.IPRateLimiter
+	if config.IPRateLimit > 0 {
+		ipLimiter = services.NewIPRateLimiter(config.IPRateLimit, config.IPRateBurst)
+	}
+
+	// Per-user cap on requests in flight, so parallel streams can't exhaust a shared account
+	var concurrencyLimiter *services.UserConcurrencyLimiter
+	if config.MaxConcurrent > 0 {
+		concurrencyLimiter = services.NewUserConcurrencyLimiter(config.MaxConcurrent)
+	}
+
+	// The proxy path only needs the token pool interface, so it can be exercised without Firestore
+	var tokens upstream.TokenProvider = oauthStore
 
 	// Create reverse proxy
-	proxy := httputil.NewSingleHostReverseProxy(config.OfficialTarget)
+	proxy := newUpstreamProxy(config, tokens, billingForwarder, modelCatalog)
 
 	// Create a custom handler that checks authentication before proxying
 	proxyHandler := func(w http.ResponseWriter, req *http.Request) {
-		log.Printf("[OAUTH] Request received: %s %s", req.Method, req.URL.Path)
+		logger := logging.FromContext(req.Context())
+		logger.Info("request received", "method", req.Method, "path", req.URL.Path)
+		lang := req.Header.Get("Accept-Language")
 		// Extract user ID from API key
 		userId := extractUserIdFromAPIKey(req, apiKeyService)
 
 		// Reject request if no valid API key provided
 		if userId == "" {
-			log.Printf("[OAUTH] No valid user ID found from API key")
-			writeError(w, messages.ClientErrorMessages.Unauthorized, http.StatusUnauthorized)
+			logger.Warn("no valid user ID found from API key")
+			writeError(w, messages.Localize(messages.Unauthorized, lang), http.StatusUnauthorized)
+			return
+		}
+		// Every later line for this request, including the proxy's response handling, carries the user
+		logger = logger.With("user_id", userId)
+		req = req.WithContext(logging.WithLogger(req.Context(), logger))
+		logger.Info("authenticated request")
+
+		// Users without allowed_models/denied_models may call any model
+		modelAccess, err := modelAccessChecker.ModelAccess(req.Context(), userId)
+		if err != nil {
+			logger.Error("failed to check model access", "error", err)
+			writeError(w, messages.Localize(messages.InternalServerError, lang), http.StatusInternalServerError)
+			return
+		}
+
+		// The model is only read from the body when account selection, aliasing, per-model limits or model restrictions need it
+		var model string
+		if tokens.SelectionUsesModel() || len(config.ModelAliases) > 0 || config.ModelPointsLimits || modelAccess.Restricted() {
+			var err error
+			model, err = readRequestModel(req)
+			if err != nil {
+				logger.Error("failed to read request body", "error", err)
+				writeError(w, messages.Localize(messages.InternalServerError, lang), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// Send aliased models upstream as their replacement; everything below sees the upstream model
+		var alias *services.ModelAlias
+		if upstreamModel, ok := config.ModelAliases.Resolve(model); ok {
+			if err := rewriteRequestModel(req, upstreamModel); err != nil {
+				logger.Error("failed to rewrite model", "error", err)
+				writeError(w, messages.Localize(messages.InternalServerError, lang), http.StatusInternalServerError)
+				return
+			}
+			logger.Info("rewrote model alias", "model", model, "upstream_model", upstreamModel)
+			alias = &services.ModelAlias{Requested: model, Upstream: upstreamModel}
+			model = upstreamModel
+		}
+
+		// Restrictions apply to the model actually called upstream, so an alias can't bypass them
+		if model != "" && !modelAccess.Allows(model) {
+			logger.Warn("rejecting model not allowed for user", "model", model)
+			writeError(w, messages.Localize(messages.ModelNotAllowed, lang), http.StatusForbidden)
 			return
 		}
-		log.Printf("[OAUTH] Found user ID: %s", userId)
 
 		// Check daily points limit before processing request
-		remainingPoints, err := usageChecker.CheckDailyPointsLimit(req.Context(), userId)
+		pointsCheck, err := usageChecker.CheckDailyPointsLimit(req.Context(), userId)
+		if err != nil {
+			logger.Error("failed to check daily points limit", "error", err)
+			writeError(w, messages.Localize(messages.InternalServerError, lang), http.StatusInternalServerError)
+			return
+		}
+		pointsCheck = applyLimitOverride(config.APIKey, req.Header.Get(limitOverrideHeader), userId, pointsCheck)
+		switch pointsCheck.State {
+		case services.PointsLimitUnset:
+			logger.Warn("no daily points limit configured")
+			writeError(w, messages.Localize(messages.NoDailyAllowance, lang), http.StatusTooManyRequests)
+			return
+		case services.PointsExhausted:
+			writeLimitExceeded(w, messages.Localize(messages.DailyLimitExceeded, lang), timewindow.CurrentDailyReset(), time.Now())
+			return
+		}
+
+		// Per-model limits cap individual models on top of the global daily limit
+		if config.ModelPointsLimits && model != "" {
+			modelCheck, err := usageChecker.CheckModelPointsLimit(req.Context(), userId, model)
+			if err != nil {
+				logger.Error("failed to check model points limit", "model", model, "error", err)
+				writeError(w, messages.Localize(messages.InternalServerError, lang), http.StatusInternalServerError)
+				return
+			}
+			if modelCheck.State == services.PointsExhausted {
+				logger.Warn("daily points limit for model reached", "model", model)
+				writeLimitExceeded(w, messages.Localize(messages.ModelLimitExceeded, lang), timewindow.CurrentDailyReset(), time.Now())
+				return
+			}
+		}
+
+		// Monthly limits are optional; only users with one configured and used up are rejected
+		monthlyCheck, err := usageChecker.CheckMonthlyPointsLimit(req.Context(), userId)
 		if err != nil {
-			log.Printf("Error checking points limit for user %s: %v", userId, err)
-			writeError(w, messages.ClientErrorMessages.InternalServerError, http.StatusInternalServerError)
+			logger.Error("failed to check monthly points limit", "error", err)
+			writeError(w, messages.Localize(messages.InternalServerError, lang), http.StatusInternalServerError)
+			return
+		}
+		if monthlyCheck.State == services.PointsExhausted {
+			logger.Warn("monthly points limit reached")
+			writeLimitExceeded(w, messages.Localize(messages.MonthlyLimitExceeded, lang), timewindow.Month(time.Now()), time.Now())
 			return
 		}
-		if remainingPoints <= 0 {
-			w.Header().Set("X-Should-Retry", "false")
-			writeError(w, messages.ClientErrorMessages.DailyLimitExceeded, http.StatusTooManyRequests)
+
+		// Users flagged for over-cap responses are paused until their throttle ends (fails open on lookup errors)
+		if until, err := throttleChecker.ThrottledUntil(req.Context(), userId); err != nil {
+			logger.Error("failed to check throttle", "error", err)
+		} else if remaining := time.Until(until); remaining > 0 {
+			logger.Warn("user is throttled", "throttled_until", until.Format(time.RFC3339))
+			writeRetryAfterError(w, messages.Localize(messages.Throttled, lang), http.StatusTooManyRequests, remaining)
 			return
 		}
 
 		// Get OAuth token for user
-		log.Printf("[OAUTH] Getting OAuth token for user %s", userId)
-		tokenBinding, err := oauthStore.GetValidTokenForUser(userId)
+		tokenBinding, err := tokens.GetValidTokenForModel(userId, model)
+		if err != nil {
+			logger.Error("failed to get valid OAuth token", "error", err)
+			writeError(w, messages.Localize(messages.InternalServerError, lang), http.StatusInternalServerError)
+			return
+		}
+		logger.Info("got OAuth token", "account_uuid", tokenBinding.AccountUUID,
+			"expires_at", tokenBinding.ExpiresAt.Format(time.RFC3339))
+
+		// A failed per-user lookup falls back to the global ceiling and the client header
+		userCeiling, err := costCeilingChecker.UserCeiling(req.Context(), userId)
+		if err != nil {
+			logger.Error("failed to check request cost ceiling", "error", err)
+		}
+		ceiling := requestCostCeiling(config.MaxRequestCost, userCeiling, req.Header.Get(maxRequestCostHeader))
+		req = withProxyContext(req, userId, tokenBinding, ceiling)
+		// Resolved before the director drops X-Forwarded-For, so billing can store it
+		req = req.WithContext(context.WithValue(req.Context(), "clientIP", clientIP(req, config.TrustedProxyHops)))
+		if alias != nil && config.RewriteModelAlias {
+			req = req.WithContext(context.WithValue(req.Context(), "modelAlias", *alias))
+		}
+		if model != "" {
+			// Lets a rate-limit retry pick its replacement account for the same model
+			req = req.WithContext(context.WithValue(req.Context(), "model", model))
+		}
+		serveWithConcurrencyLimit(concurrencyLimiter, userId, proxy, w, req)
+	}
+
+	r := mux.NewRouter()
+
+	// Health check endpoint
+	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	}).Methods("GET")
+
+	// Readiness check that also verifies Firestore connectivity
+	r.HandleFunc("/ready", serveReady(dbService)).Methods("GET")
+
+	// Admin diagnostics, authenticated with API_SECRET_KEY
+	r.HandleFunc("/admin/stats", requireAdminKey(config.APIKey, func(w http.ResponseWriter, r *http.Request) {
+		accounts, err := oauthStore.AccountPoolStats(r.Context())
 		if err != nil {
-			log.Printf("[OAUTH] ERROR: Failed to get valid token for user %s: %v", userId, err)
-			writeError(w, messages.ClientErrorMessages.InternalServerError, http.StatusInternalServerError)
+			log.Printf("[ADMIN] Failed to load account pool stats: %v", err)
+			http.Error(w, "failed to load account pool stats", http.StatusInternalServerError)
 			return
 		}
-		log.Printf("[OAUTH] Successfully got token for user %s: expires=%s", 
-			userId, tokenBinding.ExpiresAt.Format(time.RFC3339))
+		stats := adminStats{
+			ApiKeyCache:     apiKeyService.CacheStats(),
+			UsageCache:      usageChecker.CacheStats(),
+			UserTokenCache:  oauthStore.UserTokenCacheSize(),
+			Accounts:        accounts,
+			BillingTimeouts: billingForwarder.TimeoutCount(),
+			BillingDropped:  billingForwarder.DroppedCount(),
+			BillingCircuit:  billingForwarder.CircuitOpen(),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})).Methods("GET")
+
+	// Drops stale user -> account bindings after an admin reassigns or disables an account
+	r.HandleFunc("/admin/token-bindings", requireAdminKey(config.APIKey, func(w http.ResponseWriter, r *http.Request) {
+		clearTokenBindings(w, r, tokens)
+	})).Methods("DELETE")
+
+	// Drops a cached API key lookup so a revoked or disabled key is rejected on its next request
+	r.HandleFunc("/admin/api-key-cache", requireAdminKey(config.APIKey, func(w http.ResponseWriter, r *http.Request) {
+		invalidateApiKeyCache(w, r, apiKeyService)
+	})).Methods("DELETE")
+
+	// Issues signed, time-boxed daily limit overrides for X-Limit-Override
+	r.HandleFunc("/admin/limit-overrides", requireAdminKey(config.APIKey, func(w http.ResponseWriter, r *http.Request) {
+		issueLimitOverride(w, r, config.APIKey, time.Now())
+	})).Methods("POST")
+
+	// Lets clients see their daily limit, usage and reset time before hitting a 429
+	r.HandleFunc("/usage", withIPRateLimit(ipLimiter, config.TrustedProxyHops, func(w http.ResponseWriter, r *http.Request) {
+		serveUsage(w, r, apiKeyService, usageChecker)
+	})).Methods("GET")
+
+	// Prometheus scrape endpoint for the counters in internal/metrics
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
+
+	// Proxy all requests with API key validation; paused in maintenance mode while /health stays up
+	r.PathPrefix("/").HandlerFunc(withRequestID(withMetrics(withMaintenance(maintenance, withIPRateLimit(ipLimiter, config.TrustedProxyHops,
+		withBodyLimit(config.MaxBodyBytes, withHistoryLimit(config.MaxHistoryMessages, config.MaxHistoryBytes,
+			withKnownModels(config.StrictModelMode, modelCatalog, config.ModelAliases, proxyHandler))))))))
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
 
-		// Store user ID, access token, and account UUID in request context for proxy director
-		ctx := context.WithValue(req.Context(), "userId", userId)
-		ctx = context.WithValue(ctx, "accessToken", tokenBinding.AccessToken)
-		ctx = context.WithValue(ctx, "upstreamAccountUUID", tokenBinding.AccountUUID)
-		req = req.WithContext(ctx)
-		proxy.ServeHTTP(w, req)
+	log.Printf("Server starting on port %s", port)
+	log.Printf("Proxying to %s", config.OfficialTarget.String())
+	if config.DevMode {
+		log.Printf("WARNING: UPSTREAM_DEV_MODE is enabled (plain-http upstreams allowed, OAuth beta header injection: %v)", config.InjectOAuthBeta)
+	}
+	server := &http.Server{Addr: ":" + port, Handler: r}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	// Cloud Run sends SIGTERM before stopping an instance
+	signalCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	select {
+	case err := <-serverErr:
+		log.Fatalf("Server failed: %v", err)
+	case <-signalCtx.Done():
+	}
+
+	log.Printf("Shutting down: draining requests and billing forwards (timeout %ds)", config.ShutdownTimeout)
+	if err := shutdownGracefully(server, billingForwarder, time.Duration(config.ShutdownTimeout)*time.Second); err != nil {
+		log.Printf("Graceful shutdown incomplete: %v", err)
+		return
+	}
+	log.Println("Server stopped")
+}
+
+// shutdownGracefully stops accepting requests and waits for in-flight ones, then waits for their
+// billing forwards. A billing forward only ends once its client has read the whole response, so the
+// server is drained first. Both steps share timeout.
+func shutdownGracefully(server *http.Server, billingForwarder *services.BillingForwarder, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error draining in-flight requests: %v", err)
+	}
+	if err := billingForwarder.Drain(ctx); err != nil {
+		return fmt.Errorf("billing forwards still running after %s: %w", timeout, err)
+	}
+	return nil
+}
+
+// newUpstreamProxy creates the reverse proxy to the official API. Requests must carry the context
+// set by withProxyContext; responses are fed back to the token pool and streamed to billing.
+func newUpstreamProxy(config *Config, tokens upstream.TokenProvider, billingForwarder *services.BillingForwarder, modelCatalog *services.ModelCatalog) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(config.OfficialTarget)
+	if config.RetryRateLimited {
+		proxy.Transport = &rateLimitRetryTransport{next: http.DefaultTransport, tokens: tokens}
 	}
 
 	// Set target URL for all requests and add OAuth token
 	proxy.Director = func(req *http.Request) {
 		accessToken := req.Context().Value("accessToken").(string)
-		log.Printf("[OAUTH] Proxying request with token: %s...", accessToken[:min(20, len(accessToken))])
+		logging.FromContext(req.Context()).Info("proxying request upstream",
+			"token_prefix", accessToken[:min(20, len(accessToken))])
+
+		// Map the client's path to the provider's; billing matches on the client path kept in the context
+		if rewritten, ok := config.PathRewrites.Rewrite(req.URL.Path); ok {
+			req.URL.Path = rewritten
+			req.URL.RawPath = ""
+		}
 
 		// Use official target URL and OAuth token
 		req.URL.Scheme = config.OfficialTarget.Scheme
@@ -188,112 +825,137 @@ func main() {
 		req.Header.Set("Host", config.OfficialTarget.Host)
 
 		// Add OAuth beta feature to anthropic-beta header if not already present
-		addOAuthBetaHeader(req)
+		if config.InjectOAuthBeta {
+			addOAuthBetaHeader(req)
+		}
 
 		req.Header["X-Forwarded-For"] = nil
+		req.Header.Del(maxRequestCostHeader)
+		req.Header.Del(limitOverrideHeader)
 	}
 
 	// Intercept response for billing and 429 handling
 	proxy.ModifyResponse = func(resp *http.Response) error {
+		if requestStart, ok := resp.Request.Context().Value("requestStart").(time.Time); ok {
+			metrics.UpstreamLatency.Observe(time.Since(requestStart).Seconds())
+		}
+
 		// Log all non-200 responses with body
 		if resp.StatusCode != http.StatusOK {
 			logNon200Response(resp)
 		}
 
+		// Accounts whose organization was deleted never recover: disable them and move the user elsewhere
+		if resp.StatusCode >= 400 && upstream.IsOrgUnavailableError(resp.StatusCode, peekBody(resp), config.OrgErrorPatterns) {
+			handleOrgUnavailableResponse(resp, tokens)
+		}
+
+		// Replace upstream error bodies for masked status classes; the original was logged above
+		if resp.StatusCode >= 400 && config.MaskedErrorClasses[resp.StatusCode/100] {
+			maskUpstreamError(resp)
+		}
+
+		// Track the remaining token budget of the account that served this request
+		if resp.StatusCode == http.StatusOK {
+			recordTokenBudget(resp, tokens)
+		}
+
 		// Handle rate limit responses
 		if resp.StatusCode == http.StatusTooManyRequests {
-			handleRateLimitResponse(resp, oauthStore)
+			handleRateLimitResponse(resp, tokens)
 		}
 
-		if strings.Contains(resp.Request.URL.Path, "/messages") {
+		if clientPath := resp.Request.Context().Value("clientPath").(string); isBillablePath(clientPath) {
+			// Cut off runaway streams at the cost ceiling; the reader emits closing events so usage is still billed
+			ceiling := resp.Request.Context().Value("costCeiling").(float64)
+			if ceiling > 0 && resp.StatusCode == http.StatusOK && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+				resp.Body = services.NewCostCeilingReader(resp.Body, modelCatalog, ceiling)
+			}
+
 			// Store original body before modification
 			originalBody := resp.Body
 
 			// Create pipe for streaming to billing
 			billingPR, billingPW := io.Pipe()
 
+			// Time to first byte is known now; total time is set on the trailer once the stream is closed
+			requestStart := resp.Request.Context().Value("requestStart").(time.Time)
+			ttfb := time.Since(requestStart)
+			latencyTrailer := http.Header{}
+			latencyTrailer.Set(upstreamTotalTimeTrailer, "")
+
 			// Replace response body with teed version
 			resp.Body = &struct {
 				io.Reader
 				io.Closer
 			}{
 				Reader: io.TeeReader(originalBody, billingPW),
-				Closer: billingPW,
+				Closer: closerFunc(func() error {
+					latencyTrailer.Set(upstreamTotalTimeTrailer, strconv.FormatInt(time.Since(requestStart).Milliseconds(), 10))
+					return billingPW.Close()
+				}),
+			}
+
+			// Show the client the alias it asked for; billing reads the teed body above and records the real model
+			if alias, ok := resp.Request.Context().Value("modelAlias").(services.ModelAlias); ok {
+				resp.Body = services.NewModelRewriteReader(resp.Body, alias)
+				resp.Header.Del("Content-Length")
+				resp.ContentLength = -1
 			}
 
 			// Get user ID and account UUID from request context
 			userId := resp.Request.Context().Value("userId").(string)
 			accountUUID := resp.Request.Context().Value("upstreamAccountUUID").(string)
 
-			// Start streaming to billing service
-			go sendToBillingService(billingPR, resp, config, userId, accountUUID)
+			// Start streaming to billing service; shutdown waits for the forward to finish
+			sendToBillingService(billingForwarder, billingPR, resp, userId, accountUUID, ttfb, latencyTrailer)
 		}
 
 		return nil
 	}
 
-	r := mux.NewRouter()
-
-	// Health check endpoint
-	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	}).Methods("GET")
-
-	// Proxy all requests with API key validation
-	r.PathPrefix("/").HandlerFunc(proxyHandler)
-
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
+	return proxy
+}
 
-	log.Printf("Server starting on port %s", port)
-	log.Printf("Proxying to %s", config.OfficialTarget.String())
-	log.Fatal(http.ListenAndServe(":"+port, r))
+// withProxyContext stores the user ID, access token, account UUID, start time, cost ceiling and the
+// client's request path in the request context for the proxy director and response handling
+func withProxyContext(req *http.Request, userId string, binding *upstream.UserTokenBinding, costCeiling float64) *http.Request {
+	ctx := context.WithValue(req.Context(), "userId", userId)
+	ctx = context.WithValue(ctx, "accessToken", binding.AccessToken)
+	ctx = context.WithValue(ctx, "upstreamAccountUUID", binding.AccountUUID)
+	ctx = context.WithValue(ctx, "requestStart", time.Now())
+	ctx = context.WithValue(ctx, "costCeiling", costCeiling)
+	ctx = context.WithValue(ctx, "clientPath", req.URL.Path)
+	return req.WithContext(ctx)
 }
 
-func sendToBillingService(reader io.Reader, resp *http.Response, config *Config, userId string, accountUUID string) {
-	// Stream the response body directly from pipe reader
-	req, err := http.NewRequest("POST", config.BillingServiceURL, reader)
-	if err != nil {
-		log.Printf("Error creating billing request: %v", err)
-		return
+// sendToBillingService starts forwarding the teed response body to billing in the background
+func sendToBillingService(forwarder *services.BillingForwarder, reader io.Reader, resp *http.Response, userId string, accountUUID string, ttfb time.Duration, latencyTrailer http.Header) {
+	header := make(http.Header)
+	header.Set("X-User-ID", userId)
+	header.Set("X-Upstream-Account-UUID", accountUUID)
+	header.Set(upstreamTTFBHeader, strconv.FormatInt(ttfb.Milliseconds(), 10))
+	header.Set(upstreamStatusHeader, strconv.Itoa(resp.StatusCode))
+	if ip, _ := resp.Request.Context().Value("clientIP").(string); ip != "" {
+		header.Set(clientIPHeader, ip)
 	}
-	req.Header.Set("Content-Type", "application/json")
-	
-	// Only get identity token if not disabled (for testing)
-	if os.Getenv("DISABLE_IDENTITY_TOKEN") != "true" {
-		idToken, err := getIdentityToken(config.BillingServiceURL)
-		if err != nil {
-			log.Printf("Error getting identity token: %v", err)
-			return
-		}
-		req.Header.Set("Authorization", "Bearer "+idToken)
-	}
-	req.Header.Set("X-User-ID", userId)
-	req.Header.Set("X-Upstream-Account-UUID", accountUUID)
 
 	// Forward all response headers to billing service
+	// (including Content-Type, which billing uses to tell SSE streams from JSON bodies)
 	for key, values := range resp.Header {
 		for _, value := range values {
-			req.Header.Add(key, value)
+			header.Add(key, value)
 		}
 	}
-
-	client := &http.Client{
-		// No timeouts at all - let's see what happens
+	// Billing stores the correlation ID as the usage record's request_id
+	if requestID := logging.RequestID(resp.Request.Context()); requestID != "" {
+		header.Set(logging.RequestIDHeader, requestID)
 	}
-	billingResp, err := client.Do(req)
-	if err != nil {
-		log.Printf("Error sending billing request: %v", err)
-		return
-	}
-	defer billingResp.Body.Close()
 
-	if billingResp.StatusCode != http.StatusOK {
-		log.Printf("Billing service returned non-200 status: %d", billingResp.StatusCode)
-	}
+	// Total latency is filled in on the trailer when the client finishes reading the response
+	// The proxied request's context is canceled when its handler returns, usually before billing is done
+	ctx := context.WithoutCancel(resp.Request.Context())
+	forwarder.ForwardAsync(ctx, reader, header, latencyTrailer)
 }
 
 func addOAuthBetaHeader(req *http.Request) {
@@ -307,48 +969,215 @@ func addOAuthBetaHeader(req *http.Request) {
 	}
 }
 
+// recordTokenBudget stores the upstream remaining-token header, valid until its reset, for the account
+// that served the response
+func recordTokenBudget(resp *http.Response, tokens upstream.TokenProvider) {
+	remainingHeader := resp.Header.Get(tokensRemainingHeader)
+	if remainingHeader == "" {
+		return
+	}
+	remaining, err := strconv.Atoi(remainingHeader)
+	if err != nil {
+		log.Printf("[OAUTH] Ignoring invalid %s header: %q", tokensRemainingHeader, remainingHeader)
+		return
+	}
+	// A missing or unparsable reset time makes the value expire after a default TTL
+	resetAt, _ := time.Parse(time.RFC3339, resp.Header.Get(tokensResetHeader))
+	accountUUID := resp.Request.Context().Value("upstreamAccountUUID").(string)
+	tokens.RecordTokenBudget(accountUUID, remaining, resetAt)
+}
+
+// rateLimitRetryAfter returns how long until a 429'd account may be used again, from upstream's unified
+// reset time or else its Retry-After header
+func rateLimitRetryAfter(headers map[string]string, now time.Time) (time.Duration, bool) {
+	if reset := upstream.ParseRateLimitReset(headers); reset.After(now) {
+		return reset.Sub(now), true
+	}
+	for key, value := range headers {
+		if !strings.EqualFold(key, "Retry-After") {
+			continue
+		}
+		if seconds, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+// isForwardedRateLimitHeader reports whether a header of upstream's 429 is passed on with the 529:
+// the anthropic-ratelimit-* reset and remaining values, which tell clients when capacity returns
+func isForwardedRateLimitHeader(key string) bool {
+	key = strings.ToLower(key)
+	return strings.HasPrefix(key, "anthropic-ratelimit-") &&
+		(strings.HasSuffix(key, "-reset") || strings.HasSuffix(key, "-remaining"))
+}
+
 // handleRateLimitResponse handles 429 rate limit responses by logging, converting to 529, and cleaning up tokens
-func handleRateLimitResponse(resp *http.Response, oauthStore *upstream.OAuthStore) {
+func handleRateLimitResponse(resp *http.Response, tokens upstream.TokenProvider) {
 	accessToken := resp.Request.Context().Value("accessToken").(string)
 	userId := resp.Request.Context().Value("userId").(string)
-	log.Printf("[429] Rate limit for user %s, clearing token and returning 529", userId)
+	logging.FromContext(resp.Request.Context()).Warn("upstream rate limited, clearing token and returning 529")
+	metrics.RateLimited.Inc()
 
 	// Capture all headers from the 429 response
-	headers := make(map[string]string)
-	for key, values := range resp.Header {
-		if len(values) > 0 {
-			headers[key] = values[0]
-		}
-	}
+	headers := firstHeaderValues(resp.Header)
 
 	// Return 529 (overloaded) to client instead of 429
 	resp.StatusCode = 529
-	resp.Status = messages.ClientErrorMessages.TokenOverloaded
+	resp.Status = messages.Localize(messages.TokenOverloaded, resp.Request.Header.Get("Accept-Language"))
 
-	// Clear all headers from the response
+	// Clear all headers from the response, except the rate-limit reset and remaining hints
 	for key := range resp.Header {
 		resp.Header.Del(key)
 	}
+	for key, value := range headers {
+		if isForwardedRateLimitHeader(key) {
+			resp.Header.Set(key, value)
+		}
+	}
+
+	// Tell the client when the account's limit resets, when upstream said so
+	if wait, ok := rateLimitRetryAfter(headers, time.Now()); ok {
+		resp.Header.Set("Retry-After", retryAfterSeconds(wait))
+	}
 
 	go func() {
 		// Save headers to the OAuth token
-		if err := oauthStore.SaveRateLimitHeadersByToken(accessToken, headers); err != nil {
+		if err := tokens.SaveRateLimitHeadersByToken(accessToken, headers); err != nil {
 			log.Printf("[429] Failed to save rate limit headers: %v", err)
 		}
 
 		// Clear the user token binding so they get a fresh token next time
-		if err := oauthStore.ClearUserTokenBinding(userId); err != nil {
+		if err := tokens.ClearUserTokenBinding(userId); err != nil {
 			log.Printf("[429] Failed to clear user token binding for %s: %v", userId, err)
 		}
 	}()
 }
 
+// firstHeaderValues flattens response headers to their first values, as stored on rate-limited accounts
+func firstHeaderValues(header http.Header) map[string]string {
+	headers := make(map[string]string)
+	for key, values := range header {
+		if len(values) > 0 {
+			headers[key] = values[0]
+		}
+	}
+	return headers
+}
+
+// rateLimitRetryTransport replays a request that got a 429 once on another upstream account, so the
+// client only sees the 529 from handleRateLimitResponse when no other account is available
+type rateLimitRetryTransport struct {
+	next   http.RoundTripper
+	tokens upstream.TokenProvider
+}
+
+func (t *rateLimitRetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Buffer the body so it can be sent again
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		return resp, err
+	}
+
+	retry := t.rebindForRetry(req, resp)
+	if retry == nil {
+		return resp, nil
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	retry.Body = io.NopCloser(bytes.NewReader(body))
+	return t.next.RoundTrip(retry)
+}
+
+// rebindForRetry marks the rate-limited account, moves the user to another account and returns the
+// request to send there, or nil if no other account is available
+func (t *rateLimitRetryTransport) rebindForRetry(req *http.Request, resp *http.Response) *http.Request {
+	ctx := req.Context()
+	accessToken := ctx.Value("accessToken").(string)
+	userId := ctx.Value("userId").(string)
+	accountUUID := ctx.Value("upstreamAccountUUID").(string)
+	model, _ := ctx.Value("model").(string)
+
+	// Saved before selecting, so selection skips the rate-limited account
+	if err := t.tokens.SaveRateLimitHeadersByToken(accessToken, firstHeaderValues(resp.Header)); err != nil {
+		log.Printf("[429] Failed to save rate limit headers before retry: %v", err)
+		return nil
+	}
+	if err := t.tokens.ClearUserTokenBinding(userId); err != nil {
+		log.Printf("[429] Failed to clear user token binding for %s before retry: %v", userId, err)
+		return nil
+	}
+	binding, err := t.tokens.GetValidTokenForModel(userId, model)
+	if err != nil || binding.AccountUUID == accountUUID {
+		log.Printf("[429] No other account available for user %s, not retrying", userId)
+		return nil
+	}
+	log.Printf("[429] Retrying request for user %s on account %s after 429 from account %s", userId, binding.AccountUUID, accountUUID)
+
+	ctx = context.WithValue(ctx, "accessToken", binding.AccessToken)
+	ctx = context.WithValue(ctx, "upstreamAccountUUID", binding.AccountUUID)
+	retry := req.Clone(ctx)
+	retry.Header.Set("Authorization", "Bearer "+binding.AccessToken)
+	return retry
+}
+
+// handleOrgUnavailableResponse disables the account behind an org-level auth failure, rebinds the user
+// to another account and returns 529 so the client retries
+func handleOrgUnavailableResponse(resp *http.Response, tokens upstream.TokenProvider) {
+	accessToken := resp.Request.Context().Value("accessToken").(string)
+	userId := resp.Request.Context().Value("userId").(string)
+	accountUUID := resp.Request.Context().Value("upstreamAccountUUID").(string)
+	log.Printf("[ORG] Organization unavailable for account %s (status %d), disabling and rebinding user %s",
+		accountUUID, resp.StatusCode, userId)
+	reason := fmt.Sprintf("organization unavailable: upstream status %d", resp.StatusCode)
+
+	resp.StatusCode = 529
+	resp.Status = messages.Localize(messages.TokenOverloaded, resp.Request.Header.Get("Accept-Language"))
+
+	go func() {
+		if _, err := tokens.DisableAccountByToken(accessToken, reason); err != nil {
+			log.Printf("[ORG] Failed to disable account %s: %v", accountUUID, err)
+		}
+
+		binding, err := tokens.RebindUser(userId)
+		if err != nil {
+			log.Printf("[ORG] Failed to rebind user %s: %v", userId, err)
+			return
+		}
+		log.Printf("[ORG] Rebound user %s to account %s", userId, binding.AccountUUID)
+	}()
+}
+
+// peekBody returns the response body, leaving it readable for downstream consumers
+func peekBody(resp *http.Response) []byte {
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	return bodyBytes
+}
+
 // logNon200Response logs non-200 responses with their body content
 func logNon200Response(resp *http.Response) {
 	// Read the response body for logging
+	logger := logging.FromContext(resp.Request.Context()).With(
+		"status", resp.StatusCode, "method", resp.Request.Method, "path", resp.Request.URL.Path)
 	bodyBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Printf("[RESPONSE] Non-200 response: %d %s for %s %s (failed to read body: %v)", resp.StatusCode, resp.Status, resp.Request.Method, resp.Request.URL.Path, err)
+		logger.Warn("non-200 upstream response, failed to read body", "error", err)
 		return
 	}
 	
@@ -357,12 +1186,529 @@ func logNon200Response(resp *http.Response) {
 	if len(bodyStr) > 500 {
 		bodyStr = bodyStr[:500] + "..."
 	}
-	log.Printf("[RESPONSE] Non-200 response: %d %s for %s %s - Body: %s", resp.StatusCode, resp.Status, resp.Request.Method, resp.Request.URL.Path, bodyStr)
+	logger.Warn("non-200 upstream response", "body", bodyStr)
 	
 	// Restore the body for downstream consumption
 	resp.Body = io.NopCloser(strings.NewReader(string(bodyBytes)))
 }
 
+// nonBillableSubpaths are messages endpoints whose responses carry no usage, e.g. a token count
+var nonBillableSubpaths = []string{"/messages/count_tokens", "/messages/batches"}
+
+// isBillablePath reports whether responses for the client path carry usage to forward to billing
+func isBillablePath(path string) bool {
+	if !strings.Contains(path, "/messages") {
+		return false
+	}
+	for _, subpath := range nonBillableSubpaths {
+		if strings.Contains(path, subpath) {
+			return false
+		}
+	}
+	return true
+}
+
+// requestCostCeiling returns the cost ceiling for a request: the lowest of the configured ceiling, the
+// user's ceiling and a valid client header value. Zero means no ceiling from that source.
+func requestCostCeiling(configured, user float64, headerValue string) float64 {
+	ceiling := configured
+	lower := func(candidate float64) {
+		if candidate > 0 && (ceiling <= 0 || candidate < ceiling) {
+			ceiling = candidate
+		}
+	}
+	lower(user)
+	if requested, err := strconv.ParseFloat(headerValue, 64); err == nil {
+		lower(requested)
+	}
+	return ceiling
+}
+
+// maskUpstreamError replaces the response body with a generic Anthropic-schema error for the same status
+func maskUpstreamError(resp *http.Response) {
+	resp.Body.Close()
+
+	errorType, message := messages.UpstreamError(resp.StatusCode, resp.Request.Header.Get("Accept-Language"))
+	body, _ := json.Marshal(map[string]interface{}{
+		"type": "error",
+		"error": map[string]string{
+			"type":    errorType,
+			"message": message,
+		},
+	})
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Type", "application/json")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Del("Content-Encoding")
+}
+
+// readRequestModel reads the model field from a JSON request body and restores the body for proxying
+// Returns empty string if the body is empty or not a JSON object with a model field
+func readRequestModel(req *http.Request) (string, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return "", nil
+	}
+
+	bodyBytes, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+
+	var payload struct {
+		Model string `json:"model"`
+	}
+	if err := json.Unmarshal(bodyBytes, &payload); err != nil {
+		return "", nil
+	}
+
+	return payload.Model, nil
+}
+
+// rewriteRequestModel replaces the model field of a JSON request body, keeping every other field as sent
+func rewriteRequestModel(req *http.Request, model string) error {
+	bodyBytes, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal(bodyBytes, &payload); err != nil {
+		return fmt.Errorf("failed to parse request body: %w", err)
+	}
+	payload["model"], _ = json.Marshal(model)
+	if bodyBytes, err = json.Marshal(payload); err != nil {
+		return fmt.Errorf("failed to encode request body: %w", err)
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	req.ContentLength = int64(len(bodyBytes))
+	req.Header.Set("Content-Length", strconv.Itoa(len(bodyBytes)))
+	return nil
+}
+
+// readHistorySize returns the number of messages and the byte length of the messages array in a
+// request body, leaving the body readable. Bodies that aren't JSON or have no messages count as empty.
+func readHistorySize(req *http.Request) (count int, size int, err error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return 0, 0, nil
+	}
+
+	bodyBytes, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+
+	var payload struct {
+		Messages []json.RawMessage `json:"messages"`
+	}
+	if err := json.Unmarshal(bodyBytes, &payload); err != nil {
+		return 0, 0, nil
+	}
+	for _, message := range payload.Messages {
+		size += len(message)
+	}
+	return len(payload.Messages), size, nil
+}
+
+// defaultMaxBodyBytes leaves room for full-context requests with images and documents
+const defaultMaxBodyBytes = 32 << 20
+
+// withBodyLimit reads the request body into memory, returning 413 as soon as it exceeds maxBytes, so
+// an endless body is cut off early instead of being streamed upstream. 0 disables the limit.
+func withBodyLimit(maxBytes int, next http.HandlerFunc) http.HandlerFunc {
+	if maxBytes <= 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		lang := r.Header.Get("Accept-Language")
+		if r.ContentLength > int64(maxBytes) {
+			log.Printf("[BODY] Rejecting request with Content-Length %d, limit %d bytes", r.ContentLength, maxBytes)
+			writeError(w, messages.Localize(messages.RequestTooLarge, lang), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if r.Body == nil || r.Body == http.NoBody {
+			next(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxBytes)))
+		r.Body.Close()
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				log.Printf("[BODY] Rejecting request body over the %d byte limit", maxBytes)
+				writeError(w, messages.Localize(messages.RequestTooLarge, lang), http.StatusRequestEntityTooLarge)
+				return
+			}
+			log.Printf("Error reading request body: %v", err)
+			writeError(w, messages.Localize(messages.InternalServerError, lang), http.StatusInternalServerError)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		next(w, r)
+	}
+}
+
+// withHistoryLimit returns 413 for requests whose message history exceeds maxMessages or maxBytes,
+// before any upstream cost is incurred; limits of 0 are disabled
+func withHistoryLimit(maxMessages, maxBytes int, next http.HandlerFunc) http.HandlerFunc {
+	if maxMessages <= 0 && maxBytes <= 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		count, size, err := readHistorySize(r)
+		if err != nil {
+			log.Printf("Error reading request body for history check: %v", err)
+			writeError(w, messages.Localize(messages.InternalServerError, r.Header.Get("Accept-Language")), http.StatusInternalServerError)
+			return
+		}
+		if (maxMessages > 0 && count > maxMessages) || (maxBytes > 0 && size > maxBytes) {
+			log.Printf("[HISTORY] Rejecting request with %d messages (%d bytes), limits %d messages / %d bytes",
+				count, size, maxMessages, maxBytes)
+			writeError(w, messages.Localize(messages.HistoryTooLarge, r.Header.Get("Accept-Language")), http.StatusRequestEntityTooLarge)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// withKnownModels rejects requests for models the catalog cannot price with 400 before they reach
+// upstream; aliases are checked by the model they resolve to. Disabled unless strict is set.
+func withKnownModels(strict bool, catalog *services.ModelCatalog, aliases services.ModelAliases, next http.HandlerFunc) http.HandlerFunc {
+	if !strict {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		model, err := readRequestModel(r)
+		if err != nil {
+			log.Printf("Error reading request body for model check: %v", err)
+			writeError(w, messages.Localize(messages.InternalServerError, r.Header.Get("Accept-Language")), http.StatusInternalServerError)
+			return
+		}
+		if upstreamModel, ok := aliases.Resolve(model); ok {
+			model = upstreamModel
+		}
+		if model != "" && !catalog.IsKnownModel(model) {
+			logging.FromContext(r.Context()).Warn("rejecting unknown model in strict mode", "model", model)
+			writeError(w, messages.Localize(messages.UnknownModel, r.Header.Get("Accept-Language")), http.StatusBadRequest)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// readyTimeout bounds the Firestore round trip made by /ready
+const readyTimeout = 3 * time.Second
+
+// firestorePinger is the part of database.Service that /ready needs
+type firestorePinger interface {
+	Ping(ctx context.Context) error
+}
+
+// serveReady reports 503 when Firestore can't be reached, so the instance stops receiving traffic
+// while /health stays a cheap liveness check
+func serveReady(db firestorePinger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+		if err := db.Ping(ctx); err != nil {
+			log.Printf("Readiness check failed: %v", err)
+			http.Error(w, "Firestore unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	}
+}
+
+// adminStats is the response body of GET /admin/stats
+type adminStats struct {
+	ApiKeyCache     services.CacheStats       `json:"api_key_cache"`
+	UsageCache      services.CacheStats       `json:"usage_cache"`
+	UserTokenCache  int                       `json:"user_token_cache_size"`
+	Accounts        upstream.AccountPoolStats `json:"accounts"`
+	BillingTimeouts int64                     `json:"billing_timeouts"`
+	BillingDropped  int64                     `json:"billing_dropped"`
+	BillingCircuit  bool                      `json:"billing_circuit_open"`
+}
+
+// applyLimitOverride raises pointsCheck when overrideToken is a valid, unexpired override issued for userId.
+// Invalid overrides are logged and ignored so the stored limit applies.
+func applyLimitOverride(secret, overrideToken, userId string, pointsCheck services.PointsCheckResult) services.PointsCheckResult {
+	if overrideToken == "" {
+		return pointsCheck
+	}
+	override, err := services.ParseLimitOverride(secret, overrideToken, time.Now())
+	if err != nil {
+		log.Printf("[OVERRIDE] Ignoring limit override for user %s: %v", userId, err)
+		return pointsCheck
+	}
+	if override.UserID != userId {
+		log.Printf("[OVERRIDE] Ignoring limit override issued for %s presented by user %s", override.UserID, userId)
+		return pointsCheck
+	}
+	log.Printf("[OVERRIDE] Applying +%d points limit override for user %s (expires %s)",
+		override.ExtraPoints, userId, override.ExpiresAt.Format(time.RFC3339))
+	return override.Apply(pointsCheck)
+}
+
+// tokenBindingsCleared is the response body of DELETE /admin/token-bindings
+type tokenBindingsCleared struct {
+	ClearedUsers []string `json:"cleared_users"`
+}
+
+// clearTokenBindings removes the cached and stored token bindings of ?user_id= or of every user bound
+// to ?account_uuid=, so they are assigned an account afresh on their next request
+func clearTokenBindings(w http.ResponseWriter, r *http.Request, tokens upstream.TokenProvider) {
+	userID := r.URL.Query().Get("user_id")
+	accountUUID := r.URL.Query().Get("account_uuid")
+	if (userID == "") == (accountUUID == "") {
+		http.Error(w, "exactly one of user_id or account_uuid is required", http.StatusBadRequest)
+		return
+	}
+
+	cleared := []string{userID}
+	var err error
+	if accountUUID != "" {
+		cleared, err = tokens.ClearAccountBindings(accountUUID)
+	} else {
+		err = tokens.ClearUserTokenBinding(userID)
+	}
+	if err != nil {
+		log.Printf("[ADMIN] Failed to clear token bindings (user %q, account %q): %v", userID, accountUUID, err)
+		http.Error(w, "failed to clear token bindings", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[ADMIN] Cleared %d token bindings (user %q, account %q)", len(cleared), userID, accountUUID)
+
+	if cleared == nil {
+		cleared = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokenBindingsCleared{ClearedUsers: cleared})
+}
+
+// invalidateApiKeyCache evicts the cached lookup of ?key_hash= (the binding's document ID) or ?api_key=,
+// so the binding is read again from Firestore on the key's next request
+func invalidateApiKeyCache(w http.ResponseWriter, r *http.Request, apiKeyService *services.ApiKeyService) {
+	keyHash := r.URL.Query().Get("key_hash")
+	apiKey := r.URL.Query().Get("api_key")
+	if (keyHash == "") == (apiKey == "") {
+		http.Error(w, "exactly one of key_hash or api_key is required", http.StatusBadRequest)
+		return
+	}
+
+	if apiKey != "" {
+		keyHash = services.HashApiKey(apiKey)
+	}
+	apiKeyService.InvalidateKeyHash(keyHash)
+	log.Printf("[ADMIN] Invalidated cached API key lookup %s", keyHash)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// limitOverrideRequest is the request body of POST /admin/limit-overrides
+type limitOverrideRequest struct {
+	UserID      string `json:"user_id"`
+	ExtraPoints int    `json:"extra_points"`
+	TTLSeconds  int    `json:"ttl_seconds"`
+}
+
+// limitOverrideResponse is the response body of POST /admin/limit-overrides
+type limitOverrideResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// issueLimitOverride signs an override for the requested user, extra points and lifetime
+func issueLimitOverride(w http.ResponseWriter, r *http.Request, secret string, now time.Time) {
+	var body limitOverrideRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	ttl := time.Duration(body.TTLSeconds) * time.Second
+	if body.UserID == "" || body.ExtraPoints <= 0 || ttl <= 0 || ttl > maxLimitOverrideTTL {
+		http.Error(w, fmt.Sprintf("user_id, positive extra_points and ttl_seconds up to %d are required",
+			int(maxLimitOverrideTTL.Seconds())), http.StatusBadRequest)
+		return
+	}
+
+	override := services.LimitOverride{UserID: body.UserID, ExtraPoints: body.ExtraPoints, ExpiresAt: now.Add(ttl).Truncate(time.Second)}
+	token, err := services.SignLimitOverride(secret, override)
+	if err != nil {
+		log.Printf("[ADMIN] Failed to sign limit override: %v", err)
+		http.Error(w, "failed to sign limit override", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[ADMIN] Issued +%d points limit override for user %s until %s",
+		override.ExtraPoints, override.UserID, override.ExpiresAt.Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limitOverrideResponse{Token: token, ExpiresAt: override.ExpiresAt})
+}
+
+// serveUsage reports the caller's daily points limit, usage and reset time as JSON
+func serveUsage(w http.ResponseWriter, r *http.Request, apiKeyService *services.ApiKeyService, usageChecker *services.UsageChecker) {
+	lang := r.Header.Get("Accept-Language")
+	userId := extractUserIdFromAPIKey(r, apiKeyService)
+	if userId == "" {
+		writeError(w, messages.Localize(messages.Unauthorized, lang), http.StatusUnauthorized)
+		return
+	}
+
+	usage, err := usageChecker.GetDailyUsage(r.Context(), userId)
+	if err != nil {
+		log.Printf("Error reading usage for user %s: %v", userId, err)
+		writeError(w, messages.Localize(messages.InternalServerError, lang), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
+// requireAdminKey only lets requests bearing the admin secret through to next
+func requireAdminKey(secret string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if secret == "" || subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// clientIP returns the address of the client that sent req. Each trusted proxy (e.g. Cloud Run's front end)
+// appends the address it received the request from to X-Forwarded-For, so the real client is trustedHops
+// entries from the right; anything further left is client-supplied and can be spoofed.
+func clientIP(req *http.Request, trustedHops int) string {
+	if trustedHops > 0 {
+		var hops []string
+		for _, header := range req.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(header, ",") {
+				if hop = strings.TrimSpace(hop); hop != "" {
+					hops = append(hops, hop)
+				}
+			}
+		}
+		if len(hops) >= trustedHops {
+			return hops[len(hops)-trustedHops]
+		}
+		// Load balancers that don't append to X-Forwarded-For may pass the client as X-Real-IP instead
+		if realIP := strings.TrimSpace(req.Header.Get("X-Real-IP")); realIP != "" {
+			return realIP
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// withIPRateLimit returns 429 with Retry-After for client IPs over their rate; a nil limiter disables the check
+func withIPRateLimit(limiter *services.IPRateLimiter, trustedHops int, next http.HandlerFunc) http.HandlerFunc {
+	if limiter == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r, trustedHops)
+		if allowed, wait := limiter.Allow(ip); !allowed {
+			log.Printf("[RATELIMIT] Rejecting request from %s, retry in %s", ip, wait)
+			writeRetryAfterError(w, messages.Localize(messages.TooManyRequests, r.Header.Get("Accept-Language")), http.StatusTooManyRequests, wait)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// serveWithConcurrencyLimit proxies the request while holding one of the user's concurrency slots.
+// The slot is released once the proxy returns, i.e. after the response body was fully copied to the
+// client or the copy failed. A nil limiter proxies without a limit.
+func serveWithConcurrencyLimit(limiter *services.UserConcurrencyLimiter, userId string, next http.Handler, w http.ResponseWriter, req *http.Request) {
+	if limiter == nil {
+		next.ServeHTTP(w, req)
+		return
+	}
+	release, ok := limiter.Acquire(userId)
+	if !ok {
+		logging.FromContext(req.Context()).Warn("too many concurrent requests")
+		writeError(w, messages.Localize(messages.TooManyConcurrent, req.Header.Get("Accept-Language")), http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+	next.ServeHTTP(w, req)
+}
+
+// maxRequestIDLength bounds client-supplied correlation IDs; longer ones are replaced
+const maxRequestIDLength = 128
+
+// withRequestID tags the request with a correlation ID, taken from X-Request-Id or generated, so
+// every log line for it can be found together. The ID is echoed in the response for clients to quote.
+func withRequestID(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(logging.RequestIDHeader)
+		if requestID == "" || len(requestID) > maxRequestIDLength {
+			requestID = logging.NewRequestID()
+		}
+		w.Header().Set(logging.RequestIDHeader, requestID)
+		next(w, r.WithContext(logging.WithRequestID(r.Context(), requestID)))
+	}
+}
+
+// withMetrics counts requests on the proxy route and those rejected with 401
+func withMetrics(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		metrics.Requests.Inc()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r)
+		if recorder.status == http.StatusUnauthorized {
+			metrics.Unauthorized.Inc()
+		}
+	}
+}
+
+// statusRecorder remembers the status code written through it. Unwrap lets the reverse proxy
+// still flush streamed responses through http.ResponseController.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if !sr.wroteHeader {
+		sr.status = code
+		sr.wroteHeader = true
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// withMaintenance returns 503 with Retry-After instead of calling next while maintenance mode is on
+func withMaintenance(maintenance *services.MaintenanceMode, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if maintenance.Enabled() {
+			writeRetryAfterError(w, messages.Localize(messages.Maintenance, r.Header.Get("Accept-Language")), http.StatusServiceUnavailable, maintenance.RetryAfter())
+			return
+		}
+		next(w, r)
+	}
+}
+
 // extractUserIdFromAPIKey extracts user ID from API key in Authorization header
 func extractUserIdFromAPIKey(req *http.Request, apiKeyService *services.ApiKeyService) string {
 	authHeader := req.Header.Get("Authorization")
@@ -0,0 +1,1355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"simple-relay/backend/internal/logging"
+	"simple-relay/backend/internal/services"
+	"simple-relay/backend/internal/services/upstream"
+	"simple-relay/shared/pricing"
+	"simple-relay/shared/timewindow"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestValidateUpstreamURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		rawURL  string
+		devMode bool
+		wantErr bool
+	}{
+		{"https allowed", "https://api.anthropic.com", false, false},
+		{"http rejected outside dev mode", "http://localhost:9000", false, true},
+		{"http allowed in dev mode", "http://localhost:9000", true, false},
+		{"unknown scheme rejected", "ftp://example.com", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, err := url.Parse(tt.rawURL)
+			if err != nil {
+				t.Fatalf("failed to parse %s: %v", tt.rawURL, err)
+			}
+			err = validateUpstreamURL(target, tt.devMode)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateUpstreamURL(%s, devMode=%v) error = %v, wantErr %v", tt.rawURL, tt.devMode, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadOAuthClient(t *testing.T) {
+	client, err := loadOAuthClient(false)
+	if err != nil || client != upstream.DefaultOAuthClient {
+		t.Errorf("expected the default OAuth client when unset, got %+v (err %v)", client, err)
+	}
+
+	mock := httptest.NewServer(http.NotFoundHandler())
+	defer mock.Close()
+	t.Setenv("OAUTH_TOKEN_ENDPOINT", mock.URL)
+	t.Setenv("OAUTH_CLIENT_ID", "custom-client")
+	if _, err := loadOAuthClient(false); err == nil {
+		t.Error("expected a plain-http token endpoint to be rejected outside dev mode")
+	}
+	client, err = loadOAuthClient(true)
+	if err != nil || client.TokenEndpoint != mock.URL || client.ClientID != "custom-client" {
+		t.Errorf("expected the mock token endpoint in dev mode, got %+v (err %v)", client, err)
+	}
+}
+
+func TestParseErrorClasses(t *testing.T) {
+	classes := parseErrorClasses(" 4xx, 5XX ,3xx,bogus")
+	if !classes[4] || !classes[5] {
+		t.Errorf("expected 4xx and 5xx to be masked, got %v", classes)
+	}
+	if len(classes) != 2 {
+		t.Errorf("expected invalid classes to be ignored, got %v", classes)
+	}
+	if len(parseErrorClasses("")) != 0 {
+		t.Error("expected no masking by default")
+	}
+}
+
+func TestMaskUpstreamError_HidesBodyButLogsOriginal(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	sensitive := `{"type":"error","error":{"type":"invalid_request_error","message":"internal shard us-east-7 rejected org 1234"}}`
+	req, _ := http.NewRequest("POST", "https://api.anthropic.com/v1/messages", nil)
+	resp := &http.Response{
+		StatusCode: http.StatusBadRequest,
+		Status:     "400 Bad Request",
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(sensitive)),
+		Request:    req,
+	}
+
+	// Same order as ModifyResponse: log the original, then mask
+	logNon200Response(resp)
+	maskUpstreamError(resp)
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read masked body: %v", err)
+	}
+	if strings.Contains(string(body), "us-east-7") {
+		t.Errorf("sensitive details leaked to client: %s", body)
+	}
+
+	var parsed struct {
+		Type  string `json:"type"`
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		t.Fatalf("masked body is not valid JSON: %v", err)
+	}
+	if parsed.Type != "error" || parsed.Error.Type != "invalid_request_error" {
+		t.Errorf("unexpected masked error: %s", body)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status code changed to %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+		t.Errorf("Content-Length %q does not match masked body length %d", resp.Header.Get("Content-Length"), len(body))
+	}
+
+	if !strings.Contains(logs.String(), "us-east-7") {
+		t.Errorf("expected original body in server logs, got: %s", logs.String())
+	}
+}
+
+func TestRequestCostCeiling(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured float64
+		user       float64
+		header     string
+		want       float64
+	}{
+		{"configured only", 2.0, 0, "", 2.0},
+		{"header lowers ceiling", 2.0, 0, "0.5", 0.5},
+		{"header cannot raise ceiling", 2.0, 0, "10", 2.0},
+		{"header sets ceiling when none configured", 0, 0, "0.25", 0.25},
+		{"invalid header ignored", 2.0, 0, "lots", 2.0},
+		{"non-positive header ignored", 2.0, 0, "0", 2.0},
+		{"user ceiling lowers configured", 2.0, 0.75, "", 0.75},
+		{"user ceiling cannot raise configured", 2.0, 5.0, "", 2.0},
+		{"user ceiling applies when none configured", 0, 0.75, "", 0.75},
+		{"header lowers user ceiling", 2.0, 0.75, "0.5", 0.5},
+		{"header cannot raise user ceiling", 0, 0.75, "1.5", 0.75},
+		{"no ceiling anywhere", 0, 0, "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := requestCostCeiling(tt.configured, tt.user, tt.header); got != tt.want {
+				t.Errorf("requestCostCeiling(%v, %v, %q) = %v, want %v", tt.configured, tt.user, tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequireAdminKey(t *testing.T) {
+	handler := requireAdminKey("admin-secret", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		auth string
+		want int
+	}{
+		{"Bearer admin-secret", http.StatusOK},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/admin/stats", nil)
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("Authorization %q: expected %d, got %d", tt.auth, tt.want, rec.Code)
+		}
+	}
+}
+
+func TestApplyLimitOverride(t *testing.T) {
+	exhausted := services.PointsCheckResult{State: services.PointsExhausted, RemainingPoints: 0}
+	sign := func(userID string, expiresAt time.Time) string {
+		token, err := services.SignLimitOverride("server-secret", services.LimitOverride{UserID: userID, ExtraPoints: 200, ExpiresAt: expiresAt})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return token
+	}
+	valid := sign("demo@example.com", time.Now().Add(time.Hour))
+
+	if got := applyLimitOverride("server-secret", valid, "demo@example.com", exhausted); !got.Allowed() || got.RemainingPoints != 200 {
+		t.Errorf("expected valid override to raise the limit, got %+v", got)
+	}
+
+	ignored := map[string]string{
+		"expired":    sign("demo@example.com", time.Now().Add(-time.Minute)),
+		"tampered":   valid[:len(valid)-2] + "xx",
+		"other user": sign("someone@example.com", time.Now().Add(time.Hour)),
+		"no header":  "",
+		"wrong secret": func() string {
+			token, _ := services.SignLimitOverride("guess", services.LimitOverride{UserID: "demo@example.com", ExtraPoints: 200, ExpiresAt: time.Now().Add(time.Hour)})
+			return token
+		}(),
+	}
+	for name, token := range ignored {
+		if got := applyLimitOverride("server-secret", token, "demo@example.com", exhausted); got != exhausted {
+			t.Errorf("%s: expected override to be ignored, got %+v", name, got)
+		}
+	}
+}
+
+func TestInvalidateApiKeyCache(t *testing.T) {
+	apiKeyService := services.NewApiKeyService(nil)
+	invalidate := func(query string) int {
+		rec := httptest.NewRecorder()
+		invalidateApiKeyCache(rec, httptest.NewRequest(http.MethodDelete, "/admin/api-key-cache?"+query, nil), apiKeyService)
+		return rec.Code
+	}
+
+	for _, query := range []string{"key_hash=" + services.HashApiKey("sk-revoked"), "api_key=sk-revoked"} {
+		if code := invalidate(query); code != http.StatusNoContent {
+			t.Errorf("%s: expected 204, got %d", query, code)
+		}
+	}
+	for _, query := range []string{"", "key_hash=abc&api_key=sk-revoked"} {
+		if code := invalidate(query); code != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %d", query, code)
+		}
+	}
+}
+
+func TestIssueLimitOverride(t *testing.T) {
+	now := time.Now()
+	issue := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		issueLimitOverride(rec, httptest.NewRequest(http.MethodPost, "/admin/limit-overrides", strings.NewReader(body)), "server-secret", now)
+		return rec
+	}
+
+	rec := issue(`{"user_id":"demo@example.com","extra_points":300,"ttl_seconds":3600}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var issued limitOverrideResponse
+	if err := json.NewDecoder(rec.Body).Decode(&issued); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	override, err := services.ParseLimitOverride("server-secret", issued.Token, now)
+	if err != nil || override.UserID != "demo@example.com" || override.ExtraPoints != 300 {
+		t.Errorf("expected issued token to verify, got %+v (err %v)", override, err)
+	}
+
+	for _, body := range []string{
+		`{"user_id":"demo@example.com","extra_points":300,"ttl_seconds":0}`,
+		`{"user_id":"demo@example.com","extra_points":300,"ttl_seconds":99999999}`,
+		`{"user_id":"demo@example.com","extra_points":-5,"ttl_seconds":60}`,
+		`{"extra_points":300,"ttl_seconds":60}`,
+		`not json`,
+	} {
+		if rec := issue(body); rec.Code != http.StatusBadRequest {
+			t.Errorf("body %s: expected 400, got %d", body, rec.Code)
+		}
+	}
+}
+
+// newBoundTokenProvider returns a pool where user-1 and user-2 are bound to account-a and user-3 to account-b
+func newBoundTokenProvider(t *testing.T) *upstream.MemoryTokenProvider {
+	t.Helper()
+	tokens := upstream.NewMemoryTokenProvider(
+		&upstream.OAuthCredentials{AccountUUID: "account-a", AccessToken: "token-a", ExpiresAt: time.Now().Add(time.Hour)},
+		&upstream.OAuthCredentials{AccountUUID: "account-b", AccessToken: "token-b", ExpiresAt: time.Now().Add(time.Hour)},
+	)
+	bind := func(userID string) {
+		if _, err := tokens.GetValidTokenForUser(userID); err != nil {
+			t.Fatalf("failed to bind %s: %v", userID, err)
+		}
+	}
+	bind("user-1")
+	bind("user-2")
+	// Rate limit account-a before user-3 binds, so it lands on account-b
+	tokens.SaveRateLimitHeadersByToken("token-a", map[string]string{"retry-after": "60"})
+	bind("user-3")
+	return tokens
+}
+
+func TestClearTokenBindings(t *testing.T) {
+	clear := func(tokens upstream.TokenProvider, query string) (*httptest.ResponseRecorder, []string) {
+		rec := httptest.NewRecorder()
+		clearTokenBindings(rec, httptest.NewRequest(http.MethodDelete, "/admin/token-bindings?"+query, nil), tokens)
+		var body tokenBindingsCleared
+		json.NewDecoder(rec.Body).Decode(&body)
+		return rec, body.ClearedUsers
+	}
+	bound := func(tokens *upstream.MemoryTokenProvider, userID string) bool {
+		_, exists := tokens.Binding(userID)
+		return exists
+	}
+
+	t.Run("by user", func(t *testing.T) {
+		tokens := newBoundTokenProvider(t)
+		rec, cleared := clear(tokens, "user_id=user-1")
+		if rec.Code != http.StatusOK || len(cleared) != 1 || cleared[0] != "user-1" {
+			t.Fatalf("expected user-1 cleared, got %d %v", rec.Code, cleared)
+		}
+		if bound(tokens, "user-1") || !bound(tokens, "user-2") || !bound(tokens, "user-3") {
+			t.Errorf("expected only user-1's binding to be cleared")
+		}
+	})
+
+	t.Run("by account", func(t *testing.T) {
+		tokens := newBoundTokenProvider(t)
+		rec, cleared := clear(tokens, "account_uuid=account-a")
+		if rec.Code != http.StatusOK || len(cleared) != 2 || cleared[0] != "user-1" || cleared[1] != "user-2" {
+			t.Fatalf("expected user-1 and user-2 cleared, got %d %v", rec.Code, cleared)
+		}
+		if bound(tokens, "user-1") || bound(tokens, "user-2") || !bound(tokens, "user-3") {
+			t.Errorf("expected only bindings to account-a to be cleared")
+		}
+	})
+
+	for _, query := range []string{"", "user_id=user-1&account_uuid=account-a"} {
+		if rec, _ := clear(newBoundTokenProvider(t), query); rec.Code != http.StatusBadRequest {
+			t.Errorf("query %q: expected 400, got %d", query, rec.Code)
+		}
+	}
+}
+
+type fakePinger struct{ err error }
+
+func (p fakePinger) Ping(ctx context.Context) error { return p.err }
+
+func TestServeReady(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"firestore reachable", nil, http.StatusOK},
+		{"firestore unreachable", errors.New("permission denied"), http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		serveReady(fakePinger{tt.err})(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		if rec.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, rec.Code)
+		}
+	}
+}
+
+func TestParseOrgErrorPatterns(t *testing.T) {
+	if got := parseOrgErrorPatterns(""); len(got) != len(upstream.DefaultOrgUnavailablePatterns) {
+		t.Errorf("expected defaults when unset, got %v", got)
+	}
+	if got := parseOrgErrorPatterns("none"); got != nil {
+		t.Errorf("expected fallback disabled, got %v", got)
+	}
+	got := parseOrgErrorPatterns(" permission_error, organization suspended ,")
+	if len(got) != 2 || got[0] != "permission_error" || got[1] != "organization suspended" {
+		t.Errorf("unexpected patterns: %v", got)
+	}
+}
+
+func TestWithMaintenance_Toggle(t *testing.T) {
+	maintenance := services.NewMaintenanceMode(nil, false)
+	proxied := 0
+	handler := withMaintenance(maintenance, func(w http.ResponseWriter, r *http.Request) {
+		proxied++
+		w.WriteHeader(http.StatusOK)
+	})
+
+	send := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, "/v1/messages", nil))
+		return rec
+	}
+
+	if rec := send(); rec.Code != http.StatusOK {
+		t.Fatalf("expected request to be proxied, got %d", rec.Code)
+	}
+
+	maintenance.Set(true, 2*time.Minute)
+	rec := send()
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 in maintenance mode, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != "120" {
+		t.Errorf("expected Retry-After 120, got %q", rec.Header().Get("Retry-After"))
+	}
+	if !strings.Contains(rec.Body.String(), "maintenance") {
+		t.Errorf("expected maintenance message, got %q", rec.Body.String())
+	}
+
+	maintenance.Set(false, 0)
+	if rec := send(); rec.Code != http.StatusOK {
+		t.Errorf("expected request to be proxied after maintenance, got %d", rec.Code)
+	}
+	if proxied != 2 {
+		t.Errorf("expected 2 proxied requests, got %d", proxied)
+	}
+}
+
+func TestWithIPRateLimit_ThrottlesBeforeAuth(t *testing.T) {
+	limiter := services.NewIPRateLimiter(0.001, 2)
+	authChecks := 0
+	handler := withIPRateLimit(limiter, 1, func(w http.ResponseWriter, r *http.Request) {
+		// Stands in for proxyHandler, whose first step is the API key lookup
+		authChecks++
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+
+	send := func(forwardedFor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := send("203.0.113.7"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("request %d within burst should reach auth, got %d", i+1, rec.Code)
+		}
+	}
+
+	rec := send("203.0.113.7")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 once the burst is spent, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Errorf("expected a Retry-After header")
+	}
+	if authChecks != 2 {
+		t.Errorf("throttled request must not reach auth, got %d auth checks", authChecks)
+	}
+
+	// A spoofed leftmost entry doesn't give the same client a fresh bucket
+	if rec := send("198.51.100.1, 203.0.113.7"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected spoofed X-Forwarded-For to stay throttled, got %d", rec.Code)
+	}
+	// Other clients are unaffected
+	if rec := send("203.0.113.8"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected another IP to reach auth, got %d", rec.Code)
+	}
+}
+
+func TestWithIPRateLimit_DisabledWithoutLimiter(t *testing.T) {
+	handler := withIPRateLimit(nil, 1, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	for i := 0; i < 100; i++ {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, "/v1/messages", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected no rate limiting, got %d", rec.Code)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name         string
+		forwardedFor string
+		remoteAddr   string
+		trustedHops  int
+		want         string
+	}{
+		{"single proxy", "203.0.113.7", "10.0.0.1:5000", 1, "203.0.113.7"},
+		{"spoofed prefix ignored", "1.2.3.4, 203.0.113.7", "10.0.0.1:5000", 1, "203.0.113.7"},
+		{"two proxies", "203.0.113.7, 10.1.1.1", "10.0.0.1:5000", 2, "203.0.113.7"},
+		{"too few hops falls back to peer", "", "192.0.2.5:443", 1, "192.0.2.5"},
+		{"no trusted proxies", "203.0.113.7", "192.0.2.5:443", 0, "192.0.2.5"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+		}
+		if got := clientIP(req, tt.trustedHops); got != tt.want {
+			t.Errorf("%s: clientIP = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// X-Real-IP is only trusted behind a proxy, and only without enough X-Forwarded-For hops
+	realIP := []struct {
+		name         string
+		forwardedFor string
+		trustedHops  int
+		want         string
+	}{
+		{"real IP without forwarded hops", "", 1, "203.0.113.9"},
+		{"forwarded hops win over real IP", "203.0.113.7", 1, "203.0.113.7"},
+		{"real IP ignored without trusted proxies", "", 0, "192.0.2.5"},
+	}
+	for _, tt := range realIP {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.5:443"
+		req.Header.Set("X-Real-IP", "203.0.113.9")
+		if tt.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+		}
+		if got := clientIP(req, tt.trustedHops); got != tt.want {
+			t.Errorf("%s: clientIP = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// newProxyTestSetup starts a fake upstream answering with handler and returns a proxy backed by an
+// in-memory token pool holding two accounts, a builder for requests already bound to user-1's token,
+// and the bodies received by the fake billing service. configure adjusts the proxy config.
+func newProxyTestSetup(t *testing.T, handler http.HandlerFunc, configure ...func(*Config)) (*httputil.ReverseProxy, *upstream.MemoryTokenProvider, func() *http.Request, chan string) {
+	t.Helper()
+	upstreamServer := httptest.NewServer(handler)
+	t.Cleanup(upstreamServer.Close)
+	billed := make(chan string, 10)
+	billingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		billed <- string(body)
+	}))
+	t.Cleanup(billingServer.Close)
+
+	target, _ := url.Parse(upstreamServer.URL)
+	config := &Config{OfficialTarget: target, OrgErrorPatterns: upstream.DefaultOrgUnavailablePatterns}
+	for _, apply := range configure {
+		apply(config)
+	}
+	tokens := upstream.NewMemoryTokenProvider(
+		&upstream.OAuthCredentials{AccountUUID: "account-a", AccessToken: "token-a", ExpiresAt: time.Now().Add(time.Hour)},
+		&upstream.OAuthCredentials{AccountUUID: "account-b", AccessToken: "token-b", ExpiresAt: time.Now().Add(time.Hour)},
+	)
+	proxy := newUpstreamProxy(config, tokens, services.NewBillingForwarder(billingServer.URL, nil), services.NewModelCatalog())
+
+	newRequest := func() *http.Request {
+		binding, err := tokens.GetValidTokenForUser("user-1")
+		if err != nil {
+			t.Fatalf("failed to bind user: %v", err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(`{"model":"claude-sonnet-4"}`))
+		return withProxyContext(req, "user-1", binding, 0)
+	}
+	return proxy, tokens, newRequest, billed
+}
+
+// waitFor polls condition until it holds or a second has passed
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProxy_SuccessUsesBoundTokenAndRecordsBudget(t *testing.T) {
+	var authorization string
+	proxy, tokens, newRequest, _ := newProxyTestSetup(t, func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Header().Set(tokensRemainingHeader, "12345")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"msg_1","usage":{"input_tokens":1,"output_tokens":1}}`))
+	})
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, newRequest())
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if authorization != "Bearer token-a" {
+		t.Errorf("expected upstream to receive user-1's bound token, got %q", authorization)
+	}
+	if remaining, known := tokens.TokenBudget("account-a"); !known || remaining != 12345 {
+		t.Errorf("expected budget 12345 recorded for account-a, got %d (known %v)", remaining, known)
+	}
+}
+
+func TestProxy_RateLimitReturns529AndReleasesAccount(t *testing.T) {
+	proxy, tokens, newRequest, _ := newProxyTestSetup(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("anthropic-ratelimit-requests-reset", "2025-01-01T00:00:00Z")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"type":"error","error":{"type":"rate_limit_error","message":"rate limited"}}`))
+	})
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, newRequest())
+
+	if rec.Code != 529 {
+		t.Fatalf("expected 429 to be converted to 529, got %d", rec.Code)
+	}
+	waitFor(t, "rate limit headers saved", func() bool {
+		account, _ := tokens.Account("account-a")
+		return account.RateLimitHeaders != nil
+	})
+	waitFor(t, "binding cleared", func() bool {
+		_, bound := tokens.Binding("user-1")
+		return !bound
+	})
+
+	// The next request binds user-1 to the other account
+	binding, err := tokens.GetValidTokenForUser("user-1")
+	if err != nil || binding.AccountUUID != "account-b" {
+		t.Errorf("expected rebind to account-b, got %+v (err %v)", binding, err)
+	}
+}
+
+func TestProxy_RateLimitReturns529WithRetryAfter(t *testing.T) {
+	reset := time.Now().Add(5 * time.Minute).Unix()
+	proxy, _, newRequest, _ := newProxyTestSetup(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("anthropic-ratelimit-unified-reset", strconv.FormatInt(reset, 10))
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, newRequest())
+
+	if rec.Code != 529 {
+		t.Fatalf("expected 429 to be converted to 529, got %d", rec.Code)
+	}
+	seconds, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	if err != nil || seconds < 295 || seconds > 300 {
+		t.Errorf("expected Retry-After of about 300 seconds, got %q", rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestProxy_RateLimit529ForwardsResetAndRemainingHeaders(t *testing.T) {
+	proxy, tokens, newRequest, _ := newProxyTestSetup(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("anthropic-ratelimit-unified-reset", "1760000000")
+		w.Header().Set("anthropic-ratelimit-tokens-remaining", "0")
+		w.Header().Set("anthropic-ratelimit-unified-status", "rejected")
+		w.Header().Set("request-id", "req_upstream")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, newRequest())
+
+	if rec.Code != 529 {
+		t.Fatalf("expected 429 to be converted to 529, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("anthropic-ratelimit-unified-reset"); got != "1760000000" {
+		t.Errorf("expected the reset header to be forwarded, got %q", got)
+	}
+	if got := rec.Header().Get("anthropic-ratelimit-tokens-remaining"); got != "0" {
+		t.Errorf("expected the remaining header to be forwarded, got %q", got)
+	}
+	for _, dropped := range []string{"anthropic-ratelimit-unified-status", "request-id"} {
+		if got := rec.Header().Get(dropped); got != "" {
+			t.Errorf("expected %s to be dropped, got %q", dropped, got)
+		}
+	}
+
+	// The headers are still saved to the account
+	waitFor(t, "rate limit headers saved", func() bool {
+		account, _ := tokens.Account("account-a")
+		return account.RateLimitHeaders["Anthropic-Ratelimit-Unified-Status"] == "rejected"
+	})
+}
+
+func TestRateLimitRetryAfter(t *testing.T) {
+	now := time.Unix(1760000000, 0)
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    time.Duration
+		ok      bool
+	}{
+		{"unified reset", map[string]string{"Anthropic-Ratelimit-Unified-Reset": "1760000090"}, 90 * time.Second, true},
+		{"retry-after fallback", map[string]string{"Retry-After": "30"}, 30 * time.Second, true},
+		{"reset already passed", map[string]string{"anthropic-ratelimit-unified-reset": "1759999990"}, 0, false},
+		{"nothing usable", map[string]string{"retry-after": "soon"}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := rateLimitRetryAfter(tt.headers, now)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("rateLimitRetryAfter() = %v, %v; want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestWriteLimitExceeded_DailyLimitRetryAfter(t *testing.T) {
+	now := time.Date(2025, 3, 10, 18, 30, 0, 0, time.UTC)
+	rec := httptest.NewRecorder()
+	writeLimitExceeded(rec, "daily limit reached", timewindow.DailyReset(now, timewindow.DefaultDailyResetHour), now)
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", rec.Code)
+	}
+	// The daily window resets at 20:00 UTC, 90 minutes later
+	if got := rec.Header().Get("Retry-After"); got != "5400" {
+		t.Errorf("expected Retry-After 5400, got %q", got)
+	}
+	if got := rec.Header().Get("X-Should-Retry"); got != "" {
+		t.Errorf("expected no X-Should-Retry on a rejection that lifts at reset, got %q", got)
+	}
+
+	// Non-retryable rejections keep X-Should-Retry: false
+	rec = httptest.NewRecorder()
+	writeError(rec, "no daily allowance", http.StatusTooManyRequests)
+	if got := rec.Header().Get("X-Should-Retry"); got != "false" {
+		t.Errorf("expected X-Should-Retry false, got %q", got)
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	for wait, want := range map[time.Duration]string{
+		90 * time.Second:        "90",
+		1500 * time.Millisecond: "2",
+		0:                       "1",
+		-time.Second:            "1",
+	} {
+		if got := retryAfterSeconds(wait); got != want {
+			t.Errorf("retryAfterSeconds(%s) = %q, want %q", wait, got, want)
+		}
+	}
+}
+
+func TestProxy_RateLimitRetriesOnAnotherAccount(t *testing.T) {
+	var authorizations []string
+	var bodies []string
+	proxy, tokens, newRequest, billed := newProxyTestSetup(t, func(w http.ResponseWriter, r *http.Request) {
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if r.Header.Get("Authorization") == "Bearer token-a" {
+			w.Header().Set("anthropic-ratelimit-requests-reset", "2025-01-01T00:00:00Z")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"msg_1","usage":{"input_tokens":1,"output_tokens":1}}`))
+	}, func(config *Config) { config.RetryRateLimited = true })
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, newRequest())
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the retry on another account to succeed, got %d", rec.Code)
+	}
+	if len(authorizations) != 2 || authorizations[1] != "Bearer token-b" {
+		t.Errorf("expected a single retry with token-b, got %v", authorizations)
+	}
+	if len(bodies) != 2 || bodies[1] != bodies[0] || bodies[0] == "" {
+		t.Errorf("expected the request body to be replayed, got %q", bodies)
+	}
+	if account, _ := tokens.Account("account-a"); account.RateLimitHeaders == nil {
+		t.Errorf("expected the rate-limited account to be marked")
+	}
+	if binding, _ := tokens.Binding("user-1"); binding.AccountUUID != "account-b" {
+		t.Errorf("expected user-1 to be bound to account-b, got %q", binding.AccountUUID)
+	}
+	select {
+	case body := <-billed:
+		if !strings.Contains(body, "msg_1") {
+			t.Errorf("expected the retried response to be billed, got %q", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the retried response to be billed")
+	}
+}
+
+func TestProxy_RateLimitRetryReturns529WithoutAnotherAccount(t *testing.T) {
+	requests := 0
+	proxy, _, newRequest, _ := newProxyTestSetup(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusTooManyRequests)
+	}, func(config *Config) { config.RetryRateLimited = true })
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, newRequest())
+
+	if rec.Code != 529 {
+		t.Fatalf("expected 529 once every account is rate limited, got %d", rec.Code)
+	}
+	if requests != 2 {
+		t.Errorf("expected at most one retry, got %d upstream requests", requests)
+	}
+}
+
+func TestProxy_OrgUnavailableDisablesAccountAndRebinds(t *testing.T) {
+	proxy, tokens, newRequest, _ := newProxyTestSetup(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"type":"error","error":{"type":"permission_error","message":"This organization has been disabled."}}`))
+	})
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, newRequest())
+
+	if rec.Code != 529 {
+		t.Fatalf("expected org failure to be converted to 529, got %d", rec.Code)
+	}
+	waitFor(t, "user rebound to account-b", func() bool {
+		binding, bound := tokens.Binding("user-1")
+		return bound && binding.AccountUUID == "account-b"
+	})
+	if account, _ := tokens.Account("account-a"); !account.Disabled {
+		t.Errorf("expected account-a to be disabled")
+	}
+}
+
+func TestProxy_ModelAliasShownToClientButBilledAsUpstreamModel(t *testing.T) {
+	stream := "event: message_start\n" +
+		`data: {"type":"message_start","message":{"id":"msg_1","model":"claude-sonnet-4-20250514","usage":{"input_tokens":10,"output_tokens":1}}}` + "\n\n" +
+		"event: message_delta\n" +
+		`data: {"type":"message_delta","usage":{"output_tokens":5}}` + "\n\n"
+	proxy, _, newRequest, billed := newProxyTestSetup(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(stream)))
+		w.Write([]byte(stream))
+	})
+
+	req := newRequest()
+	alias := services.ModelAlias{Requested: "claude-3-sonnet-20240229", Upstream: "claude-sonnet-4-20250514"}
+	req = req.WithContext(context.WithValue(req.Context(), "modelAlias", alias))
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+
+	if !strings.Contains(rec.Body.String(), `"model":"claude-3-sonnet-20240229"`) {
+		t.Errorf("expected client to see the requested alias, got %q", rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), "claude-sonnet-4-20250514") {
+		t.Errorf("expected the upstream model to be hidden from the client")
+	}
+
+	select {
+	case body := <-billed:
+		if !strings.Contains(body, `"model":"claude-sonnet-4-20250514"`) {
+			t.Errorf("expected billing to receive the upstream model, got %q", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for billing payload")
+	}
+}
+
+func TestProxy_PathRewriteRoutesToProviderPathAndStillBills(t *testing.T) {
+	var upstreamPath string
+	proxy, _, newRequest, billed := newProxyTestSetup(t, func(w http.ResponseWriter, r *http.Request) {
+		upstreamPath = r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"msg_1","usage":{"input_tokens":1,"output_tokens":1}}`))
+	}, func(config *Config) {
+		config.PathRewrites, _ = services.ParsePathRewrites("/v1/messages=/model/claude/invoke")
+	})
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, newRequest())
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if upstreamPath != "/model/claude/invoke" {
+		t.Errorf("expected the provider path upstream, got %q", upstreamPath)
+	}
+	select {
+	case body := <-billed:
+		if !strings.Contains(body, "msg_1") {
+			t.Errorf("expected billing to receive the response, got %q", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the rewritten messages request to be billed")
+	}
+}
+
+func TestServeWithConcurrencyLimit_RejectsRequestsOverTheLimit(t *testing.T) {
+	const maxConcurrent = 2
+	var reachedUpstream atomic.Int32
+	unblock := make(chan struct{})
+	proxy, _, newRequest, _ := newProxyTestSetup(t, func(w http.ResponseWriter, r *http.Request) {
+		reachedUpstream.Add(1)
+		<-unblock
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"msg_1","usage":{"input_tokens":1,"output_tokens":1}}`))
+	})
+	limiter := services.NewUserConcurrencyLimiter(maxConcurrent)
+
+	codes := make(chan int, maxConcurrent+1)
+	for i := 0; i < maxConcurrent+1; i++ {
+		go func() {
+			rec := httptest.NewRecorder()
+			serveWithConcurrencyLimit(limiter, "user-1", proxy, rec, newRequest())
+			codes <- rec.Code
+		}()
+	}
+
+	// The request over the limit is answered without waiting for the others
+	select {
+	case code := <-codes:
+		if code != http.StatusTooManyRequests {
+			t.Fatalf("expected the extra request to get 429, got %d", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected one request to be rejected while the others are in flight")
+	}
+	waitFor(t, "requests to reach upstream", func() bool { return reachedUpstream.Load() == maxConcurrent })
+
+	close(unblock)
+	for i := 0; i < maxConcurrent; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("expected requests within the limit to succeed, got %d", code)
+		}
+	}
+	if inFlight := limiter.InFlight("user-1"); inFlight != 0 {
+		t.Errorf("expected every slot released once responses were consumed, got %d in flight", inFlight)
+	}
+}
+
+func TestProxy_CountTokensIsNotBilled(t *testing.T) {
+	var upstreamPath string
+	proxy, tokens, _, billed := newProxyTestSetup(t, func(w http.ResponseWriter, r *http.Request) {
+		upstreamPath = r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"input_tokens":42}`))
+	})
+
+	binding, err := tokens.GetValidTokenForUser("user-1")
+	if err != nil {
+		t.Fatalf("failed to bind user: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages/count_tokens", strings.NewReader(`{"model":"claude-sonnet-4"}`))
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, withProxyContext(req, "user-1", binding, 0))
+
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"input_tokens":42}` {
+		t.Fatalf("expected the token count passed through, got %d %q", rec.Code, rec.Body.String())
+	}
+	if upstreamPath != "/v1/messages/count_tokens" {
+		t.Errorf("expected count_tokens upstream, got %q", upstreamPath)
+	}
+	select {
+	case body := <-billed:
+		t.Fatalf("expected no billing request for count_tokens, got %q", body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestProxy_ErrorResponseForwardedToBillingWithStatus(t *testing.T) {
+	errorBody := `{"type":"error","error":{"type":"invalid_request_error","message":"messages: field required"}}`
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(errorBody))
+	}))
+	defer upstreamServer.Close()
+	type billingRequest struct{ status, body string }
+	billed := make(chan billingRequest, 1)
+	billingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		billed <- billingRequest{status: r.Header.Get(upstreamStatusHeader), body: string(body)}
+	}))
+	defer billingServer.Close()
+
+	target, _ := url.Parse(upstreamServer.URL)
+	tokens := upstream.NewMemoryTokenProvider(
+		&upstream.OAuthCredentials{AccountUUID: "account-a", AccessToken: "token-a", ExpiresAt: time.Now().Add(time.Hour)},
+	)
+	proxy := newUpstreamProxy(&Config{OfficialTarget: target}, tokens, services.NewBillingForwarder(billingServer.URL, nil), services.NewModelCatalog())
+	binding, err := tokens.GetValidTokenForUser("user-1")
+	if err != nil {
+		t.Fatalf("failed to bind user: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(`{"model":"claude-sonnet-4"}`))
+	proxy.ServeHTTP(rec, withProxyContext(req, "user-1", binding, 0))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected the 400 passed to the client, got %d", rec.Code)
+	}
+	select {
+	case got := <-billed:
+		if got.status != "400" || got.body != errorBody {
+			t.Errorf("expected billing to receive status 400 and the error body, got %q with %q", got.status, got.body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the error response to be forwarded to billing")
+	}
+}
+
+func TestSendToBillingService_ForwardsClientIP(t *testing.T) {
+	clientIPs := make(chan string, 1)
+	billingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		clientIPs <- r.Header.Get(clientIPHeader)
+	}))
+	defer billingServer.Close()
+
+	// Resolved the way proxyHandler does, behind one trusted proxy
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	req.RemoteAddr = "10.0.0.1:5000"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 203.0.113.7")
+	req = req.WithContext(context.WithValue(req.Context(), "clientIP", clientIP(req, 1)))
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+
+	forwarder := services.NewBillingForwarder(billingServer.URL, nil)
+	sendToBillingService(forwarder, strings.NewReader("data: usage"), resp, "user-1", "account-a", time.Millisecond, nil)
+
+	select {
+	case got := <-clientIPs:
+		if got != "203.0.113.7" {
+			t.Errorf("expected billing to receive the client IP 203.0.113.7, got %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("billing was not called")
+	}
+}
+
+func TestIsBillablePath(t *testing.T) {
+	for path, want := range map[string]bool{
+		"/v1/messages":                  true,
+		"/model/claude/messages":        true,
+		"/v1/messages/count_tokens":     false,
+		"/v1/messages/batches":          false,
+		"/v1/messages/batches/msgbatch": false,
+		"/v1/models":                    false,
+	} {
+		if got := isBillablePath(path); got != want {
+			t.Errorf("isBillablePath(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestRewriteRequestModel(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(`{"model":"old-model","max_tokens":100,"stream":true}`))
+	if err := rewriteRequestModel(req, "new-model"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	body, _ := io.ReadAll(req.Body)
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatalf("rewritten body is not JSON: %v", err)
+	}
+	if payload["model"] != "new-model" || payload["max_tokens"] != float64(100) || payload["stream"] != true {
+		t.Errorf("unexpected rewritten body %s", body)
+	}
+	if req.ContentLength != int64(len(body)) {
+		t.Errorf("expected Content-Length %d, got %d", len(body), req.ContentLength)
+	}
+
+	bad := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader("not json"))
+	if err := rewriteRequestModel(bad, "new-model"); err == nil {
+		t.Errorf("expected an error for a non-JSON body")
+	}
+}
+
+// historyBody builds a request body with count messages of text each
+func historyBody(count int, text string) string {
+	var messages []string
+	for i := 0; i < count; i++ {
+		messages = append(messages, `{"role":"user","content":"`+text+`"}`)
+	}
+	return `{"model":"claude-sonnet-4","max_tokens":100,"messages":[` + strings.Join(messages, ",") + `]}`
+}
+
+func TestWithHistoryLimit(t *testing.T) {
+	var proxiedBody string
+	handler := withHistoryLimit(3, 200, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		proxiedBody = string(body)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	send := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body)))
+		return rec
+	}
+
+	normal := historyBody(2, "hi")
+	if rec := send(normal); rec.Code != http.StatusOK {
+		t.Fatalf("expected a normal history to pass, got %d", rec.Code)
+	}
+	if proxiedBody != normal {
+		t.Errorf("expected the body to reach the proxy intact, got %q", proxiedBody)
+	}
+
+	rec := send(historyBody(4, "hi"))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for too many messages, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "Conversation history is too long") {
+		t.Errorf("expected a clear message, got %q", rec.Body.String())
+	}
+
+	if rec := send(historyBody(1, strings.Repeat("x", 300))); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for an oversized history, got %d", rec.Code)
+	}
+
+	// Requests without a messages array aren't affected
+	if rec := send(`{"model":"claude-sonnet-4"}`); rec.Code != http.StatusOK {
+		t.Errorf("expected a body without messages to pass, got %d", rec.Code)
+	}
+}
+
+func TestWithKnownModels_StrictMode(t *testing.T) {
+	catalog := services.NewModelCatalog()
+	custom := pricing.DefaultModelPricing()
+	custom["claude-custom-1"] = pricing.ModelPricing{InputPricePerMillion: 1, OutputPricePerMillion: 5}
+	catalog.Reload(custom) // as if loaded from model_pricing
+
+	var proxied int
+	handler := withKnownModels(true, catalog, services.ModelAliases{"fast": "claude-custom-1", "broken": "claude-nope"}, func(w http.ResponseWriter, r *http.Request) {
+		proxied++
+		w.WriteHeader(http.StatusOK)
+	})
+	send := func(model string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(`{"model":"`+model+`"}`)))
+		return rec
+	}
+
+	for _, model := range []string{"claude-sonnet-4-20250514", "claude-custom-1", "fast"} {
+		if rec := send(model); rec.Code != http.StatusOK {
+			t.Errorf("expected known model %s to pass, got %d", model, rec.Code)
+		}
+	}
+	for _, model := range []string{"claude-mystery-5", "broken"} {
+		rec := send(model)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expected unknown model %s to be rejected with 400, got %d", model, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), "Unsupported model") {
+			t.Errorf("expected an unsupported model message, got %q", rec.Body.String())
+		}
+	}
+	if proxied != 3 {
+		t.Errorf("expected only the known models to be proxied, got %d", proxied)
+	}
+
+	// Outside strict mode every model is proxied
+	rec := httptest.NewRecorder()
+	withKnownModels(false, catalog, nil, func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })(rec,
+		httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(`{"model":"claude-mystery-5"}`)))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected unknown models to pass outside strict mode, got %d", rec.Code)
+	}
+}
+
+func TestWithBodyLimit(t *testing.T) {
+	var proxiedBody string
+	handler := withBodyLimit(100, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		proxiedBody = string(body)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	small := `{"model":"claude-sonnet-4"}`
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(small)))
+	if rec.Code != http.StatusOK || proxiedBody != small {
+		t.Fatalf("expected a small body to pass intact, got %d with %q", rec.Code, proxiedBody)
+	}
+
+	// Declared too large: rejected from Content-Length without reading the body
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(strings.Repeat("x", 101))))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for a body over the limit, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "Request body is too large") {
+		t.Errorf("expected a clear message, got %q", rec.Body.String())
+	}
+
+	// Streamed without a length: cut off once the limit is passed
+	proxiedBody = ""
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(strings.Repeat("x", 1000)))
+	req.ContentLength = -1
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for a streamed body over the limit, got %d", rec.Code)
+	}
+	if proxiedBody != "" {
+		t.Errorf("expected an oversized body never to reach the proxy")
+	}
+}
+
+func TestWithHistoryLimit_DisabledByDefault(t *testing.T) {
+	handler := withHistoryLimit(0, 0, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(historyBody(1000, "hi"))))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected no limit when disabled, got %d", rec.Code)
+	}
+}
+
+// scrapeMetric reads a sample from /metrics as served by the default Prometheus handler; samples
+// not exported yet read as 0
+func scrapeMetric(t *testing.T, name string) float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if value, found := strings.CutPrefix(line, name+" "); found {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("invalid value for %s: %q", name, value)
+			}
+			return parsed
+		}
+	}
+	return 0
+}
+
+func TestMetrics_CountsRequestsUnauthorizedAndRateLimits(t *testing.T) {
+	proxy, _, newRequest, _ := newProxyTestSetup(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	proxied := withMetrics(proxy.ServeHTTP)
+	unauthorized := withMetrics(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, "unauthorized", http.StatusUnauthorized)
+	})
+
+	counters := []string{
+		"simple_relay_requests_total",
+		"simple_relay_unauthorized_total",
+		"simple_relay_rate_limited_total",
+		"simple_relay_upstream_latency_seconds_count",
+	}
+	before := make(map[string]float64)
+	for _, name := range counters {
+		before[name] = scrapeMetric(t, name)
+	}
+
+	for i := 0; i < 2; i++ {
+		unauthorized(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/messages", nil))
+	}
+	rec := httptest.NewRecorder()
+	proxied(rec, newRequest())
+	if rec.Code != 529 {
+		t.Fatalf("expected 529, got %d", rec.Code)
+	}
+
+	want := map[string]float64{
+		"simple_relay_requests_total":                 3,
+		"simple_relay_unauthorized_total":             2,
+		"simple_relay_rate_limited_total":             1,
+		"simple_relay_upstream_latency_seconds_count": 1,
+	}
+	for _, name := range counters {
+		if got := scrapeMetric(t, name) - before[name]; got != want[name] {
+			t.Errorf("%s increased by %v, want %v", name, got, want[name])
+		}
+	}
+}
+
+func TestWithRequestID_CorrelatesLogsAndBilling(t *testing.T) {
+	var logs bytes.Buffer
+	original := slog.Default()
+	logging.Setup(&logs, "json")
+	defer func() {
+		slog.SetDefault(original)
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"type":"error","error":{"type":"invalid_request_error","message":"bad"}}`))
+	}))
+	defer upstreamServer.Close()
+	billedRequestIDs := make(chan string, 1)
+	billingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		billedRequestIDs <- r.Header.Get(logging.RequestIDHeader)
+	}))
+	defer billingServer.Close()
+
+	target, _ := url.Parse(upstreamServer.URL)
+	tokens := upstream.NewMemoryTokenProvider(
+		&upstream.OAuthCredentials{AccountUUID: "account-a", AccessToken: "token-a", ExpiresAt: time.Now().Add(time.Hour)},
+	)
+	proxy := newUpstreamProxy(&Config{OfficialTarget: target}, tokens, services.NewBillingForwarder(billingServer.URL, nil), services.NewModelCatalog())
+
+	// Stands in for proxyHandler: authenticate, tag the logger with the user, then proxy
+	handler := withRequestID(func(w http.ResponseWriter, r *http.Request) {
+		logger := logging.FromContext(r.Context()).With("user_id", "user-1")
+		r = r.WithContext(logging.WithLogger(r.Context(), logger))
+		logger.Info("authenticated request")
+		binding, err := tokens.GetValidTokenForUser("user-1")
+		if err != nil {
+			t.Fatalf("failed to bind user: %v", err)
+		}
+		proxy.ServeHTTP(w, withProxyContext(r, "user-1", binding, 0))
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(`{"model":"claude-sonnet-4"}`))
+	req.Header.Set(logging.RequestIDHeader, "req-lifecycle-1")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+
+	if got := rec.Header().Get(logging.RequestIDHeader); got != "req-lifecycle-1" {
+		t.Errorf("expected the correlation ID echoed to the client, got %q", got)
+	}
+	select {
+	case got := <-billedRequestIDs:
+		if got != "req-lifecycle-1" {
+			t.Errorf("expected billing to receive the correlation ID, got %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("billing was not called")
+	}
+
+	messages := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line is not JSON: %q", line)
+		}
+		if entry["request_id"] != "req-lifecycle-1" {
+			continue
+		}
+		if entry["user_id"] != "user-1" {
+			t.Errorf("expected user_id on every request line, got %v", entry)
+		}
+		messages[entry["message"].(string)] = true
+	}
+	for _, message := range []string{"authenticated request", "proxying request upstream", "non-200 upstream response"} {
+		if !messages[message] {
+			t.Errorf("expected %q to be logged with the correlation ID, got %v", message, messages)
+		}
+	}
+
+	// Without a client-supplied ID one is generated
+	rec = httptest.NewRecorder()
+	withRequestID(func(w http.ResponseWriter, r *http.Request) {})(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if generated := rec.Header().Get(logging.RequestIDHeader); len(generated) != 32 {
+		t.Errorf("expected a generated 32-character ID, got %q", generated)
+	}
+}
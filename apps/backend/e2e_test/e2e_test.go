@@ -3,6 +3,7 @@ package e2e_test
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"io"
 	"net/http"
 	"os"
@@ -13,9 +14,13 @@ import (
 
 	"cloud.google.com/go/firestore"
 	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"simple-relay/backend/e2e_test/helpers"
 	"simple-relay/backend/e2e_test/mocks"
+	"simple-relay/backend/internal/services"
+	"simple-relay/backend/internal/services/upstream"
 )
 
 type E2EIntegrationTestSuite struct {
@@ -68,6 +73,9 @@ func (suite *E2EIntegrationTestSuite) SetupSuite() {
 	os.Setenv("FIRESTORE_DATABASE_NAME", "(default)")
 	os.Setenv("PORT", "8888") // Use a different port for testing
 	
+	// The mock Claude API is served over plain http, which requires dev mode
+	os.Setenv("UPSTREAM_DEV_MODE", "true")
+	
 	// Disable identity token fetching in test environment
 	// This prevents the backend from trying to contact GCP metadata service
 	os.Setenv("DISABLE_IDENTITY_TOKEN", "true")
@@ -203,7 +211,7 @@ func (suite *E2EIntegrationTestSuite) TestE2E_SuccessfulProxyRequest() {
 	err := suite.testData.SeedUser(ctx, helpers.TestUser{
 		Email:            suite.testUserEmail,
 		APIKey:           suite.testAPIKey,
-		HasAPIAccess:     true,
+		APIEnabled:       true,
 		DailyPointsLimit: 1000,
 		CreatedAt:        time.Now(),
 	})
@@ -249,6 +257,7 @@ func (suite *E2EIntegrationTestSuite) TestE2E_SuccessfulProxyRequest() {
 	suite.Equal(suite.testUserEmail, billingRequests[0].UserID)
 	suite.Equal("test-account-uuid", billingRequests[0].UpstreamAccountUUID)
 	suite.Contains(billingRequests[0].Body, "message_start", "Billing should receive SSE stream")
+	suite.Equal("req_mock_upstream_123", billingRequests[0].Headers.Get("Request-Id"), "Billing should receive Anthropic's request id")
 }
 
 // TEST: Unauthorized request without API key
@@ -276,7 +285,7 @@ func (suite *E2EIntegrationTestSuite) TestE2E_RateLimiting_DailyPointsExceeded()
 	err := suite.testData.SeedUser(ctx, helpers.TestUser{
 		Email:            rateLimitedUser,
 		APIKey:           rateLimitedAPIKey,
-		HasAPIAccess:     true,
+		APIEnabled:       true,
 		DailyPointsLimit: 0, // No points available
 		CreatedAt:        time.Now(),
 	})
@@ -298,6 +307,318 @@ func (suite *E2EIntegrationTestSuite) TestE2E_RateLimiting_DailyPointsExceeded()
 		"Expected 429 Too Many Requests for user with no daily points")
 }
 
+// TEST: Disabling one API key doesn't revoke the user's other keys
+func (suite *E2EIntegrationTestSuite) TestE2E_DisabledAPIKey_OtherKeyStillWorks() {
+	ctx := context.Background()
+
+	multiKeyUser := "multikey@example.com"
+	enabledAPIKey := "multi-key-enabled"
+	disabledAPIKey := "multi-key-disabled"
+
+	err := suite.testData.SeedUser(ctx, helpers.TestUser{
+		Email:        multiKeyUser,
+		APIEnabled:   true,
+		CreatedAt:    time.Now(),
+	})
+	suite.Require().NoError(err, "Failed to seed test user")
+	suite.Require().NoError(suite.testData.SeedApiKeyBinding(ctx, multiKeyUser, enabledAPIKey, true))
+	suite.Require().NoError(suite.testData.SeedApiKeyBinding(ctx, multiKeyUser, disabledAPIKey, false))
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	sendWithKey := func(apiKey string) int {
+		req, err := http.NewRequest("POST", suite.backendURL+"/v1/messages", nil)
+		suite.Require().NoError(err)
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := client.Do(req)
+		suite.Require().NoError(err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	suite.Equal(http.StatusUnauthorized, sendWithKey(disabledAPIKey), "Expected disabled key to be rejected")
+	// The user has no points limit, so an authenticated request stops at the limit check
+	suite.Equal(http.StatusTooManyRequests, sendWithKey(enabledAPIKey), "Expected enabled key to authenticate")
+}
+
+// TEST: Seeded documents use the canonical schema and decode through the production readers
+func (suite *E2EIntegrationTestSuite) TestE2E_SchemaRoundTrip() {
+	ctx := context.Background()
+
+	schemaUser := "schema@example.com"
+	schemaAPIKey := "schema-api-key"
+	err := suite.testData.SeedUser(ctx, helpers.TestUser{
+		Email:            schemaUser,
+		APIKey:           schemaAPIKey,
+		APIEnabled:       true,
+		DailyPointsLimit: 250,
+		CreatedAt:        time.Now(),
+	})
+	suite.Require().NoError(err, "Failed to seed test user")
+
+	// The frontend writes bindings under the key's hash, so no plaintext fallback is needed
+	apiKeyService := services.NewApiKeyService(suite.firestoreClient)
+	userEmail, err := apiKeyService.FindUserEmailByApiKey(ctx, schemaAPIKey)
+	suite.Require().NoError(err)
+	suite.Equal(schemaUser, userEmail, "API key binding should decode to the seeded user")
+
+	limit, found, err := services.NewPointsLimitService(suite.firestoreClient).GetPointsLimit(ctx, schemaUser)
+	suite.Require().NoError(err)
+	suite.True(found, "Points limit should be found")
+	suite.Equal(250, limit.Points, "Points limit should decode from canonical fields")
+}
+
+// TEST: An org-deleted error disables the bound account and rebinds the user to another one
+func (suite *E2EIntegrationTestSuite) TestE2E_OrgDeleted_DisablesAccountAndRebinds() {
+	ctx := context.Background()
+
+	orgUser := "orgdeleted@example.com"
+	orgAPIKey := "org-deleted-api-key"
+	err := suite.testData.SeedUser(ctx, helpers.TestUser{
+		Email:            orgUser,
+		APIKey:           orgAPIKey,
+		APIEnabled:       true,
+		DailyPointsLimit: 1000,
+		CreatedAt:        time.Now(),
+	})
+	suite.Require().NoError(err, "Failed to seed test user")
+
+	// The user is bound to an account whose organization was deleted; a healthy account is unbound
+	err = suite.testData.SeedOAuthToken(ctx, helpers.TestOAuthToken{
+		UserID:       orgUser,
+		AccessToken:  "deleted-org-token",
+		RefreshToken: "deleted-org-refresh",
+		ExpiresAt:    time.Now().Add(1 * time.Hour),
+		AccountUUID:  "deleted-org-account",
+		OrgName:      "Deleted Organization",
+	})
+	suite.Require().NoError(err, "Failed to seed deleted-org token")
+	err = suite.testData.SeedOAuthToken(ctx, helpers.TestOAuthToken{
+		AccessToken:  "healthy-org-token",
+		RefreshToken: "healthy-org-refresh",
+		ExpiresAt:    time.Now().Add(1 * time.Hour),
+		AccountUUID:  "healthy-org-account",
+		OrgName:      "Healthy Organization",
+	})
+	suite.Require().NoError(err, "Failed to seed healthy token")
+
+	suite.mockClaudeAPI.SetTokenError("deleted-org-token", http.StatusBadRequest,
+		`{"type":"error","error":{"type":"invalid_request_error","message":"This organization has been disabled."}}`)
+
+	requestBody := `{"model": "claude-3-opus-20240229", "messages": [{"role": "user", "content": "Hello"}], "max_tokens": 100}`
+	sendRequest := func() int {
+		req, err := http.NewRequest("POST", suite.backendURL+"/v1/messages", bytes.NewBufferString(requestBody))
+		suite.Require().NoError(err)
+		req.Header.Set("Authorization", "Bearer "+orgAPIKey)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+		suite.Require().NoError(err)
+		defer resp.Body.Close()
+		io.ReadAll(resp.Body)
+		return resp.StatusCode
+	}
+
+	suite.Equal(529, sendRequest(), "Expected org-level failure to be returned as 529")
+
+	// The account is disabled and the user rebound asynchronously
+	suite.Eventually(func() bool {
+		doc, err := suite.firestoreClient.Collection("user_token_bindings").Doc(orgUser).Get(ctx)
+		if err != nil {
+			return false
+		}
+		var binding upstream.UserTokenBinding
+		return doc.DataTo(&binding) == nil && binding.AccountUUID == "healthy-org-account"
+	}, 5*time.Second, 100*time.Millisecond, "User should be rebound to the healthy account")
+
+	doc, err := suite.firestoreClient.Collection("oauth_tokens").Doc("deleted-org-account").Get(ctx)
+	suite.Require().NoError(err)
+	var credentials upstream.OAuthCredentials
+	suite.Require().NoError(doc.DataTo(&credentials))
+	suite.True(credentials.Disabled, "Deleted-org account should be disabled")
+
+	suite.Equal(http.StatusOK, sendRequest(), "Expected retry to succeed on the rebound account")
+	claudeRequests := suite.mockClaudeAPI.GetRequests()
+	suite.Require().NotEmpty(claudeRequests)
+	suite.Equal("healthy-org-token", claudeRequests[len(claudeRequests)-1].AuthToken)
+}
+
+// TEST: An upstream 429 reaches the client as 529, clears the user's binding and saves the rate-limit headers
+func (suite *E2EIntegrationTestSuite) TestE2E_RateLimited_Returns529AndClearsBinding() {
+	ctx := context.Background()
+
+	limitedUser := "upstream429@example.com"
+	limitedAPIKey := "upstream-429-api-key"
+	err := suite.testData.SeedUser(ctx, helpers.TestUser{
+		Email:            limitedUser,
+		APIKey:           limitedAPIKey,
+		APIEnabled:       true,
+		DailyPointsLimit: 1000,
+		CreatedAt:        time.Now(),
+	})
+	suite.Require().NoError(err, "Failed to seed test user")
+
+	err = suite.testData.SeedOAuthToken(ctx, helpers.TestOAuthToken{
+		UserID:       limitedUser,
+		AccessToken:  "rate-limited-token",
+		RefreshToken: "rate-limited-refresh",
+		ExpiresAt:    time.Now().Add(1 * time.Hour),
+		AccountUUID:  "rate-limited-account",
+		OrgName:      "Rate Limited Organization",
+	})
+	suite.Require().NoError(err, "Failed to seed OAuth token")
+
+	suite.mockClaudeAPI.SetTokenRateLimited("rate-limited-token", map[string]string{
+		"anthropic-ratelimit-unified-status": "rejected",
+		"anthropic-ratelimit-unified-reset":  "1760000000",
+		"retry-after":                        "60",
+	})
+
+	requestBody := `{"model": "claude-3-opus-20240229", "messages": [{"role": "user", "content": "Hello"}], "max_tokens": 100}`
+	req, err := http.NewRequest("POST", suite.backendURL+"/v1/messages", bytes.NewBufferString(requestBody))
+	suite.Require().NoError(err)
+	req.Header.Set("Authorization", "Bearer "+limitedAPIKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	suite.Require().NoError(err)
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	suite.Equal(529, resp.StatusCode, "Expected upstream 429 to be returned as 529")
+
+	// The binding is cleared and the headers saved asynchronously
+	suite.Eventually(func() bool {
+		_, err := suite.firestoreClient.Collection("user_token_bindings").Doc(limitedUser).Get(ctx)
+		return status.Code(err) == codes.NotFound
+	}, 5*time.Second, 100*time.Millisecond, "User token binding should be cleared")
+
+	suite.Eventually(func() bool {
+		doc, err := suite.firestoreClient.Collection("oauth_tokens").Doc("rate-limited-account").Get(ctx)
+		if err != nil {
+			return false
+		}
+		var credentials upstream.OAuthCredentials
+		return doc.DataTo(&credentials) == nil && credentials.RateLimitHeaders != nil
+	}, 5*time.Second, 100*time.Millisecond, "Rate-limit headers should be saved on the account")
+
+	doc, err := suite.firestoreClient.Collection("oauth_tokens").Doc("rate-limited-account").Get(ctx)
+	suite.Require().NoError(err)
+	var credentials upstream.OAuthCredentials
+	suite.Require().NoError(doc.DataTo(&credentials))
+	suite.Equal("rejected", credentials.RateLimitHeaders["Anthropic-Ratelimit-Unified-Status"])
+	suite.Equal("1760000000", credentials.RateLimitHeaders["Anthropic-Ratelimit-Unified-Reset"])
+}
+
+// TEST: A 429 is retried once on another account and the client gets the successful response
+func (suite *E2EIntegrationTestSuite) TestE2E_RateLimited_RetriesOnAnotherAccount() {
+	ctx := context.Background()
+
+	user := "upstream429retry@example.com"
+	apiKey := "upstream-429-retry-api-key"
+	err := suite.testData.SeedUser(ctx, helpers.TestUser{
+		Email:            user,
+		APIKey:           apiKey,
+		APIEnabled:       true,
+		DailyPointsLimit: 1000,
+		CreatedAt:        time.Now(),
+	})
+	suite.Require().NoError(err, "Failed to seed test user")
+
+	// The user is bound to the rate-limited account; a second account is free
+	err = suite.testData.SeedOAuthToken(ctx, helpers.TestOAuthToken{
+		UserID:       user,
+		AccessToken:  "retry-limited-token",
+		RefreshToken: "retry-limited-refresh",
+		ExpiresAt:    time.Now().Add(1 * time.Hour),
+		AccountUUID:  "retry-limited-account",
+		OrgName:      "Rate Limited Organization",
+	})
+	suite.Require().NoError(err, "Failed to seed rate-limited OAuth token")
+	err = suite.testData.SeedOAuthToken(ctx, helpers.TestOAuthToken{
+		AccessToken:  "retry-free-token",
+		RefreshToken: "retry-free-refresh",
+		ExpiresAt:    time.Now().Add(1 * time.Hour),
+		AccountUUID:  "retry-free-account",
+		OrgName:      "Free Organization",
+	})
+	suite.Require().NoError(err, "Failed to seed free OAuth token")
+
+	suite.mockClaudeAPI.SetTokenRateLimited("retry-limited-token", map[string]string{
+		"anthropic-ratelimit-unified-status": "rejected",
+		"retry-after":                        "60",
+	})
+
+	requestBody := `{"model": "claude-3-opus-20240229", "messages": [{"role": "user", "content": "Hello"}], "max_tokens": 100}`
+	req, err := http.NewRequest("POST", suite.backendURL+"/v1/messages", bytes.NewBufferString(requestBody))
+	suite.Require().NoError(err)
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	suite.Require().NoError(err)
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	suite.Equal(http.StatusOK, resp.StatusCode, "Expected the 429 to be retried on the free account")
+
+	requests := suite.mockClaudeAPI.GetRequests()
+	suite.Require().Len(requests, 2, "Expected exactly one retry")
+	suite.Equal("retry-limited-token", requests[0].AuthToken)
+	suite.Equal("retry-free-token", requests[1].AuthToken)
+	suite.Equal(requests[0].Body, requests[1].Body, "Expected the request body to be replayed")
+
+	doc, err := suite.firestoreClient.Collection("user_token_bindings").Doc(user).Get(ctx)
+	suite.Require().NoError(err)
+	var binding upstream.UserTokenBinding
+	suite.Require().NoError(doc.DataTo(&binding))
+	suite.Equal("retry-free-account", binding.AccountUUID, "Expected the user to be moved to the free account")
+}
+
+// TEST: GET /usage reports the caller's limit, usage in the current window and reset time
+func (suite *E2EIntegrationTestSuite) TestE2E_UsageEndpoint() {
+	ctx := context.Background()
+
+	usageUser := "usage@example.com"
+	usageAPIKey := "usage-api-key"
+	err := suite.testData.SeedUser(ctx, helpers.TestUser{
+		Email:            usageUser,
+		APIKey:           usageAPIKey,
+		APIEnabled:       true,
+		DailyPointsLimit: 500,
+		CreatedAt:        time.Now(),
+	})
+	suite.Require().NoError(err, "Failed to seed test user")
+	err = suite.testData.SeedHourlyAggregate(ctx, usageUser, time.Now(), 120)
+	suite.Require().NoError(err, "Failed to seed hourly aggregate")
+
+	req, err := http.NewRequest("GET", suite.backendURL+"/usage", nil)
+	suite.Require().NoError(err)
+	req.Header.Set("Authorization", "Bearer "+usageAPIKey)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	suite.Require().NoError(err)
+	defer resp.Body.Close()
+	suite.Require().Equal(http.StatusOK, resp.StatusCode)
+
+	var usage services.DailyUsage
+	suite.Require().NoError(json.NewDecoder(resp.Body).Decode(&usage))
+	suite.Equal("available", usage.State)
+	suite.Equal(500, usage.PointsLimit)
+	suite.Equal(120, usage.PointsUsed)
+	suite.Equal(380, usage.PointsRemaining)
+	suite.True(usage.ResetsAt.After(time.Now()), "Expected the reset time to be in the future")
+	suite.Equal(24*time.Hour, usage.ResetsAt.Sub(usage.WindowStart))
+
+	// Without an API key the endpoint is unauthorized
+	resp, err = http.Get(suite.backendURL + "/usage")
+	suite.Require().NoError(err)
+	defer resp.Body.Close()
+	suite.Equal(http.StatusUnauthorized, resp.StatusCode)
+}
+
 // TEST: Health check endpoint
 func (suite *E2EIntegrationTestSuite) TestE2E_HealthCheck() {
 	resp, err := http.Get(suite.backendURL + "/health")
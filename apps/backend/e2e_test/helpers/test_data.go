@@ -2,17 +2,25 @@ package helpers
 
 import (
 	"context"
+	"strings"
 	"time"
 
+	"simple-relay/backend/internal/services"
+	"simple-relay/backend/internal/services/upstream"
+	"simple-relay/shared/timewindow"
+
 	"cloud.google.com/go/firestore"
 )
 
+// Seeded documents use the canonical field names written in production (see CLAUDE.md, Firestore Schema):
+// users and api_key_bindings as the frontend writes them, oauth_tokens and user_token_bindings via the backend structs.
+
 type TestUser struct {
-	Email           string
-	APIKey          string
-	HasAPIAccess    bool
+	Email            string
+	APIKey           string
+	APIEnabled       bool
 	DailyPointsLimit int
-	CreatedAt       time.Time
+	CreatedAt        time.Time
 }
 
 type TestOAuthToken struct {
@@ -38,12 +46,11 @@ func NewTestDataManager(client *firestore.Client, projectID string) *TestDataMan
 
 // SeedUser creates a test user with API key binding
 func (tdm *TestDataManager) SeedUser(ctx context.Context, user TestUser) error {
-	// Create user document
+	// Create user document (as written by the frontend user database)
 	userData := map[string]interface{}{
-		"email":         user.Email,
-		"hasAPIAccess":  user.HasAPIAccess,
-		"createdAt":     user.CreatedAt,
-		"apiKeyCreated": true,
+		"email":       user.Email,
+		"api_enabled": user.APIEnabled,
+		"created_at":  user.CreatedAt.Format(time.RFC3339),
 	}
 	
 	_, err := tdm.firestoreClient.Collection("users").Doc(user.Email).Set(ctx, userData)
@@ -53,23 +60,17 @@ func (tdm *TestDataManager) SeedUser(ctx context.Context, user TestUser) error {
 	
 	// Create API key binding
 	if user.APIKey != "" {
-		apiKeyData := map[string]interface{}{
-			"user_email": user.Email,  // Changed from "email" to match ApiKeyBinding struct
-			"api_key":    user.APIKey,
-			"createdAt":  time.Now(),
-		}
-		_, err = tdm.firestoreClient.Collection("api_key_bindings").Doc(user.APIKey).Set(ctx, apiKeyData)
-		if err != nil {
+		if err := tdm.SeedApiKeyBinding(ctx, user.Email, user.APIKey, true); err != nil {
 			return err
 		}
 	}
 	
 	// Set daily points limit if specified
 	if user.DailyPointsLimit > 0 {
-		limitData := map[string]interface{}{
-			"userId":      user.Email,
-			"pointsLimit": user.DailyPointsLimit,
-			"updateTime":  time.Now().Format(time.RFC3339), // Store as string to match struct
+		limitData := services.DailyPointsLimit{
+			UserID:      user.Email,
+			PointsLimit: user.DailyPointsLimit,
+			UpdateTime:  time.Now().Format(time.RFC3339),
 		}
 		_, err = tdm.firestoreClient.Collection("daily_points_limits").Doc(user.Email).Set(ctx, limitData)
 		if err != nil {
@@ -80,32 +81,69 @@ func (tdm *TestDataManager) SeedUser(ctx context.Context, user TestUser) error {
 	return nil
 }
 
+// SeedApiKeyBinding creates an additional API key binding for a user with an explicit enable flag
+func (tdm *TestDataManager) SeedApiKeyBinding(ctx context.Context, userEmail string, apiKey string, enabled bool) error {
+	// Document ID is the key's hash, as written by the frontend API key database
+	apiKeyData := map[string]interface{}{
+		"key_preview": maskApiKey(apiKey),
+		"user_email":  userEmail,
+		"enabled":    enabled,
+		"created_at": time.Now().Format(time.RFC3339),
+	}
+	_, err := tdm.firestoreClient.Collection("api_key_bindings").Doc(services.HashApiKey(apiKey)).Set(ctx, apiKeyData)
+	return err
+}
+
+// maskApiKey keeps the first 7 and last 4 characters of a key, like the frontend's key_preview
+func maskApiKey(apiKey string) string {
+	if len(apiKey) <= 11 {
+		return apiKey
+	}
+	return apiKey[:7] + strings.Repeat("*", len(apiKey)-11) + apiKey[len(apiKey)-4:]
+}
+
 // SeedOAuthToken creates an OAuth token for a user
 func (tdm *TestDataManager) SeedOAuthToken(ctx context.Context, token TestOAuthToken) error {
-	tokenData := map[string]interface{}{
-		"accessToken":  token.AccessToken,
-		"refreshToken": token.RefreshToken,
-		"expiresAt":    token.ExpiresAt,
-		"accountUUID":  token.AccountUUID,
-		"orgName":      token.OrgName,
-		"createdAt":    time.Now(),
-		"updatedAt":    time.Now(),
+	// oauth_tokens documents are keyed by account UUID, as written by the refresher and manage-oauth-tokens.sh
+	credentials := upstream.OAuthCredentials{
+		AccessToken:      token.AccessToken,
+		RefreshToken:     token.RefreshToken,
+		ExpiresAt:        token.ExpiresAt,
+		OrganizationName: token.OrgName,
+		AccountUUID:      token.AccountUUID,
+		UpdatedAt:        time.Now(),
 	}
-	
-	_, err := tdm.firestoreClient.Collection("oauth_tokens").Doc(token.AccessToken).Set(ctx, tokenData)
+	_, err := tdm.firestoreClient.Collection("oauth_tokens").Doc(token.AccountUUID).Set(ctx, credentials)
 	if err != nil {
 		return err
 	}
-	
-	// Create user token binding
-	bindingData := map[string]interface{}{
-		"user_id":      token.UserID,      // Changed from userId to match struct
-		"account_uuid": token.AccountUUID,  // Added to match UserTokenBinding struct
-		"access_token": token.AccessToken,  // Changed from accessToken to match struct
-		"expires_at":   token.ExpiresAt,    // Added to match UserTokenBinding struct
+
+	// Create user token binding; tokens seeded without a user are left unbound
+	if token.UserID == "" {
+		return nil
 	}
-	
-	_, err = tdm.firestoreClient.Collection("user_token_bindings").Doc(token.UserID).Set(ctx, bindingData)
+	binding := upstream.UserTokenBinding{
+		UserID:      token.UserID,
+		AccountUUID: token.AccountUUID,
+		AccessToken: token.AccessToken,
+		ExpiresAt:   token.ExpiresAt,
+	}
+	_, err = tdm.firestoreClient.Collection("user_token_bindings").Doc(token.UserID).Set(ctx, binding)
+	return err
+}
+
+// SeedHourlyAggregate records points used by a user in the hour containing at, as the billing aggregator writes them
+func (tdm *TestDataManager) SeedHourlyAggregate(ctx context.Context, userID string, at time.Time, points float64) error {
+	hour := at.UTC().Truncate(time.Hour)
+	aggregate := map[string]interface{}{
+		"user_id":      userID,
+		"hour":         hour,
+		"total_points": points,
+		"total_cost":   points / 10,
+		"created_at":   time.Now(),
+		"updated_at":   time.Now(),
+	}
+	_, err := tdm.firestoreClient.Collection("hourly_aggregates").Doc(userID+"_"+timewindow.HourKey(hour)).Set(ctx, aggregate)
 	return err
 }
 
@@ -135,4 +173,4 @@ func (tdm *TestDataManager) CleanupAll(ctx context.Context) error {
 	}
 	
 	return nil
-}
\ No newline at end of file
+}
@@ -16,15 +16,25 @@ type ClaudeRequest struct {
 	AuthToken   string
 }
 
+type mockError struct {
+	StatusCode int
+	Body       string
+	Headers    map[string]string
+}
+
 type MockClaudeAPI struct {
 	Server   *httptest.Server
 	Requests []ClaudeRequest
 	mu       sync.Mutex
+	
+	// Control behavior: requests with these OAuth tokens get the configured error
+	tokenErrors map[string]mockError
 }
 
 func NewMockClaudeAPI() *MockClaudeAPI {
 	mock := &MockClaudeAPI{
-		Requests: []ClaudeRequest{},
+		Requests:    []ClaudeRequest{},
+		tokenErrors: make(map[string]mockError),
 	}
 	
 	mock.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -55,6 +65,17 @@ func NewMockClaudeAPI() *MockClaudeAPI {
 			return
 		}
 		
+		// Return the configured error for this token
+		if tokenErr, exists := mock.tokenErrors[strings.TrimPrefix(authHeader, "Bearer ")]; exists {
+			w.Header().Set("Content-Type", "application/json")
+			for key, value := range tokenErr.Headers {
+				w.Header().Set(key, value)
+			}
+			w.WriteHeader(tokenErr.StatusCode)
+			w.Write([]byte(tokenErr.Body))
+			return
+		}
+		
 		// Check for beta header
 		betaHeader := r.Header.Get("anthropic-beta")
 		if !strings.Contains(betaHeader, "oauth-2025-04-20") {
@@ -70,6 +91,7 @@ func NewMockClaudeAPI() *MockClaudeAPI {
 			w.Header().Set("Content-Type", "text/event-stream")
 			w.Header().Set("Cache-Control", "no-cache")
 			w.Header().Set("Connection", "keep-alive")
+			w.Header().Set("request-id", "req_mock_upstream_123")
 			
 			// Simulate SSE stream with message_start and message_delta events
 			fmt.Fprintf(w, "event: message_start\n")
@@ -110,6 +132,25 @@ func (m *MockClaudeAPI) Reset() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.Requests = []ClaudeRequest{}
+	m.tokenErrors = make(map[string]mockError)
+}
+
+// SetTokenError makes every request using accessToken fail with the given status and body
+func (m *MockClaudeAPI) SetTokenError(accessToken string, statusCode int, body string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokenErrors[accessToken] = mockError{StatusCode: statusCode, Body: body}
+}
+
+// SetTokenRateLimited makes every request using accessToken fail with a 429 carrying the given rate-limit headers
+func (m *MockClaudeAPI) SetTokenRateLimited(accessToken string, headers map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokenErrors[accessToken] = mockError{
+		StatusCode: http.StatusTooManyRequests,
+		Body:       `{"type":"error","error":{"type":"rate_limit_error","message":"Number of request tokens has exceeded your rate limit."}}`,
+		Headers:    headers,
+	}
 }
 
 func (m *MockClaudeAPI) Close() {
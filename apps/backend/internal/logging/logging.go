@@ -0,0 +1,79 @@
+// Package logging sets up structured logs and carries a per-request logger, tagged with the
+// request's correlation ID, through the request context
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+)
+
+// RequestIDHeader carries the correlation ID from clients and on to the billing service
+const RequestIDHeader = "X-Request-Id"
+
+// NewHandler returns a slog handler writing to w. format "text" writes key=value lines for local
+// development; anything else writes JSON with the severity and message field names Cloud Logging reads.
+func NewHandler(w io.Writer, format string) slog.Handler {
+	if format == "text" {
+		return slog.NewTextHandler(w, nil)
+	}
+	return slog.NewJSONHandler(w, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if len(groups) > 0 {
+				return attr
+			}
+			switch attr.Key {
+			case slog.LevelKey:
+				attr.Key = "severity"
+			case slog.MessageKey:
+				attr.Key = "message"
+			}
+			return attr
+		},
+	})
+}
+
+// Setup makes the default slog logger write to w. Lines written with the log package go through
+// it too, so they become structured entries without a request ID.
+func Setup(w io.Writer, format string) {
+	slog.SetDefault(slog.New(NewHandler(w, format)))
+}
+
+// NewRequestID returns a random 16-byte hex correlation ID
+func NewRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
+
+type requestIDKey struct{}
+type loggerKey struct{}
+
+// WithRequestID stores the correlation ID and a default logger tagged with it in ctx
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	ctx = context.WithValue(ctx, requestIDKey{}, requestID)
+	return WithLogger(ctx, slog.Default().With("request_id", requestID))
+}
+
+// RequestID returns the correlation ID stored in ctx, or "" if there is none
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// WithLogger stores logger in ctx, e.g. after adding the authenticated user to it
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the request's logger, or the default logger outside a request
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
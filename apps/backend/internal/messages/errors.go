@@ -1,14 +1,125 @@
 package messages
 
-// ClientErrorMessages contains all error messages sent to clients
-var ClientErrorMessages = struct {
-	Unauthorized        string
-	InternalServerError string
-	DailyLimitExceeded  string
-	TokenOverloaded     string
-}{
-	Unauthorized:        "[AFL] Unauthorized",
-	InternalServerError: "[AFL] Internal Server Error",
-	DailyLimitExceeded:  "[AFL] Reached daily limit. Resets at 4am UTC+8.",
-	TokenOverloaded:     "[AFL] Token overloaded",
+// Key identifies a client-facing message
+type Key string
+
+// Client error messages
+const (
+	Unauthorized         Key = "unauthorized"
+	InternalServerError  Key = "internal_server_error"
+	DailyLimitExceeded   Key = "daily_limit_exceeded"
+	MonthlyLimitExceeded Key = "monthly_limit_exceeded"
+	ModelLimitExceeded   Key = "model_limit_exceeded"
+	NoDailyAllowance     Key = "no_daily_allowance"
+	TokenOverloaded      Key = "token_overloaded"
+	UnknownModel         Key = "unknown_model"
+	Maintenance          Key = "maintenance"
+	Throttled            Key = "throttled"
+	TooManyRequests      Key = "too_many_requests"
+	HistoryTooLarge      Key = "history_too_large"
+	RequestTooLarge      Key = "request_too_large"
+	ModelNotAllowed      Key = "model_not_allowed"
+	TooManyConcurrent    Key = "too_many_concurrent_requests"
+)
+
+// Generic messages used when upstream error bodies are masked
+const (
+	UpstreamInvalidRequest  Key = "upstream_invalid_request"
+	UpstreamAuthentication  Key = "upstream_authentication"
+	UpstreamPermission      Key = "upstream_permission"
+	UpstreamNotFound        Key = "upstream_not_found"
+	UpstreamRequestTooLarge Key = "upstream_request_too_large"
+	UpstreamRateLimit       Key = "upstream_rate_limit"
+	UpstreamOverloaded      Key = "upstream_overloaded"
+	UpstreamAPIError        Key = "upstream_api_error"
+)
+
+// DefaultPrefix is the product name shown in front of every client-facing message
+const DefaultPrefix = "[AFL]"
+
+// DefaultLanguage is used when Accept-Language names no supported language
+const DefaultLanguage = "en"
+
+// builtinCatalogs contains the messages shipped with the service, without the product prefix
+var builtinCatalogs = map[string]map[Key]string{
+	"en": {
+		Unauthorized:            "Unauthorized",
+		InternalServerError:     "Internal Server Error",
+		DailyLimitExceeded:      "Reached daily limit. Resets at 4am UTC+8.",
+		MonthlyLimitExceeded:    "Reached monthly limit. Resets on the 1st of next month (UTC).",
+		ModelLimitExceeded:      "Reached daily limit for this model. Other models are still available. Resets at 4am UTC+8.",
+		NoDailyAllowance:        "No daily points allowance configured",
+		TokenOverloaded:         "Token overloaded",
+		UnknownModel:            "Unsupported model",
+		Maintenance:             "Service is under maintenance. Please retry later.",
+		Throttled:               "Temporarily throttled after unusually large responses. Please retry later.",
+		TooManyRequests:         "Too many requests. Please slow down.",
+		HistoryTooLarge:         "Conversation history is too long. Start a new conversation or compact it and retry.",
+		RequestTooLarge:         "Request body is too large.",
+		ModelNotAllowed:         "This model is not enabled for your account. Please use another model.",
+		TooManyConcurrent:       "Too many concurrent requests. Wait for a running request to finish and retry.",
+		UpstreamInvalidRequest:  "Invalid request",
+		UpstreamAuthentication:  "Upstream authentication failed",
+		UpstreamPermission:      "Upstream permission denied",
+		UpstreamNotFound:        "Not found",
+		UpstreamRequestTooLarge: "Request too large",
+		UpstreamRateLimit:       "Rate limited by upstream",
+		UpstreamOverloaded:      "Upstream overloaded",
+		UpstreamAPIError:        "Upstream error",
+	},
+	"zh": {
+		Unauthorized:            "未授权",
+		InternalServerError:     "服务器内部错误",
+		DailyLimitExceeded:      "已达到每日额度上限，将于北京时间凌晨4点重置。",
+		MonthlyLimitExceeded:    "已达到每月额度上限，将于下月1日（UTC）重置。",
+		ModelLimitExceeded:      "已达到该模型的每日额度上限，其他模型仍可使用，将于北京时间凌晨4点重置。",
+		NoDailyAllowance:        "未配置每日积分额度",
+		TokenOverloaded:         "令牌过载",
+		UnknownModel:            "不支持的模型",
+		Maintenance:             "服务维护中，请稍后重试。",
+		Throttled:               "因响应用量异常，已被暂时限制使用，请稍后重试。",
+		TooManyRequests:         "请求过于频繁，请稍后重试。",
+		HistoryTooLarge:         "对话历史过长，请开启新对话或压缩历史后重试。",
+		RequestTooLarge:         "请求体过大。",
+		ModelNotAllowed:         "您的账户未开通该模型，请使用其他模型。",
+		TooManyConcurrent:       "并发请求过多，请等待进行中的请求完成后重试。",
+		UpstreamInvalidRequest:  "无效请求",
+		UpstreamAuthentication:  "上游认证失败",
+		UpstreamPermission:      "上游拒绝访问",
+		UpstreamNotFound:        "未找到",
+		UpstreamRequestTooLarge: "请求过大",
+		UpstreamRateLimit:       "上游限流",
+		UpstreamOverloaded:      "上游过载",
+		UpstreamAPIError:        "上游错误",
+	},
+}
+
+// UpstreamError returns the Anthropic error type and generic message for an upstream status code
+func UpstreamError(statusCode int, acceptLanguage string) (errorType string, message string) {
+	errorType, key := upstreamErrorKey(statusCode)
+	return errorType, Localize(key, acceptLanguage)
+}
+
+// upstreamErrorKey maps an upstream status code to its Anthropic error type and message key
+func upstreamErrorKey(statusCode int) (string, Key) {
+	switch statusCode {
+	case 400:
+		return "invalid_request_error", UpstreamInvalidRequest
+	case 401:
+		return "authentication_error", UpstreamAuthentication
+	case 403:
+		return "permission_error", UpstreamPermission
+	case 404:
+		return "not_found_error", UpstreamNotFound
+	case 413:
+		return "request_too_large", UpstreamRequestTooLarge
+	case 429:
+		return "rate_limit_error", UpstreamRateLimit
+	case 529:
+		return "overloaded_error", UpstreamOverloaded
+	}
+	if statusCode >= 400 && statusCode < 500 {
+		return "invalid_request_error", UpstreamInvalidRequest
+	}
+	return "api_error", UpstreamAPIError
 }
@@ -0,0 +1,117 @@
+package messages
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// active holds the prefix and catalogs in use; replaced only by Configure at startup
+var active = struct {
+	prefix   string
+	catalogs map[string]map[Key]string
+}{
+	prefix:   DefaultPrefix,
+	catalogs: builtinCatalogs,
+}
+
+// Configure sets the product prefix and merges per-language overrides from a JSON file of the form
+// {"en": {"unauthorized": "..."}, "ja": {...}}. New languages may be added; keys they omit fall back
+// to English. An empty path keeps the built-in messages. Must be called before serving requests.
+func Configure(prefix string, overridesPath string) error {
+	catalogs := make(map[string]map[Key]string)
+	for lang, catalog := range builtinCatalogs {
+		catalogs[lang] = copyCatalog(catalog)
+	}
+
+	if overridesPath != "" {
+		data, err := os.ReadFile(overridesPath)
+		if err != nil {
+			return fmt.Errorf("failed to read messages file: %w", err)
+		}
+		var overrides map[string]map[Key]string
+		if err := json.Unmarshal(data, &overrides); err != nil {
+			return fmt.Errorf("failed to parse messages file: %w", err)
+		}
+		for lang, messages := range overrides {
+			lang = strings.ToLower(lang)
+			if catalogs[lang] == nil {
+				catalogs[lang] = make(map[Key]string)
+			}
+			for key, text := range messages {
+				catalogs[lang][key] = text
+			}
+		}
+	}
+
+	active.prefix = prefix
+	active.catalogs = catalogs
+	return nil
+}
+
+// Localize renders a message in the best language from an Accept-Language header value
+func Localize(key Key, acceptLanguage string) string {
+	text, ok := active.catalogs[negotiateLanguage(acceptLanguage)][key]
+	if !ok {
+		text = active.catalogs[DefaultLanguage][key]
+	}
+	if active.prefix == "" {
+		return text
+	}
+	return active.prefix + " " + text
+}
+
+// negotiateLanguage picks the highest-weighted language from Accept-Language that has a catalog,
+// matching on the primary subtag (zh-CN matches zh)
+func negotiateLanguage(acceptLanguage string) string {
+	type weighted struct {
+		lang   string
+		weight float64
+	}
+	var candidates []weighted
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		lang := strings.ToLower(strings.TrimSpace(fields[0]))
+		if lang == "" {
+			continue
+		}
+		weight := 1.0
+		for _, param := range fields[1:] {
+			if q, found := strings.CutPrefix(strings.TrimSpace(param), "q="); found {
+				if parsed, err := strconv.ParseFloat(q, 64); err == nil {
+					weight = parsed
+				}
+			}
+		}
+		candidates = append(candidates, weighted{lang: lang, weight: weight})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].weight > candidates[j].weight
+	})
+
+	for _, candidate := range candidates {
+		if candidate.weight <= 0 {
+			continue
+		}
+		if _, ok := active.catalogs[candidate.lang]; ok {
+			return candidate.lang
+		}
+		primary, _, _ := strings.Cut(candidate.lang, "-")
+		if _, ok := active.catalogs[primary]; ok {
+			return primary
+		}
+	}
+	return DefaultLanguage
+}
+
+// copyCatalog returns a copy of catalog that can be modified safely
+func copyCatalog(catalog map[Key]string) map[Key]string {
+	copied := make(map[Key]string, len(catalog))
+	for key, text := range catalog {
+		copied[key] = text
+	}
+	return copied
+}
@@ -0,0 +1,98 @@
+package messages
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalize_AcceptLanguage(t *testing.T) {
+	tests := []struct {
+		acceptLanguage string
+		want           string
+	}{
+		{"", "[AFL] Unauthorized"},
+		{"en-US,en;q=0.9", "[AFL] Unauthorized"},
+		{"zh-CN", "[AFL] 未授权"},
+		{"zh-TW,zh;q=0.9,en;q=0.8", "[AFL] 未授权"},
+		{"en;q=0.5, zh;q=0.8", "[AFL] 未授权"},
+		{"fr-FR,fr;q=0.9", "[AFL] Unauthorized"},
+		{"zh;q=0", "[AFL] Unauthorized"},
+	}
+
+	for _, tt := range tests {
+		if got := Localize(Unauthorized, tt.acceptLanguage); got != tt.want {
+			t.Errorf("Localize(%q) = %q, want %q", tt.acceptLanguage, got, tt.want)
+		}
+	}
+}
+
+func TestUpstreamError_Localized(t *testing.T) {
+	errorType, message := UpstreamError(529, "zh-CN")
+	if errorType != "overloaded_error" || message != "[AFL] 上游过载" {
+		t.Errorf("UpstreamError(529, zh-CN) = %q, %q", errorType, message)
+	}
+	errorType, message = UpstreamError(418, "en")
+	if errorType != "invalid_request_error" || message != "[AFL] Invalid request" {
+		t.Errorf("UpstreamError(418, en) = %q, %q", errorType, message)
+	}
+}
+
+func TestBuiltinCatalogsAreComplete(t *testing.T) {
+	for lang, catalog := range builtinCatalogs {
+		for key := range builtinCatalogs[DefaultLanguage] {
+			if catalog[key] == "" {
+				t.Errorf("language %q is missing message %q", lang, key)
+			}
+		}
+	}
+}
+
+func TestConfigure_PrefixAndOverrides(t *testing.T) {
+	t.Cleanup(func() { Configure(DefaultPrefix, "") })
+
+	path := filepath.Join(t.TempDir(), "messages.json")
+	overrides := `{
+		"en": {"unauthorized": "Invalid API key"},
+		"ja": {"unauthorized": "認証されていません"}
+	}`
+	if err := os.WriteFile(path, []byte(overrides), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Configure("[Acme]", path); err != nil {
+		t.Fatalf("Configure returned error: %v", err)
+	}
+
+	if got := Localize(Unauthorized, "en"); got != "[Acme] Invalid API key" {
+		t.Errorf("overridden English = %q", got)
+	}
+	if got := Localize(Unauthorized, "ja-JP"); got != "[Acme] 認証されていません" {
+		t.Errorf("added Japanese = %q", got)
+	}
+	if got := Localize(UnknownModel, "ja"); got != "[Acme] Unsupported model" {
+		t.Errorf("missing Japanese key should fall back to English, got %q", got)
+	}
+	if got := Localize(UnknownModel, "zh"); got != "[Acme] 不支持的模型" {
+		t.Errorf("built-in Chinese = %q", got)
+	}
+
+	if err := Configure("", ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := Localize(Unauthorized, "en"); got != "Unauthorized" {
+		t.Errorf("empty prefix = %q", got)
+	}
+}
+
+func TestConfigure_InvalidFile(t *testing.T) {
+	t.Cleanup(func() { Configure(DefaultPrefix, "") })
+
+	path := filepath.Join(t.TempDir(), "messages.json")
+	os.WriteFile(path, []byte("not json"), 0o600)
+	if err := Configure("[AFL]", path); err == nil {
+		t.Error("expected error for invalid messages file")
+	}
+	if err := Configure("[AFL]", filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("expected error for missing messages file")
+	}
+}
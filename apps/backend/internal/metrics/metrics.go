@@ -0,0 +1,78 @@
+// Package metrics holds the proxy's Prometheus collectors, registered on the default registry and
+// served at /metrics
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "simple_relay"
+
+var (
+	// Requests counts requests received on the proxy route, before authentication
+	Requests = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Requests received on the proxy route.",
+	})
+
+	// Unauthorized counts proxy requests rejected with 401
+	Unauthorized = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "unauthorized_total",
+		Help:      "Proxy requests rejected with 401.",
+	})
+
+	// RateLimited counts upstream 429 responses returned to clients as 529
+	RateLimited = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_total",
+		Help:      "Upstream 429 responses returned to clients as 529.",
+	})
+
+	// BillingForwardFailures counts usage payloads the billing service didn't accept
+	BillingForwardFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "billing_forward_failures_total",
+		Help:      "Usage payloads that failed to reach the billing service or were rejected by it.",
+	})
+
+	// BillingDropped counts usage payloads dropped unsent while the billing circuit breaker was open
+	BillingDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "billing_dropped_total",
+		Help:      "Usage payloads dropped without sending while the billing circuit breaker was open.",
+	})
+
+	// BillingCircuitOpen is 1 while billing forwarding is short-circuited after repeated failures
+	BillingCircuitOpen = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "billing_circuit_open",
+		Help:      "1 while billing forwarding is short-circuited after repeated failures, 0 otherwise.",
+	})
+
+	// OAuthRefreshes counts OAuth token refreshes by result ("success" or "failure")
+	OAuthRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "oauth_refreshes_total",
+		Help:      "OAuth token refreshes by result.",
+	}, []string{"result"})
+
+	// UpstreamLatency observes the time from proxying a request to receiving upstream's response headers
+	UpstreamLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_latency_seconds",
+		Help:      "Time from proxying a request to receiving the upstream response headers.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	})
+)
+
+// RecordOAuthRefresh counts a refresh attempt by whether it returned an error
+func RecordOAuthRefresh(err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	OAuthRefreshes.WithLabelValues(result).Inc()
+}
@@ -2,7 +2,10 @@ package services
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/firestore"
@@ -11,14 +14,45 @@ import (
 
 // ApiKeyBinding represents an API key binding document
 type ApiKeyBinding struct {
-	ApiKey    string `firestore:"api_key" json:"api_key"`
-	UserEmail string `firestore:"user_email" json:"user_email"`
+	ApiKey    string     `firestore:"-" json:"api_key"` // Document ID (HashApiKey of the key, or the plaintext key for legacy bindings); not stored as a field
+	UserEmail string     `firestore:"user_email" json:"user_email"`
+	Enabled   *bool      `firestore:"enabled" json:"enabled"`                           // nil for bindings created before per-key flags; treated as enabled
+	ExpiresAt *time.Time `firestore:"expires_at,omitempty" json:"expires_at,omitempty"` // nil for keys that never expire
+	Revoked   bool       `firestore:"revoked,omitempty" json:"revoked,omitempty"`       // Set when a key is compromised; never re-enabled
+}
+
+// IsEnabled reports whether the key may be used; bindings without the flag are enabled
+func (b *ApiKeyBinding) IsEnabled() bool {
+	return b.Enabled == nil || *b.Enabled
+}
+
+// IsUsable reports whether the key is enabled, not revoked and not expired at now
+func (b *ApiKeyBinding) IsUsable(now time.Time) bool {
+	return b.IsEnabled() && !b.Revoked && (b.ExpiresAt == nil || now.Before(*b.ExpiresAt))
+}
+
+// HashApiKey returns the hex SHA-256 of a raw API key, used as the binding's document ID so
+// a database leak doesn't expose usable keys
+func HashApiKey(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// resolveBindingEmail returns the user email for a usable binding, or empty string if the key is
+// disabled, revoked or expired at now
+func resolveBindingEmail(binding *ApiKeyBinding, now time.Time) string {
+	if !binding.IsUsable(now) {
+		return ""
+	}
+	return binding.UserEmail
 }
 
 // CacheEntry represents a cached API key lookup result
 type CacheEntry struct {
 	UserEmail string
 	Timestamp time.Time
+	NotFound  bool      // No binding exists for the key; kept for the shorter negative TTL
+	KeyExpiry time.Time // When the key itself expires; the entry is dropped then even if its TTL hasn't passed
 }
 
 // ApiKeyService handles API key operations with caching
@@ -27,6 +61,14 @@ type ApiKeyService struct {
 	collection    string
 	cache         *lru.Cache[string, *CacheEntry]
 	cacheDuration time.Duration
+	negativeTTL   time.Duration // How long unknown keys are cached, so a key created later is picked up soon
+	plaintext     bool          // Also look up bindings keyed by the plaintext key, during the migration to hashed keys
+	counters      cacheCounters
+	mu            sync.Mutex        // makes the expiry check/remove and refresh of an entry atomic
+	generations   map[string]uint64 // Invalidation count per key hash; a lookup is only cached if no invalidation happened during its fetch
+
+	// fetchBinding reads a binding by document ID, returning nil when it doesn't exist; tests replace it to count reads
+	fetchBinding func(ctx context.Context, docID string) (*ApiKeyBinding, error)
 }
 
 // NewApiKeyService creates a new API key service with caching
@@ -34,54 +76,148 @@ func NewApiKeyService(client *firestore.Client) *ApiKeyService {
 	// Create LRU cache with capacity of 1000 entries
 	cache, _ := lru.New[string, *CacheEntry](1000)
 
-	return &ApiKeyService{
+	service := &ApiKeyService{
 		client:        client,
 		collection:    "api_key_bindings",
 		cache:         cache,
 		cacheDuration: 5 * time.Minute, // 5 minute cache
+		negativeTTL:   10 * time.Second,
+		generations:   make(map[string]uint64),
 	}
+	service.fetchBinding = service.firestoreBinding
+	return service
+}
+
+// SetPlaintextFallback controls whether keys without a hashed binding are looked up by their plaintext
+// document ID. Enable it until every binding has been rewritten under HashApiKey.
+func (s *ApiKeyService) SetPlaintextFallback(enabled bool) {
+	s.plaintext = enabled
+}
+
+// ttl returns how long entry stays valid
+func (s *ApiKeyService) ttl(entry *CacheEntry) time.Duration {
+	if entry.NotFound {
+		return s.negativeTTL
+	}
+	return s.cacheDuration
 }
 
 // cleanupExpiredEntry checks if cache entry is expired and removes it if so
 // Returns the entry if still valid, nil if expired or not found
 func (s *ApiKeyService) cleanupExpiredEntry(apiKey string) *CacheEntry {
+	// Without the lock a concurrent lookup could store a fresh entry between the expiry check and the
+	// Remove, and the Remove would then drop the fresh entry instead of the stale one
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if entry, exists := s.cache.Get(apiKey); exists {
-		if time.Since(entry.Timestamp) < s.cacheDuration {
+		keyExpired := !entry.KeyExpiry.IsZero() && !time.Now().Before(entry.KeyExpiry)
+		if time.Since(entry.Timestamp) < s.ttl(entry) && !keyExpired {
+			s.counters.record(true)
 			return entry
 		}
 		// Remove expired entry
 		s.cache.Remove(apiKey)
 	}
+	s.counters.record(false)
 	return nil
 }
 
+// generation returns the invalidation count of keyHash, captured before a lookup reads Firestore
+func (s *ApiKeyService) generation(keyHash string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.generations[keyHash]
+}
+
+// cacheEntry stores a lookup result, counting any entry evicted to make room. The result is dropped if
+// keyHash was invalidated since generation was captured, as the fetch may have read the binding before the change.
+func (s *ApiKeyService) cacheEntry(keyHash string, generation uint64, entry *CacheEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.generations[keyHash] != generation {
+		return
+	}
+	if evicted := s.cache.Add(keyHash, entry); evicted {
+		s.counters.recordEvictions(1)
+	}
+}
+
+// InvalidateApiKey drops the cached lookup for apiKey so a revocation or other binding change
+// takes effect on the next request instead of after the cache TTL
+func (s *ApiKeyService) InvalidateApiKey(apiKey string) {
+	s.InvalidateKeyHash(HashApiKey(apiKey))
+}
+
+// InvalidateKeyHash is InvalidateApiKey for callers that only know the binding's document ID, HashApiKey of the key
+func (s *ApiKeyService) InvalidateKeyHash(keyHash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cache.Remove(keyHash)
+	s.generations[keyHash]++
+}
+
+// CacheStats reports the API key cache size and lookup hit rate
+func (s *ApiKeyService) CacheStats() CacheStats {
+	return s.counters.snapshot(s.cache.Len())
+}
+
 // FindUserEmailByApiKey looks up the user email associated with an API key
-// Returns the user email or empty string if not found
+// Returns the user email or empty string if not found or the key is disabled, revoked or expired
 func (s *ApiKeyService) FindUserEmailByApiKey(ctx context.Context, apiKey string) (string, error) {
-	// Check cache first
-	if entry := s.cleanupExpiredEntry(apiKey); entry != nil {
+	// The cache is keyed by the key's hash, so raw keys aren't held in memory and admins can invalidate by document ID
+	keyHash := HashApiKey(apiKey)
+	if entry := s.cleanupExpiredEntry(keyHash); entry != nil {
 		return entry.UserEmail, nil
 	}
+	generation := s.generation(keyHash)
 
-	// Direct lookup using API key as document ID
-	doc, err := s.client.Collection(s.collection).Doc(apiKey).Get(ctx)
+	// Bindings are keyed by the key's hash; legacy plaintext bindings are only read during the migration
+	binding, err := s.fetchBinding(ctx, keyHash)
+	if err == nil && binding == nil && s.plaintext {
+		binding, err = s.fetchBinding(ctx, apiKey)
+	}
+	if err != nil {
+		return "", err
+	}
+	if binding == nil {
+		// Unknown keys are cached briefly so misconfigured clients retrying a bad key don't hit Firestore every time
+		s.cacheEntry(keyHash, generation, &CacheEntry{Timestamp: time.Now(), NotFound: true})
+		return "", nil
+	}
+
+	// Disabled, revoked and expired keys are cached too, so they don't hit Firestore on every request
+	now := time.Now()
+	userEmail := resolveBindingEmail(binding, now)
+
+	// Cache the result; a usable key's entry must not outlive the key
+	entry := &CacheEntry{
+		UserEmail: userEmail,
+		Timestamp: now,
+	}
+	if userEmail != "" && binding.ExpiresAt != nil {
+		entry.KeyExpiry = *binding.ExpiresAt
+	}
+	s.cacheEntry(keyHash, generation, entry)
+
+	return userEmail, nil
+}
+
+// firestoreBinding reads a binding directly by its document ID
+func (s *ApiKeyService) firestoreBinding(ctx context.Context, docID string) (*ApiKeyBinding, error) {
+	doc, err := s.client.Collection(s.collection).Doc(docID).Get(ctx)
 	if err != nil {
 		if doc != nil && !doc.Exists() {
-			return "", nil // API key not found
+			return nil, nil // API key not found
 		}
-		return "", fmt.Errorf("error fetching API key: %w", err)
+		return nil, fmt.Errorf("error fetching API key: %w", err)
 	}
 
 	var binding ApiKeyBinding
 	if err := doc.DataTo(&binding); err != nil {
-		return "", fmt.Errorf("error parsing API key binding: %w", err)
+		return nil, fmt.Errorf("error parsing API key binding: %w", err)
 	}
-
-	// Cache the result
-	s.cache.Add(apiKey, &CacheEntry{
-		UserEmail: binding.UserEmail,
-		Timestamp: time.Now(),
-	})
-
-	return binding.UserEmail, nil
+	binding.ApiKey = doc.Ref.ID
+	return &binding, nil
 }
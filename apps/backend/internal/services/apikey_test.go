@@ -0,0 +1,192 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestResolveBindingEmail_PerKeyEnableFlag(t *testing.T) {
+	enabled := true
+	disabled := false
+
+	// Same user with one enabled and one disabled key
+	enabledKey := &ApiKeyBinding{ApiKey: "sk-enabled", UserEmail: "user@example.com", Enabled: &enabled}
+	disabledKey := &ApiKeyBinding{ApiKey: "sk-disabled", UserEmail: "user@example.com", Enabled: &disabled}
+
+	if got := resolveBindingEmail(enabledKey, time.Now()); got != "user@example.com" {
+		t.Errorf("enabled key: got %q, want user@example.com", got)
+	}
+	if got := resolveBindingEmail(disabledKey, time.Now()); got != "" {
+		t.Errorf("disabled key: got %q, want empty", got)
+	}
+}
+
+func TestResolveBindingEmail_LegacyBindingIsEnabled(t *testing.T) {
+	legacy := &ApiKeyBinding{ApiKey: "sk-legacy", UserEmail: "user@example.com"}
+
+	if got := resolveBindingEmail(legacy, time.Now()); got != "user@example.com" {
+		t.Errorf("binding without enabled flag: got %q, want user@example.com", got)
+	}
+}
+
+func TestResolveBindingEmail_ExpiredAndRevokedKeys(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Minute)
+	future := now.Add(time.Hour)
+
+	if got := resolveBindingEmail(&ApiKeyBinding{UserEmail: "user@example.com", ExpiresAt: &past}, now); got != "" {
+		t.Errorf("expired key: got %q, want empty", got)
+	}
+	if got := resolveBindingEmail(&ApiKeyBinding{UserEmail: "user@example.com", ExpiresAt: &future}, now); got != "user@example.com" {
+		t.Errorf("key expiring later: got %q, want user@example.com", got)
+	}
+	if got := resolveBindingEmail(&ApiKeyBinding{UserEmail: "user@example.com", Revoked: true}, now); got != "" {
+		t.Errorf("revoked key: got %q, want empty", got)
+	}
+}
+
+func TestFindUserEmailByApiKey_CachedKeyStopsAtExpiry(t *testing.T) {
+	service := NewApiKeyService(nil)
+	expiresAt := time.Now().Add(50 * time.Millisecond)
+	service.fetchBinding = func(ctx context.Context, docID string) (*ApiKeyBinding, error) {
+		return &ApiKeyBinding{UserEmail: "user@example.com", ExpiresAt: &expiresAt}, nil
+	}
+
+	if email, _ := service.FindUserEmailByApiKey(context.Background(), "sk-expiring"); email != "user@example.com" {
+		t.Fatalf("expected key to resolve before it expires, got %q", email)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if email, _ := service.FindUserEmailByApiKey(context.Background(), "sk-expiring"); email != "" {
+		t.Errorf("expected cached key to stop resolving once expired, got %q", email)
+	}
+}
+
+func TestFindUserEmailByApiKey_RevocationAfterInvalidate(t *testing.T) {
+	service := NewApiKeyService(nil)
+	binding := &ApiKeyBinding{UserEmail: "user@example.com"}
+	service.fetchBinding = func(ctx context.Context, docID string) (*ApiKeyBinding, error) {
+		return binding, nil
+	}
+
+	if email, _ := service.FindUserEmailByApiKey(context.Background(), "sk-revoke"); email != "user@example.com" {
+		t.Fatalf("expected key to resolve before revocation, got %q", email)
+	}
+
+	// Revoked while cached: the positive entry is served until it is invalidated
+	binding = &ApiKeyBinding{UserEmail: "user@example.com", Revoked: true}
+	if email, _ := service.FindUserEmailByApiKey(context.Background(), "sk-revoke"); email != "user@example.com" {
+		t.Errorf("expected the cached entry before invalidation, got %q", email)
+	}
+	service.InvalidateApiKey("sk-revoke")
+	if email, _ := service.FindUserEmailByApiKey(context.Background(), "sk-revoke"); email != "" {
+		t.Errorf("expected revoked key to be rejected after invalidation, got %q", email)
+	}
+}
+
+func TestFindUserEmailByApiKey_InvalidationDuringFetchIsNotLost(t *testing.T) {
+	service := NewApiKeyService(nil)
+	reads := 0
+	service.fetchBinding = func(ctx context.Context, docID string) (*ApiKeyBinding, error) {
+		reads++
+		if reads == 1 {
+			// The key is revoked and invalidated after this read returned the old binding
+			service.InvalidateKeyHash(docID)
+			return &ApiKeyBinding{UserEmail: "user@example.com"}, nil
+		}
+		return &ApiKeyBinding{UserEmail: "user@example.com", Revoked: true}, nil
+	}
+
+	if email, _ := service.FindUserEmailByApiKey(context.Background(), "sk-race"); email != "user@example.com" {
+		t.Fatalf("expected the in-flight lookup to return what it read, got %q", email)
+	}
+	if email, _ := service.FindUserEmailByApiKey(context.Background(), "sk-race"); email != "" {
+		t.Errorf("expected the stale result not to be cached, got %q", email)
+	}
+	if reads != 2 {
+		t.Errorf("expected the second lookup to read Firestore again, got %d reads", reads)
+	}
+}
+
+func TestFindUserEmailByApiKey_CachesUnknownKeysBriefly(t *testing.T) {
+	service := NewApiKeyService(nil)
+	var reads int
+	var binding *ApiKeyBinding // the key doesn't exist yet
+	service.fetchBinding = func(ctx context.Context, apiKey string) (*ApiKeyBinding, error) {
+		reads++
+		return binding, nil
+	}
+
+	for i := 0; i < 50; i++ {
+		if email, err := service.FindUserEmailByApiKey(context.Background(), "sk-bad"); err != nil || email != "" {
+			t.Fatalf("expected unknown key to resolve to no user, got %q (err %v)", email, err)
+		}
+	}
+	if reads != 1 {
+		t.Errorf("expected 1 Firestore read for repeated lookups of an unknown key, got %d", reads)
+	}
+
+	// The key is created; it is picked up once the negative entry expires
+	binding = &ApiKeyBinding{ApiKey: "sk-bad", UserEmail: "late@example.com"}
+	if email, _ := service.FindUserEmailByApiKey(context.Background(), "sk-bad"); email != "" {
+		t.Errorf("expected the negative entry to be served until it expires, got %q", email)
+	}
+	service.negativeTTL = 0
+	if email, _ := service.FindUserEmailByApiKey(context.Background(), "sk-bad"); email != "late@example.com" {
+		t.Errorf("expected the new key to be found after the negative entry expired, got %q", email)
+	}
+
+	// Found keys keep the regular TTL
+	service.negativeTTL = 10 * time.Second
+	for i := 0; i < 5; i++ {
+		service.FindUserEmailByApiKey(context.Background(), "sk-bad")
+	}
+	if reads != 2 {
+		t.Errorf("expected the found key to be cached, got %d reads", reads)
+	}
+}
+
+func TestHashApiKey(t *testing.T) {
+	// sha256("sk-test") in hex
+	if got := HashApiKey("sk-test"); got != "f3abf2a6cc4f00987743db5f544ba345b4899ae31f326d8ee9c4816de153c9e0" {
+		t.Errorf("unexpected hash %q", got)
+	}
+	if HashApiKey("sk-test") == HashApiKey("sk-test2") {
+		t.Errorf("expected different keys to hash differently")
+	}
+}
+
+func TestFindUserEmailByApiKey_HashedWithPlaintextFallback(t *testing.T) {
+	bindings := map[string]*ApiKeyBinding{
+		HashApiKey("sk-hashed"): {UserEmail: "hashed@example.com"},
+		"sk-legacy":             {UserEmail: "legacy@example.com"},
+	}
+	service := NewApiKeyService(nil)
+	var lookedUp []string
+	service.fetchBinding = func(ctx context.Context, docID string) (*ApiKeyBinding, error) {
+		lookedUp = append(lookedUp, docID)
+		return bindings[docID], nil
+	}
+
+	if email, _ := service.FindUserEmailByApiKey(context.Background(), "sk-hashed"); email != "hashed@example.com" {
+		t.Errorf("expected hashed binding to resolve, got %q", email)
+	}
+	if len(lookedUp) != 1 || lookedUp[0] != HashApiKey("sk-hashed") {
+		t.Errorf("expected a single read by hash, got %v", lookedUp)
+	}
+
+	// Without the fallback, legacy plaintext bindings no longer authenticate
+	if email, _ := service.FindUserEmailByApiKey(context.Background(), "sk-legacy"); email != "" {
+		t.Errorf("expected plaintext binding to be ignored without the fallback, got %q", email)
+	}
+
+	service.SetPlaintextFallback(true)
+	service.negativeTTL = 0
+	lookedUp = nil
+	if email, _ := service.FindUserEmailByApiKey(context.Background(), "sk-legacy"); email != "legacy@example.com" {
+		t.Errorf("expected plaintext binding to resolve during the migration, got %q", email)
+	}
+	if len(lookedUp) != 2 || lookedUp[0] != HashApiKey("sk-legacy") || lookedUp[1] != "sk-legacy" {
+		t.Errorf("expected the hash to be tried before the plaintext key, got %v", lookedUp)
+	}
+}
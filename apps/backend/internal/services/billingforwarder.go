@@ -0,0 +1,326 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"simple-relay/backend/internal/logging"
+	"simple-relay/backend/internal/metrics"
+)
+
+// DefaultBillingTimeout bounds how long the billing service may take to answer a fully sent payload
+const DefaultBillingTimeout = 30 * time.Second
+
+// pendingBilling is a billing payload that couldn't be forwarded yet
+type pendingBilling struct {
+	header http.Header
+	body   []byte
+}
+
+// BillingForwarder streams proxied responses to the billing service.
+// Payloads that can't be sent because no identity token is available are queued and retried.
+type BillingForwarder struct {
+	billingURL string
+	tokens     *IdentityTokenSource // nil disables identity tokens (testing)
+	client     *http.Client
+	pending    []*pendingBilling
+	pendingMu  sync.Mutex
+	maxPending int
+	stopChan   chan struct{}
+	stopOnce   sync.Once
+	inFlight   sync.WaitGroup  // Forwards started with ForwardAsync that haven't finished
+	timeouts   atomic.Int64    // Billing requests abandoned because the billing service didn't answer in time
+	breaker    *CircuitBreaker // nil sends every payload regardless of earlier failures
+	dropped    atomic.Int64    // Payloads dropped unsent while the breaker was open
+}
+
+// NewBillingForwarder creates a forwarder for billingURL; tokens may be nil to skip authentication
+func NewBillingForwarder(billingURL string, tokens *IdentityTokenSource) *BillingForwarder {
+	return &BillingForwarder{
+		billingURL: billingURL,
+		tokens:     tokens,
+		client:     newBillingClient(DefaultBillingTimeout),
+		maxPending: 1000,
+		stopChan:   make(chan struct{}),
+	}
+}
+
+// newBillingClient creates the billing HTTP client. The timeout only starts once the body has been
+// sent: the body is a response still streaming to the client, so a whole-request timeout would cut
+// off long streams.
+func newBillingClient(timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = timeout
+	return &http.Client{Transport: transport}
+}
+
+// SetTimeout sets how long the billing service may take to answer a fully sent payload
+func (bf *BillingForwarder) SetTimeout(timeout time.Duration) {
+	bf.client = newBillingClient(timeout)
+}
+
+// TimeoutCount returns the number of billing requests abandoned because the billing service didn't answer in time
+func (bf *BillingForwarder) TimeoutCount() int64 {
+	return bf.timeouts.Load()
+}
+
+// SetCircuitBreaker stops forwarding for cooldown once threshold consecutive billing requests have
+// failed; payloads arriving meanwhile are logged and dropped. threshold <= 0 disables the breaker.
+func (bf *BillingForwarder) SetCircuitBreaker(threshold int, cooldown time.Duration) {
+	if threshold <= 0 {
+		bf.breaker = nil
+		return
+	}
+	bf.breaker = NewCircuitBreaker(threshold, cooldown)
+}
+
+// CircuitOpen reports whether billing forwarding is currently short-circuited
+func (bf *BillingForwarder) CircuitOpen() bool {
+	return bf.breaker != nil && bf.breaker.Open()
+}
+
+// DroppedCount returns the number of payloads dropped unsent while the circuit breaker was open
+func (bf *BillingForwarder) DroppedCount() int64 {
+	return bf.dropped.Load()
+}
+
+// Forward sends body to the billing service with the given headers.
+// trailer holds values that are only known once body has been fully read.
+// The body is always drained so the proxied client response is never blocked.
+// ctx is usually derived from the proxied request without its cancellation, since the request
+// finishes before its billing forward does.
+func (bf *BillingForwarder) Forward(ctx context.Context, body io.Reader, header http.Header, trailer http.Header) {
+	// While the billing service keeps failing, drop payloads instead of piling more requests onto it
+	if bf.shortCircuited() {
+		io.Copy(io.Discard, body)
+		bf.dropped.Add(1)
+		metrics.BillingDropped.Inc()
+		log.Printf("Billing circuit open, dropping billing payload for request %q", header.Get(logging.RequestIDHeader))
+		return
+	}
+
+	idToken, err := bf.identityToken()
+	if err != nil {
+		log.Printf("Error getting identity token, queueing billing payload: %v", err)
+		bodyBytes, readErr := io.ReadAll(body)
+		if readErr != nil {
+			log.Printf("Error buffering billing payload, dropping it: %v", readErr)
+			return
+		}
+		bf.enqueue(&pendingBilling{header: mergeTrailer(header, trailer), body: bodyBytes})
+		return
+	}
+
+	// Stream the response body directly from the reader
+	req, err := http.NewRequestWithContext(ctx, "POST", bf.billingURL, body)
+	if err != nil {
+		log.Printf("Error creating billing request: %v", err)
+		io.Copy(io.Discard, body)
+		return
+	}
+	req.Header = header.Clone()
+	if idToken != "" {
+		req.Header.Set("Authorization", "Bearer "+idToken)
+	}
+	req.Trailer = trailer
+
+	bf.send(req)
+}
+
+// ForwardAsync runs Forward in its own goroutine, tracked so Drain can wait for it to finish
+func (bf *BillingForwarder) ForwardAsync(ctx context.Context, body io.Reader, header http.Header, trailer http.Header) {
+	bf.inFlight.Add(1)
+	go func() {
+		defer bf.inFlight.Done()
+		bf.Forward(ctx, body, header, trailer)
+	}()
+}
+
+// Drain waits for forwards started with ForwardAsync to finish, or returns ctx's error when it is
+// done first. Used on shutdown so billing for responses already streamed to clients isn't lost.
+func (bf *BillingForwarder) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		bf.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// StartRetryLoop periodically retries queued billing payloads until Stop is called
+func (bf *BillingForwarder) StartRetryLoop(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				bf.retryPending()
+			case <-bf.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the retry loop
+func (bf *BillingForwarder) Stop() {
+	bf.stopOnce.Do(func() { close(bf.stopChan) })
+}
+
+// PendingCount returns the number of queued billing payloads
+func (bf *BillingForwarder) PendingCount() int {
+	bf.pendingMu.Lock()
+	defer bf.pendingMu.Unlock()
+	return len(bf.pending)
+}
+
+// retryPending resends queued payloads once an identity token is available again
+func (bf *BillingForwarder) retryPending() {
+	bf.pendingMu.Lock()
+	items := bf.pending
+	bf.pending = nil
+	bf.pendingMu.Unlock()
+
+	if len(items) == 0 {
+		return
+	}
+
+	// Queued payloads are kept rather than dropped while the billing service is failing
+	if bf.shortCircuited() {
+		log.Printf("Billing circuit open, keeping %d queued billing payloads", len(items))
+		for _, item := range items {
+			bf.enqueue(item)
+		}
+		return
+	}
+
+	idToken, err := bf.identityToken()
+	if err != nil {
+		log.Printf("Identity token still unavailable, keeping %d queued billing payloads: %v", len(items), err)
+		for _, item := range items {
+			bf.enqueue(item)
+		}
+		return
+	}
+
+	log.Printf("Retrying %d queued billing payloads", len(items))
+	for _, item := range items {
+		req, err := http.NewRequest("POST", bf.billingURL, bytes.NewReader(item.body))
+		if err != nil {
+			log.Printf("Error creating billing request: %v", err)
+			continue
+		}
+		req.Header = item.header.Clone()
+		if idToken != "" {
+			req.Header.Set("Authorization", "Bearer "+idToken)
+		}
+		bf.send(req)
+	}
+}
+
+// shortCircuited reports whether the circuit breaker is open, keeping the metrics gauge in step
+func (bf *BillingForwarder) shortCircuited() bool {
+	if bf.breaker == nil {
+		return false
+	}
+	if bf.breaker.Allow() {
+		metrics.BillingCircuitOpen.Set(0)
+		return false
+	}
+	metrics.BillingCircuitOpen.Set(1)
+	return true
+}
+
+// recordResult feeds a billing request's outcome to the circuit breaker. Only transport errors and
+// 5xx responses count as failures; a 4xx means the billing service is up.
+func (bf *BillingForwarder) recordResult(failed bool) {
+	if bf.breaker == nil {
+		return
+	}
+	if !failed {
+		bf.breaker.RecordSuccess()
+		metrics.BillingCircuitOpen.Set(0)
+		return
+	}
+	if bf.breaker.RecordFailure() {
+		metrics.BillingCircuitOpen.Set(1)
+		log.Printf("Billing circuit opened after %d consecutive failures, dropping billing payloads for %s",
+			bf.breaker.threshold, bf.breaker.cooldown)
+	}
+}
+
+// send executes a billing request and logs failures
+func (bf *BillingForwarder) send(req *http.Request) {
+	billingResp, err := bf.client.Do(req)
+	bf.recordResult(err != nil || billingResp.StatusCode >= http.StatusInternalServerError)
+	if err != nil {
+		metrics.BillingForwardFailures.Inc()
+		if isTimeout(err) {
+			bf.timeouts.Add(1)
+			log.Printf("Billing request timed out (%d timeouts so far): %v", bf.timeouts.Load(), err)
+			return
+		}
+		log.Printf("Error sending billing request: %v", err)
+		return
+	}
+	defer billingResp.Body.Close()
+
+	if billingResp.StatusCode != http.StatusOK {
+		metrics.BillingForwardFailures.Inc()
+		log.Printf("Billing service returned non-200 status: %d", billingResp.StatusCode)
+	}
+}
+
+// isTimeout reports whether err is a client or context timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// identityToken returns an identity token for the billing service, or empty string when disabled
+func (bf *BillingForwarder) identityToken() (string, error) {
+	if bf.tokens == nil {
+		return "", nil
+	}
+	return bf.tokens.Token(bf.billingURL)
+}
+
+// enqueue adds a payload to the retry queue, dropping the oldest one when full
+func (bf *BillingForwarder) enqueue(item *pendingBilling) {
+	bf.pendingMu.Lock()
+	defer bf.pendingMu.Unlock()
+
+	if len(bf.pending) >= bf.maxPending {
+		log.Printf("Billing retry queue full (%d), dropping oldest payload", bf.maxPending)
+		bf.pending = bf.pending[1:]
+	}
+	bf.pending = append(bf.pending, item)
+}
+
+// mergeTrailer returns header with trailer values added, for payloads replayed from memory
+func mergeTrailer(header http.Header, trailer http.Header) http.Header {
+	merged := header.Clone()
+	for key, values := range trailer {
+		for _, value := range values {
+			if value != "" {
+				merged.Add(key, value)
+			}
+		}
+	}
+	return merged
+}
@@ -0,0 +1,241 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// billingSink records requests received by a fake billing service
+type billingSink struct {
+	mu       sync.Mutex
+	auth     []string
+	bodies   []string
+	totalsMs []string
+}
+
+func (s *billingSink) handler(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	total := r.Trailer.Get("X-Upstream-Total-Ms")
+	if total == "" {
+		total = r.Header.Get("X-Upstream-Total-Ms")
+	}
+
+	s.mu.Lock()
+	s.auth = append(s.auth, r.Header.Get("Authorization"))
+	s.bodies = append(s.bodies, string(body))
+	s.totalsMs = append(s.totalsMs, total)
+	s.mu.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestBillingForwarder_UsesCachedTokenWhenMetadataFails(t *testing.T) {
+	sink := &billingSink{}
+	server := httptest.NewServer(http.HandlerFunc(sink.handler))
+	defer server.Close()
+
+	token := fakeJWT(time.Now().Add(2 * time.Minute))
+	metadataDown := false
+	tokens := NewIdentityTokenSource(func(audience string) (string, error) {
+		if metadataDown {
+			return "", errors.New("metadata unavailable")
+		}
+		return token, nil
+	})
+	tokens.retryDelay = time.Millisecond
+	if _, err := tokens.Token(server.URL); err != nil {
+		t.Fatalf("priming token cache failed: %v", err)
+	}
+
+	metadataDown = true
+	forwarder := NewBillingForwarder(server.URL, tokens)
+	forwarder.Forward(context.Background(), strings.NewReader("data: usage"), http.Header{}, nil)
+
+	if len(sink.auth) != 1 || sink.auth[0] != "Bearer "+token {
+		t.Fatalf("expected forward with cached token, got %v", sink.auth)
+	}
+	if forwarder.PendingCount() != 0 {
+		t.Errorf("expected nothing queued, got %d", forwarder.PendingCount())
+	}
+}
+
+func TestBillingForwarder_QueuesWhenNoTokenAndRetries(t *testing.T) {
+	sink := &billingSink{}
+	server := httptest.NewServer(http.HandlerFunc(sink.handler))
+	defer server.Close()
+
+	metadataDown := true
+	tokens := NewIdentityTokenSource(func(audience string) (string, error) {
+		if metadataDown {
+			return "", errors.New("metadata unavailable")
+		}
+		return fakeJWT(time.Now().Add(time.Hour)), nil
+	})
+	tokens.retryDelay = time.Millisecond
+
+	forwarder := NewBillingForwarder(server.URL, tokens)
+	trailer := http.Header{}
+	trailer.Set("X-Upstream-Total-Ms", "1234")
+	forwarder.Forward(context.Background(), strings.NewReader("data: usage"), http.Header{}, trailer)
+
+	if forwarder.PendingCount() != 1 {
+		t.Fatalf("expected payload to be queued, got %d", forwarder.PendingCount())
+	}
+	if len(sink.bodies) != 0 {
+		t.Fatalf("expected no billing request while metadata is down")
+	}
+
+	// Still down: payload stays queued
+	forwarder.retryPending()
+	if forwarder.PendingCount() != 1 {
+		t.Fatalf("expected payload to remain queued, got %d", forwarder.PendingCount())
+	}
+
+	metadataDown = false
+	forwarder.retryPending()
+
+	if forwarder.PendingCount() != 0 {
+		t.Errorf("expected queue to be drained, got %d", forwarder.PendingCount())
+	}
+	if len(sink.bodies) != 1 || sink.bodies[0] != "data: usage" {
+		t.Fatalf("expected queued body to be replayed, got %v", sink.bodies)
+	}
+	if sink.totalsMs[0] != "1234" {
+		t.Errorf("expected total latency to be replayed as header, got %q", sink.totalsMs[0])
+	}
+}
+
+func TestBillingForwarder_DropsOldestWhenQueueFull(t *testing.T) {
+	forwarder := NewBillingForwarder("http://billing.invalid", nil)
+	forwarder.maxPending = 2
+
+	for _, body := range []string{"a", "b", "c"} {
+		forwarder.enqueue(&pendingBilling{header: http.Header{}, body: []byte(body)})
+	}
+
+	if forwarder.PendingCount() != 2 {
+		t.Fatalf("expected 2 queued payloads, got %d", forwarder.PendingCount())
+	}
+	if string(forwarder.pending[0].body) != "b" {
+		t.Errorf("expected oldest payload to be dropped, head is %q", forwarder.pending[0].body)
+	}
+}
+
+func TestBillingForwarder_DrainWaitsForSlowForward(t *testing.T) {
+	release := make(chan struct{})
+	received := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	forwarder := NewBillingForwarder(server.URL, nil)
+	forwarder.ForwardAsync(context.Background(), strings.NewReader("data: usage"), http.Header{}, nil)
+
+	// The sink hasn't answered yet, so a drain that runs out of time reports it
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := forwarder.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected drain to time out while billing is in flight, got %v", err)
+	}
+
+	drained := make(chan error, 1)
+	go func() { drained <- forwarder.Drain(context.Background()) }()
+	select {
+	case err := <-drained:
+		t.Fatalf("drain returned before the slow billing sink answered: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Fatalf("Drain returned error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("drain did not return after the billing sink answered")
+	}
+	if body := <-received; body != "data: usage" {
+		t.Errorf("expected the sink to receive the full payload, got %q", body)
+	}
+}
+
+func TestBillingForwarder_TimesOutWhenBillingNeverAnswers(t *testing.T) {
+	hang := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		<-hang
+	}))
+	defer server.Close()
+	defer close(hang)
+
+	forwarder := NewBillingForwarder(server.URL, nil)
+	forwarder.SetTimeout(50 * time.Millisecond)
+	forwarder.ForwardAsync(context.Background(), strings.NewReader("data: usage"), http.Header{}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := forwarder.Drain(ctx); err != nil {
+		t.Fatalf("expected the forward to give up after its timeout, got %v", err)
+	}
+	if got := forwarder.TimeoutCount(); got != 1 {
+		t.Errorf("expected 1 timeout to be counted, got %d", got)
+	}
+}
+
+func TestBillingForwarder_CircuitBreakerStopsSendingUntilCooldown(t *testing.T) {
+	var mu sync.Mutex
+	received := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		mu.Lock()
+		received++
+		mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	receivedCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return received
+	}
+
+	now := time.Now()
+	forwarder := NewBillingForwarder(server.URL, nil)
+	forwarder.SetCircuitBreaker(2, time.Minute)
+	forwarder.breaker.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		forwarder.Forward(context.Background(), strings.NewReader("data: usage"), http.Header{}, nil)
+	}
+	if got := receivedCount(); got != 2 || !forwarder.CircuitOpen() {
+		t.Fatalf("expected 2 failed requests to open the breaker, got %d requests (open %v)", got, forwarder.CircuitOpen())
+	}
+
+	// While open, payloads are drained and dropped without reaching the billing service
+	body := strings.NewReader("data: usage")
+	forwarder.Forward(context.Background(), body, http.Header{}, nil)
+	if got := receivedCount(); got != 2 {
+		t.Errorf("expected no request while the breaker is open, got %d", got)
+	}
+	if body.Len() != 0 || forwarder.DroppedCount() != 1 {
+		t.Errorf("expected the payload drained and counted as dropped, %d bytes left, %d dropped", body.Len(), forwarder.DroppedCount())
+	}
+
+	now = now.Add(time.Minute)
+	forwarder.Forward(context.Background(), strings.NewReader("data: usage"), http.Header{}, nil)
+	if got := receivedCount(); got != 3 {
+		t.Errorf("expected forwarding to resume once the cooldown elapsed, got %d requests", got)
+	}
+}
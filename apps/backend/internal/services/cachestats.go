@@ -0,0 +1,48 @@
+package services
+
+import "sync/atomic"
+
+// CacheStats is a point-in-time view of an in-memory lookup cache
+type CacheStats struct {
+	Size      int     `json:"size"`
+	Capacity  int     `json:"capacity,omitempty"`
+	Hits      int64   `json:"hits"`
+	Misses    int64   `json:"misses"`
+	HitRate   float64 `json:"hit_rate"`
+	Evictions int64   `json:"evictions"` // Entries pushed out because the cache was full
+}
+
+// cacheCounters tracks lookup hits, misses and capacity evictions; safe for concurrent use
+type cacheCounters struct {
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+// record counts a single lookup
+func (c *cacheCounters) record(hit bool) {
+	if hit {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+}
+
+// recordEvictions counts entries evicted to make room for new ones
+func (c *cacheCounters) recordEvictions(n int) {
+	c.evictions.Add(int64(n))
+}
+
+// snapshot builds CacheStats for a cache currently holding size entries
+func (c *cacheCounters) snapshot(size int) CacheStats {
+	stats := CacheStats{
+		Size:      size,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
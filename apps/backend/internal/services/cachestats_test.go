@@ -0,0 +1,153 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestApiKeyService_CacheStats(t *testing.T) {
+	service := NewApiKeyService(nil)
+	service.cache.Add(HashApiKey("key-fresh"), &CacheEntry{UserEmail: "a@example.com", Timestamp: time.Now()})
+	service.cache.Add("key-other", &CacheEntry{UserEmail: "b@example.com", Timestamp: time.Now()})
+
+	for i := 0; i < 3; i++ {
+		if email, err := service.FindUserEmailByApiKey(context.Background(), "key-fresh"); err != nil || email != "a@example.com" {
+			t.Fatalf("expected cached email, got %q (err %v)", email, err)
+		}
+	}
+	if entry := service.cleanupExpiredEntry("key-missing"); entry != nil {
+		t.Fatalf("expected miss for unknown key")
+	}
+
+	stats := service.CacheStats()
+	if stats.Size != 2 {
+		t.Errorf("expected size 2, got %d", stats.Size)
+	}
+	if stats.Hits != 3 || stats.Misses != 1 {
+		t.Errorf("expected 3 hits and 1 miss, got %d hits and %d misses", stats.Hits, stats.Misses)
+	}
+	if stats.HitRate != 0.75 {
+		t.Errorf("expected hit rate 0.75, got %v", stats.HitRate)
+	}
+}
+
+func TestApiKeyService_ConcurrentLookupsOfExpiringKey(t *testing.T) {
+	service := NewApiKeyService(nil)
+	service.cache.Add("key-hot", &CacheEntry{UserEmail: "old@example.com", Timestamp: time.Now().Add(-time.Hour)})
+
+	const goroutines = 32
+	const lookups = 200
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < lookups; i++ {
+				// Same sequence as FindUserEmailByApiKey, with the Firestore read replaced by a fresh entry
+				if entry := service.cleanupExpiredEntry("key-hot"); entry != nil {
+					if entry.UserEmail != "new@example.com" {
+						t.Errorf("got expired entry for %q", entry.UserEmail)
+						return
+					}
+					continue
+				}
+				service.cacheEntry("key-hot", 0, &CacheEntry{UserEmail: "new@example.com", Timestamp: time.Now()})
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := service.CacheStats()
+	if stats.Hits+stats.Misses != goroutines*lookups {
+		t.Errorf("expected %d lookups counted, got %d hits and %d misses", goroutines*lookups, stats.Hits, stats.Misses)
+	}
+	if stats.Misses > goroutines {
+		t.Errorf("expected at most one miss per goroutine before the refreshed entry was visible, got %d", stats.Misses)
+	}
+	if stats.Size != 1 || stats.Evictions != 0 {
+		t.Errorf("expected the refreshed key as the only entry, got %+v", stats)
+	}
+}
+
+func TestUsageChecker_CacheStats_ExpiredEntryCountsAsMiss(t *testing.T) {
+	checker := NewUsageChecker(nil)
+	checker.cache.Add("user-fresh", &UsageCacheEntry{
+		Result:    PointsCheckResult{State: PointsAvailable, RemainingPoints: 100},
+		Timestamp: time.Now(),
+	})
+	checker.cache.Add("user-stale", &UsageCacheEntry{
+		Result:    PointsCheckResult{State: PointsAvailable, RemainingPoints: 100},
+		Timestamp: time.Now().Add(-48 * time.Hour),
+	})
+
+	if _, err := checker.CheckDailyPointsLimit(context.Background(), "user-fresh"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entry := checker.cleanupExpiredEntry("user-stale"); entry != nil {
+		t.Fatalf("expected stale entry to be evicted")
+	}
+
+	stats := checker.CacheStats()
+	if stats.Size != 1 {
+		t.Errorf("expected stale entry removed leaving size 1, got %d", stats.Size)
+	}
+	if stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("expected 1 hit and 1 miss, got %d hits and %d misses", stats.Hits, stats.Misses)
+	}
+}
+
+func TestCacheStats_NoLookups(t *testing.T) {
+	var counters cacheCounters
+	if stats := counters.snapshot(5); stats.HitRate != 0 || stats.Size != 5 {
+		t.Errorf("unexpected stats with no lookups: %+v", stats)
+	}
+}
+
+func TestUsageChecker_CacheStats_CountsEvictionsOverCapacity(t *testing.T) {
+	checker := NewUsageChecker(nil)
+	checker.SetCacheSize(2)
+
+	result := PointsCheckResult{State: PointsAvailable, RemainingPoints: 100}
+	checker.cacheResult("user-1", result)
+	checker.cacheResult("user-2", result)
+	if stats := checker.CacheStats(); stats.Evictions != 0 {
+		t.Fatalf("expected no evictions within capacity, got %d", stats.Evictions)
+	}
+
+	checker.cacheResult("user-3", result)
+	checker.cacheResult("user-4", result)
+	// Refreshing a cached user doesn't evict anyone
+	checker.cacheResult("user-4", result)
+
+	stats := checker.CacheStats()
+	if stats.Evictions != 2 {
+		t.Errorf("expected 2 evictions, got %d", stats.Evictions)
+	}
+	if stats.Size != 2 || stats.Capacity != 2 {
+		t.Errorf("expected size 2 at capacity 2, got size %d capacity %d", stats.Size, stats.Capacity)
+	}
+	if entry := checker.cleanupExpiredEntry("user-1"); entry != nil {
+		t.Errorf("expected the least recently used user to be evicted")
+	}
+}
+
+func TestUsageChecker_SetCacheSize_ShrinkCountsEvictions(t *testing.T) {
+	checker := NewUsageChecker(nil)
+	if stats := checker.CacheStats(); stats.Capacity != DefaultUsageCacheSize {
+		t.Errorf("expected default capacity %d, got %d", DefaultUsageCacheSize, stats.Capacity)
+	}
+
+	result := PointsCheckResult{State: PointsAvailable, RemainingPoints: 100}
+	for _, userID := range []string{"user-1", "user-2", "user-3"} {
+		checker.cacheResult(userID, result)
+	}
+	checker.SetCacheSize(1)
+	checker.SetCacheSize(0) // ignored
+
+	stats := checker.CacheStats()
+	if stats.Evictions != 2 || stats.Size != 1 || stats.Capacity != 1 {
+		t.Errorf("expected 2 evictions leaving 1 of 1 entries, got %+v", stats)
+	}
+}
@@ -0,0 +1,65 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitBreaker stops calls to a failing dependency. After threshold consecutive failures it opens
+// for cooldown; once the cooldown has passed calls are let through again, and the next failure
+// reopens it right away while a success closes it.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time // replaced in tests
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// NewCircuitBreaker opens after threshold consecutive failures and stays open for cooldown
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// Allow reports whether a call may be made now
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return !cb.now().Before(cb.openUntil)
+}
+
+// Open reports whether calls are currently being short-circuited
+func (cb *CircuitBreaker) Open() bool {
+	return !cb.Allow()
+}
+
+// RecordSuccess closes the breaker and resets the failure count
+func (cb *CircuitBreaker) RecordSuccess() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.failures = 0
+	cb.openUntil = time.Time{}
+}
+
+// RecordFailure counts a failed call and reports whether it opened the breaker. Failures of calls
+// that were already under way when it opened leave the cooldown as it is.
+func (cb *CircuitBreaker) RecordFailure() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.failures++
+	now := cb.now()
+	if cb.failures < cb.threshold || now.Before(cb.openUntil) {
+		return false
+	}
+	cb.openUntil = now.Add(cb.cooldown)
+	return true
+}
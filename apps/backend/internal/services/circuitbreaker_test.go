@@ -0,0 +1,48 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker_OpensAfterThresholdAndRecovers(t *testing.T) {
+	now := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	breaker := NewCircuitBreaker(3, time.Minute)
+	breaker.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if breaker.RecordFailure() {
+			t.Fatalf("expected failure %d to leave the breaker closed", i+1)
+		}
+	}
+	breaker.RecordSuccess()
+	for i := 0; i < 2; i++ {
+		breaker.RecordFailure()
+	}
+	if !breaker.Allow() {
+		t.Fatal("expected a success to reset the consecutive failure count")
+	}
+
+	if !breaker.RecordFailure() || breaker.Allow() {
+		t.Fatal("expected the third consecutive failure to open the breaker")
+	}
+	// A late failure from a call already under way neither reports nor extends the cooldown
+	now = now.Add(30 * time.Second)
+	if breaker.RecordFailure() {
+		t.Error("expected a failure while open not to reopen the breaker")
+	}
+
+	now = now.Add(30 * time.Second)
+	if !breaker.Allow() {
+		t.Fatal("expected calls to be let through once the cooldown has passed")
+	}
+	if !breaker.RecordFailure() || breaker.Allow() {
+		t.Fatal("expected a failed probe to reopen the breaker right away")
+	}
+
+	now = now.Add(time.Minute)
+	breaker.RecordSuccess()
+	if breaker.Open() {
+		t.Error("expected a successful probe to close the breaker")
+	}
+}
@@ -0,0 +1,51 @@
+package services
+
+import "sync"
+
+// UserConcurrencyLimiter caps how many requests each user may have in flight at once, so one user's
+// parallel streams can't use up a shared upstream account's rate limit
+type UserConcurrencyLimiter struct {
+	max    int
+	mu     sync.Mutex
+	active map[string]int // users without requests in flight are removed
+}
+
+// NewUserConcurrencyLimiter allows each user up to maxConcurrent requests in flight
+func NewUserConcurrencyLimiter(maxConcurrent int) *UserConcurrencyLimiter {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	return &UserConcurrencyLimiter{
+		max:    maxConcurrent,
+		active: make(map[string]int),
+	}
+}
+
+// Acquire takes one of the user's slots. It returns false when all are in use; otherwise the caller
+// must call release once the request has finished. Calling release more than once is harmless.
+func (l *UserConcurrencyLimiter) Acquire(userID string) (release func(), ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[userID] >= l.max {
+		return nil, false
+	}
+	l.active[userID]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.active[userID]--; l.active[userID] <= 0 {
+				delete(l.active, userID)
+			}
+		})
+	}, true
+}
+
+// InFlight returns how many requests the user has in flight
+func (l *UserConcurrencyLimiter) InFlight(userID string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active[userID]
+}
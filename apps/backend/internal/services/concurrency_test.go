@@ -0,0 +1,31 @@
+package services
+
+import "testing"
+
+func TestUserConcurrencyLimiter_LimitsPerUser(t *testing.T) {
+	limiter := NewUserConcurrencyLimiter(2)
+
+	releaseFirst, ok := limiter.Acquire("user-a")
+	if !ok {
+		t.Fatal("expected the first slot to be free")
+	}
+	if _, ok := limiter.Acquire("user-a"); !ok {
+		t.Fatal("expected the second slot to be free")
+	}
+	if _, ok := limiter.Acquire("user-a"); ok {
+		t.Fatal("expected a third concurrent request to be rejected")
+	}
+	if _, ok := limiter.Acquire("user-b"); !ok {
+		t.Error("expected other users to be unaffected")
+	}
+
+	// Releasing twice must not free a slot held by another request
+	releaseFirst()
+	releaseFirst()
+	if got := limiter.InFlight("user-a"); got != 1 {
+		t.Errorf("expected 1 request in flight after release, got %d", got)
+	}
+	if _, ok := limiter.Acquire("user-a"); !ok {
+		t.Error("expected the released slot to be reusable")
+	}
+}
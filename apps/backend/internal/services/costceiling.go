@@ -0,0 +1,207 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+const (
+	// estimatedCharsPerToken approximates output tokens from streamed text until the final usage arrives
+	estimatedCharsPerToken = 4
+	// costCeilingReadSize is the chunk size read from the upstream stream
+	costCeilingReadSize = 4096
+)
+
+// sseEvent is the subset of Anthropic streaming event fields needed to estimate cost
+type sseEvent struct {
+	Type    string `json:"type"`
+	Index   int    `json:"index"`
+	Message struct {
+		Model string     `json:"model"`
+		Usage usageCount `json:"usage"`
+	} `json:"message"`
+	Delta struct {
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+		Thinking    string `json:"thinking"`
+	} `json:"delta"`
+}
+
+// usageCount is the token usage reported in message_start
+type usageCount struct {
+	InputTokens              int `json:"input_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+}
+
+// CostCeilingReader passes an Anthropic SSE stream through event by event while projecting its cost.
+// Once the projected cost exceeds the ceiling, the upstream stream is closed and the client receives
+// synthetic closing events whose usage reflects what was produced, so billing still records it.
+type CostCeilingReader struct {
+	source  io.ReadCloser
+	catalog *ModelCatalog
+	ceiling float64
+
+	pending []byte       // bytes of an incomplete event
+	out     bytes.Buffer // complete events ready for the reader
+	done    bool
+
+	model       string
+	usage       usageCount
+	outputChars int
+	openBlock   int  // index of the content block currently streaming, -1 if none
+	completed   bool // message_stop was seen; nothing left to limit
+	aborted     bool
+}
+
+// NewCostCeilingReader wraps source, aborting once the projected cost exceeds ceilingUSD
+func NewCostCeilingReader(source io.ReadCloser, catalog *ModelCatalog, ceilingUSD float64) *CostCeilingReader {
+	return &CostCeilingReader{
+		source:    source,
+		catalog:   catalog,
+		ceiling:   ceilingUSD,
+		openBlock: -1,
+	}
+}
+
+// Aborted reports whether the stream was cut off at the cost ceiling
+func (r *CostCeilingReader) Aborted() bool {
+	return r.aborted
+}
+
+// Read implements io.Reader
+func (r *CostCeilingReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		buf := make([]byte, costCeilingReadSize)
+		n, err := r.source.Read(buf)
+		if n > 0 {
+			r.process(buf[:n])
+		}
+		if err == io.EOF {
+			// Pass through any trailing bytes that didn't form a complete event
+			r.out.Write(r.pending)
+			r.pending = nil
+			r.done = true
+		} else if err != nil {
+			if r.out.Len() > 0 {
+				break
+			}
+			return 0, err
+		}
+	}
+	return r.out.Read(p)
+}
+
+// Close closes the upstream stream
+func (r *CostCeilingReader) Close() error {
+	return r.source.Close()
+}
+
+// process splits incoming bytes into complete events and forwards them until the ceiling is hit
+func (r *CostCeilingReader) process(chunk []byte) {
+	if r.done {
+		return
+	}
+	r.pending = append(r.pending, chunk...)
+
+	for {
+		end := bytes.Index(r.pending, []byte("\n\n"))
+		if end < 0 {
+			return
+		}
+		event := r.pending[:end+2]
+		r.pending = r.pending[end+2:]
+
+		r.out.Write(event)
+		r.observe(event)
+
+		if r.projectedCost() > r.ceiling {
+			r.abort()
+			return
+		}
+	}
+}
+
+// observe updates the cost estimate from one SSE event
+func (r *CostCeilingReader) observe(raw []byte) {
+	for _, line := range strings.Split(string(raw), "\n") {
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		var event sseEvent
+		if err := json.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(line, "data:"))), &event); err != nil {
+			continue
+		}
+
+		switch event.Type {
+		case "message_start":
+			r.model = event.Message.Model
+			r.usage = event.Message.Usage
+		case "content_block_start":
+			r.openBlock = event.Index
+		case "content_block_delta":
+			r.outputChars += len(event.Delta.Text) + len(event.Delta.PartialJSON) + len(event.Delta.Thinking)
+		case "content_block_stop":
+			r.openBlock = -1
+		case "message_stop":
+			r.completed = true
+		}
+	}
+}
+
+// estimatedOutputTokens approximates the output tokens produced so far
+func (r *CostCeilingReader) estimatedOutputTokens() int {
+	return (r.outputChars + estimatedCharsPerToken - 1) / estimatedCharsPerToken
+}
+
+// projectedCost estimates the cost of the stream so far in USD
+func (r *CostCeilingReader) projectedCost() float64 {
+	if r.model == "" || r.completed {
+		return 0
+	}
+	modelPricing := r.catalog.PricingFor(r.model)
+	return (float64(r.usage.InputTokens)*modelPricing.InputPricePerMillion +
+		float64(r.usage.CacheReadInputTokens)*modelPricing.CacheReadPricePerMillion +
+		float64(r.usage.CacheCreationInputTokens)*modelPricing.CacheWritePricePerMillion +
+		float64(r.estimatedOutputTokens())*modelPricing.OutputPricePerMillion) / 1_000_000
+}
+
+// abort closes the upstream stream and appends closing events carrying the usage produced so far
+func (r *CostCeilingReader) abort() {
+	outputTokens := r.estimatedOutputTokens()
+	log.Printf("[COST] Aborting stream for model %s at projected cost $%.4f (ceiling $%.4f, ~%d output tokens)",
+		r.model, r.projectedCost(), r.ceiling, outputTokens)
+
+	r.aborted = true
+	r.done = true
+	r.pending = nil
+	r.source.Close()
+
+	if r.openBlock >= 0 {
+		fmt.Fprintf(&r.out, "event: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":%d}\n\n", r.openBlock)
+	}
+
+	delta, _ := json.Marshal(map[string]interface{}{
+		"type": "message_delta",
+		"delta": map[string]interface{}{
+			"stop_reason":   "max_tokens",
+			"stop_sequence": nil,
+		},
+		"usage": map[string]int{
+			"input_tokens":                r.usage.InputTokens,
+			"cache_creation_input_tokens": r.usage.CacheCreationInputTokens,
+			"cache_read_input_tokens":     r.usage.CacheReadInputTokens,
+			"output_tokens":               outputTokens,
+		},
+	})
+	fmt.Fprintf(&r.out, "event: message_delta\ndata: %s\n\n", delta)
+	r.out.WriteString("event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")
+}
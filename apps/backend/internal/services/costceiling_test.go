@@ -0,0 +1,121 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// chunkedStream serves a stream in small reads that split events, and records whether it was closed
+type chunkedStream struct {
+	reader    io.Reader
+	chunkSize int
+	closed    bool
+}
+
+func (s *chunkedStream) Read(p []byte) (int, error) {
+	if s.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if len(p) > s.chunkSize {
+		p = p[:s.chunkSize]
+	}
+	return s.reader.Read(p)
+}
+
+func (s *chunkedStream) Close() error {
+	s.closed = true
+	return nil
+}
+
+// buildStream creates an Anthropic-style SSE stream with the given number of text deltas
+func buildStream(model string, inputTokens int, deltas int, deltaText string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_1\",\"model\":%q,\"usage\":{\"input_tokens\":%d,\"output_tokens\":1}}}\n\n", model, inputTokens)
+	b.WriteString("event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":0,\"content_block\":{\"type\":\"text\",\"text\":\"\"}}\n\n")
+	for i := 0; i < deltas; i++ {
+		fmt.Fprintf(&b, "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":%q}}\n\n", deltaText)
+	}
+	b.WriteString("event: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":0}\n\n")
+	b.WriteString("event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\",\"stop_sequence\":null},\"usage\":{\"output_tokens\":1}}\n\n")
+	b.WriteString("event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")
+	return b.String()
+}
+
+func TestCostCeilingReader_AbortsLongStreamAtCeiling(t *testing.T) {
+	// Each delta is 400 chars (~100 output tokens, $0.0015 at sonnet's $15/M)
+	stream := buildStream("claude-sonnet-4-20250514", 1000, 1000, strings.Repeat("a", 400))
+	source := &chunkedStream{reader: strings.NewReader(stream), chunkSize: 37}
+
+	reader := NewCostCeilingReader(source, NewModelCatalog(), 0.05)
+	output, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("reading stream failed: %v", err)
+	}
+
+	if !reader.Aborted() {
+		t.Fatal("expected stream to be aborted at the cost ceiling")
+	}
+	if !source.closed {
+		t.Error("expected upstream stream to be closed")
+	}
+
+	text := string(output)
+	deltas := strings.Count(text, "event: content_block_delta")
+	if deltas >= 1000 || deltas == 0 {
+		t.Errorf("expected the stream to be cut short, got %d deltas", deltas)
+	}
+	if !strings.HasSuffix(text, "event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n") {
+		t.Errorf("expected stream to end with message_stop, got tail %q", text[len(text)-80:])
+	}
+	if strings.Count(text, "event: content_block_stop") != 1 {
+		t.Error("expected the open content block to be closed")
+	}
+
+	// The synthetic message_delta carries the usage produced, so billing records it
+	var usage struct {
+		Usage struct {
+			InputTokens  int `json:"input_tokens"`
+			OutputTokens int `json:"output_tokens"`
+		} `json:"usage"`
+	}
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(line, "data: ") && strings.Contains(line, `"message_delta"`) {
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &usage); err != nil {
+				t.Fatalf("invalid message_delta: %v", err)
+			}
+		}
+	}
+	if usage.Usage.InputTokens != 1000 {
+		t.Errorf("expected input tokens 1000 in final usage, got %d", usage.Usage.InputTokens)
+	}
+	if usage.Usage.OutputTokens != deltas*100 {
+		t.Errorf("expected output tokens %d in final usage, got %d", deltas*100, usage.Usage.OutputTokens)
+	}
+
+	modelPricing := NewModelCatalog().PricingFor("claude-sonnet-4-20250514")
+	billed := (1000*modelPricing.InputPricePerMillion + float64(usage.Usage.OutputTokens)*modelPricing.OutputPricePerMillion) / 1_000_000
+	if billed < 0.05 || billed > 0.05+0.0015 {
+		t.Errorf("expected billed cost just over the $0.05 ceiling, got $%.4f", billed)
+	}
+}
+
+func TestCostCeilingReader_PassesThroughStreamUnderCeiling(t *testing.T) {
+	stream := buildStream("claude-sonnet-4-20250514", 10, 5, "hello")
+	source := &chunkedStream{reader: strings.NewReader(stream), chunkSize: 11}
+
+	reader := NewCostCeilingReader(source, NewModelCatalog(), 1.0)
+	output, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("reading stream failed: %v", err)
+	}
+
+	if reader.Aborted() {
+		t.Error("expected stream under the ceiling not to be aborted")
+	}
+	if string(output) != stream {
+		t.Error("expected stream to pass through unchanged")
+	}
+}
@@ -0,0 +1,90 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"cloud.google.com/go/firestore"
+)
+
+// DailyCostLimit represents a daily cost limit document, in USD
+type DailyCostLimit struct {
+	UserID     string  `firestore:"userId" json:"userId"`
+	CostLimit  float64 `firestore:"costLimit" json:"costLimit"`
+	Unlimited  bool    `firestore:"unlimited,omitempty" json:"unlimited,omitempty"` // Uncapped; costLimit is ignored
+	UpdateTime string  `firestore:"updateTime" json:"updateTime"`
+}
+
+// CostLimitService handles daily cost limit operations
+type CostLimitService struct {
+	client     *firestore.Client
+	collection string
+}
+
+// NewCostLimitService creates a new cost limit service
+func NewCostLimitService(client *firestore.Client) *CostLimitService {
+	return &CostLimitService{
+		client:     client,
+		collection: "daily_cost_limits",
+	}
+}
+
+// GetCostLimit retrieves a daily cost limit for a user
+// Returns found=false if no cost limit is set
+func (s *CostLimitService) GetCostLimit(ctx context.Context, userID string) (DailyCostLimit, bool, error) {
+	docRef := s.client.Collection(s.collection).Doc(userID)
+	doc, err := docRef.Get(ctx)
+	if err != nil {
+		if doc != nil && !doc.Exists() {
+			return DailyCostLimit{}, false, nil // No limit configured
+		}
+		return DailyCostLimit{}, false, fmt.Errorf("error fetching cost limit: %w", err)
+	}
+
+	var limit DailyCostLimit
+	if err := doc.DataTo(&limit); err != nil {
+		return DailyCostLimit{}, false, fmt.Errorf("error parsing cost limit: %w", err)
+	}
+
+	return limit, true, nil
+}
+
+// pointsPerDollar matches the billing service's conversion: points = cost * 10
+const pointsPerDollar = 10
+
+// classifyCost builds a check result from a daily cost limit and the USD billed in the window. Cost is
+// compared in dollars, so fractional limits such as $0.05 are exact; RemainingPoints only converts what is
+// left to points for callers that report it, rounding up so any budget left counts as a point.
+func classifyCost(costLimit DailyCostLimit, limitFound bool, usedCost float64) PointsCheckResult {
+	if !limitFound {
+		return PointsCheckResult{State: PointsLimitUnset}
+	}
+	if costLimit.Unlimited {
+		return PointsCheckResult{State: PointsLimitUnlimited}
+	}
+
+	remaining := costLimit.CostLimit - usedCost
+	if remaining <= 0 {
+		return PointsCheckResult{State: PointsExhausted, RemainingPoints: int(math.Floor(remaining * pointsPerDollar))}
+	}
+	return PointsCheckResult{State: PointsAvailable, RemainingPoints: int(math.Ceil(remaining * pointsPerDollar))}
+}
+
+// combineLimitResults applies the most restrictive of a user's points and cost limit results. A limit
+// that isn't configured or is unlimited defers to the other; with neither configured the result is unset.
+func combineLimitResults(points PointsCheckResult, pointsFound bool, cost PointsCheckResult, costFound bool) PointsCheckResult {
+	switch {
+	case !costFound:
+		return points
+	case !pointsFound, points.State == PointsLimitUnlimited:
+		return cost
+	case cost.State == PointsLimitUnlimited:
+		return points
+	case !points.Allowed():
+		return points
+	case !cost.Allowed(), cost.RemainingPoints < points.RemainingPoints:
+		return cost
+	}
+	return points
+}
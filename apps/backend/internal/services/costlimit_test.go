@@ -0,0 +1,80 @@
+package services
+
+import "testing"
+
+func TestClassifyCost(t *testing.T) {
+	tests := []struct {
+		name          string
+		costLimit     DailyCostLimit
+		limitFound    bool
+		usedCost      float64
+		wantState     PointsLimitState
+		wantRemaining int
+	}{
+		{"unset", DailyCostLimit{}, false, 0, PointsLimitUnset, 0},
+		{"unlimited", DailyCostLimit{Unlimited: true}, true, 500, PointsLimitUnlimited, 0},
+		{"under the limit", DailyCostLimit{CostLimit: 20}, true, 5, PointsAvailable, 150},
+		{"at the limit", DailyCostLimit{CostLimit: 20}, true, 20, PointsExhausted, 0},
+		{"five cents is not zero", DailyCostLimit{CostLimit: 0.05}, true, 0, PointsAvailable, 1},
+		{"five cents used up", DailyCostLimit{CostLimit: 0.05}, true, 0.05, PointsExhausted, 0},
+		{"fractional dollars are not truncated", DailyCostLimit{CostLimit: 1.99}, true, 1.95, PointsAvailable, 1},
+		{"fractional limit reached", DailyCostLimit{CostLimit: 1.99}, true, 1.991, PointsExhausted, -1},
+		{"negative limit is a limit", DailyCostLimit{CostLimit: -1}, true, 0, PointsExhausted, -10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := classifyCost(tt.costLimit, tt.limitFound, tt.usedCost)
+			if result.State != tt.wantState || result.RemainingPoints != tt.wantRemaining {
+				t.Errorf("classifyCost() = %+v, want state %v remaining %d", result, tt.wantState, tt.wantRemaining)
+			}
+		})
+	}
+}
+
+func TestCombineLimitResults(t *testing.T) {
+	unset := PointsCheckResult{State: PointsLimitUnset}
+	unlimited := PointsCheckResult{State: PointsLimitUnlimited}
+	points := PointsCheckResult{State: PointsAvailable, RemainingPoints: 300}
+	cost := PointsCheckResult{State: PointsAvailable, RemainingPoints: 100}
+	exhausted := PointsCheckResult{State: PointsExhausted, RemainingPoints: -2}
+
+	tests := []struct {
+		name        string
+		points      PointsCheckResult
+		pointsFound bool
+		cost        PointsCheckResult
+		costFound   bool
+		want        PointsCheckResult
+	}{
+		{"neither set", unset, false, unset, false, unset},
+		{"points only", points, true, unset, false, points},
+		{"cost only", unset, false, cost, true, cost},
+		{"cost more restrictive", points, true, cost, true, cost},
+		{"points more restrictive", cost, true, points, true, cost},
+		{"unlimited points defers to cost", unlimited, true, cost, true, cost},
+		{"unlimited cost defers to points", points, true, unlimited, true, points},
+		{"both unlimited", unlimited, true, unlimited, true, unlimited},
+		{"exhausted cost wins", points, true, exhausted, true, exhausted},
+		{"exhausted points wins", exhausted, true, cost, true, exhausted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := combineLimitResults(tt.points, tt.pointsFound, tt.cost, tt.costFound); got != tt.want {
+				t.Errorf("combineLimitResults() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCostLimit_RejectsUserOverCostUnderPoints(t *testing.T) {
+	// $4.01 spent today is 40 points: well under the 500 points limit but over the $4 cost limit
+	usedPoints, usedCost := 40, 4.01
+	pointsResult := classifyPoints(PointsLimit{Points: 500}, true, usedPoints)
+	result := combineLimitResults(pointsResult, true, classifyCost(DailyCostLimit{CostLimit: 4}, true, usedCost), true)
+	if result.Allowed() {
+		t.Errorf("expected a user over their cost limit to be rejected, got %+v", result)
+	}
+	if !pointsResult.Allowed() {
+		t.Errorf("expected the points limit alone to allow the request, got %+v", pointsResult)
+	}
+}
@@ -0,0 +1,90 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"simple-relay/shared/timewindow"
+)
+
+// DailyUsage is a user's usage in the current daily window, as reported by GET /usage
+type DailyUsage struct {
+	State           string    `json:"state"`                // unset, unlimited, available or exhausted, of the most restrictive limit
+	PointsLimit     int       `json:"points_limit"`         // Daily points limit; zero when not set or unlimited
+	PointsUsed      int       `json:"points_used"`          // Points billed since WindowStart
+	PointsRemaining int       `json:"points_remaining"`     // Points left under the most restrictive limit; zero unless State is available
+	CostLimit       float64   `json:"cost_limit,omitempty"` // Daily USD limit; omitted when not set or unlimited
+	CostUsed        float64   `json:"cost_used,omitempty"`  // USD billed since WindowStart; only read when a cost limit applies
+	WindowStart     time.Time `json:"window_start"`
+	ResetsAt        time.Time `json:"resets_at"`
+}
+
+// String returns the state name used in API responses
+func (s PointsLimitState) String() string {
+	switch s {
+	case PointsLimitUnset:
+		return "unset"
+	case PointsLimitUnlimited:
+		return "unlimited"
+	case PointsAvailable:
+		return "available"
+	case PointsExhausted:
+		return "exhausted"
+	}
+	return "unknown"
+}
+
+// newDailyUsage reports the points and cost limits and the usage in window (pure function)
+func newDailyUsage(pointsLimit PointsLimit, pointsFound bool, usedPoints int, costLimit DailyCostLimit, costFound bool, usedCost float64, window timewindow.Window) DailyUsage {
+	result := combineLimitResults(
+		classifyPoints(pointsLimit, pointsFound, usedPoints), pointsFound,
+		classifyCost(costLimit, costFound, usedCost), costFound,
+	)
+	usage := DailyUsage{
+		State:       result.State.String(),
+		PointsUsed:  usedPoints,
+		CostUsed:    usedCost,
+		WindowStart: window.Start,
+		ResetsAt:    window.End,
+	}
+	if pointsFound && !pointsLimit.Unlimited {
+		usage.PointsLimit = pointsLimit.Points
+	}
+	if costFound && !costLimit.Unlimited {
+		usage.CostLimit = costLimit.CostLimit
+	}
+	if result.State == PointsAvailable {
+		usage.PointsRemaining = result.RemainingPoints
+	}
+	return usage
+}
+
+// GetDailyUsage reads the user's limit and usage in the current daily window from Firestore,
+// bypassing the check cache so clients see their latest billed usage
+func (uc *UsageChecker) GetDailyUsage(ctx context.Context, userID string) (DailyUsage, error) {
+	pointsLimit, pointsFound, err := uc.pointsLimitService.GetPointsLimit(ctx, userID)
+	if err != nil {
+		return DailyUsage{}, fmt.Errorf("error getting points limit: %w", err)
+	}
+	costLimit, costFound, err := uc.costLimitService.GetCostLimit(ctx, userID)
+	if err != nil {
+		return DailyUsage{}, fmt.Errorf("error getting cost limit: %w", err)
+	}
+
+	now := time.Now()
+	window := timewindow.DailyReset(now, timewindow.DefaultDailyResetHour)
+	aggregates := firestoreAggregates{client: uc.client}
+	usedPoints, err := windowedPoints(ctx, aggregates, userID, window, now)
+	if err != nil {
+		return DailyUsage{}, fmt.Errorf("error getting current usage: %w", err)
+	}
+	var usedCost float64
+	if costFound && !costLimit.Unlimited {
+		usedCost, err = aggregates.HourlyCost(ctx, userID, window.Start, window.End)
+		if err != nil {
+			return DailyUsage{}, fmt.Errorf("error getting current cost: %w", err)
+		}
+	}
+	return newDailyUsage(pointsLimit, pointsFound, usedPoints, costLimit, costFound, usedCost, window), nil
+}
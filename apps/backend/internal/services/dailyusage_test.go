@@ -0,0 +1,46 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"simple-relay/shared/timewindow"
+)
+
+func TestNewDailyUsage(t *testing.T) {
+	window := timewindow.DailyReset(time.Date(2024, 3, 11, 9, 0, 0, 0, time.UTC), timewindow.DefaultDailyResetHour)
+
+	tests := []struct {
+		name          string
+		pointsLimit   PointsLimit
+		pointsFound   bool
+		usedPoints    int
+		costLimit     DailyCostLimit
+		costFound     bool
+		usedCost      float64
+		wantState     string
+		wantLimit     int
+		wantRemaining int
+	}{
+		{"available", PointsLimit{Points: 500}, true, 120, DailyCostLimit{}, false, 0, "available", 500, 380},
+		{"exhausted", PointsLimit{Points: 500}, true, 520, DailyCostLimit{}, false, 0, "exhausted", 500, 0},
+		{"unlimited", PointsLimit{Unlimited: true}, true, 120, DailyCostLimit{}, false, 0, "unlimited", 0, 0},
+		{"negative limit", PointsLimit{Points: -1}, true, 0, DailyCostLimit{}, false, 0, "exhausted", -1, 0},
+		{"unset", PointsLimit{}, false, 0, DailyCostLimit{}, false, 0, "unset", 0, 0},
+		{"cost limit more restrictive", PointsLimit{Points: 500}, true, 120, DailyCostLimit{CostLimit: 15}, true, 12, "available", 500, 30},
+		{"over the cost limit", PointsLimit{Points: 500}, true, 19, DailyCostLimit{CostLimit: 1.99}, true, 1.99, "exhausted", 500, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usage := newDailyUsage(tt.pointsLimit, tt.pointsFound, tt.usedPoints, tt.costLimit, tt.costFound, tt.usedCost, window)
+			if usage.State != tt.wantState || usage.PointsLimit != tt.wantLimit || usage.PointsRemaining != tt.wantRemaining {
+				t.Errorf("newDailyUsage() = %+v, want state %s limit %d remaining %d",
+					usage, tt.wantState, tt.wantLimit, tt.wantRemaining)
+			}
+			if usage.PointsUsed != tt.usedPoints || usage.CostUsed != tt.usedCost || usage.CostLimit != tt.costLimit.CostLimit ||
+				!usage.ResetsAt.Equal(window.End) || !usage.WindowStart.Equal(window.Start) {
+				t.Errorf("expected used points, cost and window to be reported, got %+v", usage)
+			}
+		})
+	}
+}
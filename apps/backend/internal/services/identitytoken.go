@@ -0,0 +1,122 @@
+package services
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// identityTokenRefreshMargin is how long before expiry a cached token is proactively replaced
+	identityTokenRefreshMargin = 5 * time.Minute
+	// identityTokenDefaultLifetime is assumed when the token expiry can't be parsed
+	identityTokenDefaultLifetime = 30 * time.Minute
+)
+
+// IdentityTokenFunc fetches an identity token for the given audience
+type IdentityTokenFunc func(audience string) (string, error)
+
+// cachedIdentityToken is an identity token with its expiry
+type cachedIdentityToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+// IdentityTokenSource fetches identity tokens with retries and caches them until near expiry,
+// so brief metadata server outages don't block service-to-service calls
+type IdentityTokenSource struct {
+	fetch       IdentityTokenFunc
+	cache       map[string]cachedIdentityToken
+	mu          sync.Mutex
+	maxAttempts int
+	retryDelay  time.Duration
+}
+
+// NewIdentityTokenSource creates a caching token source around fetch
+func NewIdentityTokenSource(fetch IdentityTokenFunc) *IdentityTokenSource {
+	return &IdentityTokenSource{
+		fetch:       fetch,
+		cache:       make(map[string]cachedIdentityToken),
+		maxAttempts: 3,
+		retryDelay:  200 * time.Millisecond,
+	}
+}
+
+// Token returns a cached token for audience, fetching a new one when it is near expiry.
+// If fetching fails but the cached token hasn't actually expired yet, the cached token is returned.
+func (s *IdentityTokenSource) Token(audience string) (string, error) {
+	s.mu.Lock()
+	cached, exists := s.cache[audience]
+	s.mu.Unlock()
+
+	now := time.Now()
+	if exists && now.Before(cached.expiresAt.Add(-identityTokenRefreshMargin)) {
+		return cached.token, nil
+	}
+
+	token, err := s.fetchWithRetry(audience)
+	if err != nil {
+		if exists && now.Before(cached.expiresAt) {
+			log.Printf("Identity token fetch failed, reusing cached token valid until %s: %v",
+				cached.expiresAt.Format(time.RFC3339), err)
+			return cached.token, nil
+		}
+		return "", err
+	}
+
+	expiresAt, parseErr := parseJWTExpiry(token)
+	if parseErr != nil {
+		expiresAt = now.Add(identityTokenDefaultLifetime)
+	}
+
+	s.mu.Lock()
+	s.cache[audience] = cachedIdentityToken{token: token, expiresAt: expiresAt}
+	s.mu.Unlock()
+
+	return token, nil
+}
+
+// fetchWithRetry calls fetch up to maxAttempts times with a linear backoff
+func (s *IdentityTokenSource) fetchWithRetry(audience string) (string, error) {
+	var lastErr error
+	for attempt := 1; attempt <= s.maxAttempts; attempt++ {
+		token, err := s.fetch(audience)
+		if err == nil {
+			return token, nil
+		}
+		lastErr = err
+		if attempt < s.maxAttempts {
+			time.Sleep(time.Duration(attempt) * s.retryDelay)
+		}
+	}
+	return "", fmt.Errorf("failed to get identity token after %d attempts: %w", s.maxAttempts, lastErr)
+}
+
+// parseJWTExpiry reads the exp claim from a JWT without verifying its signature
+func parseJWTExpiry(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, fmt.Errorf("token is not a JWT")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to decode JWT payload: %w", err)
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse JWT claims: %w", err)
+	}
+	if claims.Exp == 0 {
+		return time.Time{}, fmt.Errorf("JWT has no exp claim")
+	}
+
+	return time.Unix(claims.Exp, 0), nil
+}
@@ -0,0 +1,111 @@
+package services
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fakeJWT builds an unsigned JWT with the given expiry
+func fakeJWT(expiresAt time.Time) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, expiresAt.Unix())))
+	return header + "." + payload + ".sig"
+}
+
+func TestIdentityTokenSource_CachesUntilNearExpiry(t *testing.T) {
+	calls := 0
+	source := NewIdentityTokenSource(func(audience string) (string, error) {
+		calls++
+		return fakeJWT(time.Now().Add(time.Hour)), nil
+	})
+
+	first, err := source.Token("https://billing")
+	if err != nil {
+		t.Fatalf("Token returned error: %v", err)
+	}
+	second, err := source.Token("https://billing")
+	if err != nil {
+		t.Fatalf("Token returned error: %v", err)
+	}
+
+	if first != second {
+		t.Errorf("expected cached token to be reused")
+	}
+	if calls != 1 {
+		t.Errorf("expected 1 fetch, got %d", calls)
+	}
+}
+
+func TestIdentityTokenSource_RetriesTransientFailures(t *testing.T) {
+	calls := 0
+	source := NewIdentityTokenSource(func(audience string) (string, error) {
+		calls++
+		if calls < 3 {
+			return "", errors.New("metadata unavailable")
+		}
+		return fakeJWT(time.Now().Add(time.Hour)), nil
+	})
+	source.retryDelay = time.Millisecond
+
+	if _, err := source.Token("https://billing"); err != nil {
+		t.Fatalf("expected retry to succeed, got %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 fetches, got %d", calls)
+	}
+}
+
+func TestIdentityTokenSource_FallsBackToCachedTokenOnFailure(t *testing.T) {
+	// Cached token is inside the refresh margin but not yet expired
+	cachedToken := fakeJWT(time.Now().Add(2 * time.Minute))
+	fail := false
+	source := NewIdentityTokenSource(func(audience string) (string, error) {
+		if fail {
+			return "", errors.New("metadata unavailable")
+		}
+		return cachedToken, nil
+	})
+	source.retryDelay = time.Millisecond
+
+	if _, err := source.Token("https://billing"); err != nil {
+		t.Fatalf("Token returned error: %v", err)
+	}
+
+	fail = true
+	token, err := source.Token("https://billing")
+	if err != nil {
+		t.Fatalf("expected cached token fallback, got error %v", err)
+	}
+	if token != cachedToken {
+		t.Errorf("expected cached token to be returned")
+	}
+}
+
+func TestIdentityTokenSource_FailsWithoutCachedToken(t *testing.T) {
+	source := NewIdentityTokenSource(func(audience string) (string, error) {
+		return "", errors.New("metadata unavailable")
+	})
+	source.retryDelay = time.Millisecond
+
+	if _, err := source.Token("https://billing"); err == nil {
+		t.Fatal("expected error when no token was ever fetched")
+	}
+}
+
+func TestParseJWTExpiry(t *testing.T) {
+	expiresAt := time.Unix(1700000000, 0)
+	got, err := parseJWTExpiry(fakeJWT(expiresAt))
+	if err != nil {
+		t.Fatalf("parseJWTExpiry returned error: %v", err)
+	}
+	if !got.Equal(expiresAt) {
+		t.Errorf("expected %v, got %v", expiresAt, got)
+	}
+
+	if _, err := parseJWTExpiry("not-a-jwt"); err == nil {
+		t.Error("expected error for malformed token")
+	}
+}
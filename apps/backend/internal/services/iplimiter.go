@@ -0,0 +1,48 @@
+package services
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"golang.org/x/time/rate"
+)
+
+// IPRateLimiter applies a token bucket per client IP so floods are rejected before any API key lookup.
+// Buckets idle for longer than the cache TTL are dropped and start full again.
+type IPRateLimiter struct {
+	rate     rate.Limit
+	burst    int
+	limiters *expirable.LRU[string, *rate.Limiter]
+	mu       sync.Mutex // makes get-or-create of a bucket atomic
+}
+
+// NewIPRateLimiter allows each IP requestsPerSecond on average with bursts of up to burst requests
+func NewIPRateLimiter(requestsPerSecond float64, burst int) *IPRateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &IPRateLimiter{
+		rate:     rate.Limit(requestsPerSecond),
+		burst:    burst,
+		limiters: expirable.NewLRU[string, *rate.Limiter](100000, nil, 10*time.Minute),
+	}
+}
+
+// Allow consumes a token for ip; when none is available it returns false and how long until one is
+func (l *IPRateLimiter) Allow(ip string) (bool, time.Duration) {
+	l.mu.Lock()
+	limiter, ok := l.limiters.Get(ip)
+	if !ok {
+		limiter = rate.NewLimiter(l.rate, l.burst)
+		l.limiters.Add(ip, limiter)
+	}
+	l.mu.Unlock()
+
+	reservation := limiter.Reserve()
+	if delay := reservation.Delay(); delay > 0 {
+		reservation.Cancel()
+		return false, delay
+	}
+	return true, 0
+}
@@ -0,0 +1,39 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIPRateLimiter_PerIPBuckets(t *testing.T) {
+	limiter := NewIPRateLimiter(1, 3)
+
+	for i := 0; i < 3; i++ {
+		if allowed, _ := limiter.Allow("203.0.113.7"); !allowed {
+			t.Fatalf("request %d within burst should be allowed", i+1)
+		}
+	}
+	allowed, wait := limiter.Allow("203.0.113.7")
+	if allowed {
+		t.Fatalf("expected request over burst to be rejected")
+	}
+	if wait <= 0 || wait > time.Second {
+		t.Errorf("expected a wait of up to 1s at 1 rps, got %s", wait)
+	}
+
+	if allowed, _ := limiter.Allow("203.0.113.8"); !allowed {
+		t.Errorf("a different IP should have its own bucket")
+	}
+}
+
+func TestIPRateLimiter_RejectedRequestsDoNotConsumeTokens(t *testing.T) {
+	limiter := NewIPRateLimiter(20, 1)
+	limiter.Allow("203.0.113.7")
+	for i := 0; i < 10; i++ {
+		limiter.Allow("203.0.113.7")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if allowed, _ := limiter.Allow("203.0.113.7"); !allowed {
+		t.Errorf("expected a token to be available after refilling, rejected attempts must not queue up")
+	}
+}
@@ -0,0 +1,96 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// LimitOverride temporarily raises one user's daily points limit for requests that present it,
+// e.g. for a demo, without changing the stored limit
+type LimitOverride struct {
+	UserID      string    `json:"sub"`
+	ExtraPoints int       `json:"points"`
+	ExpiresAt   time.Time `json:"-"`
+}
+
+// limitOverridePayload is the signed part of an override token
+type limitOverridePayload struct {
+	LimitOverride
+	Expiry int64 `json:"exp"` // Unix seconds
+}
+
+var (
+	ErrMalformedOverride = errors.New("malformed limit override token")
+	ErrInvalidOverride   = errors.New("invalid limit override signature")
+	ErrExpiredOverride   = errors.New("limit override token expired")
+)
+
+// SignLimitOverride issues an override token: base64url(JSON payload) "." base64url(HMAC-SHA256 of the payload)
+func SignLimitOverride(secret string, override LimitOverride) (string, error) {
+	payload, err := json.Marshal(limitOverridePayload{LimitOverride: override, Expiry: override.ExpiresAt.Unix()})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode limit override: %w", err)
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(signOverride(secret, encoded)), nil
+}
+
+// ParseLimitOverride verifies token against secret and returns the override it grants.
+// Tampered tokens and tokens expired at now are rejected.
+func ParseLimitOverride(secret string, token string, now time.Time) (LimitOverride, error) {
+	encoded, signature, found := strings.Cut(token, ".")
+	if !found || secret == "" {
+		return LimitOverride{}, ErrMalformedOverride
+	}
+	decodedSignature, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return LimitOverride{}, ErrMalformedOverride
+	}
+	if !hmac.Equal(decodedSignature, signOverride(secret, encoded)) {
+		return LimitOverride{}, ErrInvalidOverride
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return LimitOverride{}, ErrMalformedOverride
+	}
+	var parsed limitOverridePayload
+	if err := json.Unmarshal(payload, &parsed); err != nil || parsed.UserID == "" {
+		return LimitOverride{}, ErrMalformedOverride
+	}
+	override := parsed.LimitOverride
+	override.ExpiresAt = time.Unix(parsed.Expiry, 0)
+	if !now.Before(override.ExpiresAt) {
+		return LimitOverride{}, ErrExpiredOverride
+	}
+	return override, nil
+}
+
+// signOverride computes the token signature over the encoded payload
+func signOverride(secret string, encodedPayload string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(encodedPayload))
+	return mac.Sum(nil)
+}
+
+// Apply raises a points check result by the override's extra points. Users without a configured
+// limit get the extra points as their allowance; unlimited users are unaffected.
+func (o LimitOverride) Apply(result PointsCheckResult) PointsCheckResult {
+	if o.ExtraPoints <= 0 {
+		return result
+	}
+	switch result.State {
+	case PointsLimitUnset:
+		return classifyPoints(PointsLimit{Points: o.ExtraPoints}, true, 0)
+	case PointsAvailable, PointsExhausted:
+		// Usage beyond the stored limit (negative remaining points) counts against the extra points
+		return classifyPoints(PointsLimit{Points: o.ExtraPoints}, true, -result.RemainingPoints)
+	}
+	return result
+}
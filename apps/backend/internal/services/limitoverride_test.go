@@ -0,0 +1,71 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimitOverride_SignAndParse(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	token, err := SignLimitOverride("secret", LimitOverride{UserID: "demo@example.com", ExtraPoints: 500, ExpiresAt: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	override, err := ParseLimitOverride("secret", token, now)
+	if err != nil {
+		t.Fatalf("expected valid override, got %v", err)
+	}
+	if override.UserID != "demo@example.com" || override.ExtraPoints != 500 || !override.ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("unexpected override: %+v", override)
+	}
+
+	if _, err := ParseLimitOverride("secret", token, now.Add(time.Hour)); err != ErrExpiredOverride {
+		t.Errorf("expected expired override at its expiry, got %v", err)
+	}
+	if _, err := ParseLimitOverride("other-secret", token, now); err != ErrInvalidOverride {
+		t.Errorf("expected signature mismatch with another secret, got %v", err)
+	}
+}
+
+func TestLimitOverride_RejectsTamperedTokens(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	token, _ := SignLimitOverride("secret", LimitOverride{UserID: "demo@example.com", ExtraPoints: 500, ExpiresAt: now.Add(time.Hour)})
+	payload, signature, _ := strings.Cut(token, ".")
+
+	// A payload raising the points, re-encoded with the original signature
+	forged, _ := SignLimitOverride("attacker", LimitOverride{UserID: "demo@example.com", ExtraPoints: 1000000, ExpiresAt: now.Add(time.Hour)})
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+
+	for name, tampered := range map[string]string{
+		"swapped payload":   forgedPayload + "." + signature,
+		"truncated":         payload,
+		"garbage signature": payload + ".!!!",
+		"empty":             "",
+	} {
+		if _, err := ParseLimitOverride("secret", tampered, now); err == nil {
+			t.Errorf("%s: expected token to be rejected", name)
+		}
+	}
+}
+
+func TestLimitOverride_Apply(t *testing.T) {
+	override := LimitOverride{ExtraPoints: 100}
+	tests := []struct {
+		name   string
+		result PointsCheckResult
+		want   PointsCheckResult
+	}{
+		{"exhausted becomes available", PointsCheckResult{State: PointsExhausted, RemainingPoints: -20}, PointsCheckResult{State: PointsAvailable, RemainingPoints: 80}},
+		{"available gains points", PointsCheckResult{State: PointsAvailable, RemainingPoints: 50}, PointsCheckResult{State: PointsAvailable, RemainingPoints: 150}},
+		{"far over stays exhausted", PointsCheckResult{State: PointsExhausted, RemainingPoints: -300}, PointsCheckResult{State: PointsExhausted, RemainingPoints: -200}},
+		{"unset gets the extra points", PointsCheckResult{State: PointsLimitUnset}, PointsCheckResult{State: PointsAvailable, RemainingPoints: 100}},
+		{"unlimited unchanged", PointsCheckResult{State: PointsLimitUnlimited}, PointsCheckResult{State: PointsLimitUnlimited}},
+	}
+	for _, tt := range tests {
+		if got := override.Apply(tt.result); got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
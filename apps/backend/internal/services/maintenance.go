@@ -0,0 +1,139 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+const (
+	// maintenanceModeKey is the app_config document that pauses all proxied traffic when true
+	maintenanceModeKey = "maintenance_mode"
+	// maintenanceRetryAfterKey is the app_config document holding the Retry-After seconds sent while paused
+	maintenanceRetryAfterKey = "maintenance_retry_after_seconds"
+	// DefaultMaintenanceRetryAfter is sent when no retry interval is configured
+	DefaultMaintenanceRetryAfter = 5 * time.Minute
+)
+
+// MaintenanceMode tracks whether proxied traffic is paused. The flag is read from the app_config
+// collection (managed with scripts/config-manager.sh) on every refresh, so it can be toggled without
+// redeploying. A flag forced on at startup (MAINTENANCE_MODE=true) ignores the collection.
+type MaintenanceMode struct {
+	client     *firestore.Client
+	collection string
+	forced     bool
+	enabled    atomic.Bool
+	retryAfter atomic.Int64 // nanoseconds
+	stopChan   chan struct{}
+	wg         sync.WaitGroup
+}
+
+// NewMaintenanceMode creates a maintenance flag; forced keeps it on regardless of app_config
+func NewMaintenanceMode(client *firestore.Client, forced bool) *MaintenanceMode {
+	m := &MaintenanceMode{
+		client:     client,
+		collection: "app_config",
+		forced:     forced,
+		stopChan:   make(chan struct{}),
+	}
+	m.Set(forced, DefaultMaintenanceRetryAfter)
+	return m
+}
+
+// Enabled reports whether traffic is currently paused
+func (m *MaintenanceMode) Enabled() bool {
+	return m.enabled.Load()
+}
+
+// RetryAfter returns how long clients are told to wait while traffic is paused
+func (m *MaintenanceMode) RetryAfter() time.Duration {
+	return time.Duration(m.retryAfter.Load())
+}
+
+// Set turns maintenance mode on or off and sets the advertised retry interval
+func (m *MaintenanceMode) Set(enabled bool, retryAfter time.Duration) {
+	if retryAfter <= 0 {
+		retryAfter = DefaultMaintenanceRetryAfter
+	}
+	if m.enabled.Swap(enabled) != enabled {
+		log.Printf("[MAINTENANCE] Maintenance mode enabled: %v", enabled)
+	}
+	m.retryAfter.Store(int64(retryAfter))
+}
+
+// Start refreshes the flag immediately and then on every interval
+func (m *MaintenanceMode) Start(interval time.Duration) {
+	if m.forced {
+		return
+	}
+	m.wg.Add(1)
+	go m.run(interval)
+}
+
+// Stop stops refreshing the flag
+func (m *MaintenanceMode) Stop() {
+	close(m.stopChan)
+	m.wg.Wait()
+}
+
+// run is the refresh loop; the last known state is kept when a refresh fails
+func (m *MaintenanceMode) run(interval time.Duration) {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.Refresh(context.Background()); err != nil {
+			log.Printf("[MAINTENANCE] Failed to refresh maintenance mode: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-m.stopChan:
+			return
+		}
+	}
+}
+
+// Refresh reloads the flag from app_config
+func (m *MaintenanceMode) Refresh(ctx context.Context) error {
+	refs := []*firestore.DocumentRef{
+		m.client.Collection(m.collection).Doc(maintenanceModeKey),
+		m.client.Collection(m.collection).Doc(maintenanceRetryAfterKey),
+	}
+	docs, err := m.client.GetAll(ctx, refs)
+	if err != nil {
+		return fmt.Errorf("failed to read app config: %w", err)
+	}
+
+	values := make(map[string]interface{})
+	for _, doc := range docs {
+		if doc.Exists() {
+			values[doc.Ref.ID] = doc.Data()["value"]
+		}
+	}
+	enabled, retryAfter := parseMaintenanceConfig(values)
+	m.Set(enabled, retryAfter)
+	return nil
+}
+
+// parseMaintenanceConfig reads the maintenance flag and retry interval from app_config values,
+// which config-manager.sh stores as booleans and numbers
+func parseMaintenanceConfig(values map[string]interface{}) (bool, time.Duration) {
+	enabled, _ := values[maintenanceModeKey].(bool)
+
+	var retryAfter time.Duration
+	switch seconds := values[maintenanceRetryAfterKey].(type) {
+	case int64:
+		retryAfter = time.Duration(seconds) * time.Second
+	case float64:
+		retryAfter = time.Duration(seconds * float64(time.Second))
+	}
+	return enabled, retryAfter
+}
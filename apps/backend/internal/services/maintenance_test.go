@@ -0,0 +1,59 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaintenanceMode_Toggle(t *testing.T) {
+	mode := NewMaintenanceMode(nil, false)
+	if mode.Enabled() {
+		t.Fatal("maintenance mode should start disabled")
+	}
+
+	mode.Set(true, 2*time.Minute)
+	if !mode.Enabled() || mode.RetryAfter() != 2*time.Minute {
+		t.Errorf("expected enabled with 2m retry, got %v and %s", mode.Enabled(), mode.RetryAfter())
+	}
+
+	mode.Set(false, 0)
+	if mode.Enabled() {
+		t.Error("maintenance mode should be disabled")
+	}
+	if mode.RetryAfter() != DefaultMaintenanceRetryAfter {
+		t.Errorf("expected default retry interval, got %s", mode.RetryAfter())
+	}
+}
+
+func TestMaintenanceMode_ForcedIgnoresRefresh(t *testing.T) {
+	mode := NewMaintenanceMode(nil, true)
+	// Start is a no-op for forced mode, so no Firestore client is needed
+	mode.Start(time.Millisecond)
+	if !mode.Enabled() {
+		t.Error("forced maintenance mode should be enabled")
+	}
+}
+
+func TestParseMaintenanceConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		values      map[string]interface{}
+		wantEnabled bool
+		wantRetry   time.Duration
+	}{
+		{"unset", map[string]interface{}{}, false, 0},
+		{"enabled with integer seconds", map[string]interface{}{"maintenance_mode": true, "maintenance_retry_after_seconds": int64(600)}, true, 10 * time.Minute},
+		{"float seconds", map[string]interface{}{"maintenance_mode": true, "maintenance_retry_after_seconds": 90.0}, true, 90 * time.Second},
+		{"string flag is ignored", map[string]interface{}{"maintenance_mode": "true"}, false, 0},
+		{"explicitly disabled", map[string]interface{}{"maintenance_mode": false}, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enabled, retryAfter := parseMaintenanceConfig(tt.values)
+			if enabled != tt.wantEnabled || retryAfter != tt.wantRetry {
+				t.Errorf("got (%v, %s), want (%v, %s)", enabled, retryAfter, tt.wantEnabled, tt.wantRetry)
+			}
+		})
+	}
+}
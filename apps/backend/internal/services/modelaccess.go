@@ -0,0 +1,86 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// UserModelAccess restricts which models a user may call; read from the optional allowed_models and
+// denied_models fields of users/{email}. Entries match models containing them, e.g. "haiku" covers
+// every Haiku model, like per-model limit patterns.
+type UserModelAccess struct {
+	AllowedModels []string `firestore:"allowed_models" json:"allowed_models"`
+	DeniedModels  []string `firestore:"denied_models" json:"denied_models"`
+}
+
+// Restricted reports whether either list is configured
+func (a UserModelAccess) Restricted() bool {
+	return len(a.AllowedModels) > 0 || len(a.DeniedModels) > 0
+}
+
+// Allows reports whether model may be called: a denied entry always rejects it, and when an allowlist
+// is configured the model must match one of its entries (pure function)
+func (a UserModelAccess) Allows(model string) bool {
+	model = strings.ToLower(model)
+	if matchesModelPattern(model, a.DeniedModels) {
+		return false
+	}
+	return len(a.AllowedModels) == 0 || matchesModelPattern(model, a.AllowedModels)
+}
+
+// matchesModelPattern reports whether model contains any non-empty pattern, ignoring case
+func matchesModelPattern(model string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern != "" && strings.Contains(model, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// ModelAccessChecker looks up users' model restrictions, caching lookups for a minute
+type ModelAccessChecker struct {
+	client     *firestore.Client
+	collection string
+	cache      *expirable.LRU[string, UserModelAccess]
+}
+
+// NewModelAccessChecker creates a model access checker
+func NewModelAccessChecker(client *firestore.Client) *ModelAccessChecker {
+	return &ModelAccessChecker{
+		client:     client,
+		collection: "users",
+		cache:      expirable.NewLRU[string, UserModelAccess](1000, nil, time.Minute),
+	}
+}
+
+// ModelAccess returns the user's model restrictions; users without a document or lists are unrestricted
+func (mc *ModelAccessChecker) ModelAccess(ctx context.Context, userID string) (UserModelAccess, error) {
+	if access, exists := mc.cache.Get(userID); exists {
+		return access, nil
+	}
+
+	var access UserModelAccess
+	doc, err := mc.client.Collection(mc.collection).Doc(userID).Get(ctx)
+	switch {
+	case status.Code(err) == codes.NotFound:
+	case err != nil:
+		return UserModelAccess{}, fmt.Errorf("error fetching user model access: %w", err)
+	default:
+		if err := doc.DataTo(&access); err != nil {
+			return UserModelAccess{}, fmt.Errorf("error parsing user model access: %w", err)
+		}
+	}
+
+	// Unrestricted users are cached too, so the check costs one read per user per minute
+	mc.cache.Add(userID, access)
+	return access, nil
+}
@@ -0,0 +1,54 @@
+package services
+
+import (
+	"context"
+	"testing"
+)
+
+func TestUserModelAccess_Allows(t *testing.T) {
+	tests := []struct {
+		name   string
+		access UserModelAccess
+		model  string
+		want   bool
+	}{
+		{"unconfigured allows everything", UserModelAccess{}, "claude-opus-4-20250514", true},
+		{"allowed model", UserModelAccess{AllowedModels: []string{"haiku", "sonnet"}}, "claude-3-5-haiku-20241022", true},
+		{"model missing from allowlist", UserModelAccess{AllowedModels: []string{"haiku", "sonnet"}}, "claude-opus-4-20250514", false},
+		{"denied model", UserModelAccess{DeniedModels: []string{"opus"}}, "claude-opus-4-20250514", false},
+		{"model not denied", UserModelAccess{DeniedModels: []string{"opus"}}, "claude-sonnet-4-20250514", true},
+		{"denylist wins over allowlist", UserModelAccess{AllowedModels: []string{"claude"}, DeniedModels: []string{"opus"}}, "claude-opus-4-20250514", false},
+		{"matching ignores case", UserModelAccess{DeniedModels: []string{"Opus"}}, "CLAUDE-OPUS-4", false},
+		{"blank entries never match", UserModelAccess{DeniedModels: []string{"", " "}}, "claude-opus-4-20250514", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.access.Allows(tt.model); got != tt.want {
+				t.Errorf("Allows(%q) = %v, want %v", tt.model, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestModelAccessChecker_UsesCachedAccess(t *testing.T) {
+	checker := NewModelAccessChecker(nil)
+	checker.cache.Add("budget@example.com", UserModelAccess{AllowedModels: []string{"haiku"}})
+	checker.cache.Add("open@example.com", UserModelAccess{})
+
+	access, err := checker.ModelAccess(context.Background(), "budget@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !access.Restricted() || access.Allows("claude-opus-4") {
+		t.Errorf("expected budget user to be restricted to haiku, got %+v", access)
+	}
+
+	access, err = checker.ModelAccess(context.Background(), "open@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if access.Restricted() {
+		t.Errorf("expected no restrictions, got %+v", access)
+	}
+}
@@ -0,0 +1,109 @@
+package services
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// ModelAliases maps model names clients may request (e.g. a deprecated model) to the model sent upstream
+type ModelAliases map[string]string
+
+// ParseModelAliases parses "alias=model,alias=model"; aliases are matched case-insensitively
+func ParseModelAliases(value string) ModelAliases {
+	aliases := make(ModelAliases)
+	for _, part := range strings.Split(value, ",") {
+		alias, model, found := strings.Cut(part, "=")
+		alias = strings.ToLower(strings.TrimSpace(alias))
+		model = strings.TrimSpace(model)
+		if !found || alias == "" || model == "" {
+			continue
+		}
+		aliases[alias] = model
+	}
+	return aliases
+}
+
+// Resolve returns the upstream model for a requested model, if it is an alias
+func (aliases ModelAliases) Resolve(requested string) (string, bool) {
+	model, ok := aliases[strings.ToLower(requested)]
+	return model, ok
+}
+
+// ModelAlias records that a request for Requested was sent upstream as Upstream
+type ModelAlias struct {
+	Requested string
+	Upstream  string
+}
+
+// ModelRewriteReader rewrites the "model" field of a response from the upstream model back to the
+// alias the client asked for. It works line by line, so it handles both SSE streams (the model is in
+// message_start) and single-line JSON bodies. Only the exact upstream model name is replaced.
+type ModelRewriteReader struct {
+	source  io.ReadCloser
+	from    [][]byte
+	to      [][]byte
+	pending []byte       // bytes of an incomplete line
+	out     bytes.Buffer // rewritten lines ready for the reader
+	done    bool
+}
+
+// NewModelRewriteReader wraps source, replacing alias.Upstream with alias.Requested in model fields
+func NewModelRewriteReader(source io.ReadCloser, alias ModelAlias) *ModelRewriteReader {
+	r := &ModelRewriteReader{source: source}
+	for _, separator := range []string{":", ": "} {
+		r.from = append(r.from, []byte(`"model"`+separator+`"`+alias.Upstream+`"`))
+		r.to = append(r.to, []byte(`"model"`+separator+`"`+alias.Requested+`"`))
+	}
+	return r
+}
+
+// Read implements io.Reader
+func (r *ModelRewriteReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		buf := make([]byte, costCeilingReadSize)
+		n, err := r.source.Read(buf)
+		if n > 0 {
+			r.process(buf[:n])
+		}
+		if err == io.EOF {
+			r.out.Write(r.rewrite(r.pending))
+			r.pending = nil
+			r.done = true
+		} else if err != nil {
+			if r.out.Len() > 0 {
+				break
+			}
+			return 0, err
+		}
+	}
+	return r.out.Read(p)
+}
+
+// Close closes the upstream body
+func (r *ModelRewriteReader) Close() error {
+	return r.source.Close()
+}
+
+// process forwards every complete line, rewritten
+func (r *ModelRewriteReader) process(chunk []byte) {
+	r.pending = append(r.pending, chunk...)
+	end := bytes.LastIndexByte(r.pending, '\n')
+	if end < 0 {
+		return
+	}
+	r.out.Write(r.rewrite(r.pending[:end+1]))
+	r.pending = append([]byte(nil), r.pending[end+1:]...)
+}
+
+// rewrite replaces the upstream model with the alias in complete lines
+func (r *ModelRewriteReader) rewrite(lines []byte) []byte {
+	for i := range r.from {
+		lines = bytes.ReplaceAll(lines, r.from[i], r.to[i])
+	}
+	return lines
+}
@@ -0,0 +1,58 @@
+package services
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestParseModelAliases(t *testing.T) {
+	aliases := ParseModelAliases("Claude-3-Opus-20240229 = claude-opus-4-20250514, broken, =x, claude-2=claude-sonnet-4-20250514")
+
+	if len(aliases) != 2 {
+		t.Fatalf("expected 2 aliases, got %v", aliases)
+	}
+	if model, ok := aliases.Resolve("claude-3-opus-20240229"); !ok || model != "claude-opus-4-20250514" {
+		t.Errorf("expected case-insensitive alias lookup, got %q (%v)", model, ok)
+	}
+	if _, ok := aliases.Resolve("claude-sonnet-4-20250514"); ok {
+		t.Errorf("a model that isn't an alias should not resolve")
+	}
+	if len(ParseModelAliases("")) != 0 {
+		t.Errorf("expected no aliases for an empty value")
+	}
+}
+
+func TestModelRewriteReader_RewritesSplitStream(t *testing.T) {
+	stream := "event: message_start\n" +
+		`data: {"type":"message_start","message":{"model":"claude-opus-4-20250514","content":[]}}` + "\n\n" +
+		"event: content_block_delta\n" +
+		`data: {"type":"content_block_delta","delta":{"text":"the model \"claude-opus-4-20250514\" said"}}` + "\n\n"
+	alias := ModelAlias{Requested: "claude-3-opus-20240229", Upstream: "claude-opus-4-20250514"}
+
+	// One byte at a time so the model field is split across reads
+	source := io.NopCloser(iotest.OneByteReader(strings.NewReader(stream)))
+	out, err := io.ReadAll(NewModelRewriteReader(source, alias))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := strings.Replace(stream, `"model":"claude-opus-4-20250514"`, `"model":"claude-3-opus-20240229"`, 1)
+	if string(out) != want {
+		t.Errorf("unexpected rewritten stream:\n%s", out)
+	}
+}
+
+func TestModelRewriteReader_JSONBodyWithoutTrailingNewline(t *testing.T) {
+	body := `{"id":"msg_1","model": "claude-opus-4-20250514","usage":{"output_tokens":3}}`
+	alias := ModelAlias{Requested: "old-opus", Upstream: "claude-opus-4-20250514"}
+
+	out, err := io.ReadAll(NewModelRewriteReader(io.NopCloser(strings.NewReader(body)), alias))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(out) != `{"id":"msg_1","model": "old-opus","usage":{"output_tokens":3}}` {
+		t.Errorf("unexpected rewritten body %s", out)
+	}
+}
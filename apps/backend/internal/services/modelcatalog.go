@@ -0,0 +1,94 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"simple-relay/shared/pricing"
+
+	"cloud.google.com/go/firestore"
+)
+
+// ModelCatalog tracks which models have known pricing: the shared defaults plus the prices billing
+// reads from the model_pricing collection
+type ModelCatalog struct {
+	prices atomic.Pointer[map[string]pricing.ModelPricing] // Swapped whole on reload
+	client *firestore.Client
+}
+
+// NewModelCatalog creates a catalog from the shared default pricing table
+func NewModelCatalog() *ModelCatalog {
+	mc := &ModelCatalog{}
+	mc.Reload(pricing.DefaultModelPricing())
+	return mc
+}
+
+// Reload swaps in a new pricing table keyed by lowercase model name
+func (mc *ModelCatalog) Reload(table map[string]pricing.ModelPricing) {
+	mc.prices.Store(&table)
+}
+
+// SetPricingSource makes ReloadPricing read prices from the model_pricing collection of client
+func (mc *ModelCatalog) SetPricingSource(client *firestore.Client) {
+	mc.client = client
+}
+
+// ReloadPricing loads the model_pricing collection over the defaults, as billing does, so strict mode
+// and cost ceilings know the models billing can price. On error the current table is kept.
+func (mc *ModelCatalog) ReloadPricing(ctx context.Context) error {
+	if mc.client == nil {
+		return fmt.Errorf("no pricing source configured")
+	}
+	table, err := pricing.Load(ctx, mc.client)
+	if err != nil {
+		return err
+	}
+	mc.Reload(table)
+	return nil
+}
+
+// WatchPricing reloads prices on every interval until ctx is done; call ReloadPricing first so the
+// catalog starts with the stored prices
+func (mc *ModelCatalog) WatchPricing(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if err := mc.ReloadPricing(ctx); err != nil {
+			log.Printf("Failed to reload model pricing: %v", err)
+		}
+	}
+}
+
+// IsKnownModel reports whether the model has an exact pricing entry (case-insensitive)
+func (mc *ModelCatalog) IsKnownModel(model string) bool {
+	_, exists := (*mc.prices.Load())[strings.ToLower(model)]
+	return exists
+}
+
+// PricingFor returns the pricing for a model, falling back to the most expensive known rates
+// for unknown models so cost estimates err on the high side
+func (mc *ModelCatalog) PricingFor(model string) pricing.ModelPricing {
+	prices := *mc.prices.Load()
+	if modelPricing, exists := prices[strings.ToLower(model)]; exists {
+		return modelPricing
+	}
+
+	var highest pricing.ModelPricing
+	for _, modelPricing := range prices {
+		if modelPricing.OutputPricePerMillion > highest.OutputPricePerMillion {
+			highest = modelPricing
+		}
+	}
+	return highest
+}
@@ -0,0 +1,37 @@
+package services
+
+import "testing"
+
+func TestModelCatalog_IsKnownModel(t *testing.T) {
+	catalog := NewModelCatalog()
+
+	tests := []struct {
+		model string
+		known bool
+	}{
+		{"claude-sonnet-4-20250514", true},
+		{"Claude-3-Opus-20240229", true},
+		{"claude-unreleased-9", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := catalog.IsKnownModel(tt.model); got != tt.known {
+			t.Errorf("IsKnownModel(%q) = %v, want %v", tt.model, got, tt.known)
+		}
+	}
+}
+
+func TestModelCatalog_PricingFor(t *testing.T) {
+	catalog := NewModelCatalog()
+
+	sonnet := catalog.PricingFor("claude-sonnet-4-20250514")
+	if sonnet.OutputPricePerMillion != 15.0 {
+		t.Errorf("expected sonnet output price 15.0, got %v", sonnet.OutputPricePerMillion)
+	}
+
+	unknown := catalog.PricingFor("claude-unreleased-9")
+	if unknown.OutputPricePerMillion != 75.0 {
+		t.Errorf("expected unknown model to use the highest output price 75.0, got %v", unknown.OutputPricePerMillion)
+	}
+}
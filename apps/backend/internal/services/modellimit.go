@@ -0,0 +1,142 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"simple-relay/shared/database"
+	"simple-relay/shared/timewindow"
+)
+
+// modelLimitsSubcollection holds a user's per-model daily points limits under their daily_points_limits
+// document: daily_points_limits/{user}/models/{pattern}. A pattern matches models containing it, e.g.
+// "opus" caps every Opus model; the longest matching pattern wins.
+const modelLimitsSubcollection = "models"
+
+// GetModelPointsLimits reads a user's per-model points limits keyed by lowercase model pattern
+func (s *PointsLimitService) GetModelPointsLimits(ctx context.Context, userID string) (map[string]PointsLimit, error) {
+	docs, err := s.client.Collection(s.collection).Doc(userID).Collection(modelLimitsSubcollection).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching model points limits: %w", err)
+	}
+
+	limits := make(map[string]PointsLimit, len(docs))
+	for _, doc := range docs {
+		var limit DailyPointsLimit
+		if err := doc.DataTo(&limit); err != nil {
+			continue // Skip malformed limits
+		}
+		limits[strings.ToLower(doc.Ref.ID)] = limit.limit()
+	}
+	return limits, nil
+}
+
+// matchModelLimit returns the longest pattern in limits contained in model (pure function)
+func matchModelLimit(limits map[string]PointsLimit, model string) (string, PointsLimit, bool) {
+	model = strings.ToLower(model)
+	bestPattern := ""
+	for pattern := range limits {
+		if strings.Contains(model, pattern) && len(pattern) > len(bestPattern) {
+			bestPattern = pattern
+		}
+	}
+	if bestPattern == "" {
+		return "", PointsLimit{}, false
+	}
+	return bestPattern, limits[bestPattern], true
+}
+
+// modelPointsFromAggregate sums the points a model_usage map attributes to models matching pattern
+func modelPointsFromAggregate(modelUsage interface{}, pattern string) float64 {
+	usage, ok := modelUsage.(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	var total float64
+	for model, stats := range usage {
+		fields, ok := stats.(map[string]interface{})
+		if !ok || !strings.Contains(strings.ToLower(model), pattern) {
+			continue
+		}
+		points, _ := database.Number(fields["total_points"])
+		total += points
+	}
+	return total
+}
+
+// classifyModelPoints checks model against the user's per-model limits. Models without a matching
+// limit are only subject to the global daily limit, reported as PointsLimitUnlimited here.
+func classifyModelPoints(ctx context.Context, limits map[string]PointsLimit, model string, usedPoints func(ctx context.Context, pattern string) (int, error)) (PointsCheckResult, error) {
+	pattern, pointsLimit, found := matchModelLimit(limits, model)
+	if !found || pointsLimit.Unlimited {
+		return PointsCheckResult{State: PointsLimitUnlimited}, nil
+	}
+	used, err := usedPoints(ctx, pattern)
+	if err != nil {
+		return PointsCheckResult{}, err
+	}
+	return classifyPoints(pointsLimit, true, used), nil
+}
+
+// modelWindowPoints sums the points of models matching pattern over the user's hourly aggregates in window
+func (f firestoreAggregates) modelWindowPoints(ctx context.Context, userID string, window timewindow.Window, pattern string) (int, error) {
+	docs, err := f.client.Collection("hourly_aggregates").
+		Where("user_id", "==", userID).
+		Where("hour", ">=", window.Start).
+		Where("hour", "<", window.End).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return 0, fmt.Errorf("failed to query hourly aggregates: %w", err)
+	}
+
+	var totalPoints float64
+	for _, doc := range docs {
+		totalPoints += modelPointsFromAggregate(doc.Data()["model_usage"], pattern)
+	}
+	return int(math.Round(totalPoints)), nil
+}
+
+// calculateModelPointsFromDB checks model against the user's per-model limits in the current daily window
+func (uc *UsageChecker) calculateModelPointsFromDB(ctx context.Context, userID string, model string) (PointsCheckResult, error) {
+	limits, err := uc.pointsLimitService.GetModelPointsLimits(ctx, userID)
+	if err != nil {
+		return PointsCheckResult{}, err
+	}
+	window := timewindow.CurrentDailyReset()
+	source := firestoreAggregates{client: uc.client}
+	return classifyModelPoints(ctx, limits, model, func(ctx context.Context, pattern string) (int, error) {
+		return source.modelWindowPoints(ctx, userID, window, pattern)
+	})
+}
+
+// modelCacheKey identifies a user's cached result for one model
+func modelCacheKey(userID string, model string) string {
+	return userID + "\n" + strings.ToLower(model)
+}
+
+// CheckModelPointsLimit checks the user's per-model daily limit for model. Models without a per-model
+// limit get PointsLimitUnlimited and fall back to the global daily limit alone.
+func (uc *UsageChecker) CheckModelPointsLimit(ctx context.Context, userID string, model string) (PointsCheckResult, error) {
+	key := modelCacheKey(userID, model)
+	if entry, exists := uc.modelCache.Get(key); exists && time.Since(entry.Timestamp) < uc.cacheDuration {
+		// Refreshed in the background after a minute, like the daily check
+		if time.Since(entry.Timestamp) > time.Minute {
+			go func() {
+				if fresh, err := uc.calculateModelPointsFromDB(context.Background(), userID, model); err == nil {
+					uc.modelCache.Add(key, &UsageCacheEntry{Result: fresh, Timestamp: time.Now()})
+				}
+			}()
+		}
+		return entry.Result, nil
+	}
+
+	result, err := uc.calculateModelPointsFromDB(ctx, userID, model)
+	if err != nil {
+		return PointsCheckResult{}, err
+	}
+	uc.modelCache.Add(key, &UsageCacheEntry{Result: result, Timestamp: time.Now()})
+	return result, nil
+}
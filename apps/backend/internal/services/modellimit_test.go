@@ -0,0 +1,62 @@
+package services
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMatchModelLimit_LongestPatternWins(t *testing.T) {
+	limits := map[string]PointsLimit{"opus": {Points: 100}, "opus-4-1": {Points: 50}, "haiku": {Unlimited: true}}
+
+	if pattern, limit, found := matchModelLimit(limits, "claude-opus-4-1-20250805"); !found || pattern != "opus-4-1" || limit.Points != 50 {
+		t.Errorf("expected the opus-4-1 limit, got %q %+v %v", pattern, limit, found)
+	}
+	if pattern, limit, found := matchModelLimit(limits, "Claude-Opus-4-20250514"); !found || pattern != "opus" || limit.Points != 100 {
+		t.Errorf("expected the opus limit, got %q %+v %v", pattern, limit, found)
+	}
+	if _, _, found := matchModelLimit(limits, "claude-sonnet-4-20250514"); found {
+		t.Errorf("expected no limit for sonnet")
+	}
+}
+
+func TestModelPointsFromAggregate(t *testing.T) {
+	modelUsage := map[string]interface{}{
+		"claude-opus-4-20250514":   map[string]interface{}{"total_points": 80.5},
+		"claude-opus-4-1-20250805": map[string]interface{}{"total_points": int64(40)},
+		"claude-sonnet-4-20250514": map[string]interface{}{"total_points": 300.0},
+	}
+
+	if got := modelPointsFromAggregate(modelUsage, "opus"); got != 120.5 {
+		t.Errorf("expected 120.5 opus points, got %v", got)
+	}
+	if got := modelPointsFromAggregate(nil, "opus"); got != 0 {
+		t.Errorf("expected 0 points without model usage, got %v", got)
+	}
+}
+
+func TestClassifyModelPoints_BlocksOpusAllowsSonnet(t *testing.T) {
+	limits := map[string]PointsLimit{"opus": {Points: 100}}
+	modelUsage := map[string]interface{}{
+		"claude-opus-4-20250514":   map[string]interface{}{"total_points": 120.0},
+		"claude-sonnet-4-20250514": map[string]interface{}{"total_points": 900.0},
+	}
+	usedPoints := func(ctx context.Context, pattern string) (int, error) {
+		return int(modelPointsFromAggregate(modelUsage, pattern)), nil
+	}
+
+	opus, err := classifyModelPoints(context.Background(), limits, "claude-opus-4-20250514", usedPoints)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opus.Allowed() || opus.State != PointsExhausted {
+		t.Errorf("expected opus to be blocked, got %+v", opus)
+	}
+
+	sonnet, err := classifyModelPoints(context.Background(), limits, "claude-sonnet-4-20250514", usedPoints)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !sonnet.Allowed() || sonnet.State != PointsLimitUnlimited {
+		t.Errorf("expected sonnet to fall back to the global limit, got %+v", sonnet)
+	}
+}
@@ -0,0 +1,78 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"simple-relay/shared/timewindow"
+)
+
+// monthlyRefreshAfter is how old a cached monthly result gets before it is refreshed in the
+// background; monthly totals move slowly, so this is longer than the daily check's minute
+const monthlyRefreshAfter = 10 * time.Minute
+
+// classifyMonthlyPoints builds a monthly check result. Unlike the daily limit, a monthly limit is
+// optional: users without one are not capped per month.
+func classifyMonthlyPoints(pointsLimit PointsLimit, limitFound bool, usedPoints int) PointsCheckResult {
+	if !limitFound {
+		return PointsCheckResult{State: PointsLimitUnlimited}
+	}
+	return classifyPoints(pointsLimit, true, usedPoints)
+}
+
+// monthlyEntryUsable reports whether a cached monthly result may still be served at now: it must be
+// younger than maxAge and from the current UTC month, so last month's exhausted result never outlives it
+func monthlyEntryUsable(entry *UsageCacheEntry, now time.Time, maxAge time.Duration) bool {
+	return now.Sub(entry.Timestamp) < maxAge && timewindow.Month(entry.Timestamp) == timewindow.Month(now)
+}
+
+// calculateMonthlyPointsFromDB checks the user's monthly_points_limits entry against this UTC month's usage
+func (uc *UsageChecker) calculateMonthlyPointsFromDB(ctx context.Context, userID string) (PointsCheckResult, error) {
+	pointsLimit, limitFound, err := uc.monthlyLimitService.GetPointsLimit(ctx, userID)
+	if err != nil {
+		return PointsCheckResult{}, fmt.Errorf("error getting monthly points limit: %w", err)
+	}
+
+	// Users without a monthly limit, or with an unlimited one, skip the aggregate queries
+	if !limitFound || pointsLimit.Unlimited {
+		return classifyMonthlyPoints(pointsLimit, limitFound, 0), nil
+	}
+
+	now := time.Now()
+	usedPoints, err := windowedPoints(ctx, firestoreAggregates{client: uc.client}, userID, timewindow.Month(now), now)
+	if err != nil {
+		return PointsCheckResult{}, fmt.Errorf("error getting monthly usage: %w", err)
+	}
+	return classifyMonthlyPoints(pointsLimit, limitFound, usedPoints), nil
+}
+
+// cacheMonthlyResult stores a monthly check result
+func (uc *UsageChecker) cacheMonthlyResult(userID string, result PointsCheckResult) {
+	uc.monthlyCache.Add(userID, &UsageCacheEntry{
+		Result:    result,
+		Timestamp: time.Now(),
+	})
+}
+
+// CheckMonthlyPointsLimit checks the user's allowance for the current UTC calendar month. Users
+// without a monthly limit get PointsLimitUnlimited, so only PointsExhausted rejects a request.
+func (uc *UsageChecker) CheckMonthlyPointsLimit(ctx context.Context, userID string) (PointsCheckResult, error) {
+	if entry, exists := uc.monthlyCache.Get(userID); exists && monthlyEntryUsable(entry, time.Now(), uc.cacheDuration) {
+		if time.Since(entry.Timestamp) > monthlyRefreshAfter {
+			go func() {
+				if fresh, err := uc.calculateMonthlyPointsFromDB(context.Background(), userID); err == nil {
+					uc.cacheMonthlyResult(userID, fresh)
+				}
+			}()
+		}
+		return entry.Result, nil
+	}
+
+	result, err := uc.calculateMonthlyPointsFromDB(ctx, userID)
+	if err != nil {
+		return PointsCheckResult{}, err
+	}
+	uc.cacheMonthlyResult(userID, result)
+	return result, nil
+}
@@ -0,0 +1,68 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+func TestClassifyMonthlyPoints(t *testing.T) {
+	tests := []struct {
+		name        string
+		pointsLimit PointsLimit
+		limitFound  bool
+		usedPoints  int
+		wantState   PointsLimitState
+	}{
+		{"no monthly limit is uncapped", PointsLimit{}, false, 100000, PointsLimitUnlimited},
+		{"unlimited", PointsLimit{Unlimited: true}, true, 100000, PointsLimitUnlimited},
+		{"under the limit", PointsLimit{Points: 5000}, true, 4000, PointsAvailable},
+		{"over the limit", PointsLimit{Points: 5000}, true, 5000, PointsExhausted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyMonthlyPoints(tt.pointsLimit, tt.limitFound, tt.usedPoints); got.State != tt.wantState {
+				t.Errorf("classifyMonthlyPoints() state = %v, want %v", got.State, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestMonthlyEntryUsable(t *testing.T) {
+	now := time.Date(2024, 4, 1, 0, 5, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		timestamp time.Time
+		want      bool
+	}{
+		{"recent entry from this month", now.Add(-time.Minute), true},
+		{"entry from last month", now.Add(-10 * time.Minute), false},
+		{"entry older than max age", now.Add(-25 * time.Hour), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := &UsageCacheEntry{Timestamp: tt.timestamp}
+			if got := monthlyEntryUsable(entry, now, 24*time.Hour); got != tt.want {
+				t.Errorf("monthlyEntryUsable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckMonthlyPointsLimit_ServesCachedResult(t *testing.T) {
+	cache, _ := lru.New[string, *UsageCacheEntry](10)
+	uc := &UsageChecker{monthlyCache: cache, cacheDuration: 24 * time.Hour}
+	exhausted := PointsCheckResult{State: PointsExhausted, RemainingPoints: -3}
+	uc.cacheMonthlyResult("user@example.com", exhausted)
+
+	// A fresh entry is served without reading Firestore (the checker has no client)
+	got, err := uc.CheckMonthlyPointsLimit(context.Background(), "user@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != exhausted {
+		t.Errorf("expected the cached result %+v, got %+v", exhausted, got)
+	}
+}
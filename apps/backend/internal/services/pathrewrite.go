@@ -0,0 +1,59 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+)
+
+// pathRewrite maps a client path to the provider's path. Rules ending in "/" rewrite every path under them.
+type pathRewrite struct {
+	from string
+	to   string
+}
+
+// PathRewrites maps client request paths to the upstream provider's paths, e.g. "/v1/messages" to a
+// provider-specific invoke path
+type PathRewrites []pathRewrite
+
+// ParsePathRewrites parses "from=to,from=to". Both sides must be absolute paths; a rule whose from
+// ends in "/" is a prefix rule and replaces only that prefix.
+func ParsePathRewrites(value string) (PathRewrites, error) {
+	var rewrites PathRewrites
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, to, found := strings.Cut(part, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !found || !strings.HasPrefix(from, "/") || !strings.HasPrefix(to, "/") {
+			return nil, fmt.Errorf("invalid path rewrite %q: want /from=/to", part)
+		}
+		if strings.HasSuffix(from, "/") != strings.HasSuffix(to, "/") {
+			return nil, fmt.Errorf("invalid path rewrite %q: prefix rules must end in / on both sides", part)
+		}
+		rewrites = append(rewrites, pathRewrite{from: from, to: to})
+	}
+	return rewrites, nil
+}
+
+// Rewrite returns the upstream path for a client path. Exact rules win over prefix rules, and longer
+// prefixes over shorter ones; paths matching no rule are returned unchanged with false.
+func (rewrites PathRewrites) Rewrite(path string) (string, bool) {
+	var best *pathRewrite
+	for i, rule := range rewrites {
+		if !strings.HasSuffix(rule.from, "/") {
+			if path == rule.from {
+				return rule.to, true
+			}
+			continue
+		}
+		if strings.HasPrefix(path, rule.from) && (best == nil || len(rule.from) > len(best.from)) {
+			best = &rewrites[i]
+		}
+	}
+	if best == nil {
+		return path, false
+	}
+	return best.to + strings.TrimPrefix(path, best.from), true
+}
@@ -0,0 +1,42 @@
+package services
+
+import "testing"
+
+func TestPathRewrites_Rewrite(t *testing.T) {
+	rewrites, err := ParsePathRewrites("/v1/messages=/model/claude/invoke-with-response-stream, /v1/=/anthropic/v1/, /v1/models/=/catalog/")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		path    string
+		want    string
+		changed bool
+	}{
+		{"/v1/messages", "/model/claude/invoke-with-response-stream", true},
+		{"/v1/messages/count_tokens", "/anthropic/v1/messages/count_tokens", true},
+		{"/v1/models/claude-sonnet-4", "/catalog/claude-sonnet-4", true},
+		{"/health", "/health", false},
+	}
+	for _, tt := range tests {
+		got, changed := rewrites.Rewrite(tt.path)
+		if got != tt.want || changed != tt.changed {
+			t.Errorf("Rewrite(%q) = %q, %v; want %q, %v", tt.path, got, changed, tt.want, tt.changed)
+		}
+	}
+
+	if got, changed := PathRewrites(nil).Rewrite("/v1/messages"); changed || got != "/v1/messages" {
+		t.Errorf("expected no rewrites to leave the path unchanged, got %q", got)
+	}
+}
+
+func TestParsePathRewrites_Invalid(t *testing.T) {
+	for _, value := range []string{"v1/messages=/invoke", "/v1/messages", "/v1/=/invoke", "/v1/messages=invoke"} {
+		if _, err := ParsePathRewrites(value); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+	if rewrites, err := ParsePathRewrites(""); err != nil || len(rewrites) != 0 {
+		t.Errorf("expected empty value to parse to no rewrites, got %v (err %v)", rewrites, err)
+	}
+}
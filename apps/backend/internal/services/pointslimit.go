@@ -11,9 +11,22 @@ import (
 type DailyPointsLimit struct {
 	UserID      string `firestore:"userId" json:"userId"`
 	PointsLimit int    `firestore:"pointsLimit" json:"pointsLimit"`
+	Unlimited   bool   `firestore:"unlimited,omitempty" json:"unlimited,omitempty"` // Uncapped; pointsLimit is ignored
 	UpdateTime  string `firestore:"updateTime" json:"updateTime"`
 }
 
+// PointsLimit is a configured points allowance. Only Unlimited lifts the cap: a zero or negative
+// Points value leaves no points to spend.
+type PointsLimit struct {
+	Points    int
+	Unlimited bool
+}
+
+// limit returns the allowance stored in the document
+func (l DailyPointsLimit) limit() PointsLimit {
+	return PointsLimit{Points: l.PointsLimit, Unlimited: l.Unlimited}
+}
+
 // PointsLimitService handles daily points limit operations
 type PointsLimitService struct {
 	client     *firestore.Client
@@ -28,22 +41,31 @@ func NewPointsLimitService(client *firestore.Client) *PointsLimitService {
 	}
 }
 
+// NewMonthlyPointsLimitService creates a points limit service reading monthly_points_limits, whose
+// documents have the same layout as daily_points_limits
+func NewMonthlyPointsLimitService(client *firestore.Client) *PointsLimitService {
+	return &PointsLimitService{
+		client:     client,
+		collection: "monthly_points_limits",
+	}
+}
+
 // GetPointsLimit retrieves a daily points limit for a user
-// Returns 0 if no points limit is set
-func (s *PointsLimitService) GetPointsLimit(ctx context.Context, userID string) (int, error) {
+// Returns found=false if no points limit is set
+func (s *PointsLimitService) GetPointsLimit(ctx context.Context, userID string) (PointsLimit, bool, error) {
 	docRef := s.client.Collection(s.collection).Doc(userID)
 	doc, err := docRef.Get(ctx)
 	if err != nil {
 		if doc != nil && !doc.Exists() {
-			return 0, nil // Default to 0 if not found
+			return PointsLimit{}, false, nil // No limit configured
 		}
-		return 0, fmt.Errorf("error fetching points limit: %w", err)
+		return PointsLimit{}, false, fmt.Errorf("error fetching points limit: %w", err)
 	}
 
 	var limit DailyPointsLimit
 	if err := doc.DataTo(&limit); err != nil {
-		return 0, fmt.Errorf("error parsing points limit: %w", err)
+		return PointsLimit{}, false, fmt.Errorf("error parsing points limit: %w", err)
 	}
 
-	return limit.PointsLimit, nil
+	return limit.limit(), true, nil
 }
@@ -0,0 +1,62 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// UserCostCeiling is an admin-set ceiling on the cost of a single request from one user
+type UserCostCeiling struct {
+	UserID         string  `firestore:"userId" json:"userId"`
+	MaxRequestCost float64 `firestore:"maxRequestCost" json:"maxRequestCost"` // USD; 0 or less sets no ceiling
+	UpdateTime     string  `firestore:"updateTime" json:"updateTime"`
+}
+
+// CostCeilingChecker reads per-user request cost ceilings, caching lookups for a minute
+type CostCeilingChecker struct {
+	client     *firestore.Client
+	collection string
+	cache      *expirable.LRU[string, float64]
+}
+
+// NewCostCeilingChecker creates a per-user cost ceiling checker
+func NewCostCeilingChecker(client *firestore.Client) *CostCeilingChecker {
+	return &CostCeilingChecker{
+		client:     client,
+		collection: "request_cost_ceilings",
+		cache:      expirable.NewLRU[string, float64](1000, nil, time.Minute),
+	}
+}
+
+// UserCeiling returns the user's per-request cost ceiling in USD, or 0 if none is set
+func (cc *CostCeilingChecker) UserCeiling(ctx context.Context, userID string) (float64, error) {
+	if ceiling, exists := cc.cache.Get(userID); exists {
+		return ceiling, nil
+	}
+
+	var ceiling float64
+	doc, err := cc.client.Collection(cc.collection).Doc(userID).Get(ctx)
+	switch {
+	case status.Code(err) == codes.NotFound:
+	case err != nil:
+		return 0, fmt.Errorf("error fetching request cost ceiling: %w", err)
+	default:
+		var userCeiling UserCostCeiling
+		if err := doc.DataTo(&userCeiling); err != nil {
+			return 0, fmt.Errorf("error parsing request cost ceiling: %w", err)
+		}
+		if userCeiling.MaxRequestCost > 0 {
+			ceiling = userCeiling.MaxRequestCost
+		}
+	}
+
+	// Users without a ceiling are cached too, so the check costs one read per user per minute
+	cc.cache.Add(userID, ceiling)
+	return ceiling, nil
+}
@@ -0,0 +1,19 @@
+package services
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCostCeilingChecker_UsesCachedCeiling(t *testing.T) {
+	checker := NewCostCeilingChecker(nil)
+	checker.cache.Add("capped@example.com", 0.5)
+	checker.cache.Add("open@example.com", 0)
+
+	if got, err := checker.UserCeiling(context.Background(), "capped@example.com"); err != nil || got != 0.5 {
+		t.Errorf("expected a cached ceiling of 0.5, got %v (err %v)", got, err)
+	}
+	if got, err := checker.UserCeiling(context.Background(), "open@example.com"); err != nil || got != 0 {
+		t.Errorf("expected no ceiling, got %v (err %v)", got, err)
+	}
+}
@@ -0,0 +1,188 @@
+package services
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"simple-relay/backend/internal/services/upstream"
+	"simple-relay/shared/database"
+)
+
+// canonicalFields lists the field names production writers store per collection (see CLAUDE.md, Firestore Schema).
+// Struct firestore tags must use these names, otherwise reads silently return zero values.
+var canonicalFields = map[string][]string{
+	// apps/frontend/services/user-database.ts; allowed_models and denied_models are admin-managed
+	"users": {
+		"email", "created_at", "last_login", "verification_token", "verification_expires_at", "api_enabled",
+		"access_approval_pending", "allowed_models", "denied_models",
+	},
+	// apps/frontend/services/api-key-database.ts (document ID is HashApiKey of the API key)
+	"api_key_bindings": {"key_preview", "user_email", "enabled", "created_at", "expires_at", "revoked"},
+	// apps/frontend/services/points-limit-database.ts
+	"daily_points_limits": {"userId", "pointsLimit", "unlimited", "updateTime"},
+	// Admin-managed monthly limits, read with the daily_points_limits struct
+	"monthly_points_limits": {"userId", "pointsLimit", "unlimited", "updateTime"},
+	// Admin-managed daily USD limits, same layout as daily_points_limits
+	"daily_cost_limits": {"userId", "costLimit", "unlimited", "updateTime"},
+	// Admin-managed per-request USD ceilings, same layout as daily_cost_limits
+	"request_cost_ceilings": {"userId", "maxRequestCost", "updateTime"},
+	// Backend refresher and scripts/manage-oauth-tokens.sh (document ID is the account UUID)
+	"oauth_tokens": {
+		"access_token", "refresh_token", "expires_at", "scope", "organization_uuid", "organization_name",
+		"account_uuid", "account_email", "updated_at", "refresh_started_at", "rate_limit_headers",
+		"rate_limit_reset_at", "disabled", "disabled_reason", "last_used_at",
+	},
+	// Backend OAuth store
+	"user_token_bindings": {"user_id", "account_uuid", "access_token", "expires_at"},
+	// Billing service, enforced by the proxy
+	"user_throttles": {"user_id", "reason", "throttled_until", "created_at"},
+	// Admin-managed per-account caps
+	"upstream_account_points_limits": {"account_uuid", "points_limit"},
+	"upstream_account_cost_limits":   {"account_uuid", "cost_limit"},
+}
+
+// firestoreFieldNames returns the stored field names declared by a struct's firestore tags
+func firestoreFieldNames(v interface{}) []string {
+	var names []string
+	t := reflect.TypeOf(v)
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("firestore")
+		name := strings.Split(tag, ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestFirestoreTagsMatchCanonicalSchema(t *testing.T) {
+	structs := map[string]interface{}{
+		"users":                          UserModelAccess{},
+		"api_key_bindings":               ApiKeyBinding{},
+		"daily_points_limits":            DailyPointsLimit{},
+		"daily_cost_limits":              DailyCostLimit{},
+		"request_cost_ceilings":          UserCostCeiling{},
+		"monthly_points_limits":          DailyPointsLimit{},
+		"user_throttles":                 UserThrottle{},
+		"oauth_tokens":                   upstream.OAuthCredentials{},
+		"user_token_bindings":            upstream.UserTokenBinding{},
+		"upstream_account_points_limits": upstream.AccountPointsLimit{},
+		"upstream_account_cost_limits":   upstream.AccountCostLimit{},
+	}
+
+	for collection, v := range structs {
+		t.Run(collection, func(t *testing.T) {
+			allowed := make(map[string]bool)
+			for _, name := range canonicalFields[collection] {
+				allowed[name] = true
+			}
+			for _, name := range firestoreFieldNames(v) {
+				if !allowed[name] {
+					t.Errorf("%T reads field %q, which production writers of %s never store", v, name, collection)
+				}
+			}
+		})
+	}
+}
+
+// writerDocuments returns one document per collection in the layout and value types its production writer stores
+func writerDocuments(now time.Time) map[string]map[string]interface{} {
+	iso := now.UTC().Format("2006-01-02T15:04:05.000Z")
+	return map[string]map[string]interface{}{
+		// user-database.ts stores dates as ISO strings; model lists are admin-managed arrays
+		"users": {
+			"email": "schema@example.com", "created_at": iso, "last_login": iso, "api_enabled": true,
+			"access_approval_pending": false, "allowed_models": []interface{}{"claude-sonnet-4"},
+			"denied_models": []interface{}{"claude-opus-4"},
+		},
+		// api-key-database.ts; expires_at and revoked are set by admins as timestamp and boolean
+		"api_key_bindings": {
+			"key_preview": "sk-abcd****wxyz", "user_email": "schema@example.com", "enabled": true,
+			"created_at": iso, "expires_at": now.Add(time.Hour), "revoked": true,
+		},
+		// points-limit-database.ts and manage-points-limits.sh (integerValue, ISO string updateTime)
+		"daily_points_limits":   {"userId": "schema-user", "pointsLimit": int64(500), "unlimited": true, "updateTime": iso},
+		"monthly_points_limits": {"userId": "schema-user", "pointsLimit": int64(5000), "unlimited": true, "updateTime": iso},
+		"daily_cost_limits":     {"userId": "schema-user", "costLimit": 1.99, "unlimited": true, "updateTime": iso},
+		"request_cost_ceilings": {"userId": "schema-user", "maxRequestCost": 0.5, "updateTime": iso},
+		// manage-oauth-tokens.sh plus the fields the refresher and selector maintain
+		"oauth_tokens": {
+			"access_token": "access", "refresh_token": "refresh", "expires_at": now.Add(time.Hour),
+			"scope": "user:inference user:profile", "organization_uuid": "org-uuid", "organization_name": "Org",
+			"account_uuid": "account-uuid", "account_email": "account@example.com", "updated_at": now,
+			"refresh_started_at": now, "rate_limit_headers": map[string]interface{}{"retry-after": "60"},
+			"rate_limit_reset_at": now.Add(time.Minute), "disabled": true, "disabled_reason": "revoked",
+			"last_used_at": now,
+		},
+		"user_token_bindings": {
+			"user_id": "schema-user", "account_uuid": "account-uuid", "access_token": "access", "expires_at": now.Add(time.Hour),
+		},
+		// Billing output caps
+		"user_throttles": {"user_id": "schema-user", "reason": "output cap", "throttled_until": now.Add(time.Hour), "created_at": now},
+		// Admin-managed caps are entered as whole numbers
+		"upstream_account_points_limits": {"account_uuid": "account-uuid", "points_limit": int64(1000)},
+		"upstream_account_cost_limits":   {"account_uuid": "account-uuid", "cost_limit": 2.5},
+	}
+}
+
+func TestWriterDocumentsDecodeIntoStructs(t *testing.T) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST not set, skipping Firestore emulator test")
+	}
+	ctx := context.Background()
+	db, err := database.NewService("test-project", "(default)")
+	if err != nil {
+		t.Fatalf("failed to create database service: %v", err)
+	}
+	defer db.Close()
+
+	targets := map[string]func() interface{}{
+		"users":                          func() interface{} { return &UserModelAccess{} },
+		"api_key_bindings":               func() interface{} { return &ApiKeyBinding{} },
+		"daily_points_limits":            func() interface{} { return &DailyPointsLimit{} },
+		"monthly_points_limits":          func() interface{} { return &DailyPointsLimit{} },
+		"daily_cost_limits":              func() interface{} { return &DailyCostLimit{} },
+		"request_cost_ceilings":          func() interface{} { return &UserCostCeiling{} },
+		"oauth_tokens":                   func() interface{} { return &upstream.OAuthCredentials{} },
+		"user_token_bindings":            func() interface{} { return &upstream.UserTokenBinding{} },
+		"user_throttles":                 func() interface{} { return &UserThrottle{} },
+		"upstream_account_points_limits": func() interface{} { return &upstream.AccountPointsLimit{} },
+		"upstream_account_cost_limits":   func() interface{} { return &upstream.AccountCostLimit{} },
+	}
+
+	for collection, data := range writerDocuments(time.Now()) {
+		t.Run(collection, func(t *testing.T) {
+			ref := db.Client().Collection(collection).Doc("schema-test")
+			if _, err := ref.Set(ctx, data); err != nil {
+				t.Fatalf("failed to write %s document: %v", collection, err)
+			}
+			defer ref.Delete(ctx)
+
+			doc, err := ref.Get(ctx)
+			if err != nil {
+				t.Fatalf("failed to read %s document: %v", collection, err)
+			}
+			target := targets[collection]()
+			if err := doc.DataTo(target); err != nil {
+				t.Fatalf("failed to decode %s into %T: %v", collection, target, err)
+			}
+
+			// Every field the struct reads must come back populated from the writer's layout
+			v := reflect.ValueOf(target).Elem()
+			for i := 0; i < v.NumField(); i++ {
+				name := strings.Split(v.Type().Field(i).Tag.Get("firestore"), ",")[0]
+				if name == "" || name == "-" {
+					continue
+				}
+				if v.Field(i).IsZero() {
+					t.Errorf("%T.%s is zero after decoding the %s field %q", target, v.Type().Field(i).Name, collection, name)
+				}
+			}
+		})
+	}
+}
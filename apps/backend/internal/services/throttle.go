@@ -0,0 +1,62 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// UserThrottle temporarily blocks a user; written by the billing service when a response exceeds
+// its model's output token cap
+type UserThrottle struct {
+	UserID         string    `firestore:"user_id" json:"user_id"`
+	Reason         string    `firestore:"reason" json:"reason"`
+	ThrottledUntil time.Time `firestore:"throttled_until" json:"throttled_until"`
+	CreatedAt      time.Time `firestore:"created_at" json:"created_at"`
+}
+
+// ThrottleChecker reports whether a user is throttled, caching lookups for a minute
+type ThrottleChecker struct {
+	client     *firestore.Client
+	collection string
+	cache      *expirable.LRU[string, time.Time]
+}
+
+// NewThrottleChecker creates a throttle checker
+func NewThrottleChecker(client *firestore.Client) *ThrottleChecker {
+	return &ThrottleChecker{
+		client:     client,
+		collection: "user_throttles",
+		cache:      expirable.NewLRU[string, time.Time](1000, nil, time.Minute),
+	}
+}
+
+// ThrottledUntil returns when the user's throttle ends, or the zero time if the user isn't throttled
+func (tc *ThrottleChecker) ThrottledUntil(ctx context.Context, userID string) (time.Time, error) {
+	if until, exists := tc.cache.Get(userID); exists {
+		return until, nil
+	}
+
+	var until time.Time
+	doc, err := tc.client.Collection(tc.collection).Doc(userID).Get(ctx)
+	switch {
+	case status.Code(err) == codes.NotFound:
+	case err != nil:
+		return time.Time{}, fmt.Errorf("error fetching user throttle: %w", err)
+	default:
+		var throttle UserThrottle
+		if err := doc.DataTo(&throttle); err != nil {
+			return time.Time{}, fmt.Errorf("error parsing user throttle: %w", err)
+		}
+		until = throttle.ThrottledUntil
+	}
+
+	// Users without a throttle are cached too, so the check costs one read per user per minute
+	tc.cache.Add(userID, until)
+	return until, nil
+}
@@ -0,0 +1,30 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestThrottleChecker_UsesCachedThrottle(t *testing.T) {
+	checker := NewThrottleChecker(nil)
+	until := time.Now().Add(30 * time.Minute)
+	checker.cache.Add("flagged@example.com", until)
+	checker.cache.Add("clean@example.com", time.Time{})
+
+	got, err := checker.ThrottledUntil(context.Background(), "flagged@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !got.Equal(until) {
+		t.Errorf("ThrottledUntil = %s, want %s", got, until)
+	}
+
+	got, err = checker.ThrottledUntil(context.Background(), "clean@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !got.IsZero() {
+		t.Errorf("expected no throttle, got %s", got)
+	}
+}
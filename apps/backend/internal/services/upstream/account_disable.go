@@ -0,0 +1,115 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// DefaultOrgUnavailablePatterns match upstream error messages returned when the account's organization
+// was deleted or disabled. Such accounts will never work again, so they are disabled instead of retried.
+var DefaultOrgUnavailablePatterns = []string{
+	"organization has been disabled",
+	"organization has been deleted",
+	"organization not found",
+	"organization is not active",
+}
+
+// upstreamErrorBody is the Anthropic error envelope
+type upstreamErrorBody struct {
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// IsOrgUnavailableError reports whether an upstream error response means the account's organization is gone.
+// Only auth-class statuses are considered; the error type or message must match one of the patterns.
+func IsOrgUnavailableError(statusCode int, body []byte, patterns []string) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+	switch statusCode {
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden:
+	default:
+		return false
+	}
+
+	var parsed upstreamErrorBody
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return false
+	}
+	errorType := strings.ToLower(parsed.Error.Type)
+	message := strings.ToLower(parsed.Error.Message)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if errorType == pattern || strings.Contains(message, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterOutDisabledCredentials drops accounts that were disabled (pure function)
+func filterOutDisabledCredentials(allCredentials []*OAuthCredentials) []*OAuthCredentials {
+	var enabled []*OAuthCredentials
+	for _, cred := range allCredentials {
+		if !cred.Disabled {
+			enabled = append(enabled, cred)
+		}
+	}
+	return enabled
+}
+
+// DisableAccountByToken marks the account owning accessToken as disabled so it is never selected again.
+// Returns the disabled account's UUID.
+func (store *OAuthStore) DisableAccountByToken(accessToken string, reason string) (string, error) {
+	ctx := context.Background()
+
+	docs, err := store.db.Client().Collection("oauth_tokens").Where("access_token", "==", accessToken).Limit(1).Documents(ctx).GetAll()
+	if err != nil {
+		return "", fmt.Errorf("failed to find OAuth token by access token: %w", err)
+	}
+	if len(docs) == 0 {
+		return "", fmt.Errorf("no OAuth token found with access token")
+	}
+
+	if err := store.DisableAccount(ctx, docs[0].Ref.ID, reason); err != nil {
+		return "", err
+	}
+	return docs[0].Ref.ID, nil
+}
+
+// DisableAccount marks accountUUID as disabled so it is never selected again, and evicts cached
+// bindings to it
+func (store *OAuthStore) DisableAccount(ctx context.Context, accountUUID string, reason string) error {
+	_, err := store.db.Client().Collection("oauth_tokens").Doc(accountUUID).Update(ctx, []firestore.Update{
+		{Path: "disabled", Value: true},
+		{Path: "disabled_reason", Value: reason},
+		{Path: "updated_at", Value: time.Now()},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to disable account: %w", err)
+	}
+
+	evicted := store.EvictAccountBindings(accountUUID)
+	log.Printf("[OAUTH] Disabled account %s: %s (evicted %d cached bindings)", accountUUID, reason, evicted)
+	return nil
+}
+
+// RebindUser drops the user's current binding and binds them to a fresh account
+func (store *OAuthStore) RebindUser(userID string) (*UserTokenBinding, error) {
+	if err := store.ClearUserTokenBinding(userID); err != nil {
+		return nil, err
+	}
+	return store.GetValidTokenForUser(userID)
+}
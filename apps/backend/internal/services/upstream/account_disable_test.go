@@ -0,0 +1,48 @@
+package upstream
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestIsOrgUnavailableError(t *testing.T) {
+	orgDisabled := []byte(`{"type":"error","error":{"type":"invalid_request_error","message":"This organization has been disabled."}}`)
+	badToken := []byte(`{"type":"error","error":{"type":"authentication_error","message":"Invalid bearer token"}}`)
+
+	tests := []struct {
+		name     string
+		status   int
+		body     []byte
+		patterns []string
+		want     bool
+	}{
+		{"org disabled message", http.StatusBadRequest, orgDisabled, DefaultOrgUnavailablePatterns, true},
+		{"org deleted on 403", http.StatusForbidden, []byte(`{"error":{"type":"permission_error","message":"Organization has been deleted"}}`), DefaultOrgUnavailablePatterns, true},
+		{"ordinary auth failure", http.StatusUnauthorized, badToken, DefaultOrgUnavailablePatterns, false},
+		{"custom error type pattern", http.StatusUnauthorized, badToken, []string{"authentication_error"}, true},
+		{"server error is never org-level", http.StatusInternalServerError, orgDisabled, DefaultOrgUnavailablePatterns, false},
+		{"fallback disabled", http.StatusBadRequest, orgDisabled, nil, false},
+		{"non-JSON body", http.StatusBadRequest, []byte("organization has been disabled"), DefaultOrgUnavailablePatterns, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsOrgUnavailableError(tt.status, tt.body, tt.patterns); got != tt.want {
+				t.Errorf("IsOrgUnavailableError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterOutDisabledCredentials(t *testing.T) {
+	credentials := []*OAuthCredentials{
+		{AccountUUID: "account-deleted-org", Disabled: true},
+		{AccountUUID: "account-ok"},
+	}
+
+	result := filterOutDisabledCredentials(credentials)
+
+	if len(result) != 1 || result[0].AccountUUID != "account-ok" {
+		t.Errorf("expected only account-ok to remain, got %+v", result)
+	}
+}
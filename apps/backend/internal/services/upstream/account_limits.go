@@ -0,0 +1,207 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"simple-relay/shared/database"
+	"simple-relay/shared/timewindow"
+)
+
+// accountCapCacheTTL is how long account caps and daily usage are reused before being re-read, so
+// binding users doesn't query Firestore for every capped account on every new binding
+const accountCapCacheTTL = time.Minute
+
+// accountLimitsCacheSize holds one entry per caps collection
+const accountLimitsCacheSize = 8
+
+// accountUsageCacheSize is the maximum number of cached daily usage totals
+const accountUsageCacheSize = 1000
+
+// AccountPointsLimit represents a daily points cap for an upstream account
+type AccountPointsLimit struct {
+	AccountUUID string  `firestore:"account_uuid" json:"account_uuid"`
+	PointsLimit float64 `firestore:"points_limit" json:"points_limit"`
+}
+
+// AccountCostLimit represents a daily USD cost cap for an upstream account
+type AccountCostLimit struct {
+	AccountUUID string  `firestore:"account_uuid" json:"account_uuid"`
+	CostLimit   float64 `firestore:"cost_limit" json:"cost_limit"`
+}
+
+// getAccountPointsLimits loads the configured daily points caps keyed by account UUID
+func (store *OAuthStore) getAccountPointsLimits(ctx context.Context) (map[string]float64, error) {
+	const collection = "upstream_account_points_limits"
+	if limits, exists := store.accountLimitsCache.Get(collection); exists {
+		return limits, nil
+	}
+
+	docs, err := store.db.Client().Collection(collection).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get upstream account points limits: %w", err)
+	}
+
+	limits := make(map[string]float64)
+	for _, doc := range docs {
+		var limit AccountPointsLimit
+		if err := doc.DataTo(&limit); err != nil {
+			continue // Skip malformed limits
+		}
+		accountUUID := limit.AccountUUID
+		if accountUUID == "" {
+			accountUUID = doc.Ref.ID
+		}
+		limits[accountUUID] = limit.PointsLimit
+	}
+	store.accountLimitsCache.Add(collection, limits)
+	return limits, nil
+}
+
+// getAccountCostLimits loads the configured daily cost caps keyed by account UUID
+func (store *OAuthStore) getAccountCostLimits(ctx context.Context) (map[string]float64, error) {
+	const collection = "upstream_account_cost_limits"
+	if limits, exists := store.accountLimitsCache.Get(collection); exists {
+		return limits, nil
+	}
+
+	docs, err := store.db.Client().Collection(collection).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get upstream account cost limits: %w", err)
+	}
+
+	limits := make(map[string]float64)
+	for _, doc := range docs {
+		var limit AccountCostLimit
+		if err := doc.DataTo(&limit); err != nil {
+			continue // Skip malformed limits
+		}
+		accountUUID := limit.AccountUUID
+		if accountUUID == "" {
+			accountUUID = doc.Ref.ID
+		}
+		limits[accountUUID] = limit.CostLimit
+	}
+	store.accountLimitsCache.Add(collection, limits)
+	return limits, nil
+}
+
+// getAccountDailyPoints sums total_points from upstream hourly aggregates in the current daily window
+func (store *OAuthStore) getAccountDailyPoints(ctx context.Context, accountUUID string) (float64, error) {
+	return store.getAccountDailyTotal(ctx, accountUUID, "total_points")
+}
+
+// getAccountDailyCost sums total_cost from upstream hourly aggregates in the current daily window
+func (store *OAuthStore) getAccountDailyCost(ctx context.Context, accountUUID string) (float64, error) {
+	return store.getAccountDailyTotal(ctx, accountUUID, "total_cost")
+}
+
+// getAccountDailyTotal sums field from upstream hourly aggregates in the current daily window.
+// Totals are cached per window, so a new window starts from a fresh read.
+func (store *OAuthStore) getAccountDailyTotal(ctx context.Context, accountUUID string, field string) (float64, error) {
+	window := timewindow.CurrentDailyReset()
+	cacheKey := fmt.Sprintf("%s/%s/%d", accountUUID, field, window.Start.Unix())
+	if total, exists := store.accountUsageCache.Get(cacheKey); exists {
+		return total, nil
+	}
+
+	docs, err := store.db.Client().Collection("upstream_account_hourly_aggregates").
+		Where("upstream_account_uuid", "==", accountUUID).
+		Where("hour", ">=", window.Start).
+		Where("hour", "<", window.End).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return 0, fmt.Errorf("failed to query upstream hourly aggregates: %w", err)
+	}
+
+	var total float64
+	for _, doc := range docs {
+		value, _ := database.Number(doc.Data()[field])
+		total += value
+	}
+	store.accountUsageCache.Add(cacheKey, total)
+	return total, nil
+}
+
+// filterOverPointsCapCredentials applies configured points caps, failing open if usage can't be read
+func (store *OAuthStore) filterOverPointsCapCredentials(ctx context.Context, credentials []*OAuthCredentials) []*OAuthCredentials {
+	limits, err := store.getAccountPointsLimits(ctx)
+	if err != nil {
+		log.Printf("[OAUTH] Skipping points cap filter: %v", err)
+		return credentials
+	}
+	if len(limits) == 0 {
+		return credentials
+	}
+
+	usage := make(map[string]float64)
+	for _, cred := range credentials {
+		if _, capped := limits[cred.AccountUUID]; !capped {
+			continue
+		}
+		points, err := store.getAccountDailyPoints(ctx, cred.AccountUUID)
+		if err != nil {
+			log.Printf("[OAUTH] Failed to read daily points for account %s: %v", cred.AccountUUID, err)
+			continue
+		}
+		usage[cred.AccountUUID] = points
+	}
+
+	return filterOutOverPointsCap(credentials, limits, usage)
+}
+
+// filterOverCostCapCredentials applies configured cost caps, so accounts near their quota stop being
+// picked before they start returning 429s. Fails open if usage can't be read.
+func (store *OAuthStore) filterOverCostCapCredentials(ctx context.Context, credentials []*OAuthCredentials) []*OAuthCredentials {
+	limits, err := store.getAccountCostLimits(ctx)
+	if err != nil {
+		log.Printf("[OAUTH] Skipping cost cap filter: %v", err)
+		return credentials
+	}
+	if len(limits) == 0 {
+		return credentials
+	}
+
+	usage := make(map[string]float64)
+	for _, cred := range credentials {
+		if _, capped := limits[cred.AccountUUID]; !capped {
+			continue
+		}
+		cost, err := store.getAccountDailyCost(ctx, cred.AccountUUID)
+		if err != nil {
+			log.Printf("[OAUTH] Failed to read daily cost for account %s: %v", cred.AccountUUID, err)
+			continue
+		}
+		usage[cred.AccountUUID] = cost
+	}
+
+	return filterOutOverCostCap(credentials, limits, usage)
+}
+
+// filterOutOverPointsCap removes accounts whose daily points usage has reached their configured cap
+func filterOutOverPointsCap(credentials []*OAuthCredentials, limits map[string]float64, usage map[string]float64) []*OAuthCredentials {
+	return filterOutOverCap(credentials, limits, usage, "daily points")
+}
+
+// filterOutOverCostCap removes accounts whose daily USD cost has reached their configured cap
+func filterOutOverCostCap(credentials []*OAuthCredentials, limits map[string]float64, usage map[string]float64) []*OAuthCredentials {
+	return filterOutOverCap(credentials, limits, usage, "daily cost (USD)")
+}
+
+// filterOutOverCap removes accounts whose known usage has reached their cap; unit names the usage in logs
+func filterOutOverCap(credentials []*OAuthCredentials, limits map[string]float64, usage map[string]float64, unit string) []*OAuthCredentials {
+	var available []*OAuthCredentials
+	for _, cred := range credentials {
+		limit, capped := limits[cred.AccountUUID]
+		used, known := usage[cred.AccountUUID]
+		if capped && known && used >= limit {
+			log.Printf("[OAUTH] Account %s excluded: %.2f %s used of %.2f cap",
+				cred.AccountUUID, used, unit, limit)
+			continue
+		}
+		available = append(available, cred)
+	}
+	return available
+}
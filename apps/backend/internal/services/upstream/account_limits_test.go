@@ -0,0 +1,59 @@
+package upstream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"simple-relay/shared/timewindow"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+)
+
+func TestAccountCaps_CachedUntilTTL(t *testing.T) {
+	store, _ := newEmulatorStore(t)
+	store.accountLimitsCache = expirable.NewLRU[string, map[string]float64](accountLimitsCacheSize, nil, 100*time.Millisecond)
+	store.accountUsageCache = expirable.NewLRU[string, float64](accountUsageCacheSize, nil, 100*time.Millisecond)
+	ctx := context.Background()
+	client := store.db.Client()
+
+	limitRef := client.Collection("upstream_account_cost_limits").Doc("account-cached")
+	usageRef := client.Collection("upstream_account_hourly_aggregates").Doc("account-cached_cache-test")
+	t.Cleanup(func() {
+		limitRef.Delete(ctx)
+		usageRef.Delete(ctx)
+	})
+	if _, err := limitRef.Set(ctx, AccountCostLimit{AccountUUID: "account-cached", CostLimit: 10}); err != nil {
+		t.Fatalf("failed to seed cost limit: %v", err)
+	}
+	hour := timewindow.CurrentDailyReset().Start
+	if _, err := usageRef.Set(ctx, map[string]any{"upstream_account_uuid": "account-cached", "hour": hour, "total_cost": 4.0}); err != nil {
+		t.Fatalf("failed to seed usage: %v", err)
+	}
+
+	limits, err := store.getAccountCostLimits(ctx)
+	if err != nil || limits["account-cached"] != 10 {
+		t.Fatalf("expected a cost limit of 10, got %v (err %v)", limits["account-cached"], err)
+	}
+	if cost, err := store.getAccountDailyCost(ctx, "account-cached"); err != nil || cost != 4 {
+		t.Fatalf("expected a daily cost of 4, got %v (err %v)", cost, err)
+	}
+
+	// Changes within the TTL are not read back
+	limitRef.Set(ctx, AccountCostLimit{AccountUUID: "account-cached", CostLimit: 20})
+	usageRef.Set(ctx, map[string]any{"upstream_account_uuid": "account-cached", "hour": hour, "total_cost": 12.0})
+	if limits, _ := store.getAccountCostLimits(ctx); limits["account-cached"] != 10 {
+		t.Errorf("expected the cached cost limit, got %v", limits["account-cached"])
+	}
+	if cost, _ := store.getAccountDailyCost(ctx, "account-cached"); cost != 4 {
+		t.Errorf("expected the cached daily cost, got %v", cost)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if limits, _ := store.getAccountCostLimits(ctx); limits["account-cached"] != 20 {
+		t.Errorf("expected the cost limit to be re-read after the TTL, got %v", limits["account-cached"])
+	}
+	if cost, _ := store.getAccountDailyCost(ctx, "account-cached"); cost != 12 {
+		t.Errorf("expected the daily cost to be re-read after the TTL, got %v", cost)
+	}
+}
@@ -0,0 +1,135 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// EvictAccountBindings drops every cached user binding that points at accountUUID and remembers the
+// account as disabled, so bindings to it read from Firestore are migrated to another account instead
+// of being reused. Returns the number of cached bindings evicted.
+func (store *OAuthStore) EvictAccountBindings(accountUUID string) int {
+	store.disabledMu.Lock()
+	store.disabledAccounts[accountUUID] = true
+	store.disabledMu.Unlock()
+
+	return store.evictCachedBindings(map[string]bool{accountUUID: true})
+}
+
+// ClearAccountBindings removes every user binding to accountUUID from Firestore and the cache, so those
+// users are assigned an account afresh on their next request. Unlike EvictAccountBindings the account
+// stays usable, e.g. after an admin moved its users elsewhere. Returns the users whose binding was cleared.
+func (store *OAuthStore) ClearAccountBindings(accountUUID string) ([]string, error) {
+	ctx := context.Background()
+	cleared := make(map[string]bool)
+
+	// Stored bindings go first, so a request arriving meanwhile can't re-cache one about to be deleted
+	docs, err := store.db.Client().Collection("user_token_bindings").Where("account_uuid", "==", accountUUID).Documents(ctx).GetAll()
+	if err == nil {
+		for _, doc := range docs {
+			if _, err = doc.Ref.Delete(ctx); err != nil {
+				break
+			}
+			cleared[doc.Ref.ID] = true
+		}
+	}
+
+	for _, userID := range store.userTokenCache.Keys() {
+		if binding, exists := store.userTokenCache.Peek(userID); exists && binding.AccountUUID == accountUUID {
+			store.userTokenCache.Remove(userID)
+			cleared[userID] = true
+		}
+	}
+
+	users := make([]string, 0, len(cleared))
+	for userID := range cleared {
+		users = append(users, userID)
+	}
+	sort.Strings(users)
+	if err != nil {
+		return users, fmt.Errorf("failed to clear bindings to account %s: %w", accountUUID, err)
+	}
+	log.Printf("Cleared %d token bindings to account %s", len(users), accountUUID)
+	return users, nil
+}
+
+// evictCachedBindings removes cached bindings whose account is in accounts
+func (store *OAuthStore) evictCachedBindings(accounts map[string]bool) int {
+	evicted := 0
+	for _, userID := range store.userTokenCache.Keys() {
+		binding, exists := store.userTokenCache.Peek(userID)
+		if exists && accounts[binding.AccountUUID] {
+			store.userTokenCache.Remove(userID)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// isAccountDisabled reports whether accountUUID is known to be disabled
+func (store *OAuthStore) isAccountDisabled(accountUUID string) bool {
+	store.disabledMu.RLock()
+	defer store.disabledMu.RUnlock()
+	return store.disabledAccounts[accountUUID]
+}
+
+// setDisabledAccounts replaces the known disabled accounts and evicts cached bindings of the newly
+// disabled ones. Accounts missing from the list were re-enabled and become usable again.
+func (store *OAuthStore) setDisabledAccounts(accountUUIDs []string) int {
+	disabled := make(map[string]bool, len(accountUUIDs))
+	newlyDisabled := make(map[string]bool)
+
+	store.disabledMu.Lock()
+	for _, accountUUID := range accountUUIDs {
+		disabled[accountUUID] = true
+		if !store.disabledAccounts[accountUUID] {
+			newlyDisabled[accountUUID] = true
+		}
+	}
+	store.disabledAccounts = disabled
+	store.disabledMu.Unlock()
+
+	if len(newlyDisabled) == 0 {
+		return 0
+	}
+	return store.evictCachedBindings(newlyDisabled)
+}
+
+// RefreshDisabledAccounts reads the disabled flag of every account from Firestore, picking up
+// accounts disabled by other instances
+func (store *OAuthStore) RefreshDisabledAccounts(ctx context.Context) error {
+	docs, err := store.db.Client().Collection("oauth_tokens").Where("disabled", "==", true).Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to query disabled accounts: %w", err)
+	}
+
+	accountUUIDs := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		accountUUIDs = append(accountUUIDs, doc.Ref.ID)
+	}
+	if evicted := store.setDisabledAccounts(accountUUIDs); evicted > 0 {
+		log.Printf("[OAUTH] Evicted %d cached bindings to accounts disabled elsewhere", evicted)
+	}
+	return nil
+}
+
+// WatchDisabledAccounts polls for disabled accounts on every interval until ctx is done
+func (store *OAuthStore) WatchDisabledAccounts(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := store.RefreshDisabledAccounts(ctx); err != nil {
+			log.Printf("[OAUTH] Failed to refresh disabled accounts: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package upstream
+
+import (
+	"testing"
+	"time"
+)
+
+func cacheTestBindings(store *OAuthStore, bindings map[string]string) {
+	for userID, accountUUID := range bindings {
+		store.userTokenCache.Add(userID, &UserTokenBinding{
+			UserID:      userID,
+			AccountUUID: accountUUID,
+			AccessToken: "token-" + accountUUID,
+			ExpiresAt:   time.Now().Add(time.Hour),
+		})
+	}
+}
+
+func TestEvictAccountBindings_DropsOnlyBindingsOfDisabledAccount(t *testing.T) {
+	store := NewOAuthStore(nil)
+	cacheTestBindings(store, map[string]string{
+		"user-1": "account-a",
+		"user-2": "account-a",
+		"user-3": "account-b",
+	})
+
+	if evicted := store.EvictAccountBindings("account-a"); evicted != 2 {
+		t.Errorf("expected 2 evicted bindings, got %d", evicted)
+	}
+	for _, userID := range []string{"user-1", "user-2"} {
+		if _, exists := store.userTokenCache.Peek(userID); exists {
+			t.Errorf("expected %s's binding to the disabled account to be evicted", userID)
+		}
+	}
+	if _, exists := store.userTokenCache.Peek("user-3"); !exists {
+		t.Errorf("expected binding to another account to stay cached")
+	}
+	if !store.isAccountDisabled("account-a") || store.isAccountDisabled("account-b") {
+		t.Errorf("expected only account-a to be remembered as disabled")
+	}
+}
+
+func TestSetDisabledAccounts_EvictsNewlyDisabledAndForgetsReenabled(t *testing.T) {
+	store := NewOAuthStore(nil)
+	store.EvictAccountBindings("account-a")
+	cacheTestBindings(store, map[string]string{
+		"user-1": "account-a", // cached by a request racing the disable
+		"user-2": "account-b",
+		"user-3": "account-c",
+	})
+
+	// Another instance disabled account-b and re-enabled account-a
+	if evicted := store.setDisabledAccounts([]string{"account-b"}); evicted != 1 {
+		t.Errorf("expected only the newly disabled account's binding to be evicted, got %d", evicted)
+	}
+	if _, exists := store.userTokenCache.Peek("user-2"); exists {
+		t.Errorf("expected binding to account-b to be evicted")
+	}
+	if _, exists := store.userTokenCache.Peek("user-3"); !exists {
+		t.Errorf("expected binding to account-c to stay cached")
+	}
+	if store.isAccountDisabled("account-a") || !store.isAccountDisabled("account-b") {
+		t.Errorf("expected account-a re-enabled and account-b disabled")
+	}
+
+	// Polling again with no changes evicts nothing
+	cacheTestBindings(store, map[string]string{"user-4": "account-c"})
+	if evicted := store.setDisabledAccounts([]string{"account-b"}); evicted != 0 {
+		t.Errorf("expected no evictions for an unchanged disabled set, got %d", evicted)
+	}
+}
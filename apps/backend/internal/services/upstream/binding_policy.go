@@ -0,0 +1,77 @@
+package upstream
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+)
+
+// DefaultBindingTTL is how long an instance reuses a cached user binding before re-checking it in Firestore
+const DefaultBindingTTL = 24 * time.Hour
+
+// userTokenCacheSize is the maximum number of cached user bindings
+const userTokenCacheSize = 10000
+
+// SetBindingTTL sets how long a cached user binding is reused before it is re-checked in Firestore,
+// where bindings to rate-limited or capped accounts are moved to a fresh account. Shorter TTLs move
+// users off accounts rate limited by other instances sooner. Call before serving requests: the cache
+// is replaced.
+func (store *OAuthStore) SetBindingTTL(ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = DefaultBindingTTL
+	}
+	store.userTokenCache = expirable.NewLRU[string, *UserTokenBinding](userTokenCacheSize, nil, ttl)
+}
+
+// boundAccountUnavailable returns why a user should be moved off their bound account: it is disabled,
+// rate limited or over its daily points or cost cap. Returns "" when the account is usable or its state
+// can't be read, so a Firestore hiccup doesn't move every user.
+func (store *OAuthStore) boundAccountUnavailable(ctx context.Context, accountUUID string, now time.Time) string {
+	doc, err := store.db.Client().Collection("oauth_tokens").Doc(accountUUID).Get(ctx)
+	if err != nil {
+		log.Printf("[OAUTH] Failed to read bound account %s, keeping binding: %v", accountUUID, err)
+		return ""
+	}
+	var cred OAuthCredentials
+	if err := doc.DataTo(&cred); err != nil {
+		log.Printf("[OAUTH] Failed to parse bound account %s, keeping binding: %v", accountUUID, err)
+		return ""
+	}
+	if cred.Disabled {
+		return "disabled"
+	}
+	if cred.IsRateLimited(now) {
+		return "rate limited"
+	}
+	if store.boundAccountOverCap(ctx, accountUUID, "points", store.getAccountPointsLimits, store.getAccountDailyPoints) {
+		return "over its daily points cap"
+	}
+	if store.boundAccountOverCap(ctx, accountUUID, "cost", store.getAccountCostLimits, store.getAccountDailyCost) {
+		return "over its daily cost cap"
+	}
+	return ""
+}
+
+// boundAccountOverCap reports whether accountUUID's daily usage has reached its cap, read with limits and
+// usage; unit names the cap in logs. Accounts without a cap, or whose cap or usage can't be read, are not over.
+func (store *OAuthStore) boundAccountOverCap(ctx context.Context, accountUUID string, unit string,
+	limits func(context.Context) (map[string]float64, error),
+	usage func(context.Context, string) (float64, error)) bool {
+	caps, err := limits(ctx)
+	if err != nil {
+		log.Printf("[OAUTH] Skipping %s cap check of bound account %s: %v", unit, accountUUID, err)
+		return false
+	}
+	limit, capped := caps[accountUUID]
+	if !capped {
+		return false
+	}
+	used, err := usage(ctx, accountUUID)
+	if err != nil {
+		log.Printf("[OAUTH] Failed to read daily %s of bound account %s: %v", unit, accountUUID, err)
+		return false
+	}
+	return used >= limit
+}
@@ -0,0 +1,124 @@
+package upstream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"simple-relay/shared/timewindow"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+)
+
+// bindUser clears any stored binding of userID and binds it afresh
+func bindUser(t *testing.T, store *OAuthStore, userID string) *UserTokenBinding {
+	t.Helper()
+	if err := store.ClearUserTokenBinding(userID); err != nil {
+		t.Fatalf("failed to clear binding of %s: %v", userID, err)
+	}
+	binding, err := store.GetValidTokenForUser(userID)
+	if err != nil {
+		t.Fatalf("failed to bind %s: %v", userID, err)
+	}
+	return binding
+}
+
+func TestGetValidTokenForUser_RebindsWhenBoundAccountIsRateLimited(t *testing.T) {
+	store, tokens := newEmulatorStore(t)
+	valid := time.Now().Add(time.Hour)
+	seedCredentials(t, tokens,
+		&OAuthCredentials{AccountUUID: "account-a", AccessToken: "token-a", ExpiresAt: valid},
+		&OAuthCredentials{AccountUUID: "account-b", AccessToken: "token-b", ExpiresAt: valid},
+	)
+	bound := bindUser(t, store, "user-rate-limited")
+
+	// The 429 is seen by this instance; the cached binding must not be reused
+	if err := store.SaveRateLimitHeadersByToken(bound.AccessToken, map[string]string{"retry-after": "60"}); err != nil {
+		t.Fatalf("failed to save rate limit headers: %v", err)
+	}
+	rebound, err := store.GetValidTokenForUser("user-rate-limited")
+	if err != nil {
+		t.Fatalf("GetValidTokenForUser returned error: %v", err)
+	}
+	if rebound.AccountUUID == bound.AccountUUID {
+		t.Errorf("expected the user to leave rate-limited account %s", bound.AccountUUID)
+	}
+}
+
+func TestGetValidTokenForUser_RebindsAfterTTLWhenAnotherInstanceSawTheRateLimit(t *testing.T) {
+	store, tokens := newEmulatorStore(t)
+	store.SetBindingTTL(50 * time.Millisecond)
+	valid := time.Now().Add(time.Hour)
+	seedCredentials(t, tokens,
+		&OAuthCredentials{AccountUUID: "account-a", AccessToken: "token-a", ExpiresAt: valid},
+		&OAuthCredentials{AccountUUID: "account-b", AccessToken: "token-b", ExpiresAt: valid},
+	)
+	bound := bindUser(t, store, "user-elsewhere")
+
+	other := NewOAuthStore(store.db)
+	if err := other.SaveRateLimitHeadersByToken(bound.AccessToken, map[string]string{"retry-after": "60"}); err != nil {
+		t.Fatalf("failed to save rate limit headers: %v", err)
+	}
+
+	// Until the TTL passes this instance still trusts its cached binding
+	if cached, err := store.GetValidTokenForUser("user-elsewhere"); err != nil || cached.AccountUUID != bound.AccountUUID {
+		t.Fatalf("expected the cached binding before the TTL, got %+v (err %v)", cached, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	rebound, err := store.GetValidTokenForUser("user-elsewhere")
+	if err != nil {
+		t.Fatalf("GetValidTokenForUser returned error: %v", err)
+	}
+	if rebound.AccountUUID == bound.AccountUUID {
+		t.Errorf("expected the user to leave rate-limited account %s once the binding TTL passed", bound.AccountUUID)
+	}
+
+	stored, err := store.GetUserTokenBinding("user-elsewhere")
+	if err != nil {
+		t.Fatalf("failed to read stored binding: %v", err)
+	}
+	if stored.AccountUUID != rebound.AccountUUID {
+		t.Errorf("expected the new binding to be stored, got account %s", stored.AccountUUID)
+	}
+}
+
+func TestGetValidTokenForUser_RebindsWhenBoundAccountIsOverPointsCap(t *testing.T) {
+	store, tokens := newEmulatorStore(t)
+	ctx := context.Background()
+	client := store.db.Client()
+	valid := time.Now().Add(time.Hour)
+	seedCredentials(t, tokens,
+		&OAuthCredentials{AccountUUID: "account-a", AccessToken: "token-a", ExpiresAt: valid},
+		&OAuthCredentials{AccountUUID: "account-b", AccessToken: "token-b", ExpiresAt: valid},
+	)
+	bound := bindUser(t, store, "user-points-capped")
+
+	// The bound account reaches its points cap after the user was bound
+	limitRef := client.Collection("upstream_account_points_limits").Doc(bound.AccountUUID)
+	usageRef := client.Collection("upstream_account_hourly_aggregates").Doc(bound.AccountUUID + "_points-cap-test")
+	t.Cleanup(func() {
+		limitRef.Delete(ctx)
+		usageRef.Delete(ctx)
+	})
+	if _, err := limitRef.Set(ctx, AccountPointsLimit{AccountUUID: bound.AccountUUID, PointsLimit: 100}); err != nil {
+		t.Fatalf("failed to seed points limit: %v", err)
+	}
+	hour := timewindow.CurrentDailyReset().Start
+	if _, err := usageRef.Set(ctx, map[string]any{"upstream_account_uuid": bound.AccountUUID, "hour": hour, "total_points": 150}); err != nil {
+		t.Fatalf("failed to seed usage: %v", err)
+	}
+
+	// Drop what this instance cached at bind time so the binding and caps are read from Firestore
+	store.accountLimitsCache = expirable.NewLRU[string, map[string]float64](accountLimitsCacheSize, nil, accountCapCacheTTL)
+	store.accountUsageCache = expirable.NewLRU[string, float64](accountUsageCacheSize, nil, accountCapCacheTTL)
+	store.userTokenCache.Remove("user-points-capped")
+
+	rebound, err := store.GetValidTokenForUser("user-points-capped")
+	if err != nil {
+		t.Fatalf("GetValidTokenForUser returned error: %v", err)
+	}
+	if rebound.AccountUUID == bound.AccountUUID {
+		t.Errorf("expected the user to leave account %s once it reached its points cap", bound.AccountUUID)
+	}
+}
@@ -0,0 +1,56 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// DefaultExpirySafetyMargin is subtracted from expires_in so a token is refreshed before upstream
+// rejects it, absorbing small clock skew between this instance and Anthropic
+const DefaultExpirySafetyMargin = 5 * time.Minute
+
+// computeExpiresAt returns the expiry stored for a token issued at now with the given lifetime.
+// The margin never eats more than half of a short lifetime, so a fresh token is always usable.
+func computeExpiresAt(now time.Time, expiresInSeconds int, margin time.Duration) time.Time {
+	lifetime := time.Duration(expiresInSeconds) * time.Second
+	if margin > lifetime/2 {
+		margin = lifetime / 2
+	}
+	return now.Add(lifetime - margin)
+}
+
+// MeasureClockSkew compares local time against the Date header of a trusted HTTPS endpoint.
+// A positive result means the local clock is ahead. The Date header has one-second resolution,
+// so the result is only meaningful for skews of a few seconds or more.
+func MeasureClockSkew(ctx context.Context, client *http.Client, url string) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	sent := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to reach %s: %w", url, err)
+	}
+	resp.Body.Close()
+	received := time.Now()
+
+	// Assume the server stamped the response halfway through the round trip
+	local := sent.Add(received.Sub(sent) / 2)
+	return clockSkewFromDate(local, resp.Header.Get("Date"))
+}
+
+// clockSkewFromDate returns how far local is ahead of the time in an HTTP Date header
+func clockSkewFromDate(local time.Time, dateHeader string) (time.Duration, error) {
+	if dateHeader == "" {
+		return 0, fmt.Errorf("response has no Date header")
+	}
+	remote, err := http.ParseTime(dateHeader)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Date header %q: %w", dateHeader, err)
+	}
+	return local.Sub(remote), nil
+}
@@ -0,0 +1,87 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestComputeExpiresAt_SubtractsSafetyMargin(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	got := computeExpiresAt(now, 28800, DefaultExpirySafetyMargin)
+	want := now.Add(8*time.Hour - 5*time.Minute)
+	if !got.Equal(want) {
+		t.Errorf("expected expiry %s, got %s", want, got)
+	}
+
+	if got := computeExpiresAt(now, 28800, 0); !got.Equal(now.Add(8 * time.Hour)) {
+		t.Errorf("expected unreduced expiry without a margin, got %s", got)
+	}
+}
+
+func TestComputeExpiresAt_MarginCappedForShortLifetimes(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// A 4 minute token with a 5 minute margin would already be expired; half its lifetime is kept instead
+	got := computeExpiresAt(now, 240, DefaultExpirySafetyMargin)
+	if want := now.Add(2 * time.Minute); !got.Equal(want) {
+		t.Errorf("expected expiry %s, got %s", want, got)
+	}
+	if !got.After(now) {
+		t.Errorf("a freshly refreshed token must not be stored as expired")
+	}
+}
+
+func TestSetExpirySafetyMargin(t *testing.T) {
+	store := NewOAuthStore(nil)
+	if store.expiryMargin != DefaultExpirySafetyMargin {
+		t.Errorf("expected default margin %s, got %s", DefaultExpirySafetyMargin, store.expiryMargin)
+	}
+	store.SetExpirySafetyMargin(-time.Minute)
+	if store.expiryMargin != 0 {
+		t.Errorf("expected a negative margin to be clamped to 0, got %s", store.expiryMargin)
+	}
+}
+
+func TestClockSkewFromDate(t *testing.T) {
+	remote := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	header := remote.Format(http.TimeFormat)
+
+	skew, err := clockSkewFromDate(remote.Add(90*time.Second), header)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if skew != 90*time.Second {
+		t.Errorf("expected local clock 90s ahead, got %s", skew)
+	}
+
+	skew, _ = clockSkewFromDate(remote.Add(-time.Minute), header)
+	if skew != -time.Minute {
+		t.Errorf("expected local clock 1m behind, got %s", skew)
+	}
+
+	if _, err := clockSkewFromDate(remote, ""); err == nil {
+		t.Errorf("expected an error for a missing Date header")
+	}
+	if _, err := clockSkewFromDate(remote, "yesterday"); err == nil {
+		t.Errorf("expected an error for an invalid Date header")
+	}
+}
+
+func TestMeasureClockSkew(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(-10*time.Minute).UTC().Format(http.TimeFormat))
+	}))
+	defer server.Close()
+
+	skew, err := MeasureClockSkew(context.Background(), server.Client(), server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if skew < 9*time.Minute || skew > 11*time.Minute {
+		t.Errorf("expected roughly 10m of skew, got %s", skew)
+	}
+}
@@ -0,0 +1,82 @@
+package upstream
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+
+	"simple-relay/shared/database"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// leasesCollection holds one document per background job that only one instance may run at a time
+const leasesCollection = "leases"
+
+// leaseRecord is a lease document: the instance holding it and when its hold lapses
+type leaseRecord struct {
+	Holder    string    `firestore:"holder"`
+	ExpiresAt time.Time `firestore:"expires_at"`
+}
+
+// Lease elects one instance to run a background job. The holder renews it on every run; once it stops
+// renewing, e.g. because its instance crashed, another instance takes over after the lease expires.
+type Lease struct {
+	db     *database.Service
+	name   string
+	holder string
+	now    func() time.Time
+}
+
+// NewLease creates a lease on the named job held under a random ID of this instance
+func NewLease(db *database.Service, name string) *Lease {
+	return &Lease{db: db, name: name, holder: newLeaseHolder(), now: time.Now}
+}
+
+// Acquire takes or renews the lease for ttl and reports whether this instance holds it
+func (l *Lease) Acquire(ctx context.Context, ttl time.Duration) (bool, error) {
+	held := false
+	docRef := l.db.Client().Collection(leasesCollection).Doc(l.name)
+	err := l.db.Client().RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		held = false
+		var current leaseRecord
+		doc, err := tx.Get(docRef)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return fmt.Errorf("failed to read lease %s: %w", l.name, err)
+		}
+		if doc.Exists() {
+			if err := doc.DataTo(&current); err != nil {
+				return fmt.Errorf("failed to parse lease %s: %w", l.name, err)
+			}
+		}
+
+		now := l.now()
+		if !canTakeLease(current, l.holder, now) {
+			return nil
+		}
+		held = true
+		return tx.Set(docRef, leaseRecord{Holder: l.holder, ExpiresAt: now.Add(ttl)})
+	})
+	if err != nil {
+		return false, err
+	}
+	return held, nil
+}
+
+// canTakeLease reports whether holder may take or renew a lease in state current at now (pure function)
+func canTakeLease(current leaseRecord, holder string, now time.Time) bool {
+	return current.Holder == "" || current.Holder == holder || !now.Before(current.ExpiresAt)
+}
+
+// newLeaseHolder returns an ID unique to this instance, prefixed with the hostname for the logs
+func newLeaseHolder() string {
+	hostname, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return hostname + "-" + hex.EncodeToString(suffix)
+}
@@ -0,0 +1,54 @@
+package upstream
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCanTakeLease(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name    string
+		current leaseRecord
+		want    bool
+	}{
+		{"no lease yet", leaseRecord{}, true},
+		{"renewing own lease", leaseRecord{Holder: "me", ExpiresAt: now.Add(time.Minute)}, true},
+		{"held by another instance", leaseRecord{Holder: "other", ExpiresAt: now.Add(time.Minute)}, false},
+		{"expired lease of another instance", leaseRecord{Holder: "other", ExpiresAt: now.Add(-time.Second)}, true},
+	}
+	for _, tc := range cases {
+		if got := canTakeLease(tc.current, "me", now); got != tc.want {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestLease_OneHolderAtATime(t *testing.T) {
+	store, _ := newEmulatorStore(t)
+	ctx := context.Background()
+	store.db.Client().Collection(leasesCollection).Doc("test_job").Delete(ctx)
+
+	now := time.Now()
+	first := NewLease(store.db, "test_job")
+	second := NewLease(store.db, "test_job")
+	first.now = func() time.Time { return now }
+	second.now = func() time.Time { return now }
+
+	if held, err := first.Acquire(ctx, time.Minute); err != nil || !held {
+		t.Fatalf("expected the first instance to take the lease, got %v, err %v", held, err)
+	}
+	if held, err := second.Acquire(ctx, time.Minute); err != nil || held {
+		t.Fatalf("expected the second instance to be refused, got %v, err %v", held, err)
+	}
+	if held, err := first.Acquire(ctx, time.Minute); err != nil || !held {
+		t.Fatalf("expected the first instance to renew its lease, got %v, err %v", held, err)
+	}
+
+	// The first instance stops renewing
+	second.now = func() time.Time { return now.Add(2 * time.Minute) }
+	if held, err := second.Acquire(ctx, time.Minute); err != nil || !held {
+		t.Fatalf("expected the second instance to take over the expired lease, got %v, err %v", held, err)
+	}
+}
@@ -4,12 +4,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net/http"
 	"time"
 
+	"simple-relay/backend/internal/metrics"
+
 	"cloud.google.com/go/firestore"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -41,25 +45,126 @@ type OAuthRefreshResponse struct {
 	Account      Account      `json:"account"`
 }
 
+// ErrRefreshTokenRejected means the token endpoint refused the refresh token with a 400 or 401,
+// e.g. because it was revoked. Retrying won't help.
+var ErrRefreshTokenRejected = errors.New("refresh token rejected")
+
+// OAuthClient identifies the OAuth app whose refresh tokens are exchanged and where
+type OAuthClient struct {
+	TokenEndpoint string
+	ClientID      string
+}
+
+// DefaultOAuthClient is Claude Code's OAuth app
+var DefaultOAuthClient = OAuthClient{
+	TokenEndpoint: "https://console.anthropic.com/v1/oauth/token",
+	ClientID:      "9d1c250a-e61b-44d9-88ed-5944d1962f5e",
+}
+
 type OAuthRefresher struct {
-	oauthStore *OAuthStore
+	oauthStore    *OAuthStore
+	tokenEndpoint string
+	clientID      string
+	httpClient    *http.Client
+	maxAttempts   int           // attempts per refresh, including the first
+	retryDelay    time.Duration // backoff before the second attempt, doubled for each one after
 }
 
 func NewOAuthRefresher(oauthStore *OAuthStore) *OAuthRefresher {
 	return &OAuthRefresher{
-		oauthStore: oauthStore,
+		oauthStore:    oauthStore,
+		tokenEndpoint: oauthStore.oauthClient.TokenEndpoint,
+		clientID:      oauthStore.oauthClient.ClientID,
+		httpClient:    &http.Client{Timeout: 15 * time.Second},
+		maxAttempts:   3,
+		retryDelay:    500 * time.Millisecond,
 	}
 }
 
 func (or *OAuthRefresher) RefreshCredentials(credentials *OAuthCredentials) (*OAuthCredentials, error) {
+	return or.RefreshCredentialsWithin(credentials, 0)
+}
+
+// refreshLockDecision is what a refresher does after reading an account's refresh lock
+type refreshLockDecision int
+
+const (
+	refreshNotNeeded  refreshLockDecision = iota // Token is valid beyond the lookahead
+	refreshInProgress                            // Another worker holds a live lock; wait for it
+	refreshAcquire                               // No lock; take it and refresh
+	refreshTakeOver                              // Lock is older than the timeout and treated as abandoned
+)
+
+// decideRefreshLock decides how to proceed with creds at now (pure function). A lock is only
+// meaningful while the token still needs a refresh: a successful refresh leaves its start time behind.
+func decideRefreshLock(creds *OAuthCredentials, now time.Time, lookahead, lockTimeout time.Duration) refreshLockDecision {
+	if now.Add(lookahead).Before(creds.ExpiresAt) {
+		return refreshNotNeeded
+	}
+	if creds.RefreshStartedAt.IsZero() {
+		return refreshAcquire
+	}
+	if now.Sub(creds.RefreshStartedAt) < lockTimeout {
+		return refreshInProgress
+	}
+	return refreshTakeOver
+}
+
+// RefreshCredentialsWithin refreshes credentials that expire within lookahead. Credentials another
+// process already refreshed past the lookahead are returned as stored; while another process holds
+// the refresh lock this waits for it, taking the lock over once it is older than the lock timeout.
+func (or *OAuthRefresher) RefreshCredentialsWithin(credentials *OAuthCredentials, lookahead time.Duration) (*OAuthCredentials, error) {
 	log.Printf("[OAUTH] RefreshCredentials called for account: %s", credentials.AccountUUID)
 	ctx := context.Background()
 
-	var refreshedCredentials *OAuthCredentials
+	for {
+		currentCreds, decision, err := or.acquireRefreshLock(ctx, credentials.AccountUUID, lookahead)
+		if err != nil {
+			return nil, err
+		}
+		switch decision {
+		case refreshNotNeeded:
+			log.Printf("[OAUTH] Credentials for account %s were already refreshed by another process (expires=%s)",
+				credentials.AccountUUID, currentCreds.ExpiresAt.Format(time.RFC3339))
+			return currentCreds, nil
+		case refreshInProgress:
+			log.Printf("[OAUTH] Refresh of account %s in progress since %s, waiting",
+				credentials.AccountUUID, currentCreds.RefreshStartedAt.Format(time.RFC3339))
+			time.Sleep(refreshLockPollInterval)
+			continue
+		}
+
+		refreshedCredentials, err := or.refreshLocked(ctx, currentCreds)
+		metrics.RecordOAuthRefresh(err)
+		if err != nil {
+			if errors.Is(err, ErrRefreshTokenRejected) {
+				or.quarantine(ctx, currentCreds, err)
+			}
+			or.releaseRefreshLock(ctx, currentCreds)
+			return nil, err
+		}
+		return refreshedCredentials, nil
+	}
+}
+
+const (
+	// DefaultRefreshLockTimeout is how long a refresh lock is honored; it outlasts three 15s refresh
+	// attempts and the backoff between them
+	DefaultRefreshLockTimeout = 60 * time.Second
+	// refreshLockPollInterval is how often a worker waiting on another's refresh re-reads the account
+	refreshLockPollInterval = time.Second
+)
+
+// acquireRefreshLock reads the account and, when it needs a refresh and no live lock is held, commits
+// a refresh_started_at lock so other workers wait instead of refreshing concurrently. The returned
+// credentials carry the lock's start time when it was acquired.
+func (or *OAuthRefresher) acquireRefreshLock(ctx context.Context, accountUUID string, lookahead time.Duration) (*OAuthCredentials, refreshLockDecision, error) {
+	var currentCreds OAuthCredentials
+	var decision refreshLockDecision
 	err := or.oauthStore.db.Client().RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
 		// Read current credentials
-		docRef := or.oauthStore.db.Client().Collection("oauth_tokens").Doc(credentials.AccountUUID)
-		log.Printf("[OAUTH] Looking for oauth_tokens document with ID: %s", credentials.AccountUUID)
+		docRef := or.oauthStore.db.Client().Collection("oauth_tokens").Doc(accountUUID)
+		log.Printf("[OAUTH] Looking for oauth_tokens document with ID: %s", accountUUID)
 		doc, err := tx.Get(docRef)
 		if err != nil && status.Code(err) != codes.NotFound {
 			log.Printf("[OAUTH] Error reading credentials document: %v", err)
@@ -67,117 +172,197 @@ func (or *OAuthRefresher) RefreshCredentials(credentials *OAuthCredentials) (*OA
 		}
 
 		if !doc.Exists() {
-			log.Printf("[OAUTH] ERROR: Credentials document not found for account UUID: %s", credentials.AccountUUID)
+			log.Printf("[OAUTH] ERROR: Credentials document not found for account UUID: %s", accountUUID)
 			return fmt.Errorf("credentials document not found")
 		}
-		log.Printf("[OAUTH] Found credentials document for account %s", credentials.AccountUUID)
 
-		var currentCreds OAuthCredentials
 		if err := doc.DataTo(&currentCreds); err != nil {
 			return fmt.Errorf("failed to parse current credentials: %w", err)
 		}
 
 		now := time.Now()
-
-		// Check if credentials are not expired anymore
-		if now.Before(currentCreds.ExpiresAt) {
-			log.Printf("[OAUTH] Credentials for account %s were already refreshed by another process (expires=%s)", 
-				credentials.AccountUUID, currentCreds.ExpiresAt.Format(time.RFC3339))
-			refreshedCredentials = &currentCreds
+		decision = decideRefreshLock(&currentCreds, now, lookahead, or.oauthStore.refreshLockTimeout)
+		switch decision {
+		case refreshNotNeeded, refreshInProgress:
 			return nil
+		case refreshTakeOver:
+			log.Printf("[OAUTH] Refresh lock of account %s taken at %s looks abandoned, taking it over",
+				accountUUID, currentCreds.RefreshStartedAt.Format(time.RFC3339))
 		}
-		log.Printf("[OAUTH] Credentials need refresh: expires=%s, now=%s", 
+		log.Printf("[OAUTH] Credentials need refresh: expires=%s, now=%s",
 			currentCreds.ExpiresAt.Format(time.RFC3339), now.Format(time.RFC3339))
 
 		// Write to acquire lock
-		refreshStartedAt := now
-		currentCreds.RefreshStartedAt = refreshStartedAt
+		currentCreds.RefreshStartedAt = now
+		return tx.Update(docRef, []firestore.Update{{Path: "refresh_started_at", Value: now}})
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return &currentCreds, decision, nil
+}
 
-		err = tx.Set(docRef, currentCreds)
+// releaseRefreshLock clears a lock after a failed refresh so the next worker retries immediately.
+// The lock is left alone if another worker has taken it over meanwhile.
+func (or *OAuthRefresher) releaseRefreshLock(ctx context.Context, lockedCreds *OAuthCredentials) {
+	client := or.oauthStore.db.Client()
+	docRef := client.Collection("oauth_tokens").Doc(lockedCreds.AccountUUID)
+	err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(docRef)
 		if err != nil {
-			return fmt.Errorf("failed to acquire refresh lock: %w", err)
+			return err
+		}
+		var current OAuthCredentials
+		if err := doc.DataTo(&current); err != nil {
+			return err
 		}
+		if !current.RefreshStartedAt.Equal(lockedCreds.RefreshStartedAt) {
+			return nil
+		}
+		return tx.Update(docRef, []firestore.Update{{Path: "refresh_started_at", Value: time.Time{}}})
+	})
+	if err != nil {
+		log.Printf("[OAUTH] Failed to release refresh lock of account %s: %v", lockedCreds.AccountUUID, err)
+	}
+}
 
-		log.Printf("[OAUTH] Starting OAuth refresh for account %s", credentials.AccountUUID)
+// quarantine disables an account whose refresh token was rejected, so requests stop picking an
+// account that can never be refreshed until someone re-authorizes it
+func (or *OAuthRefresher) quarantine(ctx context.Context, creds *OAuthCredentials, refreshErr error) {
+	log.Printf("[OAUTH] ALERT: refresh token of account %s (%s) was rejected, disabling the account until it is re-authorized: %v",
+		creds.AccountUUID, creds.AccountEmail, refreshErr)
+	if err := or.oauthStore.DisableAccount(ctx, creds.AccountUUID, "refresh token rejected"); err != nil {
+		log.Printf("[OAUTH] Failed to disable account %s after its refresh token was rejected: %v", creds.AccountUUID, err)
+	}
+}
 
-		// HTTP request within transaction
-		reqData := OAuthRefreshRequest{
-			GrantType:    "refresh_token",
-			RefreshToken: credentials.RefreshToken,
-			ClientID:     "9d1c250a-e61b-44d9-88ed-5944d1962f5e", // Claude Code's OAuth client ID
-		}
+// refreshLocked exchanges the stored refresh token while holding the account's refresh lock and
+// saves the new credentials
+func (or *OAuthRefresher) refreshLocked(ctx context.Context, currentCreds *OAuthCredentials) (*OAuthCredentials, error) {
+	log.Printf("[OAUTH] Starting OAuth refresh for account %s", currentCreds.AccountUUID)
 
-		jsonData, err := json.Marshal(reqData)
-		if err != nil {
-			return fmt.Errorf("failed to marshal request: %w", err)
-		}
+	refreshResp, err := or.exchangeRefreshToken(ctx, currentCreds.RefreshToken)
+	if err != nil {
+		return nil, err
+	}
 
-		req, err := http.NewRequest("POST", "https://console.anthropic.com/v1/oauth/token", bytes.NewBuffer(jsonData))
-		if err != nil {
-			return fmt.Errorf("failed to create request: %w", err)
-		}
+	// Write updated credentials
+	now := time.Now()
+	expiresAt := computeExpiresAt(now, refreshResp.ExpiresIn, or.oauthStore.expiryMargin)
+
+	// Only the fields the refresh response carries are written, so a disabled flag, saved 429 headers
+	// or last use recorded by another process meanwhile are kept
+	newCredentials := *currentCreds
+	newCredentials.AccessToken = refreshResp.AccessToken
+	newCredentials.RefreshToken = refreshResp.RefreshToken
+	newCredentials.ExpiresAt = expiresAt
+	newCredentials.Scope = refreshResp.Scope
+	newCredentials.OrganizationUUID = refreshResp.Organization.UUID
+	newCredentials.OrganizationName = refreshResp.Organization.Name
+	newCredentials.AccountEmail = refreshResp.Account.EmailAddress
+	newCredentials.UpdatedAt = now
+
+	docRef := or.oauthStore.db.Client().Collection("oauth_tokens").Doc(currentCreds.AccountUUID)
+	_, err = docRef.Update(ctx, []firestore.Update{
+		{Path: "access_token", Value: newCredentials.AccessToken},
+		{Path: "refresh_token", Value: newCredentials.RefreshToken},
+		{Path: "expires_at", Value: newCredentials.ExpiresAt},
+		{Path: "scope", Value: newCredentials.Scope},
+		{Path: "organization_uuid", Value: newCredentials.OrganizationUUID},
+		{Path: "organization_name", Value: newCredentials.OrganizationName},
+		{Path: "account_email", Value: newCredentials.AccountEmail},
+		{Path: "updated_at", Value: newCredentials.UpdatedAt},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to save refreshed credentials: %w", err)
+	}
 
-		req.Header.Set("Accept", "application/json, text/plain, */*")
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("User-Agent", "axios/1.8.4")
-		req.Header.Set("Connection", "close")
+	log.Printf("[OAUTH] Successfully refreshed credentials for account %s, new expiry: %s",
+		refreshResp.Account.UUID, expiresAt.Format(time.RFC3339))
+	return &newCredentials, nil
+}
 
-		client := &http.Client{Timeout: 30 * time.Second}
-		resp, err := client.Do(req)
-		if err != nil {
-			return fmt.Errorf("failed to execute request: %w", err)
+// exchangeRefreshToken posts refreshToken to the token endpoint, retrying network errors and 5xx
+// responses with exponential backoff and jitter. A 4xx means the refresh token itself was rejected,
+// so it is returned right away.
+func (or *OAuthRefresher) exchangeRefreshToken(ctx context.Context, refreshToken string) (*OAuthRefreshResponse, error) {
+	var lastErr error
+	for attempt := 1; attempt <= or.maxAttempts; attempt++ {
+		refreshResp, retryable, err := or.postRefreshRequest(ctx, refreshToken)
+		if err == nil {
+			return refreshResp, nil
 		}
-
-		respBody, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return fmt.Errorf("failed to read response body: %w", err)
+		lastErr = err
+		if !retryable || attempt == or.maxAttempts {
+			break
 		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			log.Printf("[OAUTH] OAuth refresh failed with status %d, response: %s", resp.StatusCode, string(respBody))
-			return fmt.Errorf("credentials refresh failed with status: %d", resp.StatusCode)
+		delay := refreshBackoff(or.retryDelay, attempt)
+		log.Printf("[OAUTH] Refresh attempt %d/%d failed, retrying in %s: %v", attempt, or.maxAttempts, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
-		log.Printf("[OAUTH] OAuth refresh API returned status 200")
+	}
+	return nil, lastErr
+}
 
-		var refreshResp OAuthRefreshResponse
-		if err := json.Unmarshal(respBody, &refreshResp); err != nil {
-			return fmt.Errorf("failed to decode response: %w", err)
-		}
+// refreshBackoff returns the delay after the given failed attempt: base doubled per attempt, with
+// the upper half randomized so workers that failed together don't retry together
+func refreshBackoff(base time.Duration, attempt int) time.Duration {
+	delay := base << (attempt - 1)
+	if delay <= 1 {
+		return delay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
 
-		// Write updated credentials
-		now = time.Now()
-		expiresAt := now.Add(time.Duration(refreshResp.ExpiresIn) * time.Second)
-
-		newCredentials := OAuthCredentials{
-			AccessToken:      refreshResp.AccessToken,
-			RefreshToken:     refreshResp.RefreshToken,
-			ExpiresAt:        expiresAt,
-			Scope:            refreshResp.Scope,
-			OrganizationUUID: refreshResp.Organization.UUID,
-			OrganizationName: refreshResp.Organization.Name,
-			AccountUUID:      refreshResp.Account.UUID,
-			AccountEmail:     refreshResp.Account.EmailAddress,
-			UpdatedAt:        now,
-			RefreshStartedAt: refreshStartedAt,
-		}
+// postRefreshRequest makes a single refresh call and reports whether a failure is worth retrying
+func (or *OAuthRefresher) postRefreshRequest(ctx context.Context, refreshToken string) (*OAuthRefreshResponse, bool, error) {
+	reqData := OAuthRefreshRequest{
+		GrantType:    "refresh_token",
+		RefreshToken: refreshToken,
+		ClientID:     or.clientID,
+	}
 
-		err = tx.Set(docRef, newCredentials)
-		if err != nil {
-			return fmt.Errorf("failed to save refreshed credentials: %w", err)
-		}
+	jsonData, err := json.Marshal(reqData)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", or.tokenEndpoint, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create request: %w", err)
+	}
 
-		// Store refreshed credentials to return
-		refreshedCredentials = &newCredentials
+	req.Header.Set("Accept", "application/json, text/plain, */*")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "axios/1.8.4")
+	req.Header.Set("Connection", "close")
 
-		log.Printf("[OAUTH] Successfully refreshed credentials for account %s, new expiry: %s", 
-			refreshResp.Account.UUID, expiresAt.Format(time.RFC3339))
-		return nil
-	})
+	resp, err := or.httpClient.Do(req)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
 
+	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, true, fmt.Errorf("failed to read response body: %w", err)
 	}
 
-	return refreshedCredentials, nil
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("[OAUTH] OAuth refresh failed with status %d, response: %s", resp.StatusCode, string(respBody))
+		if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+			return nil, false, fmt.Errorf("%w: status %d", ErrRefreshTokenRejected, resp.StatusCode)
+		}
+		return nil, resp.StatusCode >= 500, fmt.Errorf("credentials refresh failed with status: %d", resp.StatusCode)
+	}
+	log.Printf("[OAUTH] OAuth refresh API returned status 200")
+
+	var refreshResp OAuthRefreshResponse
+	if err := json.Unmarshal(respBody, &refreshResp); err != nil {
+		return nil, false, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &refreshResp, false, nil
 }
@@ -0,0 +1,328 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"simple-relay/shared/database"
+
+	"cloud.google.com/go/firestore"
+)
+
+// newTestRefresher points a refresher at endpoint with no backoff between attempts
+func newTestRefresher(endpoint string) *OAuthRefresher {
+	return &OAuthRefresher{
+		tokenEndpoint: endpoint,
+		httpClient:    &http.Client{Timeout: time.Second},
+		maxAttempts:   3,
+		retryDelay:    time.Millisecond,
+	}
+}
+
+func TestExchangeRefreshToken_RetriesServerErrors(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= 2 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"access_token":"new-access","refresh_token":"new-refresh","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	resp, err := newTestRefresher(server.URL).exchangeRefreshToken(context.Background(), "old-refresh")
+	if err != nil {
+		t.Fatalf("expected the third attempt to succeed, got %v", err)
+	}
+	if resp.AccessToken != "new-access" || resp.RefreshToken != "new-refresh" {
+		t.Errorf("unexpected refresh response: %+v", resp)
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("expected 3 attempts, got %d", got)
+	}
+}
+
+func TestExchangeRefreshToken_DoesNotRetryClientErrors(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	_, err := newTestRefresher(server.URL).exchangeRefreshToken(context.Background(), "revoked")
+	if !errors.Is(err, ErrRefreshTokenRejected) {
+		t.Fatalf("expected ErrRefreshTokenRejected, got %v", err)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("expected a 4xx not to be retried, got %d attempts", got)
+	}
+}
+
+func TestExchangeRefreshToken_GivesUpAfterMaxAttempts(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	if _, err := newTestRefresher(server.URL).exchangeRefreshToken(context.Background(), "old-refresh"); err == nil {
+		t.Fatal("expected persistent 5xx responses to fail")
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("expected 3 attempts, got %d", got)
+	}
+}
+
+func TestNewOAuthRefresher_UsesConfiguredOAuthClient(t *testing.T) {
+	var got OAuthRefreshRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		w.Write([]byte(`{"access_token":"new-access","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	store := NewOAuthStore(nil)
+	store.SetOAuthClient(OAuthClient{TokenEndpoint: server.URL, ClientID: "custom-client"})
+	if _, err := NewOAuthRefresher(store).exchangeRefreshToken(context.Background(), "old-refresh"); err != nil {
+		t.Fatalf("expected the mock endpoint to be used, got %v", err)
+	}
+	if got.ClientID != "custom-client" || got.RefreshToken != "old-refresh" {
+		t.Errorf("unexpected refresh request: %+v", got)
+	}
+
+	// Empty fields keep the defaults
+	store.SetOAuthClient(OAuthClient{})
+	if store.oauthClient != DefaultOAuthClient {
+		t.Errorf("expected the default OAuth client, got %+v", store.oauthClient)
+	}
+}
+
+func TestRefreshBackoff(t *testing.T) {
+	base := 100 * time.Millisecond
+	for attempt := 1; attempt <= 3; attempt++ {
+		ceiling := base << (attempt - 1)
+		for i := 0; i < 20; i++ {
+			if got := refreshBackoff(base, attempt); got < ceiling/2 || got >= ceiling {
+				t.Fatalf("attempt %d: backoff %s outside [%s, %s)", attempt, got, ceiling/2, ceiling)
+			}
+		}
+	}
+}
+
+// newEmulatorStore returns a store backed by the Firestore emulator with no accounts, skipping the
+// test when the emulator isn't running
+func newEmulatorStore(t *testing.T) (*OAuthStore, *firestore.CollectionRef) {
+	t.Helper()
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST not set, skipping Firestore emulator test")
+	}
+	ctx := context.Background()
+	db, err := database.NewService("test-project", "(default)")
+	if err != nil {
+		t.Fatalf("failed to create database service: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	tokens := db.Client().Collection("oauth_tokens")
+	existing, err := tokens.Documents(ctx).GetAll()
+	if err != nil {
+		t.Fatalf("failed to list oauth tokens: %v", err)
+	}
+	for _, doc := range existing {
+		doc.Ref.Delete(ctx)
+	}
+	return NewOAuthStore(db), tokens
+}
+
+// seedCredentials stores accounts under their UUIDs
+func seedCredentials(t *testing.T, tokens *firestore.CollectionRef, accounts ...*OAuthCredentials) {
+	t.Helper()
+	for _, cred := range accounts {
+		if _, err := tokens.Doc(cred.AccountUUID).Set(context.Background(), cred); err != nil {
+			t.Fatalf("failed to seed %s: %v", cred.AccountUUID, err)
+		}
+	}
+}
+
+// newRefreshServer serves successful refreshes for accountUUID and counts the calls
+func newRefreshServer(t *testing.T, accountUUID string, calls *atomic.Int32) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		json.NewEncoder(w).Encode(OAuthRefreshResponse{
+			AccessToken:  "new-access",
+			RefreshToken: "new-refresh",
+			ExpiresIn:    3600,
+			Account:      Account{UUID: accountUUID},
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newRefreshServerThen serves a successful refresh for accountUUID after running before
+func newRefreshServerThen(t *testing.T, accountUUID string, before func()) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		before()
+		json.NewEncoder(w).Encode(OAuthRefreshResponse{
+			AccessToken:  "new-access",
+			RefreshToken: "new-refresh",
+			ExpiresIn:    3600,
+			Account:      Account{UUID: accountUUID},
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRefreshCredentials_NeedsRefresh(t *testing.T) {
+	store, tokens := newEmulatorStore(t)
+	expired := &OAuthCredentials{AccountUUID: "account-expired", AccessToken: "old-access", RefreshToken: "old-refresh", ExpiresAt: time.Now().Add(-time.Minute)}
+	seedCredentials(t, tokens, expired)
+
+	var calls atomic.Int32
+	refresher := newTestRefresher(newRefreshServer(t, expired.AccountUUID, &calls).URL)
+	refresher.oauthStore = store
+	refreshed, err := refresher.RefreshCredentials(expired)
+	if err != nil {
+		t.Fatalf("RefreshCredentials returned error: %v", err)
+	}
+	if refreshed.AccessToken != "new-access" || !refreshed.ExpiresAt.After(time.Now()) {
+		t.Errorf("expected fresh credentials, got %+v", refreshed)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("expected one refresh call, got %d", got)
+	}
+
+	doc, err := tokens.Doc(expired.AccountUUID).Get(context.Background())
+	if err != nil {
+		t.Fatalf("failed to read refreshed account: %v", err)
+	}
+	if token, _ := doc.DataAt("access_token"); token != "new-access" {
+		t.Errorf("expected the refreshed token to be stored, got %v", token)
+	}
+}
+
+func TestRefreshCredentials_KeepsFieldsOutsideTheRefreshResponse(t *testing.T) {
+	store, tokens := newEmulatorStore(t)
+	lastUsed := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	expired := &OAuthCredentials{AccountUUID: "account-kept", AccessToken: "old-access", RefreshToken: "old-refresh", ExpiresAt: time.Now().Add(-time.Minute), LastUsedAt: lastUsed}
+	seedCredentials(t, tokens, expired)
+
+	// Another process disables the account while this one holds the refresh lock
+	server := newRefreshServerThen(t, expired.AccountUUID, func() {
+		if err := store.DisableAccount(context.Background(), expired.AccountUUID, "disabled meanwhile"); err != nil {
+			t.Errorf("failed to disable account: %v", err)
+		}
+	})
+	refresher := newTestRefresher(server.URL)
+	refresher.oauthStore = store
+
+	if _, err := refresher.RefreshCredentials(expired); err != nil {
+		t.Fatalf("RefreshCredentials returned error: %v", err)
+	}
+
+	doc, err := tokens.Doc(expired.AccountUUID).Get(context.Background())
+	if err != nil {
+		t.Fatalf("failed to read refreshed account: %v", err)
+	}
+	var stored OAuthCredentials
+	if err := doc.DataTo(&stored); err != nil {
+		t.Fatalf("failed to parse refreshed account: %v", err)
+	}
+	if stored.AccessToken != "new-access" {
+		t.Errorf("expected the refreshed token to be stored, got %q", stored.AccessToken)
+	}
+	if !stored.Disabled || stored.DisabledReason != "disabled meanwhile" {
+		t.Errorf("expected the concurrent disable to be kept, got disabled=%v reason=%q", stored.Disabled, stored.DisabledReason)
+	}
+	if !stored.LastUsedAt.Equal(lastUsed) {
+		t.Errorf("expected last_used_at %s to be kept, got %s", lastUsed, stored.LastUsedAt)
+	}
+}
+
+func TestRefreshCredentials_AlreadyRefreshed(t *testing.T) {
+	store, tokens := newEmulatorStore(t)
+	stale := &OAuthCredentials{AccountUUID: "account-refreshed", AccessToken: "old-access", ExpiresAt: time.Now().Add(-time.Minute)}
+	stored := &OAuthCredentials{AccountUUID: "account-refreshed", AccessToken: "refreshed-elsewhere", ExpiresAt: time.Now().Add(time.Hour)}
+	seedCredentials(t, tokens, stored)
+
+	var calls atomic.Int32
+	refresher := newTestRefresher(newRefreshServer(t, stale.AccountUUID, &calls).URL)
+	refresher.oauthStore = store
+	got, err := refresher.RefreshCredentials(stale)
+	if err != nil {
+		t.Fatalf("RefreshCredentials returned error: %v", err)
+	}
+	if got.AccessToken != "refreshed-elsewhere" {
+		t.Errorf("expected the stored credentials, got %+v", got)
+	}
+	if calls.Load() != 0 {
+		t.Error("expected no refresh call for credentials another process already refreshed")
+	}
+}
+
+func TestRefreshCredentials_NotFound(t *testing.T) {
+	store, _ := newEmulatorStore(t)
+
+	var calls atomic.Int32
+	refresher := newTestRefresher(newRefreshServer(t, "account-missing", &calls).URL)
+	refresher.oauthStore = store
+	if _, err := refresher.RefreshCredentials(&OAuthCredentials{AccountUUID: "account-missing"}); err == nil {
+		t.Fatal("expected an error for an account without stored credentials")
+	}
+	if calls.Load() != 0 {
+		t.Error("expected no refresh call for an unknown account")
+	}
+}
+
+func TestRefreshCredentials_QuarantinesRejectedRefreshToken(t *testing.T) {
+	ctx := context.Background()
+	store, tokens := newEmulatorStore(t)
+	revoked := &OAuthCredentials{AccountUUID: "account-revoked", AccessToken: "token-revoked", RefreshToken: "revoked", ExpiresAt: time.Now().Add(-time.Minute)}
+	healthy := &OAuthCredentials{AccountUUID: "account-healthy", AccessToken: "token-healthy", RefreshToken: "ok", ExpiresAt: time.Now().Add(time.Hour)}
+	seedCredentials(t, tokens, revoked, healthy)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	refresher := newTestRefresher(server.URL)
+	refresher.oauthStore = store
+	if _, err := refresher.RefreshCredentials(revoked); !errors.Is(err, ErrRefreshTokenRejected) {
+		t.Fatalf("expected ErrRefreshTokenRejected, got %v", err)
+	}
+
+	doc, err := tokens.Doc(revoked.AccountUUID).Get(ctx)
+	if err != nil {
+		t.Fatalf("failed to read revoked account: %v", err)
+	}
+	var stored OAuthCredentials
+	if err := doc.DataTo(&stored); err != nil {
+		t.Fatalf("failed to parse revoked account: %v", err)
+	}
+	if !stored.Disabled {
+		t.Fatal("expected the account with a rejected refresh token to be disabled")
+	}
+
+	for i := 0; i < 10; i++ {
+		picked, err := store.GetValidCredentials()
+		if err != nil {
+			t.Fatalf("GetValidCredentials returned error: %v", err)
+		}
+		if picked.AccountUUID != healthy.AccountUUID {
+			t.Fatalf("expected only the healthy account to be selected, got %s", picked.AccountUUID)
+		}
+	}
+}
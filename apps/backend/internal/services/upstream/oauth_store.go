@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"simple-relay/shared/database"
@@ -25,6 +26,10 @@ type OAuthCredentials struct {
 	UpdatedAt        time.Time         `json:"updated_at" firestore:"updated_at"`
 	RefreshStartedAt time.Time         `json:"refresh_started_at" firestore:"refresh_started_at"`
 	RateLimitHeaders map[string]string `json:"rate_limit_headers,omitempty" firestore:"rate_limit_headers,omitempty"`
+	RateLimitResetAt time.Time         `json:"rate_limit_reset_at,omitempty" firestore:"rate_limit_reset_at,omitempty"` // See RateLimitResetTime; zero means updated_at plus DefaultRateLimitBackoff
+	Disabled         bool              `json:"disabled,omitempty" firestore:"disabled,omitempty"`
+	DisabledReason   string            `json:"disabled_reason,omitempty" firestore:"disabled_reason,omitempty"`
+	LastUsedAt       time.Time         `json:"last_used_at,omitempty" firestore:"last_used_at,omitempty"` // Last time the lru strategy picked the account
 }
 
 type UserTokenBinding struct {
@@ -37,15 +42,136 @@ type UserTokenBinding struct {
 type OAuthStore struct {
 	db             *database.Service
 	userTokenCache *expirable.LRU[string, *UserTokenBinding]
+
+	// Latest anthropic-ratelimit-tokens-remaining value seen per account UUID, until its reset
+	tokenBudgets   map[string]tokenBudget
+	tokenBudgetsMu sync.RWMutex
+	minTokenBudget int
+
+	// Ordered account selection policy; empty means random
+	selection SelectionChain
+
+	// Subtracted from expires_in when storing refreshed credentials
+	expiryMargin time.Duration
+
+	// Refresh locks older than this are treated as abandoned by a crashed worker
+	refreshLockTimeout time.Duration
+
+	// OAuth app used to refresh access tokens
+	oauthClient OAuthClient
+
+	// Accounts known to be disabled; bindings to them are migrated instead of reused
+	disabledAccounts map[string]bool
+	disabledMu       sync.RWMutex
+
+	// Account caps by collection and daily usage by account, reused for accountCapCacheTTL
+	accountLimitsCache *expirable.LRU[string, map[string]float64]
+	accountUsageCache  *expirable.LRU[string, float64]
 }
 
 func NewOAuthStore(db *database.Service) *OAuthStore {
-	cache := expirable.NewLRU[string, *UserTokenBinding](10000, nil, 24*time.Hour)
+	cache := expirable.NewLRU[string, *UserTokenBinding](userTokenCacheSize, nil, DefaultBindingTTL)
 
 	return &OAuthStore{
-		db:             db,
-		userTokenCache: cache,
+		db:                 db,
+		userTokenCache:     cache,
+		tokenBudgets:       make(map[string]tokenBudget),
+		expiryMargin:       DefaultExpirySafetyMargin,
+		refreshLockTimeout: DefaultRefreshLockTimeout,
+		oauthClient:        DefaultOAuthClient,
+		disabledAccounts:   make(map[string]bool),
+		accountLimitsCache: expirable.NewLRU[string, map[string]float64](accountLimitsCacheSize, nil, accountCapCacheTTL),
+		accountUsageCache:  expirable.NewLRU[string, float64](accountUsageCacheSize, nil, accountCapCacheTTL),
+	}
+}
+
+// SetExpirySafetyMargin sets how much earlier than upstream's expires_in a refreshed token is treated as expired
+func (store *OAuthStore) SetExpirySafetyMargin(margin time.Duration) {
+	if margin < 0 {
+		margin = 0
+	}
+	store.expiryMargin = margin
+}
+
+// SetRefreshLockTimeout sets how old a refresh lock must be before another worker takes it over
+func (store *OAuthStore) SetRefreshLockTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultRefreshLockTimeout
+	}
+	store.refreshLockTimeout = timeout
+}
+
+// SetOAuthClient sets the token endpoint and client ID used to refresh access tokens; empty fields
+// keep the defaults
+func (store *OAuthStore) SetOAuthClient(client OAuthClient) {
+	if client.TokenEndpoint == "" {
+		client.TokenEndpoint = DefaultOAuthClient.TokenEndpoint
+	}
+	if client.ClientID == "" {
+		client.ClientID = DefaultOAuthClient.ClientID
 	}
+	store.oauthClient = client
+}
+
+// SetSelectionChain sets the ordered strategies used to pick an account for a new binding
+func (store *OAuthStore) SetSelectionChain(chain SelectionChain) {
+	store.selection = chain
+}
+
+// SelectionUsesModel reports whether account selection depends on the requested model
+func (store *OAuthStore) SelectionUsesModel() bool {
+	return store.selection.UsesModel()
+}
+
+// SetMinTokenBudget sets the remaining-token threshold below which an account is deprioritized.
+// A value of 0 disables token budget aware selection.
+func (store *OAuthStore) SetMinTokenBudget(minTokens int) {
+	store.tokenBudgetsMu.Lock()
+	defer store.tokenBudgetsMu.Unlock()
+	store.minTokenBudget = minTokens
+}
+
+// DefaultTokenBudgetTTL is how long a remaining-token value is trusted when upstream sent no future
+// anthropic-ratelimit-tokens-reset time; token limits replenish continuously, so values go stale fast
+const DefaultTokenBudgetTTL = time.Minute
+
+// tokenBudget is a remaining-token value reported by upstream and when it stops applying
+type tokenBudget struct {
+	remaining int
+	expiresAt time.Time
+}
+
+// newTokenBudget returns a budget valid until resetAt, or for DefaultTokenBudgetTTL when resetAt
+// is unknown or already past (pure function)
+func newTokenBudget(remaining int, resetAt time.Time, now time.Time) tokenBudget {
+	if !resetAt.After(now) {
+		resetAt = now.Add(DefaultTokenBudgetTTL)
+	}
+	return tokenBudget{remaining: remaining, expiresAt: resetAt}
+}
+
+// RecordTokenBudget stores the latest remaining token budget reported by upstream for an account;
+// it is ignored after resetAt (the anthropic-ratelimit-tokens-reset time, zero if unknown)
+func (store *OAuthStore) RecordTokenBudget(accountUUID string, remaining int, resetAt time.Time) {
+	if accountUUID == "" {
+		return
+	}
+	store.tokenBudgetsMu.Lock()
+	defer store.tokenBudgetsMu.Unlock()
+	store.tokenBudgets[accountUUID] = newTokenBudget(remaining, resetAt, time.Now())
+}
+
+// tokenBudgetSnapshot returns a copy of the token budgets still valid at now and the configured threshold
+func (store *OAuthStore) tokenBudgetSnapshot(now time.Time) (map[string]int, int) {
+	store.tokenBudgetsMu.RLock()
+	defer store.tokenBudgetsMu.RUnlock()
+	budgets := make(map[string]int, len(store.tokenBudgets))
+	for accountUUID, budget := range store.tokenBudgets {
+		if now.Before(budget.expiresAt) {
+			budgets[accountUUID] = budget.remaining
+		}
+	}
+	return budgets, store.minTokenBudget
 }
 
 // parseCredentialsFromDocs converts Firestore documents to OAuthCredentials, skipping malformed ones
@@ -61,6 +187,19 @@ func parseCredentialsFromDocs(docs []*firestore.DocumentSnapshot) []*OAuthCreden
 	return credentials
 }
 
+// findOrganizationUUID returns the organization of accountUUID, or empty string if unknown (pure function)
+func findOrganizationUUID(credentials []*OAuthCredentials, accountUUID string) string {
+	if accountUUID == "" {
+		return ""
+	}
+	for _, cred := range credentials {
+		if cred.AccountUUID == accountUUID {
+			return cred.OrganizationUUID
+		}
+	}
+	return ""
+}
+
 // pickRandomCredential selects a random credential from the available pool
 func pickRandomCredential(credentials []*OAuthCredentials) (*OAuthCredentials, error) {
 	if len(credentials) == 0 {
@@ -70,13 +209,14 @@ func pickRandomCredential(credentials []*OAuthCredentials) (*OAuthCredentials, e
 	return credentials[randomIndex], nil
 }
 
-// filterOutRateLimitedCredentials filters out rate-limited credentials and logs those that are filtered out
-func filterOutRateLimitedCredentials(allCredentials []*OAuthCredentials) []*OAuthCredentials {
+// filterOutRateLimitedCredentials filters out credentials still rate limited at now and logs those that are filtered out.
+// Accounts whose rate limit has reset are kept.
+func filterOutRateLimitedCredentials(allCredentials []*OAuthCredentials, now time.Time) []*OAuthCredentials {
 	var availableCredentials []*OAuthCredentials
 	
 	for _, credentials := range allCredentials {
-		// Only include credentials that don't have rate limit headers
-		if credentials.RateLimitHeaders == nil {
+		// Only include credentials that aren't rate limited, or whose rate limit has reset
+		if !credentials.IsRateLimited(now) {
 			availableCredentials = append(availableCredentials, credentials)
 		} else {
 			logRateLimitedToken(credentials)
@@ -86,6 +226,29 @@ func filterOutRateLimitedCredentials(allCredentials []*OAuthCredentials) []*OAut
 	return availableCredentials
 }
 
+// deprioritizeLowTokenBudget drops accounts whose last known token budget is below minTokens,
+// unless that would leave no candidates. Accounts with no recorded budget are kept.
+func deprioritizeLowTokenBudget(credentials []*OAuthCredentials, budgets map[string]int, minTokens int) []*OAuthCredentials {
+	if minTokens <= 0 || len(budgets) == 0 {
+		return credentials
+	}
+
+	var preferred []*OAuthCredentials
+	for _, cred := range credentials {
+		if remaining, known := budgets[cred.AccountUUID]; known && remaining < minTokens {
+			log.Printf("[OAUTH] Deprioritizing account %s: %d tokens remaining (threshold %d)",
+				cred.AccountUUID, remaining, minTokens)
+			continue
+		}
+		preferred = append(preferred, cred)
+	}
+
+	if len(preferred) == 0 {
+		return credentials
+	}
+	return preferred
+}
+
 // logRateLimitedToken logs details about a rate-limited token for monitoring and debugging
 func logRateLimitedToken(credentials *OAuthCredentials) {
 	// Flatten headers for readable logging
@@ -98,6 +261,11 @@ func logRateLimitedToken(credentials *OAuthCredentials) {
 }
 
 func (store *OAuthStore) GetValidCredentials() (*OAuthCredentials, error) {
+	return store.GetValidCredentialsFor(SelectionRequest{})
+}
+
+// GetValidCredentialsFor picks a healthy account for req using the selection chain
+func (store *OAuthStore) GetValidCredentialsFor(req SelectionRequest) (*OAuthCredentials, error) {
 	log.Printf("[OAUTH] GetValidCredentials called")
 	ctx := context.Background()
 
@@ -118,25 +286,62 @@ func (store *OAuthStore) GetValidCredentials() (*OAuthCredentials, error) {
 	allCredentials := parseCredentialsFromDocs(docs)
 	log.Printf("[OAUTH] Parsed %d valid credentials from documents", len(allCredentials))
 
-	// Step 3: Filter out rate-limited credentials (pure function)
-	availableCredentials := filterOutRateLimitedCredentials(allCredentials)
+	// Step 2a: Remember the organization of the user's previous account for org-scoped selection
+	req.PreviousOrgUUID = findOrganizationUUID(allCredentials, req.PreviousAccountUUID)
+
+	// Step 2b: Drop disabled accounts, e.g. whose organization was deleted (pure function)
+	allCredentials = filterOutDisabledCredentials(allCredentials)
+
+	// Step 3: Filter out rate-limited credentials (pure function); accounts past their reset time are
+	// selectable again and their saved headers are cleared in the background
+	now := time.Now()
+	availableCredentials := filterOutRateLimitedCredentials(allCredentials, now)
 	log.Printf("[OAUTH] %d credentials available after filtering rate-limited ones", len(availableCredentials))
+	var reset []*OAuthCredentials
+	for _, cred := range availableCredentials {
+		if cred.hasExpiredRateLimit(now) {
+			reset = append(reset, cred)
+		}
+	}
+	if len(reset) > 0 {
+		go store.clearExpiredRateLimits(context.Background(), reset)
+	}
 
 	if len(availableCredentials) == 0 {
 		return nil, fmt.Errorf("no available credentials found - all credentials are rate-limited")
 	}
 
-	// Step 4: Pick random credential from available pool (pure function)
-	credentials, err := pickRandomCredential(availableCredentials)
+	// Step 3b: Filter out accounts that reached their daily points cap
+	availableCredentials = store.filterOverPointsCapCredentials(ctx, availableCredentials)
+	log.Printf("[OAUTH] %d credentials available after applying points caps", len(availableCredentials))
+
+	if len(availableCredentials) == 0 {
+		return nil, fmt.Errorf("no available credentials found - all credentials reached their points cap")
+	}
+
+	// Step 3c: Filter out accounts that reached their daily cost cap, before they start returning 429s
+	availableCredentials = store.filterOverCostCapCredentials(ctx, availableCredentials)
+	log.Printf("[OAUTH] %d credentials available after applying cost caps", len(availableCredentials))
+
+	if len(availableCredentials) == 0 {
+		return nil, fmt.Errorf("no available credentials found - all credentials reached their cost cap")
+	}
+
+	// Step 4: Prefer accounts that still have token budget left (pure function)
+	budgets, minTokenBudget := store.tokenBudgetSnapshot(time.Now())
+	availableCredentials = deprioritizeLowTokenBudget(availableCredentials, budgets, minTokenBudget)
+
+	// Step 5: Pick a credential with the configured selection chain (random by default)
+	credentials, err := store.selection.Select(ctx, req, availableCredentials)
 	if err != nil {
-		log.Printf("[OAUTH] Failed to pick random credential: %v", err)
-		return nil, fmt.Errorf("failed to pick random credential: %w", err)
+		log.Printf("[OAUTH] Failed to select credential: %v", err)
+		return nil, fmt.Errorf("failed to select credential: %w", err)
 	}
 	log.Printf("[OAUTH] Picked credential: account=%s, expires=%s", 
 		credentials.AccountUUID, credentials.ExpiresAt.Format(time.RFC3339))
 
-	// Step 5: Check if credential is expired and refresh if needed
-	now := time.Now()
+	// Step 6: Check if credential is expired and refresh if needed
+	now = time.Now()
 	if credentials.ExpiresAt.After(now) {
 		log.Printf("[OAUTH] Credential is still valid, returning without refresh")
 		return credentials, nil
@@ -162,6 +367,43 @@ func (store *OAuthStore) GetValidCredentials() (*OAuthCredentials, error) {
 	return refreshedCredentials, nil
 }
 
+// AccountPoolStats summarizes the upstream account pool
+type AccountPoolStats struct {
+	Total       int `json:"total"`
+	Disabled    int `json:"disabled"`
+	RateLimited int `json:"rate_limited"`
+	Available   int `json:"available"`
+}
+
+// summarizeAccountPool counts disabled, rate-limited and available accounts at now (pure function)
+func summarizeAccountPool(credentials []*OAuthCredentials, now time.Time) AccountPoolStats {
+	stats := AccountPoolStats{Total: len(credentials)}
+	for _, cred := range credentials {
+		switch {
+		case cred.Disabled:
+			stats.Disabled++
+		case cred.IsRateLimited(now):
+			stats.RateLimited++
+		}
+	}
+	stats.Available = stats.Total - stats.Disabled - stats.RateLimited
+	return stats
+}
+
+// AccountPoolStats reports how many upstream accounts are currently selectable
+func (store *OAuthStore) AccountPoolStats(ctx context.Context) (AccountPoolStats, error) {
+	docs, err := store.db.Client().Collection("oauth_tokens").Documents(ctx).GetAll()
+	if err != nil {
+		return AccountPoolStats{}, fmt.Errorf("failed to get credentials: %w", err)
+	}
+	return summarizeAccountPool(parseCredentialsFromDocs(docs), time.Now()), nil
+}
+
+// UserTokenCacheSize returns the number of cached user token bindings
+func (store *OAuthStore) UserTokenCacheSize() int {
+	return store.userTokenCache.Len()
+}
+
 func (store *OAuthStore) GetUserTokenBinding(userID string) (*UserTokenBinding, error) {
 	ctx := context.Background()
 
@@ -184,17 +426,23 @@ func (store *OAuthStore) GetUserTokenBinding(userID string) (*UserTokenBinding,
 }
 
 func (store *OAuthStore) GetValidTokenForUser(userID string) (*UserTokenBinding, error) {
+	return store.GetValidTokenForModel(userID, "")
+}
+
+// GetValidTokenForModel returns the user's bound token; when a new account must be chosen,
+// the requested model is passed to the selection chain
+func (store *OAuthStore) GetValidTokenForModel(userID string, model string) (*UserTokenBinding, error) {
 	log.Printf("[OAUTH] GetValidTokenForUser called for user: %s", userID)
 	
 	// Check cache first for valid tokens
 	if cached, exists := store.userTokenCache.Get(userID); exists {
 		log.Printf("[OAUTH] Found cached token for user %s, expires at: %s, current time: %s", 
 			userID, cached.ExpiresAt.Format(time.RFC3339), time.Now().Format(time.RFC3339))
-		if cached.ExpiresAt.After(time.Now()) {
+		if cached.ExpiresAt.After(time.Now()) && !store.isAccountDisabled(cached.AccountUUID) {
 			log.Printf("[OAUTH] Using cached token for user %s (still valid)", userID)
 			return cached, nil
 		}
-		log.Printf("[OAUTH] Cached token for user %s is expired, getting fresh token", userID)
+		log.Printf("[OAUTH] Cached token for user %s is expired or its account disabled, getting fresh token", userID)
 	} else {
 		log.Printf("[OAUTH] No cached token found for user %s", userID)
 	}
@@ -213,7 +461,7 @@ func (store *OAuthStore) GetValidTokenForUser(userID string) (*UserTokenBinding,
 			log.Printf("[OAUTH] No binding exists for user %s (error: %v), creating new binding", userID, txErr)
 			// Any error here means document doesn't exist (NotFound) or other transient issues
 			// In either case, we'll create a new binding with fresh credentials
-			validCreds, credsErr := store.GetValidCredentials()
+			validCreds, credsErr := store.GetValidCredentialsFor(SelectionRequest{UserID: userID, Model: model})
 			if credsErr != nil {
 				log.Printf("[OAUTH] Failed to get valid credentials for user %s: %v", userID, credsErr)
 				return fmt.Errorf("failed to get valid token for new user binding: %w", credsErr)
@@ -246,17 +494,26 @@ func (store *OAuthStore) GetValidTokenForUser(userID string) (*UserTokenBinding,
 			userID, binding.AccountUUID, binding.ExpiresAt.Format(time.RFC3339))
 
 		now := time.Now()
-		if binding.ExpiresAt.After(now) {
-			// Token is still valid, use as-is
-			log.Printf("[OAUTH] Existing binding for user %s is still valid", userID)
-			resultBinding = binding
-			store.userTokenCache.Add(resultBinding.UserID, resultBinding)
-			return nil
+		if binding.ExpiresAt.After(now) && !store.isAccountDisabled(binding.AccountUUID) {
+			// Token is still valid; keep it unless its account stopped being usable
+			reason := store.boundAccountUnavailable(ctx, binding.AccountUUID, now)
+			if reason == "" {
+				log.Printf("[OAUTH] Existing binding for user %s is still valid", userID)
+				resultBinding = binding
+				store.userTokenCache.Add(resultBinding.UserID, resultBinding)
+				return nil
+			}
+			log.Printf("[OAUTH] Account %s bound to user %s is %s, rebinding", binding.AccountUUID, userID, reason)
+		} else {
+			log.Printf("[OAUTH] Existing binding for user %s is expired or its account disabled, getting fresh credentials", userID)
 		}
-		log.Printf("[OAUTH] Existing binding for user %s is expired, getting fresh credentials", userID)
 
-		// Case 3: Binding exists but token is expired - refresh with new credentials
-		freshCreds, credsErr := store.GetValidCredentials()
+		// Case 3: Binding exists but token is expired or its account unusable - migrate to new credentials
+		freshCreds, credsErr := store.GetValidCredentialsFor(SelectionRequest{
+			UserID:              userID,
+			Model:               model,
+			PreviousAccountUUID: binding.AccountUUID,
+		})
 		if credsErr != nil {
 			log.Printf("[OAUTH] Failed to get fresh credentials for user %s: %v", userID, credsErr)
 			return fmt.Errorf("failed to get fresh token for user %s: %w", userID, credsErr)
@@ -320,9 +577,11 @@ func (store *OAuthStore) SaveRateLimitHeadersByToken(accessToken string, headers
 
 	// Update the document with rate limit headers
 	docRef := docs[0].Ref
+	now := time.Now()
 	_, err = docRef.Update(ctx, []firestore.Update{
 		{Path: "rate_limit_headers", Value: headers},
-		{Path: "updated_at", Value: time.Now()},
+		{Path: "rate_limit_reset_at", Value: RateLimitResetTime(headers, now)},
+		{Path: "updated_at", Value: now},
 	})
 	if err != nil {
 		log.Printf("Failed to update OAuth token with rate limit headers: %v", err)
@@ -330,5 +589,19 @@ func (store *OAuthStore) SaveRateLimitHeadersByToken(accessToken string, headers
 	}
 
 	log.Printf("Successfully saved rate limit headers to OAuth token")
+
+	// Other users cached on this account are re-checked on their next request and moved off it
+	store.evictCachedBindings(map[string]bool{docRef.ID: true})
+	return nil
+}
+
+// markAccountUsed records when the lru selection strategy last picked an account
+func (store *OAuthStore) markAccountUsed(ctx context.Context, accountUUID string, at time.Time) error {
+	_, err := store.db.Client().Collection("oauth_tokens").Doc(accountUUID).Update(ctx, []firestore.Update{
+		{Path: "last_used_at", Value: at},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save last_used_at: %w", err)
+	}
 	return nil
 }
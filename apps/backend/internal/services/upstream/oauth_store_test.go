@@ -0,0 +1,203 @@
+package upstream
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeprioritizeLowTokenBudget(t *testing.T) {
+	credentials := []*OAuthCredentials{
+		{AccountUUID: "account-low"},
+		{AccountUUID: "account-high"},
+		{AccountUUID: "account-unknown"},
+	}
+	budgets := map[string]int{
+		"account-low":  50,
+		"account-high": 500000,
+	}
+
+	result := deprioritizeLowTokenBudget(credentials, budgets, 20000)
+
+	if len(result) != 2 {
+		t.Fatalf("expected 2 credentials, got %d", len(result))
+	}
+	for _, cred := range result {
+		if cred.AccountUUID == "account-low" {
+			t.Errorf("account with near-zero token budget should be deprioritized")
+		}
+	}
+}
+
+func TestDeprioritizeLowTokenBudget_KeepsAllWhenEveryAccountIsLow(t *testing.T) {
+	credentials := []*OAuthCredentials{
+		{AccountUUID: "account-a"},
+		{AccountUUID: "account-b"},
+	}
+	budgets := map[string]int{
+		"account-a": 10,
+		"account-b": 0,
+	}
+
+	result := deprioritizeLowTokenBudget(credentials, budgets, 20000)
+
+	if len(result) != len(credentials) {
+		t.Errorf("expected all %d credentials when none have budget, got %d", len(credentials), len(result))
+	}
+}
+
+func TestDeprioritizeLowTokenBudget_DisabledThreshold(t *testing.T) {
+	credentials := []*OAuthCredentials{{AccountUUID: "account-low"}}
+	budgets := map[string]int{"account-low": 0}
+
+	result := deprioritizeLowTokenBudget(credentials, budgets, 0)
+
+	if len(result) != 1 {
+		t.Errorf("expected threshold 0 to disable deprioritization, got %d credentials", len(result))
+	}
+}
+
+func TestTokenBudgetSnapshot_IgnoresBudgetsPastTheirReset(t *testing.T) {
+	store := NewOAuthStore(nil)
+	now := time.Now()
+	store.RecordTokenBudget("account-resets-later", 50, now.Add(time.Hour))
+	store.RecordTokenBudget("account-no-reset", 50, time.Time{})
+
+	budgets, _ := store.tokenBudgetSnapshot(now)
+	if budgets["account-resets-later"] != 50 || budgets["account-no-reset"] != 50 {
+		t.Fatalf("expected both fresh budgets to apply, got %v", budgets)
+	}
+
+	// After the default TTL only the budget with a later reset still applies
+	budgets, _ = store.tokenBudgetSnapshot(now.Add(2 * DefaultTokenBudgetTTL))
+	if _, known := budgets["account-no-reset"]; known || budgets["account-resets-later"] != 50 {
+		t.Errorf("expected the budget without a reset to expire after the TTL, got %v", budgets)
+	}
+
+	// After its reset the low budget no longer deprioritizes the account
+	budgets, _ = store.tokenBudgetSnapshot(now.Add(2 * time.Hour))
+	if len(budgets) != 0 {
+		t.Errorf("expected every budget to expire, got %v", budgets)
+	}
+}
+
+func TestFilterOutOverPointsCap(t *testing.T) {
+	credentials := []*OAuthCredentials{
+		{AccountUUID: "account-over"},
+		{AccountUUID: "account-under"},
+		{AccountUUID: "account-uncapped"},
+	}
+	limits := map[string]float64{
+		"account-over":  1000,
+		"account-under": 1000,
+	}
+	usage := map[string]float64{
+		"account-over":  1000.5,
+		"account-under": 999,
+	}
+
+	result := filterOutOverPointsCap(credentials, limits, usage)
+
+	if len(result) != 2 {
+		t.Fatalf("expected 2 credentials, got %d", len(result))
+	}
+	for _, cred := range result {
+		if cred.AccountUUID == "account-over" {
+			t.Errorf("account exceeding its points cap should be excluded")
+		}
+	}
+}
+
+func TestFilterOutOverCostCap(t *testing.T) {
+	credentials := []*OAuthCredentials{
+		{AccountUUID: "account-over"},
+		{AccountUUID: "account-under"},
+		{AccountUUID: "account-unread"},
+	}
+	limits := map[string]float64{
+		"account-over":   50,
+		"account-under":  50,
+		"account-unread": 50,
+	}
+	// account-unread has no usage because its aggregates couldn't be read: it stays selectable
+	usage := map[string]float64{
+		"account-over":  52.75,
+		"account-under": 49.99,
+	}
+
+	result := filterOutOverCostCap(credentials, limits, usage)
+
+	if len(result) != 2 {
+		t.Fatalf("expected 2 credentials, got %d", len(result))
+	}
+	for _, cred := range result {
+		if cred.AccountUUID == "account-over" {
+			t.Errorf("account exceeding its cost cap should be excluded")
+		}
+	}
+}
+
+func TestSummarizeAccountPool(t *testing.T) {
+	credentials := []*OAuthCredentials{
+		{AccountUUID: "account-a"},
+		{AccountUUID: "account-b", RateLimitHeaders: map[string]string{"anthropic-ratelimit-unified-status": "rejected"}, UpdatedAt: time.Now()},
+		{AccountUUID: "account-c"},
+		{AccountUUID: "account-d", Disabled: true},
+	}
+
+	stats := summarizeAccountPool(credentials, time.Now())
+
+	if stats.Total != 4 || stats.Disabled != 1 || stats.RateLimited != 1 || stats.Available != 2 {
+		t.Errorf("unexpected pool stats: %+v", stats)
+	}
+}
+
+func TestUserTokenCacheSize(t *testing.T) {
+	store := NewOAuthStore(nil)
+	store.userTokenCache.Add("user-1", &UserTokenBinding{UserID: "user-1"})
+	store.userTokenCache.Add("user-2", &UserTokenBinding{UserID: "user-2"})
+
+	if size := store.UserTokenCacheSize(); size != 2 {
+		t.Errorf("expected 2 cached bindings, got %d", size)
+	}
+}
+
+func TestDecideRefreshLock(t *testing.T) {
+	now := time.Now()
+	expired := now.Add(-time.Minute)
+	tests := []struct {
+		name  string
+		creds OAuthCredentials
+		want  refreshLockDecision
+	}{
+		{"valid token", OAuthCredentials{ExpiresAt: now.Add(time.Hour)}, refreshNotNeeded},
+		{"valid token with old refresh record", OAuthCredentials{ExpiresAt: now.Add(time.Hour), RefreshStartedAt: now.Add(-time.Hour)}, refreshNotNeeded},
+		{"expired without lock", OAuthCredentials{ExpiresAt: expired}, refreshAcquire},
+		{"refresh started 10 seconds ago", OAuthCredentials{ExpiresAt: expired, RefreshStartedAt: now.Add(-10 * time.Second)}, refreshInProgress},
+		{"refresh started 5 minutes ago", OAuthCredentials{ExpiresAt: expired, RefreshStartedAt: now.Add(-5 * time.Minute)}, refreshTakeOver},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decideRefreshLock(&tt.creds, now, 0, DefaultRefreshLockTimeout); got != tt.want {
+				t.Errorf("decideRefreshLock() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Within the lookahead a valid token still needs a refresh
+	nearExpiry := OAuthCredentials{ExpiresAt: now.Add(5 * time.Minute)}
+	if got := decideRefreshLock(&nearExpiry, now, 10*time.Minute, DefaultRefreshLockTimeout); got != refreshAcquire {
+		t.Errorf("expected a refresh within the lookahead, got %v", got)
+	}
+}
+
+func TestSetRefreshLockTimeout(t *testing.T) {
+	store := &OAuthStore{}
+	store.SetRefreshLockTimeout(2 * time.Minute)
+	if store.refreshLockTimeout != 2*time.Minute {
+		t.Errorf("expected 2m timeout, got %s", store.refreshLockTimeout)
+	}
+	store.SetRefreshLockTimeout(0)
+	if store.refreshLockTimeout != DefaultRefreshLockTimeout {
+		t.Errorf("expected non-positive timeout to fall back to the default, got %s", store.refreshLockTimeout)
+	}
+}
@@ -0,0 +1,169 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// unifiedResetHeader carries the unix time at which a 429'd account may be used again
+const unifiedResetHeader = "anthropic-ratelimit-unified-reset"
+
+// ParseRateLimitReset returns the reset time from saved 429 headers, matching the header name
+// case-insensitively. The value is unix seconds; RFC 3339 timestamps are accepted too. Returns the
+// zero time when there is no usable reset header.
+func ParseRateLimitReset(headers map[string]string) time.Time {
+	for key, value := range headers {
+		if !strings.EqualFold(key, unifiedResetHeader) {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if seconds, err := strconv.ParseInt(value, 10, 64); err == nil && seconds > 0 {
+			return time.Unix(seconds, 0)
+		}
+		if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+			return parsed
+		}
+	}
+	return time.Time{}
+}
+
+// DefaultRateLimitBackoff is how long an account is excluded after a 429 that carries no reset time
+const DefaultRateLimitBackoff = 60 * time.Second
+
+// RateLimitResetTime returns when a 429'd account may be used again: the unified reset, else the
+// Retry-After delay, else the latest future anthropic-ratelimit-*-reset time, else
+// DefaultRateLimitBackoff from now. Never returns the zero time, so no account is excluded forever.
+func RateLimitResetTime(headers map[string]string, now time.Time) time.Time {
+	if reset := ParseRateLimitReset(headers); !reset.IsZero() {
+		return reset
+	}
+	var latest time.Time
+	for key, value := range headers {
+		value = strings.TrimSpace(value)
+		if strings.EqualFold(key, "Retry-After") {
+			if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+				return now.Add(time.Duration(seconds) * time.Second)
+			}
+			continue
+		}
+		key = strings.ToLower(key)
+		if !strings.HasPrefix(key, "anthropic-ratelimit-") || !strings.HasSuffix(key, "-reset") {
+			continue
+		}
+		if parsed, err := time.Parse(time.RFC3339, value); err == nil && parsed.After(now) && parsed.After(latest) {
+			latest = parsed
+		}
+	}
+	if !latest.IsZero() {
+		return latest
+	}
+	return now.Add(DefaultRateLimitBackoff)
+}
+
+// IsRateLimited reports whether the account is still rate limited at now. Headers saved without a
+// reset time exclude the account for DefaultRateLimitBackoff after they were saved.
+func (c *OAuthCredentials) IsRateLimited(now time.Time) bool {
+	if c.RateLimitHeaders == nil {
+		return false
+	}
+	resetAt := c.RateLimitResetAt
+	if resetAt.IsZero() {
+		resetAt = c.UpdatedAt.Add(DefaultRateLimitBackoff)
+	}
+	return now.Before(resetAt)
+}
+
+// hasExpiredRateLimit reports whether the account has saved 429 headers whose reset time has passed
+func (c *OAuthCredentials) hasExpiredRateLimit(now time.Time) bool {
+	return c.RateLimitHeaders != nil && !c.IsRateLimited(now)
+}
+
+// clearExpiredRateLimits removes the saved 429 headers of accounts whose reset time has passed.
+// Each account is re-read in a transaction, so headers saved by a newer 429 are kept.
+func (store *OAuthStore) clearExpiredRateLimits(ctx context.Context, credentials []*OAuthCredentials) int {
+	cleared := 0
+	for _, cred := range credentials {
+		ok, err := store.clearExpiredRateLimit(ctx, cred.AccountUUID)
+		if err != nil {
+			log.Printf("[OAUTH] Failed to clear expired rate limit of account %s: %v", cred.AccountUUID, err)
+			continue
+		}
+		if ok {
+			cleared++
+		}
+	}
+	return cleared
+}
+
+// ClearExpiredRateLimits clears the saved 429 headers of every account whose reset time has passed,
+// including disabled accounts that selection never looks at, and returns how many were cleared.
+// Safe to run on several instances at once: each account is re-checked in its own transaction.
+func (store *OAuthStore) ClearExpiredRateLimits(ctx context.Context) (int, error) {
+	credentials, err := store.loadCredentials(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	var expired []*OAuthCredentials
+	for _, cred := range credentials {
+		if cred.hasExpiredRateLimit(now) {
+			expired = append(expired, cred)
+		}
+	}
+	return store.clearExpiredRateLimits(ctx, expired), nil
+}
+
+// WatchExpiredRateLimits clears expired rate limits on every interval until ctx is done
+func (store *OAuthStore) WatchExpiredRateLimits(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := store.ClearExpiredRateLimits(ctx); err != nil {
+			log.Printf("[OAUTH] Failed to clear expired rate limits: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// clearExpiredRateLimit clears one account's 429 headers if its reset time has passed, reporting
+// whether they were cleared
+func (store *OAuthStore) clearExpiredRateLimit(ctx context.Context, accountUUID string) (bool, error) {
+	client := store.db.Client()
+	docRef := client.Collection("oauth_tokens").Doc(accountUUID)
+	cleared := false
+	err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		cleared = false
+		doc, err := tx.Get(docRef)
+		if err != nil {
+			return fmt.Errorf("failed to read account: %w", err)
+		}
+		var current OAuthCredentials
+		if err := doc.DataTo(&current); err != nil {
+			return fmt.Errorf("failed to parse account: %w", err)
+		}
+		if !current.hasExpiredRateLimit(time.Now()) {
+			return nil
+		}
+		log.Printf("[OAUTH] Rate limit of account %s reset at %s, clearing saved headers",
+			accountUUID, current.RateLimitResetAt.Format(time.RFC3339))
+		cleared = true
+		return tx.Update(docRef, []firestore.Update{
+			{Path: "rate_limit_headers", Value: firestore.Delete},
+			{Path: "rate_limit_reset_at", Value: firestore.Delete},
+		})
+	})
+	return cleared, err
+}
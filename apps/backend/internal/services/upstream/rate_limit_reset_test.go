@@ -0,0 +1,170 @@
+package upstream
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimitReset(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    time.Time
+	}{
+		{"unix seconds, canonical key", map[string]string{"Anthropic-Ratelimit-Unified-Reset": "1760000000"}, time.Unix(1760000000, 0)},
+		{"lowercase key", map[string]string{"anthropic-ratelimit-unified-reset": "1760000000"}, time.Unix(1760000000, 0)},
+		{"RFC 3339", map[string]string{"anthropic-ratelimit-unified-reset": "2025-10-09T08:53:20Z"}, time.Unix(1760000000, 0)},
+		{"missing", map[string]string{"retry-after": "60"}, time.Time{}},
+		{"invalid", map[string]string{"anthropic-ratelimit-unified-reset": "soon"}, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseRateLimitReset(tt.headers); !got.Equal(tt.want) {
+				t.Errorf("ParseRateLimitReset() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitResetTime(t *testing.T) {
+	now := time.Date(2025, 10, 9, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    time.Time
+	}{
+		{"unified reset wins", map[string]string{"anthropic-ratelimit-unified-reset": "1760000000", "retry-after": "5"}, time.Unix(1760000000, 0)},
+		{"retry-after", map[string]string{"Retry-After": "30", "anthropic-ratelimit-tokens-reset": "2025-10-09T09:00:00Z"}, now.Add(30 * time.Second)},
+		{"latest other reset", map[string]string{
+			"anthropic-ratelimit-requests-reset": "2025-10-09T08:01:00Z",
+			"anthropic-ratelimit-tokens-reset":   "2025-10-09T08:05:00Z",
+		}, now.Add(5 * time.Minute)},
+		{"only past resets", map[string]string{"anthropic-ratelimit-requests-reset": "2025-01-01T00:00:00Z"}, now.Add(DefaultRateLimitBackoff)},
+		{"no reset at all", map[string]string{"anthropic-ratelimit-unified-status": "rejected"}, now.Add(DefaultRateLimitBackoff)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RateLimitResetTime(tt.headers, now); !got.Equal(tt.want) {
+				t.Errorf("RateLimitResetTime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryTokenProvider_RetryAfterOnlyRateLimitExpires(t *testing.T) {
+	provider := NewMemoryTokenProvider(
+		&OAuthCredentials{AccountUUID: "account-a", AccessToken: "token-a", ExpiresAt: time.Now().Add(time.Hour)},
+	)
+	if err := provider.SaveRateLimitHeadersByToken("token-a", map[string]string{"retry-after": "30"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	account := provider.accounts["account-a"]
+	if !account.IsRateLimited(time.Now()) {
+		t.Error("expected the account to be rate limited during Retry-After")
+	}
+	if account.IsRateLimited(time.Now().Add(31 * time.Second)) {
+		t.Error("expected the account to be usable again after Retry-After")
+	}
+}
+
+func TestFilterOutRateLimitedCredentials_KeepsAccountsPastReset(t *testing.T) {
+	now := time.Now()
+	limited := map[string]string{"anthropic-ratelimit-unified-status": "rejected"}
+	credentials := []*OAuthCredentials{
+		{AccountUUID: "reset-passed", RateLimitHeaders: limited, RateLimitResetAt: now.Add(-time.Minute)},
+		{AccountUUID: "reset-pending", RateLimitHeaders: limited, RateLimitResetAt: now.Add(time.Minute)},
+		{AccountUUID: "no-reset", RateLimitHeaders: limited, UpdatedAt: now.Add(-10 * time.Second)},
+		{AccountUUID: "no-reset-stale", RateLimitHeaders: limited, UpdatedAt: now.Add(-2 * DefaultRateLimitBackoff)},
+		{AccountUUID: "healthy"},
+	}
+
+	available := filterOutRateLimitedCredentials(credentials, now)
+
+	if len(available) != 3 || available[0].AccountUUID != "reset-passed" || available[1].AccountUUID != "no-reset-stale" || available[2].AccountUUID != "healthy" {
+		t.Errorf("expected reset-passed, no-reset-stale and healthy to be selectable, got %v", accountUUIDs(available))
+	}
+	if !available[0].hasExpiredRateLimit(now) || !available[1].hasExpiredRateLimit(now) || available[2].hasExpiredRateLimit(now) {
+		t.Errorf("expected reset-passed and no-reset-stale to have headers left to clear")
+	}
+	if stats := summarizeAccountPool(credentials, now); stats.RateLimited != 2 || stats.Available != 3 {
+		t.Errorf("expected 2 rate-limited and 3 available accounts, got %+v", stats)
+	}
+}
+
+func TestMemoryTokenProvider_AccountSelectableAfterReset(t *testing.T) {
+	provider := NewMemoryTokenProvider(
+		&OAuthCredentials{AccountUUID: "account-a", AccessToken: "token-a", ExpiresAt: time.Now().Add(time.Hour)},
+	)
+
+	pastReset := time.Now().Add(-time.Minute).Unix()
+	if err := provider.SaveRateLimitHeadersByToken("token-a", map[string]string{
+		"Anthropic-Ratelimit-Unified-Reset": time.Unix(pastReset, 0).Format(time.RFC3339),
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	binding, err := provider.GetValidTokenForUser("user-1")
+	if err != nil || binding.AccountUUID != "account-a" {
+		t.Errorf("expected account-a to be selectable after its reset, got %+v (err %v)", binding, err)
+	}
+}
+
+func TestClearExpiredRateLimits_ClearsOnlyPastResets(t *testing.T) {
+	ctx := context.Background()
+	store, tokens := newEmulatorStore(t)
+	limited := map[string]string{"anthropic-ratelimit-unified-status": "rejected"}
+	seedCredentials(t, tokens,
+		&OAuthCredentials{AccountUUID: "reset-passed", RateLimitHeaders: limited, RateLimitResetAt: time.Now().Add(-time.Minute)},
+		&OAuthCredentials{AccountUUID: "disabled-reset-passed", Disabled: true, RateLimitHeaders: limited, RateLimitResetAt: time.Now().Add(-time.Hour)},
+		&OAuthCredentials{AccountUUID: "reset-pending", RateLimitHeaders: limited, RateLimitResetAt: time.Now().Add(time.Hour)},
+		&OAuthCredentials{AccountUUID: "no-reset", RateLimitHeaders: limited},
+	)
+
+	// Sweeps on several instances at once clear each account exactly once
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	total := 0
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cleared, err := store.ClearExpiredRateLimits(ctx)
+			if err != nil {
+				t.Errorf("ClearExpiredRateLimits returned error: %v", err)
+			}
+			mu.Lock()
+			total += cleared
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if total != 2 {
+		t.Errorf("expected 2 accounts cleared across concurrent sweeps, got %d", total)
+	}
+
+	for uuid, wantHeaders := range map[string]bool{"reset-passed": false, "disabled-reset-passed": false, "reset-pending": true, "no-reset": true} {
+		doc, err := tokens.Doc(uuid).Get(ctx)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", uuid, err)
+		}
+		var stored OAuthCredentials
+		if err := doc.DataTo(&stored); err != nil {
+			t.Fatalf("failed to parse %s: %v", uuid, err)
+		}
+		if hasHeaders := stored.RateLimitHeaders != nil; hasHeaders != wantHeaders {
+			t.Errorf("%s: expected saved headers %v, got %v", uuid, wantHeaders, hasHeaders)
+		}
+	}
+}
+
+// accountUUIDs lists the account UUIDs of credentials, for test messages
+func accountUUIDs(credentials []*OAuthCredentials) []string {
+	uuids := make([]string, 0, len(credentials))
+	for _, cred := range credentials {
+		uuids = append(uuids, cred.AccountUUID)
+	}
+	return uuids
+}
@@ -0,0 +1,322 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SelectionRequest carries what strategies may use to choose an account for a user
+type SelectionRequest struct {
+	UserID string
+	// Model is the requested model, when the proxy read it from the request body
+	Model string
+	// PreviousAccountUUID is the account of the user's expiring binding, if any
+	PreviousAccountUUID string
+	// PreviousOrgUUID is the organization of PreviousAccountUUID, filled in by the store
+	PreviousOrgUUID string
+}
+
+// SelectionStrategy picks an account from healthy candidates (not rate-limited, under their points cap).
+// Returning nil defers to the next strategy in the chain.
+type SelectionStrategy interface {
+	Name() string
+	Select(ctx context.Context, req SelectionRequest, candidates []*OAuthCredentials) *OAuthCredentials
+}
+
+// SelectionChain tries strategies in order and stops at the first that picks an account
+type SelectionChain []SelectionStrategy
+
+// DefaultSelectionChain is the chain used when none is configured: a uniformly random pick
+const DefaultSelectionChain = "random"
+
+// Select runs the chain; a random pick is the final fallback so a non-empty pool always yields an account
+func (chain SelectionChain) Select(ctx context.Context, req SelectionRequest, candidates []*OAuthCredentials) (*OAuthCredentials, error) {
+	for _, strategy := range chain {
+		if picked := strategy.Select(ctx, req, candidates); picked != nil {
+			log.Printf("[OAUTH] Selection strategy %s picked account %s for user %s", strategy.Name(), picked.AccountUUID, req.UserID)
+			return picked, nil
+		}
+	}
+	return pickRandomCredential(candidates)
+}
+
+// UsesModel reports whether any strategy needs SelectionRequest.Model
+func (chain SelectionChain) UsesModel() bool {
+	for _, strategy := range chain {
+		if _, ok := strategy.(*modelPoolStrategy); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSelectionChain builds a chain from a comma-separated list of strategy names:
+// org (stay in the previous account's organization), model-pool (accounts assigned to the model),
+// cost (least daily points used), headroom (weighted by remaining daily cost cap), lru (least recently
+// picked) and random. modelPools is the ACCOUNT_MODEL_POOLS value.
+func ParseSelectionChain(spec string, modelPools string, store *OAuthStore) (SelectionChain, error) {
+	if strings.TrimSpace(spec) == "" {
+		spec = DefaultSelectionChain
+	}
+
+	var chain SelectionChain
+	for _, name := range strings.Split(spec, ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "":
+			continue
+		case "org":
+			chain = append(chain, orgScopedStrategy{})
+		case "model-pool":
+			pools, err := parseModelPools(modelPools)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, &modelPoolStrategy{pools: pools})
+		case "cost":
+			chain = append(chain, costAwareStrategy{dailyPoints: store.getAccountDailyPoints})
+		case "headroom":
+			chain = append(chain, headroomStrategy{limits: store.getAccountCostLimits, dailyCost: store.getAccountDailyCost, random: rand.Float64})
+		case "lru":
+			chain = append(chain, newLRUStrategy(store.markAccountUsed))
+		case "random":
+			chain = append(chain, randomStrategy{})
+		default:
+			return nil, fmt.Errorf("unknown selection strategy %q", name)
+		}
+	}
+	return chain, nil
+}
+
+// orgScopedStrategy keeps a user in the organization of their previous account
+type orgScopedStrategy struct{}
+
+func (orgScopedStrategy) Name() string { return "org" }
+
+func (orgScopedStrategy) Select(ctx context.Context, req SelectionRequest, candidates []*OAuthCredentials) *OAuthCredentials {
+	if req.PreviousOrgUUID == "" {
+		return nil
+	}
+	var sameOrg []*OAuthCredentials
+	for _, cred := range candidates {
+		if cred.OrganizationUUID == req.PreviousOrgUUID {
+			sameOrg = append(sameOrg, cred)
+		}
+	}
+	picked, _ := pickRandomCredential(sameOrg)
+	return picked
+}
+
+// modelPoolStrategy picks from the accounts assigned to the requested model
+type modelPoolStrategy struct {
+	pools map[string]map[string]bool // model pattern -> account UUIDs
+}
+
+// parseModelPools parses "pattern=uuid1|uuid2,pattern=uuid3"; a pattern matches models containing it
+func parseModelPools(value string) (map[string]map[string]bool, error) {
+	pools := make(map[string]map[string]bool)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		pattern, accounts, found := strings.Cut(part, "=")
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if !found || pattern == "" {
+			return nil, fmt.Errorf("invalid model pool %q, expected pattern=uuid1|uuid2", part)
+		}
+		pools[pattern] = make(map[string]bool)
+		for _, accountUUID := range strings.Split(accounts, "|") {
+			if accountUUID = strings.TrimSpace(accountUUID); accountUUID != "" {
+				pools[pattern][accountUUID] = true
+			}
+		}
+	}
+	return pools, nil
+}
+
+func (*modelPoolStrategy) Name() string { return "model-pool" }
+
+func (s *modelPoolStrategy) Select(ctx context.Context, req SelectionRequest, candidates []*OAuthCredentials) *OAuthCredentials {
+	if req.Model == "" {
+		return nil
+	}
+	// The longest matching pattern wins so a specific model can override its family's pool
+	model := strings.ToLower(req.Model)
+	bestPattern := ""
+	for pattern := range s.pools {
+		if strings.Contains(model, pattern) && len(pattern) > len(bestPattern) {
+			bestPattern = pattern
+		}
+	}
+	if bestPattern == "" {
+		return nil
+	}
+
+	var pooled []*OAuthCredentials
+	for _, cred := range candidates {
+		if s.pools[bestPattern][cred.AccountUUID] {
+			pooled = append(pooled, cred)
+		}
+	}
+	picked, _ := pickRandomCredential(pooled)
+	return picked
+}
+
+// costAwareStrategy picks the account that has used the fewest points in the current daily window
+type costAwareStrategy struct {
+	dailyPoints func(ctx context.Context, accountUUID string) (float64, error)
+}
+
+func (costAwareStrategy) Name() string { return "cost" }
+
+func (s costAwareStrategy) Select(ctx context.Context, req SelectionRequest, candidates []*OAuthCredentials) *OAuthCredentials {
+	var cheapest *OAuthCredentials
+	var cheapestPoints float64
+	for _, cred := range candidates {
+		points, err := s.dailyPoints(ctx, cred.AccountUUID)
+		if err != nil {
+			log.Printf("[OAUTH] Cost-aware selection skipping account %s: %v", cred.AccountUUID, err)
+			continue
+		}
+		if cheapest == nil || points < cheapestPoints {
+			cheapest, cheapestPoints = cred, points
+		}
+	}
+	return cheapest
+}
+
+// headroomStrategy picks at random with probability proportional to each account's remaining daily
+// cost cap, so accounts on larger plans take a larger share of new users. Accounts without a cap are
+// weighted like the capped account with the most headroom. Defers when no caps are configured.
+type headroomStrategy struct {
+	limits    func(ctx context.Context) (map[string]float64, error)
+	dailyCost func(ctx context.Context, accountUUID string) (float64, error)
+	random    func() float64 // Uniform in [0, 1)
+}
+
+func (headroomStrategy) Name() string { return "headroom" }
+
+func (s headroomStrategy) Select(ctx context.Context, req SelectionRequest, candidates []*OAuthCredentials) *OAuthCredentials {
+	limits, err := s.limits(ctx)
+	if err != nil {
+		log.Printf("[OAUTH] Headroom selection skipped: %v", err)
+		return nil
+	}
+	if len(limits) == 0 {
+		return nil
+	}
+
+	headroom := make(map[string]float64, len(candidates))
+	var weighted, uncapped []*OAuthCredentials
+	maxHeadroom := 0.0
+	for _, cred := range candidates {
+		limit, capped := limits[cred.AccountUUID]
+		if !capped {
+			uncapped = append(uncapped, cred)
+			continue
+		}
+		cost, err := s.dailyCost(ctx, cred.AccountUUID)
+		if err != nil {
+			log.Printf("[OAUTH] Headroom selection skipping account %s: %v", cred.AccountUUID, err)
+			continue
+		}
+		if remaining := limit - cost; remaining > 0 {
+			headroom[cred.AccountUUID] = remaining
+			weighted = append(weighted, cred)
+			maxHeadroom = max(maxHeadroom, remaining)
+		}
+	}
+	for _, cred := range uncapped {
+		if maxHeadroom > 0 {
+			headroom[cred.AccountUUID] = maxHeadroom
+			weighted = append(weighted, cred)
+		}
+	}
+	return pickWeighted(weighted, headroom, s.random())
+}
+
+// pickWeighted picks the credential at fraction r (in [0, 1)) of the cumulative weights (pure function)
+func pickWeighted(credentials []*OAuthCredentials, weights map[string]float64, r float64) *OAuthCredentials {
+	total := 0.0
+	for _, cred := range credentials {
+		total += weights[cred.AccountUUID]
+	}
+	if total <= 0 {
+		return nil
+	}
+
+	target := r * total
+	for _, cred := range credentials {
+		target -= weights[cred.AccountUUID]
+		if target < 0 {
+			return cred
+		}
+	}
+	return credentials[len(credentials)-1]
+}
+
+// lruStrategy picks the account whose last pick is oldest, spreading new bindings round-robin across
+// the pool. Picks are remembered in memory and persisted as last_used_at, so instances sharing the pool
+// also see each other's picks once they reload the accounts.
+type lruStrategy struct {
+	mu       sync.Mutex
+	lastUsed map[string]time.Time // Picks made by this instance, by account UUID
+	now      func() time.Time
+	persist  func(ctx context.Context, accountUUID string, at time.Time) error
+}
+
+func newLRUStrategy(persist func(ctx context.Context, accountUUID string, at time.Time) error) *lruStrategy {
+	return &lruStrategy{
+		lastUsed: make(map[string]time.Time),
+		now:      time.Now,
+		persist:  persist,
+	}
+}
+
+func (*lruStrategy) Name() string { return "lru" }
+
+func (s *lruStrategy) Select(ctx context.Context, req SelectionRequest, candidates []*OAuthCredentials) *OAuthCredentials {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var picked *OAuthCredentials
+	var pickedLastUsed time.Time
+	for _, cred := range candidates {
+		lastUsed := cred.LastUsedAt
+		if local := s.lastUsed[cred.AccountUUID]; local.After(lastUsed) {
+			lastUsed = local
+		}
+		if picked == nil || lastUsed.Before(pickedLastUsed) {
+			picked, pickedLastUsed = cred, lastUsed
+		}
+	}
+	if picked == nil {
+		return nil
+	}
+
+	now := s.now()
+	s.lastUsed[picked.AccountUUID] = now
+	if s.persist != nil {
+		go func(accountUUID string) {
+			if err := s.persist(context.Background(), accountUUID, now); err != nil {
+				log.Printf("[OAUTH] Failed to record last use of account %s: %v", accountUUID, err)
+			}
+		}(picked.AccountUUID)
+	}
+	return picked
+}
+
+// randomStrategy picks uniformly at random
+type randomStrategy struct{}
+
+func (randomStrategy) Name() string { return "random" }
+
+func (randomStrategy) Select(ctx context.Context, req SelectionRequest, candidates []*OAuthCredentials) *OAuthCredentials {
+	picked, _ := pickRandomCredential(candidates)
+	return picked
+}
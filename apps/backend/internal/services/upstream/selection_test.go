@@ -0,0 +1,273 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// stubStrategy returns a fixed pick and records whether it ran
+type stubStrategy struct {
+	name   string
+	pick   *OAuthCredentials
+	called bool
+}
+
+func (s *stubStrategy) Name() string { return s.name }
+
+func (s *stubStrategy) Select(ctx context.Context, req SelectionRequest, candidates []*OAuthCredentials) *OAuthCredentials {
+	s.called = true
+	return s.pick
+}
+
+func TestSelectionChain_FallsThroughToNextStrategy(t *testing.T) {
+	candidates := []*OAuthCredentials{{AccountUUID: "a"}, {AccountUUID: "b"}}
+	first := &stubStrategy{name: "first"}
+	second := &stubStrategy{name: "second", pick: candidates[1]}
+	third := &stubStrategy{name: "third", pick: candidates[0]}
+
+	picked, err := SelectionChain{first, second, third}.Select(context.Background(), SelectionRequest{}, candidates)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if picked.AccountUUID != "b" {
+		t.Errorf("expected the second strategy's pick b, got %s", picked.AccountUUID)
+	}
+	if !first.called || !second.called {
+		t.Errorf("expected the first two strategies to run")
+	}
+	if third.called {
+		t.Errorf("chain should stop at the first strategy that picks an account")
+	}
+}
+
+func TestSelectionChain_FallsBackToRandomWhenNothingPicks(t *testing.T) {
+	candidates := []*OAuthCredentials{{AccountUUID: "a"}}
+	chain := SelectionChain{&stubStrategy{name: "empty"}, orgScopedStrategy{}}
+
+	picked, err := chain.Select(context.Background(), SelectionRequest{}, candidates)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if picked.AccountUUID != "a" {
+		t.Errorf("expected fallback pick a, got %s", picked.AccountUUID)
+	}
+
+	if _, err := chain.Select(context.Background(), SelectionRequest{}, nil); err == nil {
+		t.Errorf("expected an error with no candidates")
+	}
+}
+
+func TestOrgScopedStrategy(t *testing.T) {
+	candidates := []*OAuthCredentials{
+		{AccountUUID: "a", OrganizationUUID: "org-1"},
+		{AccountUUID: "b", OrganizationUUID: "org-2"},
+	}
+	strategy := orgScopedStrategy{}
+
+	if picked := strategy.Select(context.Background(), SelectionRequest{PreviousOrgUUID: "org-2"}, candidates); picked == nil || picked.AccountUUID != "b" {
+		t.Errorf("expected account b from org-2, got %v", picked)
+	}
+	if picked := strategy.Select(context.Background(), SelectionRequest{PreviousOrgUUID: "org-3"}, candidates); picked != nil {
+		t.Errorf("expected no pick for an org without healthy accounts, got %s", picked.AccountUUID)
+	}
+	if picked := strategy.Select(context.Background(), SelectionRequest{}, candidates); picked != nil {
+		t.Errorf("expected no pick without a previous org, got %s", picked.AccountUUID)
+	}
+}
+
+func TestModelPoolStrategy_LongestPatternWins(t *testing.T) {
+	pools, err := parseModelPools("opus=a|b, opus-4-1=c")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	strategy := &modelPoolStrategy{pools: pools}
+	candidates := []*OAuthCredentials{{AccountUUID: "a"}, {AccountUUID: "c"}, {AccountUUID: "d"}}
+
+	if picked := strategy.Select(context.Background(), SelectionRequest{Model: "claude-opus-4-1-20250805"}, candidates); picked == nil || picked.AccountUUID != "c" {
+		t.Errorf("expected the opus-4-1 pool account c, got %v", picked)
+	}
+	if picked := strategy.Select(context.Background(), SelectionRequest{Model: "Claude-Opus-4-20250514"}, candidates); picked == nil || picked.AccountUUID != "a" {
+		t.Errorf("expected the opus pool account a, got %v", picked)
+	}
+	if picked := strategy.Select(context.Background(), SelectionRequest{Model: "claude-sonnet-4-20250514"}, candidates); picked != nil {
+		t.Errorf("expected no pick for a model without a pool, got %s", picked.AccountUUID)
+	}
+	if picked := strategy.Select(context.Background(), SelectionRequest{Model: "claude-opus-4-1"}, []*OAuthCredentials{{AccountUUID: "d"}}); picked != nil {
+		t.Errorf("expected no pick when the pool has no healthy accounts, got %s", picked.AccountUUID)
+	}
+}
+
+func TestCostAwareStrategy_PicksLeastUsedAndSkipsErrors(t *testing.T) {
+	usage := map[string]float64{"a": 500, "b": 100, "c": 50}
+	strategy := costAwareStrategy{dailyPoints: func(ctx context.Context, accountUUID string) (float64, error) {
+		if accountUUID == "c" {
+			return 0, errors.New("read failed")
+		}
+		return usage[accountUUID], nil
+	}}
+	candidates := []*OAuthCredentials{{AccountUUID: "a"}, {AccountUUID: "b"}, {AccountUUID: "c"}}
+
+	if picked := strategy.Select(context.Background(), SelectionRequest{}, candidates); picked == nil || picked.AccountUUID != "b" {
+		t.Errorf("expected least used account b, got %v", picked)
+	}
+	if picked := strategy.Select(context.Background(), SelectionRequest{}, candidates[2:]); picked != nil {
+		t.Errorf("expected no pick when every usage read fails, got %s", picked.AccountUUID)
+	}
+}
+
+func TestHeadroomStrategy_FavorsAccountWithMoreHeadroom(t *testing.T) {
+	limits := map[string]float64{"large": 100, "small": 100}
+	usage := map[string]float64{"large": 10, "small": 80} // 90 vs 20 headroom
+	rng := rand.New(rand.NewSource(1))
+	strategy := headroomStrategy{
+		limits:    func(ctx context.Context) (map[string]float64, error) { return limits, nil },
+		dailyCost: func(ctx context.Context, accountUUID string) (float64, error) { return usage[accountUUID], nil },
+		random:    rng.Float64,
+	}
+	candidates := []*OAuthCredentials{{AccountUUID: "large"}, {AccountUUID: "small"}}
+
+	picks := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		picked := strategy.Select(context.Background(), SelectionRequest{}, candidates)
+		if picked == nil {
+			t.Fatal("expected a pick when accounts have headroom")
+		}
+		picks[picked.AccountUUID]++
+	}
+	// Expected share of large is 90/110, about 82%
+	if share := float64(picks["large"]) / 10000; share < 0.78 || share > 0.86 {
+		t.Errorf("expected large to get about 82%% of picks, got %.1f%% (%v)", share*100, picks)
+	}
+}
+
+func TestHeadroomStrategy_DefersWithoutLimits(t *testing.T) {
+	strategy := headroomStrategy{
+		limits:    func(ctx context.Context) (map[string]float64, error) { return map[string]float64{}, nil },
+		dailyCost: func(ctx context.Context, accountUUID string) (float64, error) { return 0, nil },
+		random:    func() float64 { return 0 },
+	}
+	if picked := strategy.Select(context.Background(), SelectionRequest{}, []*OAuthCredentials{{AccountUUID: "a"}}); picked != nil {
+		t.Errorf("expected no pick without cost caps, got %s", picked.AccountUUID)
+	}
+}
+
+func TestPickWeighted(t *testing.T) {
+	candidates := []*OAuthCredentials{{AccountUUID: "capped"}, {AccountUUID: "exhausted"}, {AccountUUID: "uncapped"}}
+	weights := map[string]float64{"capped": 30, "uncapped": 70}
+
+	for _, tc := range []struct {
+		r    float64
+		want string
+	}{{0, "capped"}, {0.29, "capped"}, {0.3, "uncapped"}, {0.99, "uncapped"}} {
+		if picked := pickWeighted(candidates, weights, tc.r); picked == nil || picked.AccountUUID != tc.want {
+			t.Errorf("r=%v: expected %s, got %v", tc.r, tc.want, picked)
+		}
+	}
+	if picked := pickWeighted(candidates, map[string]float64{}, 0.5); picked != nil {
+		t.Errorf("expected no pick without weights, got %s", picked.AccountUUID)
+	}
+}
+
+func TestParseSelectionChain(t *testing.T) {
+	chain, err := ParseSelectionChain("org, model-pool ,cost,headroom,lru,random", "opus=a", &OAuthStore{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var names []string
+	for _, strategy := range chain {
+		names = append(names, strategy.Name())
+	}
+	if len(names) != 6 || names[0] != "org" || names[1] != "model-pool" || names[2] != "cost" || names[3] != "headroom" || names[4] != "lru" || names[5] != "random" {
+		t.Errorf("unexpected chain order %v", names)
+	}
+	if !chain.UsesModel() {
+		t.Errorf("chain with model-pool should use the model")
+	}
+
+	chain, err = ParseSelectionChain("", "", nil)
+	if err != nil || len(chain) != 1 || chain[0].Name() != "random" {
+		t.Errorf("expected the default random chain, got %v (err %v)", chain, err)
+	}
+	if chain.UsesModel() {
+		t.Errorf("default chain should not use the model")
+	}
+
+	if _, err := ParseSelectionChain("org,fastest", "", nil); err == nil {
+		t.Errorf("expected an error for an unknown strategy")
+	}
+	if _, err := ParseSelectionChain("model-pool", "opus", nil); err == nil {
+		t.Errorf("expected an error for a pool without accounts")
+	}
+}
+
+func TestFindOrganizationUUID(t *testing.T) {
+	credentials := []*OAuthCredentials{
+		{AccountUUID: "a", OrganizationUUID: "org-1"},
+		{AccountUUID: "b", OrganizationUUID: "org-2"},
+	}
+	if got := findOrganizationUUID(credentials, "b"); got != "org-2" {
+		t.Errorf("expected org-2, got %q", got)
+	}
+	if got := findOrganizationUUID(credentials, "missing"); got != "" {
+		t.Errorf("expected empty org for an unknown account, got %q", got)
+	}
+}
+
+func TestLRUStrategy_RotatesAcrossAccounts(t *testing.T) {
+	candidates := []*OAuthCredentials{{AccountUUID: "a"}, {AccountUUID: "b"}, {AccountUUID: "c"}}
+	clock := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	strategy := newLRUStrategy(nil)
+	strategy.now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+
+	picks := make(map[string]int)
+	var order []string
+	for i := 0; i < 9; i++ {
+		picked := strategy.Select(context.Background(), SelectionRequest{}, candidates)
+		picks[picked.AccountUUID]++
+		order = append(order, picked.AccountUUID)
+	}
+
+	for _, cred := range candidates {
+		if picks[cred.AccountUUID] != 3 {
+			t.Errorf("expected every account to be picked 3 times, got %v", picks)
+			break
+		}
+	}
+	for i := 3; i < len(order); i++ {
+		if order[i] != order[i-3] {
+			t.Errorf("expected a round-robin order, got %v", order)
+			break
+		}
+	}
+}
+
+func TestLRUStrategy_PrefersOldestPersistedUse(t *testing.T) {
+	now := time.Now()
+	candidates := []*OAuthCredentials{
+		{AccountUUID: "recent", LastUsedAt: now.Add(-time.Minute)},
+		{AccountUUID: "oldest", LastUsedAt: now.Add(-time.Hour)},
+		{AccountUUID: "older", LastUsedAt: now.Add(-10 * time.Minute)},
+	}
+	persisted := make(chan string, 1)
+	strategy := newLRUStrategy(func(ctx context.Context, accountUUID string, at time.Time) error {
+		persisted <- accountUUID
+		return nil
+	})
+
+	if picked := strategy.Select(context.Background(), SelectionRequest{}, candidates); picked.AccountUUID != "oldest" {
+		t.Errorf("expected the least recently used account, got %s", picked.AccountUUID)
+	}
+	if accountUUID := <-persisted; accountUUID != "oldest" {
+		t.Errorf("expected the pick to be persisted, got %s", accountUUID)
+	}
+	// This instance's own pick outranks the stale persisted timestamp
+	if picked := strategy.Select(context.Background(), SelectionRequest{}, candidates); picked.AccountUUID != "older" {
+		t.Errorf("expected the next least recently used account, got %s", picked.AccountUUID)
+	}
+}
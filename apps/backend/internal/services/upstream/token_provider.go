@@ -0,0 +1,220 @@
+package upstream
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TokenProvider is what the proxy needs from the upstream account pool: a token per user and
+// feedback about how the token's account behaved. OAuthStore implements it on Firestore;
+// MemoryTokenProvider implements it in memory for tests.
+type TokenProvider interface {
+	GetValidTokenForUser(userID string) (*UserTokenBinding, error)
+	// GetValidTokenForModel is GetValidTokenForUser with the requested model passed to account selection
+	GetValidTokenForModel(userID string, model string) (*UserTokenBinding, error)
+	ClearUserTokenBinding(userID string) error
+	// ClearAccountBindings clears every user's binding to the account, returning the affected users
+	ClearAccountBindings(accountUUID string) ([]string, error)
+	SaveRateLimitHeadersByToken(accessToken string, headers map[string]string) error
+	RecordTokenBudget(accountUUID string, remaining int, resetAt time.Time)
+	// SelectionUsesModel reports whether GetValidTokenForModel needs the model to choose an account
+	SelectionUsesModel() bool
+	DisableAccountByToken(accessToken string, reason string) (string, error)
+	RebindUser(userID string) (*UserTokenBinding, error)
+}
+
+var (
+	_ TokenProvider = (*OAuthStore)(nil)
+	_ TokenProvider = (*MemoryTokenProvider)(nil)
+)
+
+// MemoryTokenProvider keeps accounts and user bindings in memory. Accounts are picked in UUID
+// order so tests are deterministic; disabled accounts and accounts rate limited until a later reset are
+// skipped as in OAuthStore.
+type MemoryTokenProvider struct {
+	mu       sync.Mutex
+	accounts map[string]*OAuthCredentials // by account UUID
+	bindings map[string]*UserTokenBinding // by user ID
+	budgets  map[string]tokenBudget       // last reported remaining tokens by account UUID
+}
+
+// NewMemoryTokenProvider creates an in-memory pool holding copies of the given accounts
+func NewMemoryTokenProvider(accounts ...*OAuthCredentials) *MemoryTokenProvider {
+	provider := &MemoryTokenProvider{
+		accounts: make(map[string]*OAuthCredentials),
+		bindings: make(map[string]*UserTokenBinding),
+		budgets:  make(map[string]tokenBudget),
+	}
+	for _, account := range accounts {
+		copied := *account
+		provider.accounts[account.AccountUUID] = &copied
+	}
+	return provider
+}
+
+func (p *MemoryTokenProvider) GetValidTokenForUser(userID string) (*UserTokenBinding, error) {
+	return p.GetValidTokenForModel(userID, "")
+}
+
+func (p *MemoryTokenProvider) GetValidTokenForModel(userID string, model string) (*UserTokenBinding, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// As in OAuthStore, a binding to an account that was rate limited since is moved to a fresh account
+	if binding, exists := p.bindings[userID]; exists && binding.ExpiresAt.After(time.Now()) {
+		if account := p.accounts[binding.AccountUUID]; account == nil || !account.IsRateLimited(time.Now()) {
+			copied := *binding
+			return &copied, nil
+		}
+	}
+
+	account := p.pickAccountLocked()
+	if account == nil {
+		return nil, fmt.Errorf("no valid OAuth credentials available")
+	}
+	binding := &UserTokenBinding{
+		UserID:      userID,
+		AccountUUID: account.AccountUUID,
+		AccessToken: account.AccessToken,
+		ExpiresAt:   account.ExpiresAt,
+	}
+	p.bindings[userID] = binding
+	copied := *binding
+	return &copied, nil
+}
+
+// pickAccountLocked returns the first usable account in UUID order, or nil
+func (p *MemoryTokenProvider) pickAccountLocked() *OAuthCredentials {
+	uuids := make([]string, 0, len(p.accounts))
+	for accountUUID := range p.accounts {
+		uuids = append(uuids, accountUUID)
+	}
+	sort.Strings(uuids)
+
+	now := time.Now()
+	for _, accountUUID := range uuids {
+		account := p.accounts[accountUUID]
+		if account.Disabled || account.IsRateLimited(now) || !account.ExpiresAt.After(now) {
+			continue
+		}
+		return account
+	}
+	return nil
+}
+
+func (p *MemoryTokenProvider) ClearUserTokenBinding(userID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.bindings, userID)
+	return nil
+}
+
+func (p *MemoryTokenProvider) ClearAccountBindings(accountUUID string) ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var cleared []string
+	for userID, binding := range p.bindings {
+		if binding.AccountUUID == accountUUID {
+			delete(p.bindings, userID)
+			cleared = append(cleared, userID)
+		}
+	}
+	sort.Strings(cleared)
+	return cleared, nil
+}
+
+func (p *MemoryTokenProvider) SaveRateLimitHeadersByToken(accessToken string, headers map[string]string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	account := p.accountByTokenLocked(accessToken)
+	if account == nil {
+		return fmt.Errorf("no OAuth token found with access token")
+	}
+	now := time.Now()
+	account.RateLimitHeaders = headers
+	account.RateLimitResetAt = RateLimitResetTime(headers, now)
+	account.UpdatedAt = now
+	return nil
+}
+
+func (p *MemoryTokenProvider) RecordTokenBudget(accountUUID string, remaining int, resetAt time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.budgets[accountUUID] = newTokenBudget(remaining, resetAt, time.Now())
+}
+
+func (p *MemoryTokenProvider) SelectionUsesModel() bool {
+	return false
+}
+
+func (p *MemoryTokenProvider) DisableAccountByToken(accessToken string, reason string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	account := p.accountByTokenLocked(accessToken)
+	if account == nil {
+		return "", fmt.Errorf("no OAuth token found with access token")
+	}
+	account.Disabled = true
+	account.DisabledReason = reason
+	// Bindings to a disabled account are dropped, as OAuthStore evicts them from its cache
+	for userID, binding := range p.bindings {
+		if binding.AccountUUID == account.AccountUUID {
+			delete(p.bindings, userID)
+		}
+	}
+	return account.AccountUUID, nil
+}
+
+func (p *MemoryTokenProvider) RebindUser(userID string) (*UserTokenBinding, error) {
+	if err := p.ClearUserTokenBinding(userID); err != nil {
+		return nil, err
+	}
+	return p.GetValidTokenForUser(userID)
+}
+
+// Account returns a copy of an account's current state
+func (p *MemoryTokenProvider) Account(accountUUID string) (OAuthCredentials, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	account, exists := p.accounts[accountUUID]
+	if !exists {
+		return OAuthCredentials{}, false
+	}
+	return *account, true
+}
+
+// Binding returns a copy of the user's current binding
+func (p *MemoryTokenProvider) Binding(userID string) (UserTokenBinding, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	binding, exists := p.bindings[userID]
+	if !exists {
+		return UserTokenBinding{}, false
+	}
+	return *binding, true
+}
+
+// TokenBudget returns the last remaining-token value recorded for an account, unless it has expired
+func (p *MemoryTokenProvider) TokenBudget(accountUUID string) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	budget, known := p.budgets[accountUUID]
+	if !known || !time.Now().Before(budget.expiresAt) {
+		return 0, false
+	}
+	return budget.remaining, true
+}
+
+// accountByTokenLocked finds the account currently holding accessToken
+func (p *MemoryTokenProvider) accountByTokenLocked(accessToken string) *OAuthCredentials {
+	for _, account := range p.accounts {
+		if account.AccessToken == accessToken {
+			return account
+		}
+	}
+	return nil
+}
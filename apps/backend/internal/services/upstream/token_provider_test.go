@@ -0,0 +1,67 @@
+package upstream
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryTokenProvider_SkipsUnusableAccounts(t *testing.T) {
+	valid := time.Now().Add(time.Hour)
+	provider := NewMemoryTokenProvider(
+		&OAuthCredentials{AccountUUID: "a-disabled", AccessToken: "token-1", ExpiresAt: valid, Disabled: true},
+		&OAuthCredentials{AccountUUID: "b-limited", AccessToken: "token-2", ExpiresAt: valid, RateLimitHeaders: map[string]string{"retry-after": "60"}, RateLimitResetAt: valid},
+		&OAuthCredentials{AccountUUID: "c-expired", AccessToken: "token-3", ExpiresAt: time.Now().Add(-time.Minute)},
+		&OAuthCredentials{AccountUUID: "d-ok", AccessToken: "token-4", ExpiresAt: valid},
+	)
+
+	binding, err := provider.GetValidTokenForUser("user-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if binding.AccountUUID != "d-ok" || binding.AccessToken != "token-4" {
+		t.Errorf("expected the only usable account d-ok, got %+v", binding)
+	}
+
+	// Disabling the account drops its bindings, leaving nothing to migrate to
+	if _, err := provider.DisableAccountByToken("token-4", "test"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, exists := provider.Binding("user-1"); exists {
+		t.Errorf("expected the binding to the disabled account to be dropped")
+	}
+	if _, err := provider.GetValidTokenForUser("user-1"); err == nil {
+		t.Errorf("expected an error once no usable account is left")
+	}
+	if _, err := provider.RebindUser("user-1"); err == nil {
+		t.Errorf("expected an error once no usable account is left")
+	}
+}
+
+func TestMemoryTokenProvider_RebindsWhenBoundAccountIsRateLimited(t *testing.T) {
+	valid := time.Now().Add(time.Hour)
+	provider := NewMemoryTokenProvider(
+		&OAuthCredentials{AccountUUID: "a", AccessToken: "token-a", ExpiresAt: valid},
+		&OAuthCredentials{AccountUUID: "b", AccessToken: "token-b", ExpiresAt: valid},
+	)
+	if binding, err := provider.GetValidTokenForUser("user-1"); err != nil || binding.AccountUUID != "a" {
+		t.Fatalf("expected user-1 bound to a, got %+v (err %v)", binding, err)
+	}
+
+	if err := provider.SaveRateLimitHeadersByToken("token-a", map[string]string{"retry-after": "60"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	binding, err := provider.GetValidTokenForUser("user-1")
+	if err != nil || binding.AccountUUID != "b" {
+		t.Errorf("expected user-1 rebound to b, got %+v (err %v)", binding, err)
+	}
+}
+
+func TestMemoryTokenProvider_UnknownToken(t *testing.T) {
+	provider := NewMemoryTokenProvider()
+	if err := provider.SaveRateLimitHeadersByToken("missing", map[string]string{}); err == nil {
+		t.Errorf("expected an error for an unknown token")
+	}
+	if _, err := provider.DisableAccountByToken("missing", "test"); err == nil {
+		t.Errorf("expected an error for an unknown token")
+	}
+}
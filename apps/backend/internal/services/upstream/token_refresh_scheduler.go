@@ -0,0 +1,118 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// DefaultRefreshLookahead is how long before expiry the scheduler refreshes a token by default
+const DefaultRefreshLookahead = 10 * time.Minute
+
+// tokenRefreshLease names the lease electing the instance that runs the scheduler
+const tokenRefreshLease = "token_refresh_scheduler"
+
+// refreshLeaseIntervals is how many missed runs the leader may skip before another instance takes over
+const refreshLeaseIntervals = 3
+
+// TokenRefreshScheduler refreshes OAuth tokens in the background shortly before they expire, so
+// requests almost never wait on a refresh. A token is refreshed once it expires within the lookahead;
+// the refresh transaction skips tokens another instance already refreshed. Only the instance holding
+// the scheduler's lease runs it, so instances don't race each other for every token.
+type TokenRefreshScheduler struct {
+	lookahead time.Duration
+	elect     func(ctx context.Context, ttl time.Duration) (bool, error) // nil runs on every instance
+	load      func(ctx context.Context) ([]*OAuthCredentials, error)
+	refresh   func(credentials *OAuthCredentials, lookahead time.Duration) (*OAuthCredentials, error)
+	now       func() time.Time
+}
+
+// NewTokenRefreshScheduler creates a scheduler refreshing the store's tokens that expire within lookahead
+func NewTokenRefreshScheduler(store *OAuthStore, lookahead time.Duration) *TokenRefreshScheduler {
+	return &TokenRefreshScheduler{
+		lookahead: lookahead,
+		elect:     NewLease(store.db, tokenRefreshLease).Acquire,
+		load:      store.loadCredentials,
+		refresh:   NewOAuthRefresher(store).RefreshCredentialsWithin,
+		now:       time.Now,
+	}
+}
+
+// RefreshExpiring refreshes every enabled, not rate-limited account whose token expires within the
+// lookahead and returns how many were refreshed. A failed refresh is logged and left to the next run or request.
+func (s *TokenRefreshScheduler) RefreshExpiring(ctx context.Context) (int, error) {
+	credentials, err := s.load(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	refreshed := 0
+	for _, cred := range credentialsExpiringWithin(credentials, s.now(), s.lookahead) {
+		updated, err := s.refresh(cred, s.lookahead)
+		if err != nil {
+			log.Printf("[OAUTH] Proactive refresh of account %s failed: %v", cred.AccountUUID, err)
+			continue
+		}
+		log.Printf("[OAUTH] Proactively refreshed account %s, new expiry: %s",
+			cred.AccountUUID, updated.ExpiresAt.Format(time.RFC3339))
+		refreshed++
+	}
+	return refreshed, nil
+}
+
+// Run refreshes expiring tokens on every interval until ctx is done, while this instance holds the lease
+func (s *TokenRefreshScheduler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if s.isLeader(ctx, interval) {
+			if _, err := s.RefreshExpiring(ctx); err != nil {
+				log.Printf("[OAUTH] Failed to check for expiring tokens: %v", err)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// isLeader takes or renews the scheduler's lease; a leader that stops renewing it is replaced after
+// refreshLeaseIntervals runs. Requests still refresh expired tokens inline when no instance leads.
+func (s *TokenRefreshScheduler) isLeader(ctx context.Context, interval time.Duration) bool {
+	if s.elect == nil {
+		return true
+	}
+	held, err := s.elect(ctx, refreshLeaseIntervals*interval)
+	if err != nil {
+		log.Printf("[OAUTH] Failed to acquire the token refresh lease: %v", err)
+		return false
+	}
+	return held
+}
+
+// credentialsExpiringWithin returns the enabled credentials that expire before now+lookahead (pure function).
+// Rate-limited accounts are left to the request path, which only refreshes them once they are usable again.
+func credentialsExpiringWithin(credentials []*OAuthCredentials, now time.Time, lookahead time.Duration) []*OAuthCredentials {
+	deadline := now.Add(lookahead)
+	var expiring []*OAuthCredentials
+	for _, cred := range credentials {
+		if !cred.Disabled && !cred.IsRateLimited(now) && cred.ExpiresAt.Before(deadline) {
+			expiring = append(expiring, cred)
+		}
+	}
+	return expiring
+}
+
+// loadCredentials reads every account from the oauth_tokens collection
+func (store *OAuthStore) loadCredentials(ctx context.Context) ([]*OAuthCredentials, error) {
+	docs, err := store.db.Client().Collection("oauth_tokens").Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query oauth_tokens: %w", err)
+	}
+	return parseCredentialsFromDocs(docs), nil
+}
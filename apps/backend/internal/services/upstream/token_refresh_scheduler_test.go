@@ -0,0 +1,191 @@
+package upstream
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenRefreshScheduler_RefreshesNearExpiryWithoutRequest(t *testing.T) {
+	now := time.Now()
+	accounts := []*OAuthCredentials{
+		{AccountUUID: "near-expiry", ExpiresAt: now.Add(5 * time.Minute)},
+		{AccountUUID: "expired", ExpiresAt: now.Add(-time.Minute)},
+		{AccountUUID: "fresh", ExpiresAt: now.Add(2 * time.Hour)},
+		{AccountUUID: "disabled", ExpiresAt: now.Add(time.Minute), Disabled: true},
+		{AccountUUID: "rate-limited", ExpiresAt: now.Add(time.Minute),
+			RateLimitHeaders: map[string]string{"anthropic-ratelimit-unified-status": "rejected"}, RateLimitResetAt: now.Add(time.Hour)},
+	}
+
+	refreshed := make(chan string, len(accounts))
+	scheduler := &TokenRefreshScheduler{
+		lookahead: DefaultRefreshLookahead,
+		load: func(ctx context.Context) ([]*OAuthCredentials, error) {
+			return accounts, nil
+		},
+		refresh: func(credentials *OAuthCredentials, lookahead time.Duration) (*OAuthCredentials, error) {
+			if lookahead != DefaultRefreshLookahead {
+				t.Errorf("expected the lookahead to reach the refresher, got %v", lookahead)
+			}
+			refreshed <- credentials.AccountUUID
+			return &OAuthCredentials{AccountUUID: credentials.AccountUUID, ExpiresAt: now.Add(time.Hour)}, nil
+		},
+		now: func() time.Time { return now },
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go scheduler.Run(ctx, time.Hour)
+
+	got := map[string]bool{}
+	for len(got) < 2 {
+		select {
+		case accountUUID := <-refreshed:
+			got[accountUUID] = true
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for the scheduler, refreshed %v", got)
+		}
+	}
+	if !got["near-expiry"] || !got["expired"] {
+		t.Errorf("expected near-expiry and expired accounts to be refreshed, got %v", got)
+	}
+
+	cancel()
+	select {
+	case accountUUID := <-refreshed:
+		t.Errorf("unexpected refresh of account %s", accountUUID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestTokenRefreshScheduler_OnlyLeaderRefreshes(t *testing.T) {
+	now := time.Now()
+	var refreshes atomic.Int32
+	var leaseTTL time.Duration
+	scheduler := &TokenRefreshScheduler{
+		lookahead: DefaultRefreshLookahead,
+		elect: func(ctx context.Context, ttl time.Duration) (bool, error) {
+			leaseTTL = ttl
+			return false, nil
+		},
+		load: func(ctx context.Context) ([]*OAuthCredentials, error) {
+			return []*OAuthCredentials{{AccountUUID: "expired", ExpiresAt: now.Add(-time.Minute)}}, nil
+		},
+		refresh: func(credentials *OAuthCredentials, lookahead time.Duration) (*OAuthCredentials, error) {
+			refreshes.Add(1)
+			return credentials, nil
+		},
+		now: func() time.Time { return now },
+	}
+
+	if scheduler.isLeader(context.Background(), time.Minute) {
+		t.Fatal("expected an instance refused the lease not to lead")
+	}
+	if leaseTTL != refreshLeaseIntervals*time.Minute {
+		t.Errorf("expected the lease to outlast %d intervals, got %v", refreshLeaseIntervals, leaseTTL)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go scheduler.Run(ctx, time.Hour)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if got := refreshes.Load(); got != 0 {
+		t.Errorf("expected a follower not to refresh, got %d refreshes", got)
+	}
+}
+
+func TestTokenRefreshScheduler_RefreshesExpiredTokenEndToEnd(t *testing.T) {
+	store, tokens := newEmulatorStore(t)
+	expired := &OAuthCredentials{AccountUUID: "account-scheduled", AccessToken: "old-access", RefreshToken: "old-refresh", ExpiresAt: time.Now().Add(-time.Minute)}
+	seedCredentials(t, tokens, expired)
+
+	var calls atomic.Int32
+	server := newRefreshServer(t, expired.AccountUUID, &calls)
+	store.SetOAuthClient(OAuthClient{TokenEndpoint: server.URL})
+
+	refreshed, err := NewTokenRefreshScheduler(store, DefaultRefreshLookahead).RefreshExpiring(context.Background())
+	if err != nil {
+		t.Fatalf("RefreshExpiring returned error: %v", err)
+	}
+	if refreshed != 1 || calls.Load() != 1 {
+		t.Fatalf("expected one account refreshed with one call, got %d refreshed and %d calls", refreshed, calls.Load())
+	}
+
+	doc, err := tokens.Doc(expired.AccountUUID).Get(context.Background())
+	if err != nil {
+		t.Fatalf("failed to read refreshed account: %v", err)
+	}
+	var stored OAuthCredentials
+	if err := doc.DataTo(&stored); err != nil {
+		t.Fatalf("failed to parse refreshed account: %v", err)
+	}
+	if stored.AccessToken != "new-access" || stored.RefreshToken != "new-refresh" || !stored.ExpiresAt.After(time.Now()) {
+		t.Errorf("expected the refreshed credentials to be stored, got %+v", stored)
+	}
+}
+
+func TestTokenRefreshScheduler_KeepsRateLimitState(t *testing.T) {
+	store, tokens := newEmulatorStore(t)
+	resetAt := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	headers := map[string]string{"anthropic-ratelimit-unified-status": "rejected"}
+	limited := &OAuthCredentials{AccountUUID: "account-limited", RefreshToken: "old-refresh", ExpiresAt: time.Now().Add(-time.Minute),
+		RateLimitHeaders: headers, RateLimitResetAt: resetAt}
+	seedCredentials(t, tokens, limited)
+
+	var calls atomic.Int32
+	server := newRefreshServer(t, limited.AccountUUID, &calls)
+	store.SetOAuthClient(OAuthClient{TokenEndpoint: server.URL})
+
+	// The scheduler leaves the rate-limited account alone
+	if refreshed, err := NewTokenRefreshScheduler(store, DefaultRefreshLookahead).RefreshExpiring(context.Background()); err != nil || refreshed != 0 {
+		t.Fatalf("expected the rate-limited account to be skipped, got %d refreshed, err %v", refreshed, err)
+	}
+
+	// A refresh from elsewhere must not clear its rate-limit state either
+	if _, err := NewOAuthRefresher(store).RefreshCredentials(limited); err != nil {
+		t.Fatalf("RefreshCredentials returned error: %v", err)
+	}
+	doc, err := tokens.Doc(limited.AccountUUID).Get(context.Background())
+	if err != nil {
+		t.Fatalf("failed to read refreshed account: %v", err)
+	}
+	var stored OAuthCredentials
+	if err := doc.DataTo(&stored); err != nil {
+		t.Fatalf("failed to parse refreshed account: %v", err)
+	}
+	if stored.AccessToken != "new-access" || calls.Load() != 1 {
+		t.Errorf("expected one refresh to be stored, got token %q after %d calls", stored.AccessToken, calls.Load())
+	}
+	if stored.RateLimitHeaders["anthropic-ratelimit-unified-status"] != "rejected" || !stored.RateLimitResetAt.Equal(resetAt) {
+		t.Errorf("expected the rate-limit state to be kept, got headers %v reset %s", stored.RateLimitHeaders, stored.RateLimitResetAt)
+	}
+	if !stored.IsRateLimited(time.Now()) {
+		t.Error("expected the account to still be rate limited after the refresh")
+	}
+}
+
+func TestTokenRefreshScheduler_UsesTheRequestPathTokenEndpoint(t *testing.T) {
+	store, tokens := newEmulatorStore(t)
+	var calls atomic.Int32
+	server := newRefreshServer(t, "account-shared", &calls)
+	store.SetOAuthClient(OAuthClient{TokenEndpoint: server.URL})
+
+	// Request path: an expired account picked for a request is refreshed inline
+	seedCredentials(t, tokens, &OAuthCredentials{AccountUUID: "account-shared", RefreshToken: "old-refresh", ExpiresAt: time.Now().Add(-time.Minute)})
+	if _, err := store.GetValidCredentials(); err != nil {
+		t.Fatalf("GetValidCredentials returned error: %v", err)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("expected the request path to call the configured endpoint once, got %d", got)
+	}
+
+	// Scheduler: the same account expiring again is refreshed through the same endpoint
+	seedCredentials(t, tokens, &OAuthCredentials{AccountUUID: "account-shared", RefreshToken: "new-refresh", ExpiresAt: time.Now().Add(-time.Minute)})
+	if _, err := NewTokenRefreshScheduler(store, DefaultRefreshLookahead).RefreshExpiring(context.Background()); err != nil {
+		t.Fatalf("RefreshExpiring returned error: %v", err)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("expected the scheduler to call the configured endpoint too, got %d calls", got)
+	}
+}
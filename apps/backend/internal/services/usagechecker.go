@@ -3,37 +3,111 @@ package services
 import (
 	"context"
 	"fmt"
+	"math"
 	"time"
 
+	"simple-relay/shared/database"
+	"simple-relay/shared/timewindow"
+
 	"cloud.google.com/go/firestore"
 	lru "github.com/hashicorp/golang-lru/v2"
 )
 
+// PointsLimitState describes a user's daily points allowance
+type PointsLimitState int
+
+const (
+	// PointsLimitUnset means no limit is configured for the user: no usage allowed
+	PointsLimitUnset PointsLimitState = iota
+	// PointsLimitUnlimited means the limit document is marked unlimited: usage is not capped
+	PointsLimitUnlimited
+	// PointsAvailable means a limit is configured and points remain
+	PointsAvailable
+	// PointsExhausted means a limit is configured and fully consumed
+	PointsExhausted
+)
+
+// PointsCheckResult is the outcome of a daily points limit check
+type PointsCheckResult struct {
+	State PointsLimitState
+	// RemainingPoints is only meaningful for PointsAvailable and PointsExhausted
+	// (zero or negative when exhausted)
+	RemainingPoints int
+}
+
+// Allowed reports whether the user may make another request
+func (r PointsCheckResult) Allowed() bool {
+	return r.State == PointsLimitUnlimited || r.State == PointsAvailable
+}
+
+// classifyPoints builds a check result from the configured limit and current usage
+func classifyPoints(pointsLimit PointsLimit, limitFound bool, usedPoints int) PointsCheckResult {
+	if !limitFound {
+		return PointsCheckResult{State: PointsLimitUnset}
+	}
+	if pointsLimit.Unlimited {
+		return PointsCheckResult{State: PointsLimitUnlimited}
+	}
+
+	remaining := pointsLimit.Points - usedPoints
+	if remaining <= 0 {
+		return PointsCheckResult{State: PointsExhausted, RemainingPoints: remaining}
+	}
+	return PointsCheckResult{State: PointsAvailable, RemainingPoints: remaining}
+}
+
 // UsageCacheEntry represents a cached usage check result
 type UsageCacheEntry struct {
-	RemainingPoints int
-	Timestamp       time.Time
+	Result    PointsCheckResult
+	Timestamp time.Time
 }
 
 // UsageChecker handles daily points limit checking
 type UsageChecker struct {
 	client              *firestore.Client
 	pointsLimitService  *PointsLimitService
+	costLimitService    *CostLimitService
+	monthlyLimitService *PointsLimitService
+	monthlyCache        *lru.Cache[string, *UsageCacheEntry]
+	modelCache          *lru.Cache[string, *UsageCacheEntry] // Per-model results keyed by user and model
 	cache               *lru.Cache[string, *UsageCacheEntry]
 	cacheDuration       time.Duration
+	cacheSize           int
+	counters            cacheCounters
 }
 
+// DefaultUsageCacheSize is the number of users whose check results are cached unless configured otherwise
+const DefaultUsageCacheSize = 1000
+
 // NewUsageChecker creates a new usage checker
 func NewUsageChecker(client *firestore.Client) *UsageChecker {
-	// Create LRU cache with capacity of 1000 entries
-	cache, _ := lru.New[string, *UsageCacheEntry](1000)
+	cache, _ := lru.New[string, *UsageCacheEntry](DefaultUsageCacheSize)
+	monthlyCache, _ := lru.New[string, *UsageCacheEntry](DefaultUsageCacheSize)
+	modelCache, _ := lru.New[string, *UsageCacheEntry](DefaultUsageCacheSize)
 
 	return &UsageChecker{
-		client:             client,
-		pointsLimitService: NewPointsLimitService(client),
-		cache:              cache,
+		client:              client,
+		pointsLimitService:  NewPointsLimitService(client),
+		costLimitService:    NewCostLimitService(client),
+		monthlyLimitService: NewMonthlyPointsLimitService(client),
+		monthlyCache:        monthlyCache,
+		modelCache:          modelCache,
+		cache:               cache,
 		cacheDuration:      24 * time.Hour, // 24 hour cache
+		cacheSize:          DefaultUsageCacheSize,
+	}
+}
+
+// SetCacheSize changes how many users' results are cached; shrinking evicts the least recently used.
+// Values below 1 are ignored.
+func (uc *UsageChecker) SetCacheSize(size int) {
+	if size < 1 {
+		return
 	}
+	uc.counters.recordEvictions(uc.cache.Resize(size))
+	uc.monthlyCache.Resize(size)
+	uc.modelCache.Resize(size)
+	uc.cacheSize = size
 }
 
 // cleanupExpiredEntry checks if cache entry is expired and removes it if so
@@ -41,128 +115,223 @@ func NewUsageChecker(client *firestore.Client) *UsageChecker {
 func (uc *UsageChecker) cleanupExpiredEntry(userID string) *UsageCacheEntry {
 	if entry, exists := uc.cache.Get(userID); exists {
 		if time.Since(entry.Timestamp) < uc.cacheDuration {
+			uc.counters.record(true)
 			return entry
 		}
 		// Remove expired entry
 		uc.cache.Remove(userID)
 	}
+	uc.counters.record(false)
 	return nil
 }
 
-// calculateRemainingPointsFromDB calculates remaining points by querying database
-func (uc *UsageChecker) calculateRemainingPointsFromDB(ctx context.Context, userID string) (int, error) {
-	// Get user's points limit (defaults to 0 if not set)
+// CacheStats reports the usage cache size, capacity, lookup hit rate and evictions
+func (uc *UsageChecker) CacheStats() CacheStats {
+	stats := uc.counters.snapshot(uc.cache.Len())
+	stats.Capacity = uc.cacheSize
+	return stats
+}
+
+// calculateRemainingPointsFromDB calculates the points check result by querying database
+func (uc *UsageChecker) calculateRemainingPointsFromDB(ctx context.Context, userID string) (PointsCheckResult, error) {
+	// Get user's points limit
 	// Points are stored as cost * 10 in the database
-	pointsLimit, err := uc.pointsLimitService.GetPointsLimit(ctx, userID)
+	pointsLimit, pointsFound, err := uc.pointsLimitService.GetPointsLimit(ctx, userID)
 	if err != nil {
-		return 0, fmt.Errorf("error getting points limit: %w", err)
+		return PointsCheckResult{}, fmt.Errorf("error getting points limit: %w", err)
 	}
-
-	// If limit is 0, return 0 directly (no usage allowed) - don't cache
-	if pointsLimit == 0 {
-		return 0, nil
+	costLimit, costFound, err := uc.costLimitService.GetCostLimit(ctx, userID)
+	if err != nil {
+		return PointsCheckResult{}, fmt.Errorf("error getting cost limit: %w", err)
 	}
 
-	// Calculate current 24-hour usage (8pm-8pm UTC window)
-	// This returns points from the database (cost * 10)
-	currentUsagePoints, err := uc.getCurrentDailyUsage(ctx, userID)
-	if err != nil {
-		return 0, fmt.Errorf("error getting current usage: %w", err)
+	// Usage in the current 24-hour window (8pm-8pm UTC) is only read for limits that depend on it;
+	// unset and unlimited limits skip their aggregate queries. Points are stored as cost * 10.
+	var currentUsagePoints int
+	if pointsFound && !pointsLimit.Unlimited {
+		currentUsagePoints, err = uc.getCurrentDailyUsage(ctx, userID)
+		if err != nil {
+			return PointsCheckResult{}, fmt.Errorf("error getting current usage: %w", err)
+		}
+	}
+	var currentUsageCost float64
+	if costFound && !costLimit.Unlimited {
+		currentUsageCost, err = uc.getCurrentDailyCost(ctx, userID)
+		if err != nil {
+			return PointsCheckResult{}, fmt.Errorf("error getting current cost: %w", err)
+		}
 	}
 
-	// Both pointsLimit and currentUsagePoints are points (cost * 10)
-	// Return remaining points directly
-	remainingPoints := pointsLimit - currentUsagePoints
+	return combineLimitResults(
+		classifyPoints(pointsLimit, pointsFound, currentUsagePoints), pointsFound,
+		classifyCost(costLimit, costFound, currentUsageCost), costFound,
+	), nil
+}
 
-	return remainingPoints, nil
+// cacheResult stores a check result, except unset limits so a newly granted limit applies immediately
+func (uc *UsageChecker) cacheResult(userID string, result PointsCheckResult) {
+	if result.State == PointsLimitUnset {
+		return
+	}
+	evicted := uc.cache.Add(userID, &UsageCacheEntry{
+		Result:    result,
+		Timestamp: time.Now(),
+	})
+	if evicted {
+		uc.counters.recordEvictions(1)
+	}
 }
 
 // refreshCacheInBackground updates cache entry in background
 func (uc *UsageChecker) refreshCacheInBackground(userID string) {
 	bgCtx := context.Background()
-	if freshPoints, err := uc.calculateRemainingPointsFromDB(bgCtx, userID); err == nil {
-		// Only cache if not zero (zero limits are not cached)
-		if freshPoints != 0 {
-			uc.cache.Add(userID, &UsageCacheEntry{
-				RemainingPoints: freshPoints,
-				Timestamp:       time.Now(),
-			})
-		}
+	if freshResult, err := uc.calculateRemainingPointsFromDB(bgCtx, userID); err == nil {
+		uc.cacheResult(userID, freshResult)
 	}
 }
 
-// CheckDailyPointsLimit checks if user has exceeded their daily points limit
-// Returns remaining points (negative if over limit, positive if under limit)
-func (uc *UsageChecker) CheckDailyPointsLimit(ctx context.Context, userID string) (int, error) {
+// CheckDailyPointsLimit checks the user's daily points allowance
+// The result distinguishes unset, unlimited, available and exhausted limits
+func (uc *UsageChecker) CheckDailyPointsLimit(ctx context.Context, userID string) (PointsCheckResult, error) {
 	// Check cache first
 	if entry := uc.cleanupExpiredEntry(userID); entry != nil {
 		// If cache is older than 1 minute, refresh in background
 		if time.Since(entry.Timestamp) > 1*time.Minute {
 			go uc.refreshCacheInBackground(userID)
 		}
-		return entry.RemainingPoints, nil
+		return entry.Result, nil
 	}
 
 	// Calculate from database
-	remainingPoints, err := uc.calculateRemainingPointsFromDB(ctx, userID)
+	result, err := uc.calculateRemainingPointsFromDB(ctx, userID)
 	if err != nil {
-		return 0, err
+		return PointsCheckResult{}, err
 	}
 
-	// Cache the result (only if not zero)
-	if remainingPoints != 0 {
-		uc.cache.Add(userID, &UsageCacheEntry{
-			RemainingPoints: remainingPoints,
-			Timestamp:       time.Now(),
-		})
-	}
+	uc.cacheResult(userID, result)
 
-	return remainingPoints, nil
+	return result, nil
 }
 
 // getCurrentDailyUsage calculates the total points for the current 24-hour period (8pm-8pm UTC)
 func (uc *UsageChecker) getCurrentDailyUsage(ctx context.Context, userID string) (int, error) {
-	startTime, endTime := uc.getCurrentDailyWindow()
+	return windowedPoints(ctx, firestoreAggregates{client: uc.client}, userID, timewindow.CurrentDailyReset(), time.Now())
+}
 
-	// Query hourly aggregates for the 8pm-8pm UTC window
-	query := uc.client.Collection("hourly_aggregates").
-		Where("user_id", "==", userID).
-		Where("hour", ">=", startTime).
-		Where("hour", "<", endTime)
+// getCurrentDailyCost sums the USD billed for the current 24-hour period (8pm-8pm UTC)
+func (uc *UsageChecker) getCurrentDailyCost(ctx context.Context, userID string) (float64, error) {
+	window := timewindow.CurrentDailyReset()
+	return firestoreAggregates{client: uc.client}.HourlyCost(ctx, userID, window.Start, window.End)
+}
 
-	docs, err := query.Documents(ctx).GetAll()
+// aggregateSource reads a user's points totals from the aggregate collections
+type aggregateSource interface {
+	// DailyPoints returns points per UTC day start for days with a daily aggregate in [start, end)
+	DailyPoints(ctx context.Context, userID string, start, end time.Time) (map[time.Time]int, error)
+	// HourlyPoints returns the points summed over hourly aggregates in [start, end)
+	HourlyPoints(ctx context.Context, userID string, start, end time.Time) (int, error)
+}
+
+// windowedPoints sums a user's points in window with the fewest aggregate reads: daily aggregates for
+// whole days and hourly aggregates for the boundary hours. Days without a daily aggregate fall back to hours.
+func windowedPoints(ctx context.Context, source aggregateSource, userID string, window timewindow.Window, now time.Time) (int, error) {
+	days, hourRanges := timewindow.SplitDays(window, now)
+
+	var totalPoints int
+	if len(days) > 0 {
+		daily, err := source.DailyPoints(ctx, userID, days[0].Start, days[len(days)-1].End)
+		if err != nil {
+			return 0, err
+		}
+		for _, day := range days {
+			points, found := daily[day.Start]
+			if !found {
+				hourRanges = append(hourRanges, day)
+				continue
+			}
+			totalPoints += points
+		}
+	}
+
+	for _, hours := range hourRanges {
+		points, err := source.HourlyPoints(ctx, userID, hours.Start, hours.End)
+		if err != nil {
+			return 0, err
+		}
+		totalPoints += points
+	}
+
+	return totalPoints, nil
+}
+
+// firestoreAggregates reads aggregates written by the billing service
+type firestoreAggregates struct {
+	client *firestore.Client
+}
+
+// DailyPoints reads daily_aggregates documents keyed by their UTC "day" start
+func (f firestoreAggregates) DailyPoints(ctx context.Context, userID string, start, end time.Time) (map[time.Time]int, error) {
+	docs, err := f.client.Collection("daily_aggregates").
+		Where("user_id", "==", userID).
+		Where("day", ">=", start).
+		Where("day", "<", end).
+		Documents(ctx).GetAll()
 	if err != nil {
-		return 0, fmt.Errorf("failed to query hourly aggregates: %w", err)
+		return nil, fmt.Errorf("failed to query daily aggregates: %w", err)
 	}
 
-	var totalPoints int
+	daily := make(map[time.Time]int)
 	for _, doc := range docs {
 		data := doc.Data()
-		if points, ok := data["total_points"].(float64); ok {
-			totalPoints += int(points)
+		day, ok := data["day"].(time.Time)
+		if !ok {
+			continue
 		}
+		daily[day.UTC()] += aggregatePoints(data["total_points"])
 	}
+	return daily, nil
+}
 
+// HourlyPoints sums total_points over hourly_aggregates in [start, end)
+func (f firestoreAggregates) HourlyPoints(ctx context.Context, userID string, start, end time.Time) (int, error) {
+	docs, err := f.client.Collection("hourly_aggregates").
+		Where("user_id", "==", userID).
+		Where("hour", ">=", start).
+		Where("hour", "<", end).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return 0, fmt.Errorf("failed to query hourly aggregates: %w", err)
+	}
+
+	var totalPoints int
+	for _, doc := range docs {
+		totalPoints += aggregatePoints(doc.Data()["total_points"])
+	}
 	return totalPoints, nil
 }
 
-// getCurrentDailyWindow returns the start and end times for the current 8pm-8pm UTC window
-func (uc *UsageChecker) getCurrentDailyWindow() (time.Time, time.Time) {
-	now := time.Now().UTC()
-
-	// Find the most recent 8pm (20:00)
-	var windowStart time.Time
-	if now.Hour() >= 20 {
-		// If it's after 8pm today, the window started at 8pm today
-		windowStart = time.Date(now.Year(), now.Month(), now.Day(), 20, 0, 0, 0, time.UTC)
-	} else {
-		// If it's before 8pm today, the window started at 8pm yesterday
-		yesterday := now.AddDate(0, 0, -1)
-		windowStart = time.Date(yesterday.Year(), yesterday.Month(), yesterday.Day(), 20, 0, 0, 0, time.UTC)
+// HourlyCost sums total_cost over hourly_aggregates in [start, end), keeping fractions of a cent
+func (f firestoreAggregates) HourlyCost(ctx context.Context, userID string, start, end time.Time) (float64, error) {
+	docs, err := f.client.Collection("hourly_aggregates").
+		Where("user_id", "==", userID).
+		Where("hour", ">=", start).
+		Where("hour", "<", end).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return 0, fmt.Errorf("failed to query hourly aggregates: %w", err)
 	}
 
-	// Window ends 24 hours later
-	windowEnd := windowStart.Add(24 * time.Hour)
+	var totalCost float64
+	for _, doc := range docs {
+		cost, _ := database.Number(doc.Data()["total_cost"])
+		totalCost += cost
+	}
+	return totalCost, nil
+}
 
-	return windowStart, windowEnd
+// aggregatePoints reads a total_points field. The user aggregator stores whole points (int64) while
+// upstream aggregates store fractional points (float64); fractions are rounded to the nearest point.
+func aggregatePoints(value interface{}) int {
+	points, _ := database.Number(value)
+	return int(math.Round(points))
 }
@@ -0,0 +1,183 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"simple-relay/shared/timewindow"
+)
+
+func TestClassifyPoints(t *testing.T) {
+	tests := []struct {
+		name          string
+		limit         PointsLimit
+		found         bool
+		used          int
+		wantState     PointsLimitState
+		wantRemaining int
+		wantAllowed   bool
+	}{
+		{"unset limit", PointsLimit{}, false, 0, PointsLimitUnset, 0, false},
+		{"zero limit is exhausted", PointsLimit{}, true, 0, PointsExhausted, 0, false},
+		{"fully consumed", PointsLimit{Points: 100}, true, 100, PointsExhausted, 0, false},
+		{"over limit", PointsLimit{Points: 100}, true, 130, PointsExhausted, -30, false},
+		{"points remaining", PointsLimit{Points: 100}, true, 40, PointsAvailable, 60, true},
+		{"unlimited", PointsLimit{Unlimited: true}, true, 5000, PointsLimitUnlimited, 0, true},
+		{"negative limit blocks", PointsLimit{Points: -1}, true, 0, PointsExhausted, -1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := classifyPoints(tt.limit, tt.found, tt.used)
+			if result.State != tt.wantState {
+				t.Errorf("state = %v, want %v", result.State, tt.wantState)
+			}
+			if result.RemainingPoints != tt.wantRemaining {
+				t.Errorf("remaining = %d, want %d", result.RemainingPoints, tt.wantRemaining)
+			}
+			if result.Allowed() != tt.wantAllowed {
+				t.Errorf("allowed = %v, want %v", result.Allowed(), tt.wantAllowed)
+			}
+		})
+	}
+}
+
+// fakeAggregates serves hourly aggregates and the daily aggregates the billing service would derive from them
+type fakeAggregates struct {
+	hourly      map[time.Time]int
+	missingDays map[time.Time]bool // days without a daily aggregate document
+	reads       int
+}
+
+func (f *fakeAggregates) DailyPoints(ctx context.Context, userID string, start, end time.Time) (map[time.Time]int, error) {
+	f.reads++
+	daily := make(map[time.Time]int)
+	for hour, points := range f.hourly {
+		day := timewindow.Day(hour).Start
+		if !hour.Before(start) && hour.Before(end) && !f.missingDays[day] {
+			daily[day] += points
+		}
+	}
+	return daily, nil
+}
+
+func (f *fakeAggregates) HourlyPoints(ctx context.Context, userID string, start, end time.Time) (int, error) {
+	f.reads++
+	var total int
+	for hour, points := range f.hourly {
+		if !hour.Before(start) && hour.Before(end) {
+			total += points
+		}
+	}
+	return total, nil
+}
+
+// sumHourly is the reference result: every hourly aggregate inside the window
+func (f *fakeAggregates) sumHourly(window timewindow.Window) int {
+	var total int
+	for hour, points := range f.hourly {
+		if window.Contains(hour) {
+			total += points
+		}
+	}
+	return total
+}
+
+func TestWindowedPoints_MatchesHourlySum(t *testing.T) {
+	windowStart := time.Date(2024, 3, 10, 20, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		window      timewindow.Window
+		now         time.Time
+		missingDays map[time.Time]bool
+	}{
+		{
+			name:   "before midnight",
+			window: timewindow.DailyReset(windowStart, timewindow.DefaultDailyResetHour),
+			now:    windowStart.Add(3 * time.Hour),
+		},
+		{
+			name:   "after midnight uses the daily aggregate",
+			window: timewindow.DailyReset(windowStart, timewindow.DefaultDailyResetHour),
+			now:    windowStart.Add(13 * time.Hour),
+		},
+		{
+			name:        "missing daily aggregate falls back to hours",
+			window:      timewindow.DailyReset(windowStart, timewindow.DefaultDailyResetHour),
+			now:         windowStart.Add(13 * time.Hour),
+			missingDays: map[time.Time]bool{time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC): true},
+		},
+		{
+			name:   "past window excludes usage after its end",
+			window: timewindow.DailyReset(windowStart, timewindow.DefaultDailyResetHour),
+			now:    windowStart.Add(30 * time.Hour),
+		},
+		{
+			name:   "multi-day window",
+			window: timewindow.Window{Start: windowStart, End: windowStart.Add(58 * time.Hour)},
+			now:    windowStart.Add(60 * time.Hour),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// One aggregate per hour with distinct points, up to now
+			source := &fakeAggregates{hourly: make(map[time.Time]int), missingDays: tt.missingDays}
+			for hour := windowStart.Add(-6 * time.Hour); hour.Before(tt.now); hour = hour.Add(time.Hour) {
+				source.hourly[hour] = hour.Hour() + 1
+			}
+
+			got, err := windowedPoints(context.Background(), source, "user@example.com", tt.window, tt.now)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if want := source.sumHourly(tt.window); got != want {
+				t.Errorf("windowed read = %d, want hourly sum %d", got, want)
+			}
+		})
+	}
+}
+
+func TestWindowedPoints_ReadsDailyAggregateInsteadOfHours(t *testing.T) {
+	window := timewindow.DailyReset(time.Date(2024, 3, 11, 9, 0, 0, 0, time.UTC), timewindow.DefaultDailyResetHour)
+	source := &fakeAggregates{hourly: map[time.Time]int{
+		time.Date(2024, 3, 10, 21, 0, 0, 0, time.UTC): 5,
+		time.Date(2024, 3, 11, 8, 0, 0, 0, time.UTC):  7,
+	}}
+
+	got, err := windowedPoints(context.Background(), source, "user@example.com", window, time.Date(2024, 3, 11, 9, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != 12 {
+		t.Errorf("expected 12 points, got %d", got)
+	}
+	// One daily read for March 11 and one hourly range read for the leading 4 hours
+	if source.reads != 2 {
+		t.Errorf("expected 2 aggregate reads, got %d", source.reads)
+	}
+}
+
+func TestAggregatePoints_ReadsEachStoredType(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  int
+	}{
+		{"user aggregator int", int64(120), 120},
+		{"upstream aggregator float", 120.0, 120},
+		{"fractional float rounds", 119.6, 120},
+		{"fraction below half rounds down", 0.4, 0},
+		{"missing field", nil, 0},
+		{"non-numeric", "120", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := aggregatePoints(tt.value); got != tt.want {
+				t.Errorf("aggregatePoints(%v) = %d, want %d", tt.value, got, tt.want)
+			}
+		})
+	}
+}
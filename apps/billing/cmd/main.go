@@ -1,15 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
 	"os"
+	"os/signal"
 	"simple-relay/billing/internal/services"
 	"simple-relay/shared/database"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
@@ -19,6 +28,39 @@ type Config struct {
 	ProjectID      string
 	DatabaseName   string
 	BillingEnabled bool
+	RetentionDays  int // Days of usage_records to keep (0 keeps records forever)
+
+	SingleCommitAggregation bool          // Write every aggregate dimension of a flush in one BulkWriter commit
+	AggregationLagThreshold time.Duration // Dimensions not written successfully for longer are reported stale (0 disables)
+
+	PricingReloadInterval time.Duration // How often model_pricing is reloaded from Firestore (0 uses the built-in prices only)
+
+	CacheWriteAlertTokens int // Flag usage records whose cache-write tokens exceed this (0 disables)
+
+	OutputTokenCaps   services.OutputTokenCaps // Per-model output token caps; over-cap records are flagged
+	OutputCapThrottle time.Duration            // How long over-cap users are throttled (0 only flags)
+
+	BigQueryDataset             string // Dataset for aggregate export (empty disables the exporter)
+	BigQueryHourlyTable         string // Table receiving hourly_aggregates
+	BigQueryUpstreamHourlyTable string // Table receiving upstream_account_hourly_aggregates
+	BigQueryExportInterval      time.Duration
+	BigQueryExportStart         time.Time // First day exported to tables without a watermark (zero starts at the first run)
+
+	ShutdownTimeout time.Duration // How long SIGTERM waits for in-flight requests and the final billing flush
+}
+
+// getEnvInt reads an integer environment variable, returning defaultValue when unset or invalid
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using default %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return parsed
 }
 
 func loadConfig() *Config {
@@ -37,57 +79,357 @@ func loadConfig() *Config {
 
 	billingEnabled := os.Getenv("BILLING_ENABLED") == "true"
 
+	bigQueryHourlyTable := os.Getenv("BIGQUERY_HOURLY_TABLE")
+	if bigQueryHourlyTable == "" {
+		bigQueryHourlyTable = "hourly_aggregates"
+	}
+	bigQueryUpstreamHourlyTable := os.Getenv("BIGQUERY_UPSTREAM_HOURLY_TABLE")
+	if bigQueryUpstreamHourlyTable == "" {
+		bigQueryUpstreamHourlyTable = "upstream_account_hourly_aggregates"
+	}
+
+	var bigQueryExportStart time.Time
+	if value := os.Getenv("BIGQUERY_EXPORT_START"); value != "" {
+		start, err := time.Parse(time.DateOnly, value)
+		if err != nil {
+			log.Printf("Invalid value for BIGQUERY_EXPORT_START: %q, starting new tables at the first export", value)
+		}
+		bigQueryExportStart = start
+	}
+
 	return &Config{
 		ProjectID:      projectID,
 		DatabaseName:   databaseName,
 		BillingEnabled: billingEnabled,
+		RetentionDays:  getEnvInt("USAGE_RECORDS_RETENTION_DAYS", 0),
+
+		SingleCommitAggregation: os.Getenv("AGGREGATE_SINGLE_COMMIT") == "true",
+		AggregationLagThreshold: time.Duration(getEnvInt("AGGREGATION_LAG_THRESHOLD_SECONDS", 300)) * time.Second,
+
+		PricingReloadInterval: time.Duration(getEnvInt("MODEL_PRICING_RELOAD_MINUTES", 5)) * time.Minute,
+
+		CacheWriteAlertTokens: getEnvInt("CACHE_WRITE_ALERT_TOKENS", 0),
+
+		OutputTokenCaps:   services.ParseOutputTokenCaps(os.Getenv("OUTPUT_TOKEN_CAPS")),
+		OutputCapThrottle: time.Duration(getEnvInt("OUTPUT_CAP_THROTTLE_MINUTES", 0)) * time.Minute,
+
+		BigQueryDataset:             os.Getenv("BIGQUERY_DATASET"),
+		BigQueryHourlyTable:         bigQueryHourlyTable,
+		BigQueryUpstreamHourlyTable: bigQueryUpstreamHourlyTable,
+		BigQueryExportInterval:      time.Duration(getEnvInt("BIGQUERY_EXPORT_INTERVAL_MINUTES", 60)) * time.Minute,
+		BigQueryExportStart:         bigQueryExportStart,
+
+		ShutdownTimeout: time.Duration(getEnvInt("SHUTDOWN_TIMEOUT_SECONDS", 10)) * time.Second,
 	}
 }
 
-// parseSSEForUsageData extracts model and usage data from message_start and message_delta events
-func parseSSEForUsageData(sseData string) (*services.ClaudeMessage, error) {
-	lines := strings.Split(sseData, "\n")
+// shutdownGracefully stops accepting requests, waits for in-flight ones to finish, then closes the
+// billing service so records still buffered in its BatchWriter are flushed. Both steps share timeout.
+func shutdownGracefully(server *http.Server, billingService *services.BillingService, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	var messageID, model string
-	var finalUsage map[string]interface{}
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error draining in-flight requests: %v", err)
+	}
+	if billingService == nil {
+		return nil
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- billingService.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			return fmt.Errorf("failed to flush buffered billing records: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timed out after %s flushing buffered billing records", timeout)
+	}
+}
 
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
+// readyTimeout bounds the Firestore round trip made by /ready
+const readyTimeout = 3 * time.Second
 
-		if strings.HasPrefix(line, "data: ") {
-			jsonData := strings.TrimPrefix(line, "data: ")
-			if jsonData == "[DONE]" {
-				continue
+// firestorePinger is the part of database.Service that /ready needs
+type firestorePinger interface {
+	Ping(ctx context.Context) error
+}
+
+// serveReady reports 503 when Firestore can't be reached, so the instance stops receiving traffic
+// while /health stays a cheap liveness check
+func serveReady(db firestorePinger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+		if err := db.Ping(ctx); err != nil {
+			log.Printf("Readiness check failed: %v", err)
+			http.Error(w, "Firestore unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	}
+}
+
+// writeAggregationLag writes the per-dimension lag as JSON, with 503 if any dimension is stale
+func writeAggregationLag(w http.ResponseWriter, lags []services.DimensionLag) {
+	status := http.StatusOK
+	for _, lag := range lags {
+		if lag.Stale {
+			status = http.StatusServiceUnavailable
+			break
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"dimensions": lags})
+}
+
+// bodyFormat is the detected format of a response body forwarded for billing
+type bodyFormat int
+
+const (
+	bodyFormatUnknown bodyFormat = iota
+	bodyFormatSSE
+	bodyFormatJSON
+)
+
+// utf8BOM is the byte order mark some clients prepend to bodies
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// detectBodyFormat determines the body format from the forwarded Content-Type header,
+// falling back to sniffing the body only when the header is absent or unrecognized
+func detectBodyFormat(contentType string, body []byte) bodyFormat {
+	if contentType != "" {
+		if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+			switch mediaType {
+			case "text/event-stream":
+				return bodyFormatSSE
+			case "application/json":
+				return bodyFormatJSON
 			}
+		}
+	}
+
+	trimmed := bytes.TrimLeft(bytes.TrimPrefix(body, utf8BOM), " \t\r\n")
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("event:")), bytes.HasPrefix(trimmed, []byte("data:")):
+		return bodyFormatSSE
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		return bodyFormatJSON
+	default:
+		return bodyFormatUnknown
+	}
+}
+
+// parseUsageBody extracts the billed message from a forwarded response body, SSE or JSON.
+// Returns nil without an error for bodies that carry no message usage, e.g. error responses.
+func parseUsageBody(contentType string, body []byte) (*services.ClaudeMessage, error) {
+	body = bytes.TrimPrefix(body, utf8BOM)
+	switch detectBodyFormat(contentType, body) {
+	case bodyFormatSSE:
+		// Usage comes from the message_start and message_delta events
+		return parseSSEForUsageData(string(body))
+	case bodyFormatJSON:
+		return parseJSONForUsageData(body)
+	default:
+		return nil, nil
+	}
+}
 
-			var event map[string]interface{}
-			if err := json.Unmarshal([]byte(jsonData), &event); err != nil {
+// parseJSONForUsageData extracts model and usage data from a non-streaming ("stream": false) response.
+// JSON bodies that are not a message, such as errors or token counts, return nil without an error.
+func parseJSONForUsageData(body []byte) (*services.ClaudeMessage, error) {
+	var message services.ClaudeMessage
+	if err := json.Unmarshal(body, &message); err != nil {
+		return nil, fmt.Errorf("invalid JSON response: %w", err)
+	}
+	if message.ID == "" || message.Model == "" {
+		return nil, nil
+	}
+	return &message, nil
+}
+
+// parseLatencyMs parses a millisecond latency value forwarded by the proxy, returning 0 if absent or invalid
+func parseLatencyMs(value string) int64 {
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ms < 0 {
+		return 0
+	}
+	return ms
+}
+
+// upstreamStatusHeader carries the status code upstream answered the proxied request with
+const upstreamStatusHeader = "X-Upstream-Status"
+
+// parseUpstreamStatus parses the status code forwarded by the proxy, returning 0 if absent or invalid
+func parseUpstreamStatus(value string) int {
+	status, err := strconv.Atoi(value)
+	if err != nil || status < 100 || status > 999 {
+		return 0
+	}
+	return status
+}
+
+// maxErrorMessageLength bounds the error message stored on a usage record
+const maxErrorMessageLength = 500
+
+// parseErrorMessage returns "type: message" from an Anthropic error body, either JSON or an SSE error
+// event, falling back to the start of the raw body for errors in any other shape
+func parseErrorMessage(body []byte) string {
+	body = bytes.TrimPrefix(body, utf8BOM)
+	payloads := []string{string(body)}
+	if detectBodyFormat("", body) == bodyFormatSSE {
+		payloads = sseEventData(string(body))
+	}
+	for _, payload := range payloads {
+		var event struct {
+			Type  string `json:"type"`
+			Error struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal([]byte(payload), &event) == nil && event.Type == "error" {
+			return truncateErrorMessage(event.Error.Type + ": " + event.Error.Message)
+		}
+	}
+	return truncateErrorMessage(strings.TrimSpace(string(body)))
+}
+
+// truncateErrorMessage cuts message to maxErrorMessageLength bytes without splitting a UTF-8 character
+func truncateErrorMessage(message string) string {
+	if len(message) <= maxErrorMessageLength {
+		return message
+	}
+	cut := maxErrorMessageLength
+	for cut > 0 && !utf8.RuneStart(message[cut]) {
+		cut--
+	}
+	return message[:cut]
+}
+
+// anthropicRequestID returns Anthropic's request id from the upstream response headers forwarded by the proxy
+func anthropicRequestID(header http.Header) string {
+	return header.Get("Request-Id")
+}
+
+// mergeUsage overlays the counts from a message_delta onto the usage seen so far. Missing, null and
+// zero counts don't replace a known value, so a delta carrying only output_tokens keeps the input tokens.
+// Nested objects such as cache_creation (the 5-minute and 1-hour cache write buckets) are merged the same way.
+func mergeUsage(current, delta map[string]interface{}) map[string]interface{} {
+	if current == nil {
+		current = make(map[string]interface{})
+	}
+	for key, value := range delta {
+		if value == nil {
+			continue
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			known, _ := current[key].(map[string]interface{})
+			current[key] = mergeUsage(known, nested)
+			continue
+		}
+		if number, ok := value.(float64); ok && number == 0 {
+			if _, known := current[key]; known {
 				continue
 			}
+		}
+		current[key] = value
+	}
+	return current
+}
+
+// sseEventData splits an SSE body into the data payloads of its events. Data lines of one event are
+// joined with newlines, as the SSE spec requires. Bodies that were re-chunked on the way are tolerated:
+// a line without a field name continues the previous data line, and a payload that isn't valid JSON
+// is carried into the next event, so a JSON object split across an event boundary is reassembled.
+func sseEventData(sseData string) []string {
+	sseData = strings.ReplaceAll(sseData, "\r\n", "\n")
+	sseData = strings.ReplaceAll(sseData, "\r", "\n")
+
+	var payloads []string
+	var dataLines []string
+	var carried string
+	dispatch := func() {
+		if len(dataLines) == 0 {
+			return
+		}
+		data := strings.Join(dataLines, "\n")
+		dataLines = nil
+		switch {
+		case data == "[DONE]":
+		case carried != "" && json.Valid([]byte(carried+data)):
+			payloads = append(payloads, carried+data)
+			carried = ""
+		case json.Valid([]byte(data)):
+			// A payload that is complete on its own ends any unfinished one before it
+			payloads = append(payloads, data)
+			carried = ""
+		default:
+			carried += data
+		}
+	}
+
+	for _, line := range strings.Split(sseData, "\n") {
+		switch {
+		case strings.TrimSpace(line) == "":
+			dispatch()
+		case strings.HasPrefix(line, "data:"):
+			value := strings.TrimPrefix(line, "data:")
+			dataLines = append(dataLines, strings.TrimPrefix(value, " "))
+		case strings.HasPrefix(line, ":"), strings.HasPrefix(line, "event:"), strings.HasPrefix(line, "id:"), strings.HasPrefix(line, "retry:"):
+			// Comments and fields other than data carry nothing billed
+		case len(dataLines) > 0:
+			dataLines[len(dataLines)-1] += line
+		}
+	}
+	dispatch()
+	return payloads
+}
+
+// parseSSEForUsageData extracts model and usage data from message_start and message_delta events.
+// Other events, such as content_block_delta, may be interleaved anywhere. Usage is cumulative, so a
+// repeated message_start or message_delta doesn't double count.
+func parseSSEForUsageData(sseData string) (*services.ClaudeMessage, error) {
+	var messageID, model string
+	var finalUsage map[string]interface{}
 
-			eventType, _ := event["type"].(string)
-
-			// Handle different event types
-			if eventType == "message_start" {
-				// Extract message ID and model from message_start event
-				if message, ok := event["message"].(map[string]interface{}); ok {
-					if id, ok := message["id"].(string); ok {
-						messageID = id
-					}
-					if m, ok := message["model"].(string); ok {
-						model = m
-					}
-					// Also check for initial usage in message_start
-					if usage, ok := message["usage"].(map[string]interface{}); ok {
-						finalUsage = usage
-					}
+	for _, jsonData := range sseEventData(sseData) {
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(jsonData), &event); err != nil {
+			continue
+		}
+
+		eventType, _ := event["type"].(string)
+
+		// Handle different event types
+		if eventType == "message_start" {
+			// Extract message ID and model from message_start event
+			if message, ok := event["message"].(map[string]interface{}); ok {
+				if id, ok := message["id"].(string); ok && messageID == "" {
+					messageID = id
 				}
-			} else if eventType == "message_delta" {
-				// Extract cumulative usage data from message_delta event (final counts are here)
-				if delta, ok := event["delta"].(map[string]interface{}); ok {
-					if usage, ok := delta["usage"].(map[string]interface{}); ok {
-						finalUsage = usage
-					}
+				if m, ok := message["model"].(string); ok && model == "" {
+					model = m
+				}
+				// Initial usage; counts already taken from a message_delta stay ahead of it
+				if usage, ok := message["usage"].(map[string]interface{}); ok {
+					finalUsage = mergeUsage(usage, finalUsage)
+				}
+			}
+		} else if eventType == "message_delta" {
+			// Extract cumulative usage data from message_delta event (final counts are here)
+			// Anthropic sends usage at the top level of the event, usually only output_tokens;
+			// older streams nested it under delta. Either way it is merged over the message_start usage
+			// so input tokens reported only at the start are kept
+			if usage, ok := event["usage"].(map[string]interface{}); ok {
+				finalUsage = mergeUsage(finalUsage, usage)
+			} else if delta, ok := event["delta"].(map[string]interface{}); ok {
+				if usage, ok := delta["usage"].(map[string]interface{}); ok {
+					finalUsage = mergeUsage(finalUsage, usage)
 				}
 			}
 		}
@@ -133,12 +475,44 @@ func main() {
 	var billingService *services.BillingService
 	if config.BillingEnabled {
 		billingService = services.NewBillingService(dbService, true)
-		defer billingService.Close()
+		billingService.SetCacheWriteAlertThreshold(config.CacheWriteAlertTokens)
+		billingService.SetOutputTokenCaps(config.OutputTokenCaps, config.OutputCapThrottle)
+		billingService.SetSingleCommitAggregation(config.SingleCommitAggregation)
+		if config.PricingReloadInterval > 0 {
+			billingService.StartPricingReload(config.PricingReloadInterval)
+		}
+		// Closed by shutdownGracefully, which flushes the buffered records
 		log.Printf("Billing service initialized for project: %s", config.ProjectID)
 	} else {
 		log.Println("Billing service is disabled")
 	}
 
+	// Initialize usage records retention job
+	if config.RetentionDays > 0 {
+		retentionService := services.NewRetentionService(dbService.Client(), config.RetentionDays, time.Hour)
+		retentionService.Start()
+		defer retentionService.Stop()
+		log.Printf("Usage records retention enabled: %d days", config.RetentionDays)
+	}
+
+	// Initialize BigQuery export of hourly aggregates
+	if config.BigQueryDataset != "" {
+		inserter, err := services.NewBigQueryInserter(context.Background(), config.ProjectID)
+		if err != nil {
+			log.Fatalf("Failed to initialize BigQuery export: %v", err)
+		}
+		exporter := services.NewBigQueryExporter(dbService.Client(), inserter, config.BigQueryDataset, []services.BigQueryExportTable{
+			{Collection: "hourly_aggregates", TableID: config.BigQueryHourlyTable, TimeField: "hour"},
+			{Collection: "upstream_account_hourly_aggregates", TableID: config.BigQueryUpstreamHourlyTable, TimeField: "hour"},
+		}, config.BigQueryExportInterval)
+		if !config.BigQueryExportStart.IsZero() {
+			exporter.SetStartTime(config.BigQueryExportStart)
+		}
+		exporter.Start()
+		defer exporter.Stop()
+		log.Printf("BigQuery export enabled: dataset %s every %s", config.BigQueryDataset, config.BigQueryExportInterval)
+	}
+
 	r := mux.NewRouter()
 
 	// Health check endpoint
@@ -147,6 +521,101 @@ func main() {
 		w.Write([]byte("OK"))
 	}).Methods("GET")
 
+	// Readiness check that also verifies Firestore connectivity
+	r.HandleFunc("/ready", serveReady(dbService)).Methods("GET")
+
+	// Age of the last successful write per aggregation dimension; 503 when any is stale so uptime checks can alert
+	r.HandleFunc("/health/aggregation-lag", func(w http.ResponseWriter, r *http.Request) {
+		if billingService == nil {
+			http.Error(w, "Billing service not enabled", http.StatusServiceUnavailable)
+			return
+		}
+		writeAggregationLag(w, billingService.AggregationLag(time.Now(), config.AggregationLagThreshold))
+	}).Methods("GET")
+
+	// Admin lookup of usage records by Anthropic request id (access is restricted by Cloud Run IAM)
+	r.HandleFunc("/admin/usage-records", func(w http.ResponseWriter, r *http.Request) {
+		if billingService == nil {
+			http.Error(w, "Billing service not enabled", http.StatusServiceUnavailable)
+			return
+		}
+
+		upstreamRequestID := r.URL.Query().Get("anthropic_request_id")
+		if upstreamRequestID == "" {
+			http.Error(w, "anthropic_request_id query parameter is required", http.StatusBadRequest)
+			return
+		}
+
+		records, err := billingService.FindByAnthropicRequestID(r.Context(), upstreamRequestID)
+		if err != nil {
+			log.Printf("Error looking up usage records for request %s: %v", upstreamRequestID, err)
+			http.Error(w, "Error looking up usage records", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(records)
+	}).Methods("GET")
+
+	// Admin p50/p95 upstream latency per model over [start, end), given as RFC3339 times at most
+	// services.MaxLatencyRange (7 days) apart (access is restricted by Cloud Run IAM)
+	r.HandleFunc("/admin/latency", func(w http.ResponseWriter, r *http.Request) {
+		if billingService == nil {
+			http.Error(w, "Billing service not enabled", http.StatusServiceUnavailable)
+			return
+		}
+
+		start, startErr := time.Parse(time.RFC3339, r.URL.Query().Get("start"))
+		end, endErr := time.Parse(time.RFC3339, r.URL.Query().Get("end"))
+		if startErr != nil || endErr != nil {
+			http.Error(w, "start and end query parameters are required as RFC3339 times", http.StatusBadRequest)
+			return
+		}
+
+		stats, err := billingService.GetLatencyPercentiles(r.Context(), start, end)
+		switch {
+		case errors.Is(err, services.ErrInvalidLatencyRange):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			log.Printf("Error computing latency percentiles for %s to %s: %v", start.Format(time.RFC3339), end.Format(time.RFC3339), err)
+			http.Error(w, "Error computing latency percentiles", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"models": stats})
+	}).Methods("GET")
+
+	// Admin rebuild of user hourly/daily and upstream account hourly aggregates from usage_records over whole UTC days
+	// [start, end), given as YYYY-MM-DD (access is restricted by Cloud Run IAM)
+	rebuilder := services.NewAggregateRebuilder(dbService.Client(), config.RetentionDays)
+	r.HandleFunc("/admin/rebuild-aggregates", func(w http.ResponseWriter, r *http.Request) {
+		start, startErr := time.Parse(time.DateOnly, r.URL.Query().Get("start"))
+		end, endErr := time.Parse(time.DateOnly, r.URL.Query().Get("end"))
+		if startErr != nil || endErr != nil {
+			http.Error(w, "start and end query parameters are required as YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+
+		stats, err := rebuilder.RebuildAggregates(r.Context(), start, end)
+		switch {
+		case errors.Is(err, services.ErrRebuildInProgress):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case errors.Is(err, services.ErrInvalidRebuildRange):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			log.Printf("Error rebuilding aggregates for %s to %s: %v", start.Format(time.DateOnly), end.Format(time.DateOnly), err)
+			http.Error(w, "Error rebuilding aggregates", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	}).Methods("POST")
+
 	// Root endpoint to accept billing requests
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
@@ -182,28 +651,48 @@ func main() {
 		}
 
 		// Extract additional metadata from headers if available
-		requestID := r.Header.Get("X-Request-Id") // From Claude API response
-
-		// Process SSE data - extract message_stop and pass to ProcessResponse
-		bodyStr := string(responseBody)
+		requestID := r.Header.Get("X-Request-Id")
+		upstreamRequestID := anthropicRequestID(r.Header) // Anthropic's request-id, for correlating with their logs
+		clientIP := r.Header.Get("X-Client-IP")           // Resolved by the proxy from its trusted forwarding headers
+
+		// Upstream latency measured by the proxy; the total arrives as a trailer after the body,
+		// or as a regular header when the proxy replays a payload it had to queue
+		totalMs := r.Trailer.Get("X-Upstream-Total-Ms")
+		if totalMs == "" {
+			totalMs = r.Header.Get("X-Upstream-Total-Ms")
+		}
+		latency := services.RequestLatency{
+			TTFBMs:  parseLatencyMs(r.Header.Get("X-Upstream-TTFB-Ms")),
+			TotalMs: parseLatencyMs(totalMs),
+		}
 
-		// Only process SSE streams - use guard clause for early return
-		if !strings.HasPrefix(bodyStr, "event:") && !strings.HasPrefix(bodyStr, "data:") {
-			log.Printf("Skipping non-SSE response for billing")
+		// Error responses carry no usage; they are recorded so operators can see a user's failed requests
+		if status := parseUpstreamStatus(r.Header.Get(upstreamStatusHeader)); status >= http.StatusBadRequest {
+			err := billingService.ProcessErrorResponse(userID, upstreamAccountUUID, clientIP, requestID, upstreamRequestID, status, parseErrorMessage(responseBody), latency)
+			if err != nil {
+				log.Printf("Error recording error response for user %s: %v", userID, err)
+				http.Error(w, "Error processing billing", http.StatusInternalServerError)
+				return
+			}
 			w.WriteHeader(http.StatusOK)
 			return
 		}
 
-		// Parse SSE stream to extract usage data from message_start and message_delta events
-		message, err := parseSSEForUsageData(bodyStr)
+		// Extract usage from SSE streams and non-streaming JSON responses
+		message, err := parseUsageBody(r.Header.Get("Content-Type"), responseBody)
 		if err != nil {
-			log.Printf("Error parsing SSE stream for user %s: %v", userID, err)
-			http.Error(w, "Error parsing SSE stream", http.StatusBadRequest)
+			log.Printf("Error parsing response body for user %s: %v", userID, err)
+			http.Error(w, "Error parsing response body", http.StatusBadRequest)
+			return
+		}
+		if message == nil {
+			log.Printf("Skipping response without message usage for billing (Content-Type: %q)", r.Header.Get("Content-Type"))
+			w.WriteHeader(http.StatusOK)
 			return
 		}
 
 		// Use ProcessRequest with the parsed message
-		err = billingService.ProcessRequest(message, userID, upstreamAccountUUID, requestID)
+		err = billingService.ProcessRequest(message, userID, upstreamAccountUUID, clientIP, requestID, upstreamRequestID, latency)
 		if err != nil {
 			log.Printf("Error processing billing request for user %s: %v", userID, err)
 			http.Error(w, "Error processing billing", http.StatusInternalServerError)
@@ -221,6 +710,27 @@ func main() {
 		port = "8081"
 	}
 
-	log.Printf("Billing service starting on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	server := &http.Server{Addr: ":" + port, Handler: r}
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Printf("Billing service starting on port %s", port)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	// Cloud Run sends SIGTERM before stopping an instance
+	signalCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	select {
+	case err := <-serverErr:
+		log.Fatalf("Billing server failed: %v", err)
+	case <-signalCtx.Done():
+	}
+
+	log.Printf("Shutting down: draining requests and flushing buffered billing records (timeout %s)", config.ShutdownTimeout)
+	if err := shutdownGracefully(server, billingService, config.ShutdownTimeout); err != nil {
+		log.Printf("Graceful shutdown incomplete: %v", err)
+		return
+	}
+	log.Println("Billing service stopped")
 }
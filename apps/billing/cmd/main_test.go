@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"simple-relay/billing/internal/services"
+	"simple-relay/shared/database"
+)
+
+func TestDetectBodyFormat(t *testing.T) {
+	sse := "event: message_start\ndata: {\"type\":\"message_start\"}\n\n"
+	json := `{"id":"msg_1","model":"claude-sonnet-4-20250514"}`
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        bodyFormat
+	}{
+		{"sse content type", "text/event-stream; charset=utf-8", sse, bodyFormatSSE},
+		{"json content type", "application/json", json, bodyFormatJSON},
+		{"header wins over body", "application/json", sse, bodyFormatJSON},
+		{"sse with leading whitespace and no header", "", "\n\r\n  " + sse, bodyFormatSSE},
+		{"sse with BOM and no header", "", "\xEF\xBB\xBF" + sse, bodyFormatSSE},
+		{"data-only sse and no header", "", "data: {}\n\n", bodyFormatSSE},
+		{"json with leading whitespace and no header", "", "\n  " + json, bodyFormatJSON},
+		{"unrecognized header falls back to sniffing", "text/plain", sse, bodyFormatSSE},
+		{"unknown body", "", "not a claude response", bodyFormatUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectBodyFormat(tt.contentType, []byte(tt.body)); got != tt.want {
+				t.Errorf("detectBodyFormat(%q) = %v, want %v", tt.contentType, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrorMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"json error", `{"type":"error","error":{"type":"invalid_request_error","message":"messages: field required"}}`, "invalid_request_error: messages: field required"},
+		{"sse error event", "event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\",\"message\":\"Overloaded\"}}\n\n", "overloaded_error: Overloaded"},
+		{"other body", "  upstream connect error  ", "upstream connect error"},
+		{"long body is truncated", strings.Repeat("x", 2*maxErrorMessageLength), strings.Repeat("x", maxErrorMessageLength)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseErrorMessage([]byte(tt.body)); got != tt.want {
+				t.Errorf("parseErrorMessage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	for value, want := range map[string]int{"400": 400, "529": 529, "": 0, "abc": 0, "42": 0} {
+		if got := parseUpstreamStatus(value); got != want {
+			t.Errorf("parseUpstreamStatus(%q) = %d, want %d", value, got, want)
+		}
+	}
+}
+
+func TestParseSSEForUsageData_TopLevelDeltaUsage(t *testing.T) {
+	// Shape of a stream the proxy cut off at its cost ceiling: usage sits at the top level of message_delta
+	stream := "event: message_start\n" +
+		"data: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_1\",\"model\":\"claude-sonnet-4-20250514\",\"usage\":{\"input_tokens\":1000,\"output_tokens\":1}}}\n\n" +
+		"event: message_delta\n" +
+		"data: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"max_tokens\",\"stop_sequence\":null},\"usage\":{\"output_tokens\":3200}}\n\n" +
+		"event: message_stop\n" +
+		"data: {\"type\":\"message_stop\"}\n\n"
+
+	message, err := parseSSEForUsageData(stream)
+	if err != nil {
+		t.Fatalf("parseSSEForUsageData returned error: %v", err)
+	}
+	if message.Usage.InputTokens != 1000 {
+		t.Errorf("expected input tokens from message_start to be kept, got %d", message.Usage.InputTokens)
+	}
+	if message.Usage.OutputTokens != 3200 {
+		t.Errorf("expected output tokens from message_delta, got %d", message.Usage.OutputTokens)
+	}
+}
+
+func TestParseSSEForUsageData_DeltaWithoutInputTokensKeepsStartInput(t *testing.T) {
+	start := "event: message_start\n" +
+		"data: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_2\",\"model\":\"claude-sonnet-4-20250514\",\"usage\":{\"input_tokens\":2500,\"cache_read_input_tokens\":400,\"output_tokens\":1}}}\n\n"
+
+	tests := []struct {
+		name  string
+		delta string
+	}{
+		{"nested delta usage", `{"type":"message_delta","delta":{"stop_reason":"end_turn","usage":{"output_tokens":120}}}`},
+		{"top-level usage", `{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":120}}`},
+		{"zero and null input in delta", `{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"input_tokens":0,"cache_read_input_tokens":null,"output_tokens":120}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message, err := parseSSEForUsageData(start + "event: message_delta\ndata: " + tt.delta + "\n\n")
+			if err != nil {
+				t.Fatalf("parseSSEForUsageData returned error: %v", err)
+			}
+			if message.Usage.InputTokens != 2500 || message.Usage.CacheReadInputTokens != 400 {
+				t.Errorf("expected input usage from message_start, got %+v", message.Usage)
+			}
+			if message.Usage.OutputTokens != 120 {
+				t.Errorf("expected output tokens from message_delta, got %d", message.Usage.OutputTokens)
+			}
+		})
+	}
+}
+
+func TestParseSSEForUsageData_CumulativeDeltaInputWins(t *testing.T) {
+	stream := "data: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_3\",\"model\":\"claude-sonnet-4-20250514\",\"usage\":{\"input_tokens\":100,\"output_tokens\":1}}}\n\n" +
+		"data: {\"type\":\"message_delta\",\"usage\":{\"input_tokens\":180,\"output_tokens\":40}}\n\n"
+
+	message, err := parseSSEForUsageData(stream)
+	if err != nil {
+		t.Fatalf("parseSSEForUsageData returned error: %v", err)
+	}
+	// Delta usage is cumulative, so a reported input count replaces the one from message_start
+	if message.Usage.InputTokens != 180 || message.Usage.OutputTokens != 40 {
+		t.Errorf("expected cumulative counts from message_delta, got %+v", message.Usage)
+	}
+}
+
+func TestParseSSEForUsageData_CacheCreationBuckets(t *testing.T) {
+	stream := "data: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_4\",\"model\":\"claude-sonnet-4-20250514\",\"usage\":{\"input_tokens\":10,\"cache_creation_input_tokens\":3000,\"cache_creation\":{\"ephemeral_5m_input_tokens\":1000,\"ephemeral_1h_input_tokens\":2000},\"output_tokens\":1}}}\n\n" +
+		"data: {\"type\":\"message_delta\",\"usage\":{\"output_tokens\":40,\"cache_creation\":{\"ephemeral_1h_input_tokens\":0}}}\n\n"
+
+	message, err := parseSSEForUsageData(stream)
+	if err != nil {
+		t.Fatalf("parseSSEForUsageData returned error: %v", err)
+	}
+	cacheCreation := message.Usage.CacheCreation
+	if message.Usage.CacheCreationInputTokens != 3000 || cacheCreation.Ephemeral5mInputTokens != 1000 || cacheCreation.Ephemeral1hInputTokens != 2000 {
+		t.Errorf("expected 3000 cache write tokens split 1000/2000, got %+v", message.Usage)
+	}
+}
+
+func TestParseSSEForUsageData_RechunkedStream(t *testing.T) {
+	// CRLF line endings, content_block_delta events interleaved around usage events, a message_start
+	// spread over several data lines, a message_delta split mid-line and one split across an event
+	// boundary, plus a repeated message_start that must not reset the counts
+	stream := "event: message_start\r\n" +
+		"data: {\"type\":\"message_start\",\r\n" +
+		"data: \"message\":{\"id\":\"msg_6\",\"model\":\"claude-sonnet-4-20250514\",\r\n" +
+		"data: \"usage\":{\"input_tokens\":900,\"cache_read_input_tokens\":300,\"output_tokens\":1}}}\r\n\r\n" +
+		"event: content_block_start\r\n" +
+		"data: {\"type\":\"content_block_start\",\"index\":0,\"content_block\":{\"type\":\"text\",\"text\":\"\"}}\r\n\r\n" +
+		": keep-alive\r\n\r\n" +
+		"event: content_block_delta\r\n" +
+		"data: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"Hel\"}}\r\n\r\n" +
+		"event: message_delta\r\n" +
+		"data: {\"type\":\"message_delta\",\"usage\":{\"outp\r\n" +
+		"ut_tokens\":40}}\r\n\r\n" +
+		"event: content_block_delta\r\n" +
+		"data: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"lo\"}}\r\n\r\n" +
+		"data: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_6\",\"model\":\"claude-sonnet-4-20250514\",\"usage\":{\"input_tokens\":900,\"output_tokens\":1}}}\r\n\r\n" +
+		"event: message_delta\r\n" +
+		"data: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"},\r\n\r\n" +
+		"data: \"usage\":{\"output_tokens\":275}}\r\n\r\n" +
+		"event: message_stop\r\n" +
+		"data: {\"type\":\"message_stop\"}\r\n\r\n" +
+		"data: [DONE]\r\n\r\n"
+
+	message, err := parseSSEForUsageData(stream)
+	if err != nil {
+		t.Fatalf("parseSSEForUsageData returned error: %v", err)
+	}
+	if message.ID != "msg_6" || message.Model != "claude-sonnet-4-20250514" {
+		t.Errorf("expected msg_6 on claude-sonnet-4-20250514, got %q on %q", message.ID, message.Model)
+	}
+	if message.Usage.InputTokens != 900 || message.Usage.CacheReadInputTokens != 300 {
+		t.Errorf("expected input usage from the multi-line message_start, got %+v", message.Usage)
+	}
+	if message.Usage.OutputTokens != 275 {
+		t.Errorf("expected final output tokens from the split message_delta, got %d", message.Usage.OutputTokens)
+	}
+}
+
+func TestParseSSEForUsageData_StartCacheTokensReachBilledRecord(t *testing.T) {
+	stream := "event: message_start\n" +
+		"data: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_5\",\"model\":\"claude-sonnet-4-20250514\",\"usage\":{\"input_tokens\":12,\"cache_creation_input_tokens\":5000,\"cache_read_input_tokens\":80000,\"output_tokens\":1}}}\n\n" +
+		"event: message_delta\n" +
+		"data: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"},\"usage\":{\"output_tokens\":250}}\n\n"
+
+	message, err := parseSSEForUsageData(stream)
+	if err != nil {
+		t.Fatalf("parseSSEForUsageData returned error: %v", err)
+	}
+	record, err := services.NewBillingService(nil, false).ProcessResponse(message, "user@example.com", "account-1", "", "req_5", "", services.RequestLatency{})
+	if err != nil {
+		t.Fatalf("ProcessResponse returned error: %v", err)
+	}
+	if record.CacheWriteTokens != 5000 || record.CacheReadTokens != 80000 {
+		t.Errorf("expected cache tokens from message_start in the record, got write=%d read=%d", record.CacheWriteTokens, record.CacheReadTokens)
+	}
+	if record.InputTokens != 12 || record.OutputTokens != 250 {
+		t.Errorf("expected input 12 and output 250, got %d/%d", record.InputTokens, record.OutputTokens)
+	}
+}
+
+func TestParseUsageBody_NonStreamingJSON(t *testing.T) {
+	body := []byte(`{"id":"msg_6","type":"message","role":"assistant","model":"claude-sonnet-4-20250514",` +
+		`"content":[{"type":"text","text":"hi"}],"stop_reason":"end_turn",` +
+		`"usage":{"input_tokens":300,"output_tokens":42,"cache_read_input_tokens":1000}}`)
+
+	message, err := parseUsageBody("application/json", body)
+	if err != nil || message == nil {
+		t.Fatalf("expected a message from the JSON body, got %v (err %v)", message, err)
+	}
+	record, err := services.NewBillingService(nil, false).ProcessResponse(message, "user@example.com", "account-1", "", "", "", services.RequestLatency{})
+	if err != nil {
+		t.Fatalf("ProcessResponse returned error: %v", err)
+	}
+	if record.RequestID != "msg_6" || record.InputTokens != 300 || record.OutputTokens != 42 || record.CacheReadTokens != 1000 {
+		t.Errorf("unexpected usage record %+v", record)
+	}
+
+	// Sniffed without a Content-Type, as for SSE
+	if message, err := parseUsageBody("", body); err != nil || message == nil {
+		t.Errorf("expected a sniffed JSON body to be parsed, got %v (err %v)", message, err)
+	}
+}
+
+func TestParseUsageBody_SkipsBodiesWithoutMessage(t *testing.T) {
+	bodies := map[string]string{
+		"error response": `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`,
+		"token count":    `{"input_tokens":42}`,
+		"plain text":     "upstream connect error",
+	}
+	for name, body := range bodies {
+		t.Run(name, func(t *testing.T) {
+			if message, err := parseUsageBody("", []byte(body)); err != nil || message != nil {
+				t.Errorf("expected body to be skipped, got %v (err %v)", message, err)
+			}
+		})
+	}
+
+	if _, err := parseUsageBody("application/json", []byte("{truncated")); err == nil {
+		t.Errorf("expected invalid JSON to be rejected")
+	}
+}
+
+func TestAnthropicRequestID(t *testing.T) {
+	header := http.Header{}
+	// The proxy forwards Anthropic's response headers as received
+	header.Add("request-id", "req_011CPx9b2")
+	header.Set("X-Request-Id", "internal-123")
+
+	if got := anthropicRequestID(header); got != "req_011CPx9b2" {
+		t.Errorf("anthropicRequestID = %q, want req_011CPx9b2", got)
+	}
+	if got := anthropicRequestID(http.Header{}); got != "" {
+		t.Errorf("expected empty id when the header is missing, got %q", got)
+	}
+}
+
+func TestWriteAggregationLag_StaleDimensionReturns503(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeAggregationLag(rec, []services.DimensionLag{
+		{Dimension: services.DimensionUserHourly, AgeSeconds: 5},
+		{Dimension: services.DimensionUpstreamMinute, AgeSeconds: 900, Stale: true},
+	})
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 with a stale dimension, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	writeAggregationLag(rec, []services.DimensionLag{{Dimension: services.DimensionUserHourly, AgeSeconds: 5}})
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200 when every dimension is current, got %d", rec.Code)
+	}
+}
+
+func TestServeReady_ConnectedToEmulator(t *testing.T) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST not set, skipping Firestore emulator test")
+	}
+	dbService, err := database.NewService("test-project", "(default)")
+	if err != nil {
+		t.Fatalf("failed to create database service: %v", err)
+	}
+	t.Cleanup(func() { dbService.Close() })
+
+	rec := httptest.NewRecorder()
+	serveReady(dbService)(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200 when Firestore is reachable, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestShutdownGracefully_FlushesBufferedRecords(t *testing.T) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST not set, skipping Firestore emulator test")
+	}
+	ctx := context.Background()
+	dbService, err := database.NewService("test-project", "(default)")
+	if err != nil {
+		t.Fatalf("failed to create database service: %v", err)
+	}
+	t.Cleanup(func() { dbService.Close() })
+
+	const userID = "shutdown@example.com"
+	records := dbService.Client().Collection("usage_records").Where("user_id", "==", userID)
+	existing, err := records.Documents(ctx).GetAll()
+	if err != nil {
+		t.Fatalf("failed to list usage records: %v", err)
+	}
+	for _, doc := range existing {
+		doc.Ref.Delete(ctx)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := &http.Server{Handler: http.NotFoundHandler()}
+	go server.Serve(listener)
+
+	// The BatchWriter holds up to 100 records for 5 seconds, so these stay buffered until shutdown
+	billingService := services.NewBillingService(dbService, true)
+	for i := 0; i < 3; i++ {
+		message := &services.ClaudeMessage{ID: fmt.Sprintf("msg_shutdown_%d", i), Model: "claude-sonnet-4-20250514"}
+		message.Usage.InputTokens = 100
+		message.Usage.OutputTokens = 10
+		if err := billingService.ProcessRequest(message, userID, "acct-1", "", "", "", services.RequestLatency{}); err != nil {
+			t.Fatalf("ProcessRequest returned error: %v", err)
+		}
+	}
+
+	if err := shutdownGracefully(server, billingService, 10*time.Second); err != nil {
+		t.Fatalf("shutdownGracefully returned error: %v", err)
+	}
+
+	if _, err := http.Get("http://" + listener.Addr().String()); err == nil {
+		t.Errorf("expected the server to stop accepting requests after shutdown")
+	}
+	flushed, err := records.Documents(ctx).GetAll()
+	if err != nil {
+		t.Fatalf("failed to list usage records: %v", err)
+	}
+	if len(flushed) != 3 {
+		t.Errorf("expected 3 buffered records to be flushed on shutdown, got %d", len(flushed))
+	}
+}
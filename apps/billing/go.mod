@@ -5,6 +5,8 @@ go 1.24
 require (
 	cloud.google.com/go/firestore v1.14.0
 	github.com/gorilla/mux v1.8.1
+	google.golang.org/api v0.128.0
+	google.golang.org/grpc v1.57.0
 	simple-relay/shared v0.0.0
 )
 
@@ -12,7 +14,7 @@ replace simple-relay/shared => ../shared
 
 require (
 	github.com/google/go-cmp v0.5.9 // indirect
-	google.golang.org/grpc v1.57.0 // indirect
+	github.com/google/uuid v1.3.0 // indirect
 )
 
 require (
@@ -35,7 +37,6 @@ require (
 	golang.org/x/text v0.13.0 // indirect
 	golang.org/x/time v0.3.0 // indirect
 	golang.org/x/xerrors v0.0.0-20220907171357-04be3eba64a2 // indirect
-	google.golang.org/api v0.128.0 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/genproto v0.0.0-20230822172742-b8732ec3820d // indirect
 	google.golang.org/genproto/googleapis/api v0.0.0-20230822172742-b8732ec3820d // indirect
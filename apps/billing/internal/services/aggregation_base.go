@@ -0,0 +1,224 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"simple-relay/shared/timewindow"
+
+	"cloud.google.com/go/firestore"
+)
+
+// AggregateConfig defines one aggregate dimension: what records are grouped by, at which time
+// granularity, and where the aggregates are stored
+type AggregateConfig struct {
+	CollectionName string
+	KeyField       string                    // Document field holding the grouping key, e.g. "user_id"
+	Key            func(*UsageRecord) string // Grouping key of a record; records with an empty key are skipped
+	TimeFormat     string
+	TimeFieldName  string
+	LogDescription string
+}
+
+// userKey groups records by user
+func userKey(record *UsageRecord) string { return record.UserID }
+
+// upstreamAccountKey groups records by the upstream account that served them
+func upstreamAccountKey(record *UsageRecord) string { return record.UpstreamAccountUUID }
+
+// MemoryAggregate is one aggregate document's totals accumulated in memory before persistence
+type MemoryAggregate struct {
+	Key                   string                      `json:"key"`      // Value of the configured key field
+	TimeKey               string                      `json:"time_key"` // Period in the configured time format
+	TotalRequests         int                         `json:"total_requests"`
+	TotalInputTokens      int                         `json:"total_input_tokens"`
+	TotalOutputTokens     int                         `json:"total_output_tokens"`
+	TotalCacheReadTokens  int                         `json:"total_cache_read_tokens"`
+	TotalCacheWriteTokens int                         `json:"total_cache_write_tokens"`
+	TotalCacheReadCost    float64                     `json:"total_cache_read_cost"`
+	TotalCacheWriteCost   float64                     `json:"total_cache_write_cost"`
+	TotalCost             float64                     `json:"total_cost"`
+	TotalPoints           float64                     `json:"total_points"`
+	ModelUsage            map[string]MemoryModelStats `json:"model_usage"`
+}
+
+// AggregationBase provides the aggregation shared by every dimension
+type AggregationBase struct {
+	db             *firestore.Client
+	billingService *BillingService
+	config         AggregateConfig
+}
+
+// NewAggregationBase creates a new base aggregation service
+func NewAggregationBase(db *firestore.Client, billingService *BillingService, config AggregateConfig) *AggregationBase {
+	return &AggregationBase{
+		db:             db,
+		billingService: billingService,
+		config:         config,
+	}
+}
+
+// AggregateRecords adds usage records to their aggregates with atomic increments
+func (ab *AggregationBase) AggregateRecords(ctx context.Context, records []*UsageRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	// Group records by key and time for aggregation
+	aggregateMap := make(map[string]*MemoryAggregate)
+	for _, record := range records {
+		ab.config.accumulate(aggregateMap, record)
+	}
+
+	// Execute atomic incremental updates for each aggregate
+	failed := 0
+	for key, memAggregate := range aggregateMap {
+		if err := ab.atomicIncrementAggregate(ctx, key, memAggregate); err != nil {
+			log.Printf("Error atomically updating %s %s: %v", ab.config.LogDescription, key, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d %s writes failed", failed, len(aggregateMap), ab.config.LogDescription)
+	}
+
+	log.Printf("Successfully aggregated %d records into %d %ss using atomic increments",
+		len(records), len(aggregateMap), ab.config.LogDescription)
+	return nil
+}
+
+// accumulate adds one usage record to the in-memory aggregate for its key and time bucket
+func (config AggregateConfig) accumulate(aggregateMap map[string]*MemoryAggregate, record *UsageRecord) {
+	keyValue := config.Key(record)
+	if keyValue == "" {
+		return
+	}
+
+	// Use the key and time as composite key for document ID
+	timeKey := timewindow.Key(record.Timestamp, config.TimeFormat)
+	docID := fmt.Sprintf("%s_%s", keyValue, timeKey)
+
+	aggregate, exists := aggregateMap[docID]
+	if !exists {
+		aggregate = &MemoryAggregate{
+			Key:        keyValue,
+			TimeKey:    timeKey,
+			ModelUsage: make(map[string]MemoryModelStats),
+		}
+		aggregateMap[docID] = aggregate
+	}
+
+	// Accumulate data in memory
+	points := ConvertCostToPoints(record.TotalCost)
+	aggregate.TotalRequests++
+	aggregate.TotalInputTokens += record.InputTokens
+	aggregate.TotalOutputTokens += record.OutputTokens
+	aggregate.TotalCacheReadTokens += record.CacheReadTokens
+	aggregate.TotalCacheWriteTokens += record.CacheWriteTokens
+	aggregate.TotalCacheReadCost += record.CacheReadCost
+	aggregate.TotalCacheWriteCost += record.CacheWriteCost
+	aggregate.TotalCost += record.TotalCost
+	aggregate.TotalPoints += points
+
+	// Update model statistics
+	modelStats := aggregate.ModelUsage[record.Model]
+	modelStats.RequestCount++
+	modelStats.InputTokens += record.InputTokens
+	modelStats.OutputTokens += record.OutputTokens
+	modelStats.CacheReadTokens += record.CacheReadTokens
+	modelStats.CacheWriteTokens += record.CacheWriteTokens
+	modelStats.CacheReadCost += record.CacheReadCost
+	modelStats.CacheWriteCost += record.CacheWriteCost
+	modelStats.TotalCost += record.TotalCost
+	modelStats.TotalPoints += points
+	aggregate.ModelUsage[record.Model] = modelStats
+}
+
+// atomicIncrementAggregate performs atomic incremental updates to aggregate document
+func (ab *AggregationBase) atomicIncrementAggregate(ctx context.Context, docID string, memAggregate *MemoryAggregate) error {
+	docRef := ab.db.Collection(ab.config.CollectionName).Doc(docID)
+
+	// Execute upsert operation with MergeAll
+	_, err := docRef.Set(ctx, ab.config.upsertData(memAggregate), firestore.MergeAll)
+	if err != nil {
+		return fmt.Errorf("failed to atomically upsert %s: %w", ab.config.LogDescription, err)
+	}
+
+	log.Printf("Atomically upserted %s %s: +%d requests, +%d input tokens, +%d output tokens, +$%.6f cost, +%.2f points",
+		ab.config.LogDescription, docID, memAggregate.TotalRequests, memAggregate.TotalInputTokens,
+		memAggregate.TotalOutputTokens, memAggregate.TotalCost, memAggregate.TotalPoints)
+	return nil
+}
+
+// upsertData builds the atomic increment and metadata fields written for an aggregate document
+func (config AggregateConfig) upsertData(memAggregate *MemoryAggregate) map[string]any {
+	upsertData := map[string]any{
+		// Atomic increment fields
+		"total_requests":           firestore.Increment(memAggregate.TotalRequests),
+		"total_input_tokens":       firestore.Increment(memAggregate.TotalInputTokens),
+		"total_output_tokens":      firestore.Increment(memAggregate.TotalOutputTokens),
+		"total_cache_read_tokens":  firestore.Increment(memAggregate.TotalCacheReadTokens),
+		"total_cache_write_tokens": firestore.Increment(memAggregate.TotalCacheWriteTokens),
+		"total_cache_read_cost":    firestore.Increment(memAggregate.TotalCacheReadCost),
+		"total_cache_write_cost":   firestore.Increment(memAggregate.TotalCacheWriteCost),
+		"total_cost":               firestore.Increment(memAggregate.TotalCost),
+		"total_points":             firestore.Increment(memAggregate.TotalPoints),
+
+		// Metadata fields
+		config.KeyField: memAggregate.Key,
+		"updated_at":    time.Now(),
+	}
+
+	// Parse and set time field
+	if parsedTime, err := timewindow.ParseKey(memAggregate.TimeKey, config.TimeFormat); err == nil {
+		upsertData[config.TimeFieldName] = parsedTime
+		upsertData["created_at"] = time.Now()
+	}
+
+	// Add model-related atomic increments
+	for model, stats := range memAggregate.ModelUsage {
+		modelPath := fmt.Sprintf("model_usage.%s", model)
+		upsertData[fmt.Sprintf("%s.request_count", modelPath)] = firestore.Increment(stats.RequestCount)
+		upsertData[fmt.Sprintf("%s.input_tokens", modelPath)] = firestore.Increment(stats.InputTokens)
+		upsertData[fmt.Sprintf("%s.output_tokens", modelPath)] = firestore.Increment(stats.OutputTokens)
+		upsertData[fmt.Sprintf("%s.cache_read_tokens", modelPath)] = firestore.Increment(stats.CacheReadTokens)
+		upsertData[fmt.Sprintf("%s.cache_write_tokens", modelPath)] = firestore.Increment(stats.CacheWriteTokens)
+		upsertData[fmt.Sprintf("%s.cache_read_cost", modelPath)] = firestore.Increment(stats.CacheReadCost)
+		upsertData[fmt.Sprintf("%s.cache_write_cost", modelPath)] = firestore.Increment(stats.CacheWriteCost)
+		upsertData[fmt.Sprintf("%s.total_cost", modelPath)] = firestore.Increment(stats.TotalCost)
+		upsertData[fmt.Sprintf("%s.total_points", modelPath)] = firestore.Increment(stats.TotalPoints)
+	}
+
+	return upsertData
+}
+
+// snapshotData builds a complete aggregate document holding the totals as plain values, so writing it
+// without merge replaces whatever the document held instead of adding to it
+func (config AggregateConfig) snapshotData(memAggregate *MemoryAggregate, now time.Time) map[string]any {
+	modelUsage := make(map[string]ModelStats, len(memAggregate.ModelUsage))
+	for model, stats := range memAggregate.ModelUsage {
+		modelUsage[model] = ModelStats(stats)
+	}
+
+	data := map[string]any{
+		"total_requests":           memAggregate.TotalRequests,
+		"total_input_tokens":       memAggregate.TotalInputTokens,
+		"total_output_tokens":      memAggregate.TotalOutputTokens,
+		"total_cache_read_tokens":  memAggregate.TotalCacheReadTokens,
+		"total_cache_write_tokens": memAggregate.TotalCacheWriteTokens,
+		"total_cache_read_cost":    memAggregate.TotalCacheReadCost,
+		"total_cache_write_cost":   memAggregate.TotalCacheWriteCost,
+		"total_cost":               memAggregate.TotalCost,
+		"total_points":             memAggregate.TotalPoints,
+		"model_usage":              modelUsage,
+		config.KeyField:            memAggregate.Key,
+		"created_at":               now,
+		"updated_at":               now,
+	}
+	if parsedTime, err := timewindow.ParseKey(memAggregate.TimeKey, config.TimeFormat); err == nil {
+		data[config.TimeFieldName] = parsedTime
+	}
+	return data
+}
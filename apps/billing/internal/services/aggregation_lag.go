@@ -0,0 +1,80 @@
+package services
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Dimensions tracked by AggregationLag: the raw usage records plus each aggregate collection
+const (
+	DimensionUsageRecords   = "usage_records"
+	DimensionUserHourly     = "hourly_aggregates"
+	DimensionUserDaily      = "daily_aggregates"
+	DimensionUpstreamHourly = "upstream_account_hourly_aggregates"
+	DimensionUpstreamMinute = "upstream_account_minute_aggregates"
+)
+
+// DimensionLag is how far one dimension's writes are behind
+type DimensionLag struct {
+	Dimension   string    `json:"dimension"`
+	LastSuccess time.Time `json:"last_success"`
+	AgeSeconds  float64   `json:"age_seconds"` // Gauge: seconds since LastSuccess
+	Stale       bool      `json:"stale"`       // AgeSeconds exceeds the configured threshold
+}
+
+// AggregationLag records when each dimension last caught up, so usage enforcement reading stale
+// aggregates can be alerted on. A flush with nothing buffered counts as caught up, so the age only
+// grows while writes fail or stop, not while traffic is idle.
+type AggregationLag struct {
+	mu          sync.Mutex
+	started     time.Time
+	lastSuccess map[string]time.Time
+}
+
+// NewAggregationLag creates a tracker whose dimensions are measured from now until their first success
+func NewAggregationLag(dimensions []string, now time.Time) *AggregationLag {
+	lag := &AggregationLag{
+		started:     now,
+		lastSuccess: make(map[string]time.Time, len(dimensions)),
+	}
+	for _, dimension := range dimensions {
+		lag.lastSuccess[dimension] = time.Time{}
+	}
+	return lag
+}
+
+// RecordSuccess marks dimensions as caught up at time at
+func (l *AggregationLag) RecordSuccess(at time.Time, dimensions ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, dimension := range dimensions {
+		if at.After(l.lastSuccess[dimension]) {
+			l.lastSuccess[dimension] = at
+		}
+	}
+}
+
+// Snapshot returns the lag of every dimension at now, sorted by dimension. Dimensions without a
+// success yet are aged from when tracking started. threshold 0 never marks a dimension stale.
+func (l *AggregationLag) Snapshot(now time.Time, threshold time.Duration) []DimensionLag {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lags := make([]DimensionLag, 0, len(l.lastSuccess))
+	for dimension, lastSuccess := range l.lastSuccess {
+		since := lastSuccess
+		if since.IsZero() {
+			since = l.started
+		}
+		age := now.Sub(since)
+		lags = append(lags, DimensionLag{
+			Dimension:   dimension,
+			LastSuccess: lastSuccess,
+			AgeSeconds:  age.Seconds(),
+			Stale:       threshold > 0 && age > threshold,
+		})
+	}
+	sort.Slice(lags, func(i, j int) bool { return lags[i].Dimension < lags[j].Dimension })
+	return lags
+}
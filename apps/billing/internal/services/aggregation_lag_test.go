@@ -0,0 +1,81 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAggregationLag_Snapshot(t *testing.T) {
+	started := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	lag := NewAggregationLag([]string{DimensionUserHourly, DimensionUpstreamHourly}, started)
+
+	lag.RecordSuccess(started.Add(4*time.Minute), DimensionUserHourly)
+	// An older success never moves the gauge backwards
+	lag.RecordSuccess(started.Add(time.Minute), DimensionUserHourly)
+
+	lags := lag.Snapshot(started.Add(10*time.Minute), 5*time.Minute)
+	if len(lags) != 2 {
+		t.Fatalf("expected 2 dimensions, got %d", len(lags))
+	}
+	user, upstream := lags[0], lags[1]
+	if user.Dimension != DimensionUserHourly || user.AgeSeconds != 360 || !user.Stale {
+		t.Errorf("unexpected user hourly lag: %+v", user)
+	}
+	// Never written: aged from when tracking started
+	if upstream.Dimension != DimensionUpstreamHourly || upstream.AgeSeconds != 600 || !upstream.LastSuccess.IsZero() {
+		t.Errorf("unexpected upstream hourly lag: %+v", upstream)
+	}
+
+	for _, dimension := range lag.Snapshot(started.Add(10*time.Minute), 0) {
+		if dimension.Stale {
+			t.Errorf("expected no stale dimensions without a threshold, got %+v", dimension)
+		}
+	}
+}
+
+func TestBatchWriter_EmptyFlushCountsAsCaughtUp(t *testing.T) {
+	bw := NewBatchWriter(nil, 100, time.Hour, nil)
+	bw.lag = NewAggregationLag(append([]string{DimensionUsageRecords}, aggregateDimensions...), time.Now().Add(-time.Hour))
+
+	if err := bw.flush(); err != nil {
+		t.Fatalf("flush returned error: %v", err)
+	}
+	for _, lag := range bw.AggregationLag(time.Now(), time.Minute) {
+		if lag.Stale || lag.LastSuccess.IsZero() {
+			t.Errorf("expected %s to be caught up after an empty flush, got %+v", lag.Dimension, lag)
+		}
+	}
+}
+
+func TestBatchWriter_FlushUpdatesAggregationLag(t *testing.T) {
+	client := newEmulatorClient(t)
+	for _, collection := range []string{"usage_records", "hourly_aggregates", "upstream_account_hourly_aggregates", "upstream_account_minute_aggregates"} {
+		clearCollection(t, client, collection)
+	}
+
+	for _, singleCommit := range []bool{false, true} {
+		bw := NewBatchWriter(client, 100, time.Hour, nil)
+		bw.SetSingleCommitAggregation(singleCommit)
+		before := time.Now()
+
+		for _, record := range multiDimensionTestRecords(time.Date(2025, 3, 1, 10, 5, 10, 0, time.UTC)) {
+			record.ID += "-lag"
+			if err := bw.Add(record); err != nil {
+				t.Fatalf("Add returned error: %v", err)
+			}
+		}
+		if err := bw.flush(); err != nil {
+			t.Fatalf("flush returned error: %v", err)
+		}
+
+		lags := bw.AggregationLag(time.Now(), time.Minute)
+		if len(lags) != 4 {
+			t.Fatalf("expected 4 dimensions, got %d", len(lags))
+		}
+		for _, lag := range lags {
+			if lag.LastSuccess.Before(before) || lag.Stale {
+				t.Errorf("single commit %v: expected %s updated by the flush, got %+v", singleCommit, lag.Dimension, lag)
+			}
+		}
+	}
+}
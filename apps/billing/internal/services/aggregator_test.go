@@ -0,0 +1,151 @@
+package services
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"simple-relay/shared/timewindow"
+
+	"cloud.google.com/go/firestore"
+)
+
+func cacheTestRecords(base time.Time) []*UsageRecord {
+	return []*UsageRecord{
+		{ID: "c1", UserID: "user-a", Model: "claude-sonnet-4", Timestamp: base, InputTokens: 10, CacheReadTokens: 1000, CacheReadCost: 0.25, TotalCost: 0.3},
+		{ID: "c2", UserID: "user-a", Model: "claude-sonnet-4", Timestamp: base.Add(time.Minute), InputTokens: 20, CacheWriteTokens: 400, CacheWriteCost: 0.5, TotalCost: 0.6},
+		{ID: "c3", UserID: "user-a", Model: "claude-opus-4", Timestamp: base.Add(2 * time.Minute), InputTokens: 30, CacheReadTokens: 200, CacheWriteTokens: 100, CacheReadCost: 0.125, CacheWriteCost: 0.75, TotalCost: 1.0},
+	}
+}
+
+func TestAccumulateHourlyAggregate_IncrementsCacheFields(t *testing.T) {
+	base := time.Date(2025, 3, 1, 10, 5, 0, 0, time.UTC)
+	aggregates := make(map[string]*MemoryAggregate)
+	for _, record := range cacheTestRecords(base) {
+		accumulateHourlyAggregate(aggregates, record)
+	}
+
+	aggregate := aggregates["user-a_"+timewindow.HourKey(base)]
+	if aggregate == nil {
+		t.Fatalf("expected one hourly aggregate, got %v", aggregates)
+	}
+	if aggregate.TotalCacheReadTokens != 1200 || aggregate.TotalCacheWriteTokens != 500 {
+		t.Errorf("expected 1200 cache read and 500 cache write tokens, got %d and %d",
+			aggregate.TotalCacheReadTokens, aggregate.TotalCacheWriteTokens)
+	}
+	if aggregate.TotalCacheReadCost != 0.375 || aggregate.TotalCacheWriteCost != 1.25 {
+		t.Errorf("expected cache read cost 0.375 and cache write cost 1.25, got %v and %v",
+			aggregate.TotalCacheReadCost, aggregate.TotalCacheWriteCost)
+	}
+
+	sonnet := aggregate.ModelUsage["claude-sonnet-4"]
+	if sonnet.CacheReadTokens != 1000 || sonnet.CacheWriteTokens != 400 || sonnet.CacheReadCost != 0.25 || sonnet.CacheWriteCost != 0.5 {
+		t.Errorf("unexpected sonnet cache stats: %+v", sonnet)
+	}
+
+	data := hourlyAggregateUpsertData(aggregate)
+	for _, field := range []string{
+		"total_cache_read_tokens", "total_cache_write_tokens", "total_cache_read_cost", "total_cache_write_cost",
+		"model_usage.claude-opus-4.cache_read_cost", "model_usage.claude-opus-4.cache_write_cost",
+	} {
+		if _, ok := data[field]; !ok {
+			t.Errorf("expected upsert data to increment %s", field)
+		}
+	}
+}
+
+// TestHourlyAggregateUpsertData_MatchesPreviousSchema pins the hourly_aggregates fields the user
+// aggregator wrote before it moved onto the generic aggregation base
+func TestHourlyAggregateUpsertData_MatchesPreviousSchema(t *testing.T) {
+	base := time.Date(2025, 3, 1, 10, 5, 0, 0, time.UTC)
+	records := []*UsageRecord{
+		{ID: "p1", UserID: "user-a", UpstreamAccountUUID: "acct-1", Model: "claude-sonnet-4", Timestamp: base, InputTokens: 10, OutputTokens: 5, CacheReadTokens: 100, CacheReadCost: 0.25, TotalCost: 0.5},
+		{ID: "p2", UserID: "user-a", Model: "claude-sonnet-4", Timestamp: base.Add(time.Minute), InputTokens: 20, OutputTokens: 15, CacheWriteTokens: 40, CacheWriteCost: 0.125, TotalCost: 0.25},
+	}
+	aggregates := make(map[string]*MemoryAggregate)
+	for _, record := range records {
+		accumulateHourlyAggregate(aggregates, record)
+	}
+	docID := "user-a_" + timewindow.HourKey(base)
+	if len(aggregates) != 1 || aggregates[docID] == nil {
+		t.Fatalf("expected a single aggregate %s, got %v", docID, aggregates)
+	}
+
+	data := hourlyAggregateUpsertData(aggregates[docID])
+	want := map[string]any{
+		"total_requests":           firestore.Increment(2),
+		"total_input_tokens":       firestore.Increment(30),
+		"total_output_tokens":      firestore.Increment(20),
+		"total_cache_read_tokens":  firestore.Increment(100),
+		"total_cache_write_tokens": firestore.Increment(40),
+		"total_cache_read_cost":    firestore.Increment(0.25),
+		"total_cache_write_cost":   firestore.Increment(0.125),
+		"total_cost":               firestore.Increment(0.75),
+		"total_points":             firestore.Increment(ConvertCostToPoints(0.5) + ConvertCostToPoints(0.25)),
+		"user_id":                  "user-a",
+		"hour":                     time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC),
+		"model_usage.claude-sonnet-4.request_count":      firestore.Increment(2),
+		"model_usage.claude-sonnet-4.input_tokens":       firestore.Increment(30),
+		"model_usage.claude-sonnet-4.output_tokens":      firestore.Increment(20),
+		"model_usage.claude-sonnet-4.cache_read_tokens":  firestore.Increment(100),
+		"model_usage.claude-sonnet-4.cache_write_tokens": firestore.Increment(40),
+		"model_usage.claude-sonnet-4.cache_read_cost":    firestore.Increment(0.25),
+		"model_usage.claude-sonnet-4.cache_write_cost":   firestore.Increment(0.125),
+		"model_usage.claude-sonnet-4.total_cost":         firestore.Increment(0.75),
+		"model_usage.claude-sonnet-4.total_points":       firestore.Increment(ConvertCostToPoints(0.5) + ConvertCostToPoints(0.25)),
+	}
+	for _, timestamp := range []string{"created_at", "updated_at"} {
+		if _, ok := data[timestamp].(time.Time); !ok {
+			t.Errorf("expected %s to be set, got %v", timestamp, data[timestamp])
+		}
+	}
+	if len(data) != len(want)+2 {
+		t.Errorf("expected %d fields, got %d: %v", len(want)+2, len(data), data)
+	}
+	for field, value := range want {
+		if !reflect.DeepEqual(data[field], value) {
+			t.Errorf("%s: expected %v, got %v", field, value, data[field])
+		}
+	}
+}
+
+func TestAggregatorService_IncrementsCacheFieldsAcrossBatches(t *testing.T) {
+	client := newEmulatorClient(t)
+	ctx := context.Background()
+	clearCollection(t, client, "hourly_aggregates")
+
+	as := NewAggregatorService(client, nil)
+	base := time.Date(2025, 3, 1, 10, 5, 0, 0, time.UTC)
+	// Two batches for the same hour: the second must add to, not replace, the first
+	for i := 0; i < 2; i++ {
+		if err := as.AggregateRecords(ctx, cacheTestRecords(base)); err != nil {
+			t.Fatalf("AggregateRecords returned error: %v", err)
+		}
+	}
+
+	doc, err := client.Collection("hourly_aggregates").Doc("user-a_" + timewindow.HourKey(base)).Get(ctx)
+	if err != nil {
+		t.Fatalf("failed to read hourly aggregate: %v", err)
+	}
+	var hourly HourlyAggregate
+	if err := doc.DataTo(&hourly); err != nil {
+		t.Fatalf("failed to parse hourly aggregate: %v", err)
+	}
+	if hourly.TotalCacheReadTokens != 2400 || hourly.TotalCacheWriteTokens != 1000 {
+		t.Errorf("expected 2400 cache read and 1000 cache write tokens, got %d and %d",
+			hourly.TotalCacheReadTokens, hourly.TotalCacheWriteTokens)
+	}
+	if hourly.TotalCacheReadCost != 0.75 || hourly.TotalCacheWriteCost != 2.5 {
+		t.Errorf("expected cache read cost 0.75 and cache write cost 2.5, got %v and %v",
+			hourly.TotalCacheReadCost, hourly.TotalCacheWriteCost)
+	}
+
+	opus, err := doc.DataAtPath(firestore.FieldPath{"model_usage", "claude-opus-4", "cache_write_cost"})
+	if err != nil {
+		t.Fatalf("failed to read opus cache write cost: %v", err)
+	}
+	if cost, _ := opus.(float64); cost != 1.5 {
+		t.Errorf("expected opus cache write cost 1.5, got %v", opus)
+	}
+}
@@ -2,42 +2,80 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
 	"time"
 
 	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // BatchWriter 批量写入器，用于优化数据库写入性能
 type BatchWriter struct {
 	client                     *firestore.Client
 	buffer                     []*UsageRecord
-	bufferMu                   sync.Mutex
+	bufferMu                   sync.Mutex                // 只保护缓冲区和刷新状态，写入数据库时不持有
+	flushMu                    sync.Mutex                // 同一时间只有一次刷新
 	maxSize                    int
+	maxRetained                int                       // 缓冲区最多保留的记录数，写入持续失败时超出部分被丢弃
+	nextFlushAt                time.Time                 // 刷新失败后，缓冲区满触发的刷新推迟到此时间
 	flushTime                  time.Duration
 	stopChan                   chan struct{}
+	intervalChan               chan time.Duration        // 通知运行中的循环按新间隔重建定时器
 	wg                         sync.WaitGroup
 	collection                 string
 	aggregator                 *AggregatorService
+	dailyAggregator            *DailyAggregatorService
 	upstreamAggregator         *UpstreamHourlyAggregatorService
 	upstreamMinuteAggregator   *UpstreamMinuteAggregatorService
+	multiAggregator            *MultiDimensionAggregator // 非空时所有聚合维度一次遍历、一次BulkWriter提交
+	lag                        *AggregationLag           // 各维度最近一次成功写入的时间
+	commitAttempts             int                       // 每次刷新写入使用记录的最多尝试次数
+	commitRetryDelay           time.Duration             // 第一次重试前的等待时间，之后每次翻倍
+	writesPerCommit            int                       // 每次提交最多写入的使用记录数
+	unconfirmed                map[string]bool           // 写入返回错误的记录ID，服务端可能已提交；由flushMu保护
+	// create 写入一批使用记录，返回新写入的、已存在的和需要重试的记录；测试中替换
+	create func(ctx context.Context, records []*UsageRecord) (created, existing, failed []*UsageRecord)
 }
 
+// maxWritesPerCommit Firestore单次提交最多500个写操作，超出的使用记录分多次提交
+const maxWritesPerCommit = 500
+
+// defaultMaxRetained 默认最多保留的记录数，限制Firestore故障期间的内存占用
+const defaultMaxRetained = 10000
+
+// ErrBufferFull 缓冲区已达到保留上限，记录未被接收
+var ErrBufferFull = errors.New("usage record buffer is full")
+
+// aggregateDimensions 聚合服务写入的维度
+var aggregateDimensions = []string{DimensionUserHourly, DimensionUserDaily, DimensionUpstreamHourly, DimensionUpstreamMinute}
+
 // NewBatchWriter 创建新的批量写入器
 func NewBatchWriter(client *firestore.Client, maxSize int, flushTime time.Duration, billingService *BillingService) *BatchWriter {
-	return &BatchWriter{
+	bw := &BatchWriter{
 		client:                   client,
 		buffer:                   make([]*UsageRecord, 0, maxSize),
 		maxSize:                  maxSize,
+		maxRetained:              defaultMaxRetained,
 		flushTime:                flushTime,
 		stopChan:                 make(chan struct{}),
+		intervalChan:             make(chan time.Duration, 1),
 		collection:               "usage_records",
 		aggregator:               NewAggregatorService(client, billingService),
+		dailyAggregator:          NewDailyAggregatorService(client),
 		upstreamAggregator:       NewUpstreamHourlyAggregatorService(client, billingService),
 		upstreamMinuteAggregator: NewUpstreamMinuteAggregatorService(client, billingService),
+		lag:                      NewAggregationLag(append([]string{DimensionUsageRecords}, aggregateDimensions...), time.Now()),
+		commitAttempts:           3,
+		commitRetryDelay:         100 * time.Millisecond,
+		writesPerCommit:          maxWritesPerCommit,
+		unconfirmed:              make(map[string]bool),
 	}
+	bw.create = bw.createRecords
+	return bw
 }
 
 // Start 启动批量写入器
@@ -55,30 +93,47 @@ func (bw *BatchWriter) Stop() error {
 	return bw.flush()
 }
 
-// Add 添加记录到缓冲区
+// Add 添加记录到缓冲区；缓冲区达到保留上限时拒绝记录并返回ErrBufferFull
 func (bw *BatchWriter) Add(record *UsageRecord) error {
 	bw.bufferMu.Lock()
-	defer bw.bufferMu.Unlock()
-
+	if len(bw.buffer) >= bw.maxRetained {
+		bw.bufferMu.Unlock()
+		log.Printf("Dropping usage record %s: %d records already waiting to be written", record.ID, bw.maxRetained)
+		return ErrBufferFull
+	}
 	bw.buffer = append(bw.buffer, record)
+	// 缓冲区满了立即刷新；上次刷新失败时等到退避结束，由定时刷新重试
+	full := len(bw.buffer) >= bw.maxSize && !time.Now().Before(bw.nextFlushAt)
+	bw.bufferMu.Unlock()
 
-	// 如果缓冲区满了，立即刷新
-	if len(bw.buffer) >= bw.maxSize {
-		return bw.flushLocked()
+	if full {
+		return bw.flushIfIdle()
 	}
-
 	return nil
 }
 
+// flushIfIdle 在没有其他刷新进行时刷新；正在进行的刷新结束后，剩余记录由下一次刷新写入
+func (bw *BatchWriter) flushIfIdle() error {
+	if !bw.flushMu.TryLock() {
+		return nil
+	}
+	defer bw.flushMu.Unlock()
+	return bw.flushPending()
+}
+
 // run 运行批量写入器的主循环
 func (bw *BatchWriter) run() {
 	defer bw.wg.Done()
 
+	bw.bufferMu.Lock()
 	ticker := time.NewTicker(bw.flushTime)
+	bw.bufferMu.Unlock()
 	defer ticker.Stop()
 
 	for {
 		select {
+		case interval := <-bw.intervalChan:
+			ticker.Reset(interval)
 		case <-ticker.C:
 			if err := bw.flush(); err != nil {
 				log.Printf("Error flushing batch: %v", err)
@@ -91,62 +146,257 @@ func (bw *BatchWriter) run() {
 
 // flush 刷新缓冲区到数据库
 func (bw *BatchWriter) flush() error {
-	bw.bufferMu.Lock()
-	defer bw.bufferMu.Unlock()
+	bw.flushMu.Lock()
+	defer bw.flushMu.Unlock()
 
-	return bw.flushLocked()
+	return bw.flushPending()
 }
 
-// flushLocked 在已加锁的情况下刷新缓冲区
-func (bw *BatchWriter) flushLocked() error {
-	if len(bw.buffer) == 0 {
+// flushPending 取出缓冲区中的记录写入数据库，调用方持有flushMu
+// 写入和重试期间不持有bufferMu，Add不会被阻塞
+func (bw *BatchWriter) flushPending() error {
+	flushStarted := time.Now()
+	bw.bufferMu.Lock()
+	pending := bw.buffer
+	bw.buffer = make([]*UsageRecord, 0, bw.maxSize)
+	bw.bufferMu.Unlock()
+
+	if len(pending) == 0 {
+		// 没有待写入的记录，所有维度都已追上
+		bw.lag.RecordSuccess(flushStarted, append([]string{DimensionUsageRecords}, aggregateDimensions...)...)
 		return nil
 	}
 
 	ctx := context.Background()
-	batch := bw.client.Batch()
 
-	// 批量添加使用记录文档
-	for _, record := range bw.buffer {
-		docRef := bw.client.Collection(bw.collection).Doc(record.ID)
-		batch.Set(docRef, record)
+	// 按稳定ID创建使用记录，已存在的记录（重复投递）被跳过，只有新写入的记录计入聚合
+	// 每次提交不超过writesPerCommit条，一次提交失败不影响其他分块
+	var recordsCopy, failed []*UsageRecord
+	for _, chunk := range chunkRecords(uniqueRecords(pending), bw.writesPerCommit) {
+		created, chunkFailed := bw.createWithRetry(ctx, chunk)
+		recordsCopy = append(recordsCopy, created...)
+		failed = append(failed, chunkFailed...)
 	}
 
-	// 执行批量写入
-	_, err := batch.Commit(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to commit batch: %w", err)
+	// 写入失败的记录放回缓冲区开头，下次刷新时重试
+	bw.retain(failed, flushStarted)
+	if len(failed) == 0 {
+		bw.lag.RecordSuccess(flushStarted, DimensionUsageRecords)
 	}
 
-	// 使用聚合服务更新小时聚合数据
-	// 清空缓冲区前先复制记录
-	recordsCopy := make([]*UsageRecord, len(bw.buffer))
-	copy(recordsCopy, bw.buffer)
+	bw.aggregate(ctx, recordsCopy, flushStarted)
+	log.Printf("Successfully flushed %d records to database", len(recordsCopy))
 
-	// 清空缓冲区
-	bw.buffer = bw.buffer[:0]
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to write %d usage records", len(failed))
+	}
+	return nil
+}
+
+// retain 将写入失败的记录放回缓冲区，超出maxRetained的部分丢弃并记录日志
+// 有失败时，缓冲区满触发的刷新推迟一个刷新间隔，避免每次Add都重新进入重试
+func (bw *BatchWriter) retain(failed []*UsageRecord, flushStarted time.Time) {
+	bw.bufferMu.Lock()
+	defer bw.bufferMu.Unlock()
+
+	if len(failed) == 0 {
+		bw.nextFlushAt = time.Time{}
+		return
+	}
+	bw.nextFlushAt = flushStarted.Add(bw.flushTime)
+
+	buffer := append(failed, bw.buffer...)
+	if len(buffer) > bw.maxRetained {
+		dropped := buffer[bw.maxRetained:]
+		log.Printf("Dropping %d usage records that could not be written (first %s); at most %d are retained",
+			len(dropped), dropped[0].ID, bw.maxRetained)
+		buffer = buffer[:bw.maxRetained]
+		for _, record := range dropped {
+			delete(bw.unconfirmed, record.ID)
+		}
+	}
+	bw.buffer = buffer
+}
+
+// aggregate 将新写入的记录计入各聚合维度；聚合失败不阻塞刷新操作，仅记录日志
+func (bw *BatchWriter) aggregate(ctx context.Context, records []*UsageRecord, flushStarted time.Time) {
+	if len(records) == 0 {
+		return
+	}
+
+	// 只有错误响应记录时没有用量要写入，各聚合维度已是最新
+	records = billableRecords(records)
+	if len(records) == 0 {
+		bw.lag.RecordSuccess(flushStarted, aggregateDimensions...)
+		return
+	}
+
+	// 单次提交模式：一次遍历计算所有维度并通过一个BulkWriter写入
+	if bw.multiAggregator != nil {
+		if err := bw.multiAggregator.AggregateRecords(ctx, records); err != nil {
+			log.Printf("Error aggregating records in single commit: %v", err)
+		} else {
+			bw.lag.RecordSuccess(flushStarted, aggregateDimensions...)
+		}
+		return
+	}
 
 	// 执行记录聚合 (includes both cost and points)
-	if err := bw.aggregator.AggregateRecords(ctx, recordsCopy); err != nil {
+	if err := bw.aggregator.AggregateRecords(ctx, records); err != nil {
 		log.Printf("Error aggregating user records: %v", err)
-		// 聚合失败不阻塞刷新操作，仅记录日志
+	} else {
+		bw.lag.RecordSuccess(flushStarted, DimensionUserHourly)
+	}
+
+	// 执行用户日聚合
+	if err := bw.dailyAggregator.AggregateRecords(ctx, records); err != nil {
+		log.Printf("Error aggregating user daily records: %v", err)
+	} else {
+		bw.lag.RecordSuccess(flushStarted, DimensionUserDaily)
 	}
 
 	// 执行上游账户聚合
-	if err := bw.upstreamAggregator.AggregateRecords(ctx, recordsCopy); err != nil {
+	if err := bw.upstreamAggregator.AggregateRecords(ctx, records); err != nil {
 		log.Printf("Error aggregating upstream account records: %v", err)
-		// 聚合失败不阻塞刷新操作，仅记录日志
+	} else {
+		bw.lag.RecordSuccess(flushStarted, DimensionUpstreamHourly)
 	}
 
 	// 执行上游账户分钟级聚合
-	if err := bw.upstreamMinuteAggregator.AggregateRecords(ctx, recordsCopy); err != nil {
+	if err := bw.upstreamMinuteAggregator.AggregateRecords(ctx, records); err != nil {
 		log.Printf("Error aggregating upstream account minute records: %v", err)
-		// 聚合失败不阻塞刷新操作，仅记录日志
+	} else {
+		bw.lag.RecordSuccess(flushStarted, DimensionUpstreamMinute)
 	}
+}
 
-	log.Printf("Successfully flushed %d records to database", len(recordsCopy))
+// createWithRetry 写入使用记录，失败的记录按指数退避重试，最多尝试commitAttempts次
+// 仍然失败的记录返回给调用方，留在缓冲区等下次刷新
+// 写入返回错误时服务端可能已经提交，这类记录重试时遇到AlreadyExists视为本次写入，仍计入聚合；
+// 其他已存在的记录是重复投递，跳过
+func (bw *BatchWriter) createWithRetry(ctx context.Context, records []*UsageRecord) (created []*UsageRecord, failed []*UsageRecord) {
+	pending := records
+	duplicates := 0
+	defer func() {
+		if duplicates > 0 {
+			log.Printf("Skipped %d usage records that were already billed", duplicates)
+		}
+	}()
+	for attempt := 1; ; attempt++ {
+		newlyCreated, existing, stillFailed := bw.create(ctx, pending)
+		for _, record := range newlyCreated {
+			delete(bw.unconfirmed, record.ID)
+		}
+		created = append(created, newlyCreated...)
+		for _, record := range existing {
+			if bw.unconfirmed[record.ID] {
+				delete(bw.unconfirmed, record.ID)
+				created = append(created, record)
+				continue
+			}
+			duplicates++
+		}
+		for _, record := range stillFailed {
+			bw.unconfirmed[record.ID] = true
+		}
+		if len(stillFailed) == 0 || attempt >= bw.commitAttempts {
+			return created, stillFailed
+		}
+		delay := bw.commitRetryDelay << (attempt - 1)
+		log.Printf("Retrying %d usage records in %s (attempt %d/%d)", len(stillFailed), delay, attempt+1, bw.commitAttempts)
+		time.Sleep(delay)
+		pending = stillFailed
+	}
+}
 
-	return nil
+// createRecords 通过BulkWriter逐条Create使用记录
+// 返回新写入的记录、文档已存在的记录和需要重试的记录
+func (bw *BatchWriter) createRecords(ctx context.Context, records []*UsageRecord) (created, existing, failed []*UsageRecord) {
+	bulkWriter := bw.client.BulkWriter(ctx)
+
+	jobs := make([]*firestore.BulkWriterJob, len(records))
+	for i, record := range records {
+		job, err := bulkWriter.Create(bw.client.Collection(bw.collection).Doc(record.ID), record)
+		if err != nil {
+			log.Printf("Error enqueueing usage record %s: %v", record.ID, err)
+			continue
+		}
+		jobs[i] = job
+	}
+	bulkWriter.End()
+
+	for i, job := range jobs {
+		if job == nil {
+			failed = append(failed, records[i])
+			continue
+		}
+		if _, err := job.Results(); err != nil {
+			if status.Code(err) == codes.AlreadyExists {
+				existing = append(existing, records[i])
+				continue
+			}
+			log.Printf("Error writing usage record %s: %v", records[i].ID, err)
+			failed = append(failed, records[i])
+			continue
+		}
+		created = append(created, records[i])
+	}
+	return created, existing, failed
+}
+
+// billableRecords 去掉错误响应记录：它们只保存在 usage_records 中，没有用量可聚合
+func billableRecords(records []*UsageRecord) []*UsageRecord {
+	billable := make([]*UsageRecord, 0, len(records))
+	for _, record := range records {
+		if record.Status != UsageStatusError {
+			billable = append(billable, record)
+		}
+	}
+	return billable
+}
+
+// chunkRecords 将记录按size条一组切分
+func chunkRecords(records []*UsageRecord, size int) [][]*UsageRecord {
+	var chunks [][]*UsageRecord
+	for start := 0; start < len(records); start += size {
+		end := start + size
+		if end > len(records) {
+			end = len(records)
+		}
+		chunks = append(chunks, records[start:end])
+	}
+	return chunks
+}
+
+// uniqueRecords 去掉同一批次中ID重复的记录（保留第一条）
+func uniqueRecords(records []*UsageRecord) []*UsageRecord {
+	seen := make(map[string]bool, len(records))
+	unique := make([]*UsageRecord, 0, len(records))
+	for _, record := range records {
+		if seen[record.ID] {
+			continue
+		}
+		seen[record.ID] = true
+		unique = append(unique, record)
+	}
+	return unique
+}
+
+// SetSingleCommitAggregation 设置是否将所有聚合维度合并为一次BulkWriter提交
+func (bw *BatchWriter) SetSingleCommitAggregation(enabled bool) {
+	bw.flushMu.Lock()
+	defer bw.flushMu.Unlock()
+
+	if enabled {
+		bw.multiAggregator = NewMultiDimensionAggregator(bw.client, bw.upstreamAggregator.base, bw.upstreamMinuteAggregator.base)
+	} else {
+		bw.multiAggregator = nil
+	}
+}
+
+// AggregationLag 返回各维度距最近一次成功写入的时长（超过threshold标记为stale，0表示不标记）
+func (bw *BatchWriter) AggregationLag(now time.Time, threshold time.Duration) []DimensionLag {
+	return bw.lag.Snapshot(now, threshold)
 }
 
 // GetBufferSize 获取当前缓冲区大小
@@ -160,18 +410,42 @@ func (bw *BatchWriter) GetBufferSize() int {
 // SetMaxSize 设置最大缓冲区大小
 func (bw *BatchWriter) SetMaxSize(size int) {
 	bw.bufferMu.Lock()
-	defer bw.bufferMu.Unlock()
-
 	bw.maxSize = size
+	full := len(bw.buffer) >= bw.maxSize
+	bw.bufferMu.Unlock()
 
 	// 如果当前缓冲区超过新的大小限制，立即刷新
-	if len(bw.buffer) >= bw.maxSize {
-		bw.flushLocked()
+	if full {
+		bw.flushIfIdle()
+	}
+}
+
+// SetMaxRetained 设置写入持续失败时缓冲区最多保留的记录数
+func (bw *BatchWriter) SetMaxRetained(limit int) {
+	if limit <= 0 {
+		return
 	}
+
+	bw.bufferMu.Lock()
+	defer bw.bufferMu.Unlock()
+
+	bw.maxRetained = limit
 }
 
-// SetFlushInterval 设置刷新间隔
+// SetFlushInterval 设置刷新间隔，运行中的批量写入器立即按新间隔刷新
 func (bw *BatchWriter) SetFlushInterval(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	bw.bufferMu.Lock()
+	defer bw.bufferMu.Unlock()
+
 	bw.flushTime = interval
-	// 注意：这不会立即影响正在运行的定时器，需要重启批量写入器才能生效
+	// 只保留最新的间隔：替换还未被运行循环取走的旧值
+	select {
+	case <-bw.intervalChan:
+	default:
+	}
+	bw.intervalChan <- interval
 }
@@ -0,0 +1,382 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"simple-relay/shared/timewindow"
+
+	"cloud.google.com/go/firestore"
+	bigquery "google.golang.org/api/bigquery/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// bigQueryInsertBatchSize is the number of rows per insertAll request (BigQuery recommends at most 500)
+	bigQueryInsertBatchSize = 500
+	// bigQueryExportDelay keeps recently closed hours out of the export until late batch writes have landed
+	bigQueryExportDelay = 15 * time.Minute
+	// bigQueryExportStateCollection stores the export watermark per BigQuery table
+	bigQueryExportStateCollection = "bigquery_export_state"
+	// bigQueryExportWindow is the longest span of hours exported under one claim
+	bigQueryExportWindow = 24 * time.Hour
+	// bigQueryClaimTTL is how long a claimed window is reserved for the claiming instance; an
+	// instance that crashes mid-export releases its window when the claim expires
+	bigQueryClaimTTL = 10 * time.Minute
+)
+
+// bigQueryExportState is the export progress of one table. A window [ExportedUntil, ClaimUntil) is
+// claimed by ClaimHolder before it is exported, so instances never export the same window together.
+type bigQueryExportState struct {
+	ExportedUntil  time.Time `firestore:"exported_until"`
+	ClaimHolder    string    `firestore:"claim_holder"`
+	ClaimUntil     time.Time `firestore:"claim_until"`
+	ClaimExpiresAt time.Time `firestore:"claim_expires_at"`
+	UpdatedAt      time.Time `firestore:"updated_at"`
+}
+
+// claimedByOther reports whether another instance holds an unexpired claim on the table
+func (s bigQueryExportState) claimedByOther(holder string, now time.Time) bool {
+	return s.ClaimHolder != "" && s.ClaimHolder != holder && now.Before(s.ClaimExpiresAt)
+}
+
+// nextBigQueryExportWindow returns the next window to export after since, at most
+// bigQueryExportWindow long and ending by until; ok is false when since has caught up
+func nextBigQueryExportWindow(since, until time.Time) (start, end time.Time, ok bool) {
+	if !since.Before(until) {
+		return time.Time{}, time.Time{}, false
+	}
+	end = since.Add(bigQueryExportWindow)
+	if end.After(until) {
+		end = until
+	}
+	return since, end, true
+}
+
+// BigQueryRow is a single row for a streaming insert; InsertID lets BigQuery drop duplicate inserts
+type BigQueryRow struct {
+	InsertID string
+	Values   map[string]interface{}
+}
+
+// BigQueryInserter streams rows into a BigQuery table
+type BigQueryInserter interface {
+	InsertAll(ctx context.Context, datasetID, tableID string, rows []BigQueryRow) error
+}
+
+// bigQueryAPIInserter implements BigQueryInserter with the BigQuery REST API (tabledata.insertAll)
+type bigQueryAPIInserter struct {
+	service   *bigquery.Service
+	projectID string
+}
+
+// NewBigQueryInserter creates an inserter for tables in projectID using application default credentials
+func NewBigQueryInserter(ctx context.Context, projectID string) (BigQueryInserter, error) {
+	service, err := bigquery.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create BigQuery client: %w", err)
+	}
+	return &bigQueryAPIInserter{service: service, projectID: projectID}, nil
+}
+
+// InsertAll streams rows into datasetID.tableID
+func (i *bigQueryAPIInserter) InsertAll(ctx context.Context, datasetID, tableID string, rows []BigQueryRow) error {
+	request := &bigquery.TableDataInsertAllRequest{
+		Rows: make([]*bigquery.TableDataInsertAllRequestRows, 0, len(rows)),
+	}
+	for _, row := range rows {
+		values := make(map[string]bigquery.JsonValue, len(row.Values))
+		for key, value := range row.Values {
+			values[key] = value
+		}
+		request.Rows = append(request.Rows, &bigquery.TableDataInsertAllRequestRows{
+			InsertId: row.InsertID,
+			Json:     values,
+		})
+	}
+
+	response, err := i.service.Tabledata.InsertAll(i.projectID, datasetID, tableID, request).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("insertAll into %s.%s failed: %w", datasetID, tableID, err)
+	}
+	if len(response.InsertErrors) > 0 {
+		first := response.InsertErrors[0]
+		message := "unknown error"
+		if len(first.Errors) > 0 {
+			message = first.Errors[0].Message
+		}
+		return fmt.Errorf("insertAll into %s.%s rejected %d rows (row %d: %s)",
+			datasetID, tableID, len(response.InsertErrors), first.Index, message)
+	}
+	return nil
+}
+
+// BigQueryExportTable maps a Firestore aggregate collection to a BigQuery table
+type BigQueryExportTable struct {
+	Collection string // Firestore collection to read
+	TableID    string // BigQuery table to write
+	TimeField  string // Bucket time field used to select closed hours
+}
+
+// BigQueryExporter periodically exports closed hourly aggregates to BigQuery.
+// Each table keeps a watermark of the last exported hour, and rows are keyed by Firestore doc ID,
+// so re-running an export does not duplicate rows. Every instance runs the exporter; each window is
+// claimed in a Firestore transaction first, so only one instance exports it.
+type BigQueryExporter struct {
+	client          *firestore.Client
+	inserter        BigQueryInserter
+	datasetID       string
+	tables          []BigQueryExportTable
+	stateCollection string
+	interval        time.Duration
+	batchSize       int
+	startAt         time.Time // First hour exported for tables without a watermark; zero starts at the first run
+	holder          string    // Identifies this instance's claims
+	now             func() time.Time
+	stopChan        chan struct{}
+	wg              sync.WaitGroup
+}
+
+// NewBigQueryExporter creates an exporter writing the given tables into datasetID
+func NewBigQueryExporter(client *firestore.Client, inserter BigQueryInserter, datasetID string, tables []BigQueryExportTable, interval time.Duration) *BigQueryExporter {
+	return &BigQueryExporter{
+		client:          client,
+		inserter:        inserter,
+		datasetID:       datasetID,
+		tables:          tables,
+		stateCollection: bigQueryExportStateCollection,
+		interval:        interval,
+		batchSize:       bigQueryInsertBatchSize,
+		holder:          newExportClaimHolder(),
+		now:             time.Now,
+		stopChan:        make(chan struct{}),
+	}
+}
+
+// SetStartTime sets the first hour exported for tables that have no watermark yet, for backfilling
+// history. Without it a new table starts at the hour of the first run rather than exporting all history.
+func (e *BigQueryExporter) SetStartTime(start time.Time) {
+	e.startAt = timewindow.Hour(start).Start
+}
+
+// newExportClaimHolder identifies this instance in export claims: the hostname (the Cloud Run
+// instance) plus a random suffix, so two processes on one host never share claims
+func newExportClaimHolder() string {
+	hostname, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%s", hostname, hex.EncodeToString(suffix))
+}
+
+// Start runs the export immediately and then on every interval
+func (e *BigQueryExporter) Start() {
+	e.wg.Add(1)
+	go e.run()
+}
+
+// Stop stops the exporter and waits for an in-progress export to finish
+func (e *BigQueryExporter) Stop() {
+	close(e.stopChan)
+	e.wg.Wait()
+}
+
+// run is the main loop of the exporter
+func (e *BigQueryExporter) run() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		if exported, err := e.ExportClosedHours(context.Background()); err != nil {
+			log.Printf("Error exporting aggregates to BigQuery: %v", err)
+		} else if exported > 0 {
+			log.Printf("Exported %d aggregate rows to BigQuery dataset %s", exported, e.datasetID)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-e.stopChan:
+			return
+		}
+	}
+}
+
+// ExportClosedHours exports aggregates for hours that closed since each table's watermark
+// Returns the number of exported rows
+func (e *BigQueryExporter) ExportClosedHours(ctx context.Context) (int, error) {
+	until := timewindow.Hour(e.now().Add(-bigQueryExportDelay)).Start
+
+	exported := 0
+	for _, table := range e.tables {
+		count, err := e.exportTable(ctx, table, until)
+		exported += count
+		if err != nil {
+			return exported, fmt.Errorf("failed to export %s: %w", table.Collection, err)
+		}
+	}
+	return exported, nil
+}
+
+// exportTable exports documents of one collection from its watermark up to until, one claimed window
+// at a time, advancing the watermark after each window. Stops early when another instance holds the claim.
+func (e *BigQueryExporter) exportTable(ctx context.Context, table BigQueryExportTable, until time.Time) (int, error) {
+	stateRef := e.client.Collection(e.stateCollection).Doc(table.TableID)
+
+	exported := 0
+	for {
+		start, end, claimed, err := e.claimWindow(ctx, stateRef, until)
+		if err != nil || !claimed {
+			return exported, err
+		}
+
+		docs, err := e.client.Collection(table.Collection).
+			Where(table.TimeField, ">=", start).
+			Where(table.TimeField, "<", end).
+			Documents(ctx).GetAll()
+		if err != nil {
+			return exported, fmt.Errorf("failed to query aggregates: %w", err)
+		}
+
+		rows := make([]BigQueryRow, 0, len(docs))
+		for _, doc := range docs {
+			rows = append(rows, aggregateToBigQueryRow(doc.Ref.ID, doc.Data()))
+		}
+		if err := e.insertRows(ctx, table.TableID, rows); err != nil {
+			return exported, err
+		}
+		exported += len(rows)
+
+		// Advance the watermark only after every row was accepted
+		if err := e.completeWindow(ctx, stateRef, end); err != nil {
+			return exported, err
+		}
+	}
+}
+
+// claimWindow reserves the next window after the table's watermark for this instance. claimed is
+// false when the watermark has caught up with until or another instance holds an unexpired claim.
+func (e *BigQueryExporter) claimWindow(ctx context.Context, stateRef *firestore.DocumentRef, until time.Time) (start, end time.Time, claimed bool, err error) {
+	err = e.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		claimed = false
+		now := e.now()
+
+		var state bigQueryExportState
+		doc, err := tx.Get(stateRef)
+		switch {
+		case status.Code(err) == codes.NotFound:
+		case err != nil:
+			return fmt.Errorf("failed to read export watermark: %w", err)
+		default:
+			if err := doc.DataTo(&state); err != nil {
+				return fmt.Errorf("failed to parse export watermark: %w", err)
+			}
+		}
+		if state.ExportedUntil.IsZero() {
+			state.ExportedUntil = e.startAt
+			if state.ExportedUntil.IsZero() {
+				state.ExportedUntil = until
+			}
+		}
+
+		if state.claimedByOther(e.holder, now) {
+			return nil
+		}
+		var ok bool
+		if start, end, ok = nextBigQueryExportWindow(state.ExportedUntil, until); !ok {
+			// Record the starting watermark of a new table even when there is nothing to export yet
+			if doc == nil || !doc.Exists() {
+				state.UpdatedAt = now
+				return tx.Set(stateRef, state)
+			}
+			return nil
+		}
+
+		state.ClaimHolder = e.holder
+		state.ClaimUntil = end
+		state.ClaimExpiresAt = now.Add(bigQueryClaimTTL)
+		state.UpdatedAt = now
+		claimed = true
+		return tx.Set(stateRef, state)
+	})
+	if err != nil {
+		return time.Time{}, time.Time{}, false, fmt.Errorf("failed to claim export window: %w", err)
+	}
+	return start, end, claimed, nil
+}
+
+// completeWindow advances the watermark to end and releases this instance's claim. Fails if the claim
+// expired and another instance took the window over meanwhile; insert IDs keep its rows from doubling.
+func (e *BigQueryExporter) completeWindow(ctx context.Context, stateRef *firestore.DocumentRef, end time.Time) error {
+	err := e.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(stateRef)
+		if err != nil {
+			return fmt.Errorf("failed to read export watermark: %w", err)
+		}
+		var state bigQueryExportState
+		if err := doc.DataTo(&state); err != nil {
+			return fmt.Errorf("failed to parse export watermark: %w", err)
+		}
+		if state.ClaimHolder != e.holder || !state.ClaimUntil.Equal(end) {
+			return fmt.Errorf("export claim up to %s was taken over by %s", end.Format(time.RFC3339), state.ClaimHolder)
+		}
+
+		state.ExportedUntil = end
+		state.ClaimHolder = ""
+		state.ClaimUntil = time.Time{}
+		state.ClaimExpiresAt = time.Time{}
+		state.UpdatedAt = e.now()
+		return tx.Set(stateRef, state)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save export watermark: %w", err)
+	}
+	return nil
+}
+
+// insertRows streams rows in batches of batchSize
+func (e *BigQueryExporter) insertRows(ctx context.Context, tableID string, rows []BigQueryRow) error {
+	for start := 0; start < len(rows); start += e.batchSize {
+		end := start + e.batchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		if err := e.inserter.InsertAll(ctx, e.datasetID, tableID, rows[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// aggregateToBigQueryRow converts an aggregate document into a BigQuery row keyed by its doc ID.
+// Timestamps are written as RFC 3339 strings and nested maps (model_usage) as JSON strings.
+func aggregateToBigQueryRow(docID string, data map[string]interface{}) BigQueryRow {
+	values := make(map[string]interface{}, len(data)+1)
+	values["doc_id"] = docID
+
+	for key, value := range data {
+		switch v := value.(type) {
+		case time.Time:
+			values[key] = v.UTC().Format(time.RFC3339)
+		case map[string]interface{}:
+			encoded, err := json.Marshal(v)
+			if err != nil {
+				log.Printf("Skipping field %s of %s for BigQuery export: %v", key, docID, err)
+				continue
+			}
+			values[key] = string(encoded)
+		default:
+			values[key] = v
+		}
+	}
+
+	return BigQueryRow{InsertID: docID, Values: values}
+}
@@ -0,0 +1,263 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"simple-relay/shared/timewindow"
+)
+
+// fakeBigQuery records inserted rows and, like BigQuery, drops rows whose insert ID was already seen
+type fakeBigQuery struct {
+	mu    sync.Mutex
+	calls int
+	rows  map[string]map[string]BigQueryRow // table -> insert ID -> row
+}
+
+func newFakeBigQuery() *fakeBigQuery {
+	return &fakeBigQuery{rows: make(map[string]map[string]BigQueryRow)}
+}
+
+func (f *fakeBigQuery) InsertAll(ctx context.Context, datasetID, tableID string, rows []BigQueryRow) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+
+	table := datasetID + "." + tableID
+	if f.rows[table] == nil {
+		f.rows[table] = make(map[string]BigQueryRow)
+	}
+	for _, row := range rows {
+		if _, exists := f.rows[table][row.InsertID]; !exists {
+			f.rows[table][row.InsertID] = row
+		}
+	}
+	return nil
+}
+
+func TestAggregateToBigQueryRow_Shape(t *testing.T) {
+	hour := time.Date(2024, 3, 10, 14, 0, 0, 0, time.UTC)
+	data := map[string]interface{}{
+		"user_id":        "user@example.com",
+		"hour":           hour,
+		"total_requests": int64(3),
+		"total_cost":     0.25,
+		"model_usage": map[string]interface{}{
+			"claude-sonnet-4": map[string]interface{}{"request_count": int64(3)},
+		},
+	}
+
+	row := aggregateToBigQueryRow("user@example.com_2024-03-10T14", data)
+
+	if row.InsertID != "user@example.com_2024-03-10T14" {
+		t.Errorf("InsertID = %q, want doc ID", row.InsertID)
+	}
+	if row.Values["doc_id"] != row.InsertID {
+		t.Errorf("doc_id = %v, want %q", row.Values["doc_id"], row.InsertID)
+	}
+	if row.Values["hour"] != "2024-03-10T14:00:00Z" {
+		t.Errorf("hour = %v, want RFC 3339 string", row.Values["hour"])
+	}
+	if row.Values["total_requests"] != int64(3) || row.Values["total_cost"] != 0.25 {
+		t.Errorf("numeric fields not copied: %v", row.Values)
+	}
+
+	modelUsage, ok := row.Values["model_usage"].(string)
+	if !ok {
+		t.Fatalf("model_usage = %T, want JSON string", row.Values["model_usage"])
+	}
+	var decoded map[string]map[string]int
+	if err := json.Unmarshal([]byte(modelUsage), &decoded); err != nil {
+		t.Fatalf("model_usage is not valid JSON: %v", err)
+	}
+	if decoded["claude-sonnet-4"]["request_count"] != 3 {
+		t.Errorf("unexpected model_usage: %s", modelUsage)
+	}
+}
+
+func TestBigQueryExporter_InsertRowsBatchesAndIsIdempotent(t *testing.T) {
+	fake := newFakeBigQuery()
+	exporter := NewBigQueryExporter(nil, fake, "analytics", nil, time.Hour)
+	exporter.batchSize = 2
+
+	rows := []BigQueryRow{
+		aggregateToBigQueryRow("a_2024-03-10T14", map[string]interface{}{"total_points": 1.0}),
+		aggregateToBigQueryRow("b_2024-03-10T14", map[string]interface{}{"total_points": 2.0}),
+		aggregateToBigQueryRow("c_2024-03-10T14", map[string]interface{}{"total_points": 3.0}),
+	}
+
+	ctx := context.Background()
+	if err := exporter.insertRows(ctx, "hourly_aggregates", rows); err != nil {
+		t.Fatalf("insertRows returned error: %v", err)
+	}
+	if fake.calls != 2 {
+		t.Errorf("expected 2 insertAll calls for 3 rows with batch size 2, got %d", fake.calls)
+	}
+
+	// Re-running the same export must not create duplicate rows
+	if err := exporter.insertRows(ctx, "hourly_aggregates", rows); err != nil {
+		t.Fatalf("insertRows returned error: %v", err)
+	}
+	if got := len(fake.rows["analytics.hourly_aggregates"]); got != 3 {
+		t.Errorf("expected 3 unique rows after re-run, got %d", got)
+	}
+}
+
+func TestBigQueryExporter_ExportClosedHoursUsesWatermark(t *testing.T) {
+	client := newEmulatorClient(t)
+	ctx := context.Background()
+	clearCollection(t, client, "hourly_aggregates")
+	clearCollection(t, client, bigQueryExportStateCollection)
+
+	closedHour := timewindow.Hour(time.Now().Add(-3 * time.Hour)).Start
+	openHour := timewindow.Hour(time.Now()).Start
+	seed := map[string]time.Time{
+		"user@example.com_closed": closedHour,
+		"user@example.com_open":   openHour,
+	}
+	for docID, hour := range seed {
+		_, err := client.Collection("hourly_aggregates").Doc(docID).Set(ctx, map[string]interface{}{
+			"user_id":      "user@example.com",
+			"hour":         hour,
+			"total_points": 1.0,
+		})
+		if err != nil {
+			t.Fatalf("failed to seed %s: %v", docID, err)
+		}
+	}
+
+	fake := newFakeBigQuery()
+	exporter := NewBigQueryExporter(client, fake, "analytics", []BigQueryExportTable{
+		{Collection: "hourly_aggregates", TableID: "hourly_aggregates", TimeField: "hour"},
+	}, time.Hour)
+	exporter.SetStartTime(closedHour.Add(-2 * bigQueryExportWindow)) // Spans several claimed windows
+
+	exported, err := exporter.ExportClosedHours(ctx)
+	if err != nil {
+		t.Fatalf("ExportClosedHours returned error: %v", err)
+	}
+	if exported != 1 {
+		t.Errorf("expected only the closed hour to be exported, got %d rows", exported)
+	}
+
+	// Second run finds nothing new past the watermark
+	exported, err = exporter.ExportClosedHours(ctx)
+	if err != nil {
+		t.Fatalf("ExportClosedHours returned error: %v", err)
+	}
+	if exported != 0 {
+		t.Errorf("expected re-run to export nothing, got %d rows", exported)
+	}
+	if _, ok := fake.rows["analytics.hourly_aggregates"]["user@example.com_closed"]; !ok {
+		t.Error("expected closed-hour row keyed by doc ID")
+	}
+}
+
+func TestNextBigQueryExportWindow(t *testing.T) {
+	since := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+
+	if _, _, ok := nextBigQueryExportWindow(since, since); ok {
+		t.Error("expected no window once the watermark has caught up")
+	}
+	if start, end, ok := nextBigQueryExportWindow(since, since.Add(3*time.Hour)); !ok || !start.Equal(since) || !end.Equal(since.Add(3*time.Hour)) {
+		t.Errorf("expected a window up to until, got %s-%s (%v)", start, end, ok)
+	}
+	if _, end, ok := nextBigQueryExportWindow(since, since.Add(72*time.Hour)); !ok || !end.Equal(since.Add(bigQueryExportWindow)) {
+		t.Errorf("expected a window capped at %s, got end %s (%v)", bigQueryExportWindow, end, ok)
+	}
+}
+
+func TestBigQueryExportState_ClaimedByOther(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		state bigQueryExportState
+		want  bool
+	}{
+		{"unclaimed", bigQueryExportState{}, false},
+		{"own claim", bigQueryExportState{ClaimHolder: "me", ClaimExpiresAt: now.Add(time.Minute)}, false},
+		{"other instance's claim", bigQueryExportState{ClaimHolder: "other", ClaimExpiresAt: now.Add(time.Minute)}, true},
+		{"expired claim", bigQueryExportState{ClaimHolder: "other", ClaimExpiresAt: now.Add(-time.Minute)}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.state.claimedByOther("me", now); got != tt.want {
+			t.Errorf("%s: claimedByOther() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBigQueryExporter_NewTableStartsAtFirstRun(t *testing.T) {
+	client := newEmulatorClient(t)
+	ctx := context.Background()
+	clearCollection(t, client, "hourly_aggregates")
+	clearCollection(t, client, bigQueryExportStateCollection)
+
+	oldHour := timewindow.Hour(time.Now().Add(-48 * time.Hour)).Start
+	if _, err := client.Collection("hourly_aggregates").Doc("user@example.com_old").Set(ctx, map[string]interface{}{
+		"user_id": "user@example.com", "hour": oldHour, "total_points": 1.0,
+	}); err != nil {
+		t.Fatalf("failed to seed aggregate: %v", err)
+	}
+
+	fake := newFakeBigQuery()
+	exporter := NewBigQueryExporter(client, fake, "analytics", []BigQueryExportTable{
+		{Collection: "hourly_aggregates", TableID: "hourly_aggregates", TimeField: "hour"},
+	}, time.Hour)
+
+	// Without a start time, history before the first run is not exported
+	if exported, err := exporter.ExportClosedHours(ctx); err != nil || exported != 0 {
+		t.Errorf("expected no rows on the first run, got %d (err %v)", exported, err)
+	}
+	doc, err := client.Collection(bigQueryExportStateCollection).Doc("hourly_aggregates").Get(ctx)
+	if err != nil {
+		t.Fatalf("expected the starting watermark to be stored: %v", err)
+	}
+	if exportedUntil, _ := doc.Data()["exported_until"].(time.Time); !exportedUntil.After(oldHour) {
+		t.Errorf("expected the watermark to start at the first run, got %s", exportedUntil)
+	}
+}
+
+func TestBigQueryExporter_SkipsWindowClaimedByAnotherInstance(t *testing.T) {
+	client := newEmulatorClient(t)
+	ctx := context.Background()
+	clearCollection(t, client, "hourly_aggregates")
+	clearCollection(t, client, bigQueryExportStateCollection)
+
+	closedHour := timewindow.Hour(time.Now().Add(-3 * time.Hour)).Start
+	if _, err := client.Collection("hourly_aggregates").Doc("user@example.com_closed").Set(ctx, map[string]interface{}{
+		"user_id": "user@example.com", "hour": closedHour, "total_points": 1.0,
+	}); err != nil {
+		t.Fatalf("failed to seed aggregate: %v", err)
+	}
+
+	tables := []BigQueryExportTable{{Collection: "hourly_aggregates", TableID: "hourly_aggregates", TimeField: "hour"}}
+	fake := newFakeBigQuery()
+	first := NewBigQueryExporter(client, fake, "analytics", tables, time.Hour)
+	second := NewBigQueryExporter(client, fake, "analytics", tables, time.Hour)
+	for _, exporter := range []*BigQueryExporter{first, second} {
+		exporter.SetStartTime(closedHour)
+	}
+
+	// The first instance claims the window and stalls before inserting
+	until := timewindow.Hour(time.Now().Add(-bigQueryExportDelay)).Start
+	stateRef := client.Collection(bigQueryExportStateCollection).Doc("hourly_aggregates")
+	if _, _, claimed, err := first.claimWindow(ctx, stateRef, until); err != nil || !claimed {
+		t.Fatalf("expected the first instance to claim the window, got %v (err %v)", claimed, err)
+	}
+
+	if exported, err := second.ExportClosedHours(ctx); err != nil || exported != 0 {
+		t.Errorf("expected the second instance to skip the claimed window, got %d rows (err %v)", exported, err)
+	}
+	if fake.calls != 0 {
+		t.Errorf("expected no inserts while the window is claimed, got %d", fake.calls)
+	}
+
+	// Once the claim expires the window is taken over
+	second.now = func() time.Time { return time.Now().Add(bigQueryClaimTTL + time.Minute) }
+	if exported, err := second.ExportClosedHours(ctx); err != nil || exported != 1 {
+		t.Errorf("expected the expired claim to be taken over, got %d rows (err %v)", exported, err)
+	}
+}
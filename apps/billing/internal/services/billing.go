@@ -2,12 +2,16 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"simple-relay/shared/database"
+	"simple-relay/shared/timewindow"
 
 	"cloud.google.com/go/firestore"
 )
@@ -23,17 +27,57 @@ type UsageRecord struct {
 	OutputTokens        int       `firestore:"output_tokens" json:"output_tokens"`
 	CacheReadTokens     int       `firestore:"cache_read_tokens" json:"cache_read_tokens"`
 	CacheWriteTokens    int       `firestore:"cache_write_tokens" json:"cache_write_tokens"`
+	CacheWrite1hTokens  int       `firestore:"cache_write_1h_tokens" json:"cache_write_1h_tokens"` // CacheWriteTokens 中1小时TTL的部分
 	TotalCost           float64   `firestore:"total_cost" json:"total_cost"`
 	InputCost           float64   `firestore:"input_cost" json:"input_cost"`
 	OutputCost          float64   `firestore:"output_cost" json:"output_cost"`
 	CacheReadCost       float64   `firestore:"cache_read_cost" json:"cache_read_cost"`
 	CacheWriteCost      float64   `firestore:"cache_write_cost" json:"cache_write_cost"`
 	RequestID           string    `firestore:"request_id" json:"request_id"`
+	AnthropicRequestID  string    `firestore:"anthropic_request_id" json:"anthropic_request_id"` // 上游返回的 request-id 头，用于对照 Anthropic 日志
+	TTFBMs              int64     `firestore:"ttfb_ms" json:"ttfb_ms"`
+	TotalLatencyMs      int64     `firestore:"total_latency_ms" json:"total_latency_ms"`
+	CacheWriteFlagged   bool      `firestore:"cache_write_flagged" json:"cache_write_flagged"`
 	Timestamp           time.Time `firestore:"timestamp" json:"timestamp"`
 	Status              string    `firestore:"status" json:"status"`
+	StatusCode          int       `firestore:"status_code,omitempty" json:"status_code,omitempty"` // 错误记录的上游HTTP状态码
 	ErrorMessage        string    `firestore:"error_message,omitempty" json:"error_message,omitempty"`
 }
 
+// 使用记录状态
+const (
+	UsageStatusSuccess = "success"
+	UsageStatusFlagged = "flagged" // 输出token超过模型上限，需人工复核
+	UsageStatusError   = "error"   // 上游返回错误响应，零token零费用，不计入聚合
+)
+
+// RequestLatency 代理测量的上游延迟（毫秒）
+type RequestLatency struct {
+	TTFBMs  int64 // 首字节时间
+	TotalMs int64 // 响应总时长
+}
+
+// MaxLatencyRange 延迟分位数查询允许的最大时间范围，每次查询都会读取范围内的全部使用记录
+const MaxLatencyRange = 7 * 24 * time.Hour
+
+// ErrInvalidLatencyRange 延迟分位数查询的时间范围为空、颠倒或超过 MaxLatencyRange
+var ErrInvalidLatencyRange = errors.New("invalid latency range")
+
+// LatencyStats 单个模型的延迟分位数统计（毫秒）
+type LatencyStats struct {
+	Count    int   `json:"count"`
+	TTFBP50  int64 `json:"ttfb_p50"`
+	TTFBP95  int64 `json:"ttfb_p95"`
+	TotalP50 int64 `json:"total_p50"`
+	TotalP95 int64 `json:"total_p95"`
+}
+
+// CacheCreationUsage 按缓存TTL拆分的缓存写入token数（cache_creation_input_tokens 为两者之和）
+type CacheCreationUsage struct {
+	Ephemeral5mInputTokens int `json:"ephemeral_5m_input_tokens"`
+	Ephemeral1hInputTokens int `json:"ephemeral_1h_input_tokens"`
+}
+
 // ClaudeAPIResponse Claude API响应结构
 type ClaudeAPIResponse struct {
 	ID      string `json:"id"`
@@ -43,10 +87,11 @@ type ClaudeAPIResponse struct {
 		Type string `json:"type"`
 	} `json:"content"`
 	Usage struct {
-		InputTokens              int `json:"input_tokens"`
-		OutputTokens             int `json:"output_tokens"`
-		CacheCreationInputTokens int `json:"cache_creation_input_tokens,omitempty"`
-		CacheReadInputTokens     int `json:"cache_read_input_tokens,omitempty"`
+		InputTokens              int                `json:"input_tokens"`
+		OutputTokens             int                `json:"output_tokens"`
+		CacheCreationInputTokens int                `json:"cache_creation_input_tokens,omitempty"`
+		CacheReadInputTokens     int                `json:"cache_read_input_tokens,omitempty"`
+		CacheCreation            CacheCreationUsage `json:"cache_creation,omitempty"`
 	} `json:"usage"`
 	StopReason string `json:"stop_reason"`
 }
@@ -60,10 +105,11 @@ type ClaudeMessage struct {
 		Type string `json:"type"`
 	} `json:"content"`
 	Usage struct {
-		InputTokens              int `json:"input_tokens"`
-		OutputTokens             int `json:"output_tokens"`
-		CacheCreationInputTokens int `json:"cache_creation_input_tokens,omitempty"`
-		CacheReadInputTokens     int `json:"cache_read_input_tokens,omitempty"`
+		InputTokens              int                `json:"input_tokens"`
+		OutputTokens             int                `json:"output_tokens"`
+		CacheCreationInputTokens int                `json:"cache_creation_input_tokens,omitempty"`
+		CacheReadInputTokens     int                `json:"cache_read_input_tokens,omitempty"`
+		CacheCreation            CacheCreationUsage `json:"cache_creation,omitempty"`
 	} `json:"usage"`
 	StopReason string `json:"stop_reason"`
 }
@@ -89,6 +135,11 @@ type BillingService struct {
 	pricing     *PricingCalculator
 	mu          sync.RWMutex
 	enabled     bool
+
+	cacheWriteAlertTokens int // 单次请求缓存写入token超过该值时标记记录（0表示禁用）
+
+	outputCaps        OutputTokenCaps // 按模型的单次输出token上限
+	outputCapThrottle time.Duration   // 超限后限制用户的时长（0表示只标记不限制）
 }
 
 // NewBillingService 创建新的计费服务
@@ -100,6 +151,9 @@ func NewBillingService(dbService *database.Service, enabled bool) *BillingServic
 	}
 
 	// 初始化批量写入器
+	if dbService != nil {
+		service.pricing.SetPricingSource(dbService.Client())
+	}
 	if enabled && dbService != nil {
 		service.batchWriter = NewBatchWriter(dbService.Client(), 100, 5*time.Second, service)
 		service.batchWriter.Start()
@@ -108,6 +162,42 @@ func NewBillingService(dbService *database.Service, enabled bool) *BillingServic
 	return service
 }
 
+// StartPricingReload 立即从 model_pricing 集合加载价格，之后按间隔重新加载（集合为空或不可用时使用内置价格）
+func (bs *BillingService) StartPricingReload(interval time.Duration) {
+	bs.pricing.StartReloading(interval)
+}
+
+// SetCacheWriteAlertThreshold 设置缓存写入告警阈值（0表示禁用）
+func (bs *BillingService) SetCacheWriteAlertThreshold(tokens int) {
+	bs.cacheWriteAlertTokens = tokens
+}
+
+// SetOutputTokenCaps 设置按模型的输出token上限及超限后的用户限制时长（0表示只标记）
+func (bs *BillingService) SetOutputTokenCaps(caps OutputTokenCaps, throttle time.Duration) {
+	bs.outputCaps = caps
+	bs.outputCapThrottle = throttle
+}
+
+// SetSingleCommitAggregation 设置是否在一次BulkWriter提交中写入所有聚合维度
+func (bs *BillingService) SetSingleCommitAggregation(enabled bool) {
+	if bs.batchWriter != nil {
+		bs.batchWriter.SetSingleCommitAggregation(enabled)
+	}
+}
+
+// AggregationLag 返回各聚合维度的延迟；计费未启用时返回nil
+func (bs *BillingService) AggregationLag(now time.Time, threshold time.Duration) []DimensionLag {
+	if bs.batchWriter == nil {
+		return nil
+	}
+	return bs.batchWriter.AggregationLag(now, threshold)
+}
+
+// exceedsCacheWriteThreshold 判断缓存写入token是否超过告警阈值
+func (bs *BillingService) exceedsCacheWriteThreshold(cacheWriteTokens int) bool {
+	return bs.cacheWriteAlertTokens > 0 && cacheWriteTokens > bs.cacheWriteAlertTokens
+}
+
 // RecordUsage 记录API使用情况
 func (bs *BillingService) RecordUsage(ctx context.Context, record *UsageRecord) error {
 	if !bs.enabled {
@@ -123,7 +213,8 @@ func (bs *BillingService) RecordUsage(ctx context.Context, record *UsageRecord)
 		record.InputTokens,
 		record.OutputTokens,
 		record.CacheReadTokens,
-		record.CacheWriteTokens,
+		record.CacheWriteTokens-record.CacheWrite1hTokens,
+		record.CacheWrite1hTokens,
 	)
 	record.InputCost = inputCost
 	record.OutputCost = outputCost
@@ -135,8 +226,18 @@ func (bs *BillingService) RecordUsage(ctx context.Context, record *UsageRecord)
 	return bs.batchWriter.Add(record)
 }
 
+// usageRecordID 返回使用记录的文档ID：同一用户的同一Claude消息总是得到相同的ID，重复投递只计费一次
+// 没有消息ID时退回到带时间戳的唯一ID
+func usageRecordID(userID string, messageID string, requestID string) string {
+	if messageID == "" {
+		return fmt.Sprintf("%s_%d", requestID, time.Now().UnixNano())
+	}
+	// 文档ID不能包含 "/"
+	return strings.ReplaceAll(userID, "/", "_") + "_" + messageID
+}
+
 // ProcessResponse 处理Claude API响应并提取计费信息
-func (bs *BillingService) ProcessResponse(message *ClaudeMessage, userID string, upstreamAccountUUID string, clientIP string, requestID string) (*UsageRecord, error) {
+func (bs *BillingService) ProcessResponse(message *ClaudeMessage, userID string, upstreamAccountUUID string, clientIP string, requestID string, anthropicRequestID string, latency RequestLatency) (*UsageRecord, error) {
 	// Validate that we have usage information
 	if message.Usage.InputTokens == 0 && message.Usage.OutputTokens == 0 {
 		log.Printf("Warning: No usage tokens found in message for request %s", requestID)
@@ -148,7 +249,7 @@ func (bs *BillingService) ProcessResponse(message *ClaudeMessage, userID string,
 	}
 
 	record := &UsageRecord{
-		ID:                  fmt.Sprintf("%s_%d", requestID, time.Now().UnixNano()),
+		ID:                  usageRecordID(userID, message.ID, requestID),
 		UserID:              userID,
 		UpstreamAccountUUID: upstreamAccountUUID,
 		ClientIP:            clientIP,
@@ -157,9 +258,33 @@ func (bs *BillingService) ProcessResponse(message *ClaudeMessage, userID string,
 		OutputTokens:        message.Usage.OutputTokens,
 		CacheReadTokens:     message.Usage.CacheReadInputTokens,
 		CacheWriteTokens:    message.Usage.CacheCreationInputTokens,
+		CacheWrite1hTokens:  message.Usage.CacheCreation.Ephemeral1hInputTokens,
 		RequestID:           requestID,
+		AnthropicRequestID:  anthropicRequestID,
+		TTFBMs:              latency.TTFBMs,
+		TotalLatencyMs:      latency.TotalMs,
 		Timestamp:           time.Now(),
-		Status:              "success",
+		Status:              UsageStatusSuccess,
+	}
+
+	// 总数缺失或小于按TTL拆分之和时，以拆分之和为准，保证1小时部分不超过总数
+	cacheCreation := message.Usage.CacheCreation
+	if split := cacheCreation.Ephemeral5mInputTokens + cacheCreation.Ephemeral1hInputTokens; split > record.CacheWriteTokens {
+		record.CacheWriteTokens = split
+	}
+
+	// 输出token超过模型上限的记录照常计费，但标记为待复核
+	if limit, capped := bs.outputCaps.CapFor(record.Model); capped && record.OutputTokens > limit {
+		record.Status = UsageStatusFlagged
+		log.Printf("[ALERT] Output tokens %d exceed cap %d for model %s: user=%s, account=%s, request=%s",
+			record.OutputTokens, limit, record.Model, userID, upstreamAccountUUID, requestID)
+	}
+
+	// 缓存写入比输入贵25%，异常大的缓存写入需要标记以便排查
+	if bs.exceedsCacheWriteThreshold(record.CacheWriteTokens) {
+		record.CacheWriteFlagged = true
+		log.Printf("[ALERT] Cache write tokens %d exceed threshold %d: user=%s, account=%s, model=%s, request=%s",
+			record.CacheWriteTokens, bs.cacheWriteAlertTokens, userID, upstreamAccountUUID, record.Model, requestID)
 	}
 
 	log.Printf("Successfully parsed usage: Model=%s, Input=%d, Output=%d",
@@ -169,13 +294,13 @@ func (bs *BillingService) ProcessResponse(message *ClaudeMessage, userID string,
 }
 
 // ProcessRequest 处理请求并计算账单
-func (bs *BillingService) ProcessRequest(message *ClaudeMessage, userID string, upstreamAccountUUID string, requestID string) error {
+func (bs *BillingService) ProcessRequest(message *ClaudeMessage, userID string, upstreamAccountUUID string, clientIP string, requestID string, anthropicRequestID string, latency RequestLatency) error {
 	if !bs.enabled {
 		return nil
 	}
 
 	// 处理响应获取usage信息
-	record, err := bs.ProcessResponse(message, userID, upstreamAccountUUID, "", requestID)
+	record, err := bs.ProcessResponse(message, userID, upstreamAccountUUID, clientIP, requestID, anthropicRequestID, latency)
 	if err != nil {
 		return fmt.Errorf("error processing message: %w", err)
 	}
@@ -186,12 +311,54 @@ func (bs *BillingService) ProcessRequest(message *ClaudeMessage, userID string,
 		return fmt.Errorf("error recording usage: %w", err)
 	}
 
+	// 超限用户在代理端被暂时限制
+	if record.Status == UsageStatusFlagged && bs.outputCapThrottle > 0 && bs.dbService != nil {
+		reason := fmt.Sprintf("output tokens %d over cap for model %s", record.OutputTokens, record.Model)
+		if err := bs.throttleUser(ctx, userID, reason); err != nil {
+			log.Printf("Error throttling user %s: %v", userID, err)
+		}
+	}
+
 	log.Printf("Usage recorded: Model=%s, Input=%d, Output=%d, CacheRead=%d, CacheWrite=%d, Cost=$%.4f",
 		record.Model, record.InputTokens, record.OutputTokens, record.CacheReadTokens, record.CacheWriteTokens, record.TotalCost)
 
 	return nil
 }
 
+// newErrorRecord 为上游错误响应创建零token、零费用的使用记录
+func newErrorRecord(userID string, upstreamAccountUUID string, clientIP string, requestID string, anthropicRequestID string, statusCode int, errorMessage string, latency RequestLatency) *UsageRecord {
+	return &UsageRecord{
+		ID:                  usageRecordID(userID, "", requestID),
+		UserID:              userID,
+		UpstreamAccountUUID: upstreamAccountUUID,
+		ClientIP:            clientIP,
+		RequestID:           requestID,
+		AnthropicRequestID:  anthropicRequestID,
+		TTFBMs:              latency.TTFBMs,
+		TotalLatencyMs:      latency.TotalMs,
+		Timestamp:           time.Now(),
+		Status:              UsageStatusError,
+		StatusCode:          statusCode,
+		ErrorMessage:        errorMessage,
+	}
+}
+
+// ProcessErrorResponse 记录上游错误响应，便于统计用户的失败请求
+func (bs *BillingService) ProcessErrorResponse(userID string, upstreamAccountUUID string, clientIP string, requestID string, anthropicRequestID string, statusCode int, errorMessage string, latency RequestLatency) error {
+	if !bs.enabled {
+		return nil
+	}
+
+	// 错误记录没有模型和token，不经过计价，避免触发未知模型告警
+	record := newErrorRecord(userID, upstreamAccountUUID, clientIP, requestID, anthropicRequestID, statusCode, errorMessage, latency)
+	if err := bs.batchWriter.Add(record); err != nil {
+		return fmt.Errorf("error recording error response: %w", err)
+	}
+
+	log.Printf("Error response recorded: user=%s, account=%s, status=%d, error=%s", userID, upstreamAccountUUID, statusCode, errorMessage)
+	return nil
+}
+
 // GetUserUsage 获取用户使用统计
 func (bs *BillingService) GetUserUsage(ctx context.Context, userID string, startTime, endTime time.Time) ([]UsageRecord, error) {
 	if !bs.enabled || bs.dbService == nil {
@@ -222,23 +389,52 @@ func (bs *BillingService) GetUserUsage(ctx context.Context, userID string, start
 	return records, nil
 }
 
+// FindByAnthropicRequestID 按上游 request-id 查找使用记录（单字段等值查询，使用 Firestore 自动索引）
+func (bs *BillingService) FindByAnthropicRequestID(ctx context.Context, anthropicRequestID string) ([]UsageRecord, error) {
+	if !bs.enabled || bs.dbService == nil {
+		return []UsageRecord{}, nil
+	}
+	return findUsageRecordsByAnthropicRequestID(ctx, bs.dbService.Client(), anthropicRequestID)
+}
+
+// findUsageRecordsByAnthropicRequestID 查询 usage_records 中匹配上游 request-id 的记录
+func findUsageRecordsByAnthropicRequestID(ctx context.Context, client *firestore.Client, anthropicRequestID string) ([]UsageRecord, error) {
+	docs, err := client.Collection("usage_records").
+		Where("anthropic_request_id", "==", anthropicRequestID).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage records: %w", err)
+	}
+
+	records := []UsageRecord{}
+	for _, doc := range docs {
+		var record UsageRecord
+		if err := doc.DataTo(&record); err != nil {
+			log.Printf("Error parsing usage record: %v", err)
+			continue
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
 // GetDailyAggregate 获取每日聚合数据
 func (bs *BillingService) GetDailyAggregate(ctx context.Context, userID string, date time.Time) (map[string]interface{}, error) {
 	if !bs.enabled || bs.dbService == nil {
 		return nil, nil
 	}
 
-	startOfDay := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
-	endOfDay := startOfDay.Add(24 * time.Hour)
+	day := timewindow.Day(date)
 
-	records, err := bs.GetUserUsage(ctx, userID, startOfDay, endOfDay)
+	records, err := bs.GetUserUsage(ctx, userID, day.Start, day.End)
 	if err != nil {
 		return nil, err
 	}
 
 	// 聚合统计
 	aggregate := map[string]interface{}{
-		"date":                startOfDay,
+		"date":                day.Start,
 		"user_id":             userID,
 		"total_requests":      len(records),
 		"total_input_tokens":  0,
@@ -259,8 +455,85 @@ func (bs *BillingService) GetDailyAggregate(ctx context.Context, userID string,
 	return aggregate, nil
 }
 
+// GetLatencyPercentiles 获取 [startTime, endTime) 内各模型的延迟分位数，范围不能超过 MaxLatencyRange
+func (bs *BillingService) GetLatencyPercentiles(ctx context.Context, startTime, endTime time.Time) (map[string]LatencyStats, error) {
+	if !startTime.Before(endTime) || endTime.Sub(startTime) > MaxLatencyRange {
+		return nil, fmt.Errorf("%w: start must be before end and at most %s earlier", ErrInvalidLatencyRange, MaxLatencyRange)
+	}
+	if !bs.enabled || bs.dbService == nil {
+		return map[string]LatencyStats{}, nil
+	}
+
+	// 只读取计算分位数需要的字段
+	query := bs.dbService.Client().Collection("usage_records").
+		Where("timestamp", ">=", startTime).
+		Where("timestamp", "<", endTime).
+		Select("model", "status", "ttfb_ms", "total_latency_ms")
+
+	docs, err := query.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage records: %w", err)
+	}
+
+	var records []UsageRecord
+	for _, doc := range docs {
+		var record UsageRecord
+		if err := doc.DataTo(&record); err != nil {
+			log.Printf("Error parsing usage record: %v", err)
+			continue
+		}
+		records = append(records, record)
+	}
+
+	return computeLatencyPercentiles(records), nil
+}
+
+// computeLatencyPercentiles 按模型计算p50/p95延迟，忽略没有延迟数据的记录
+func computeLatencyPercentiles(records []UsageRecord) map[string]LatencyStats {
+	ttfbByModel := make(map[string][]int64)
+	totalByModel := make(map[string][]int64)
+	for _, record := range records {
+		// 错误响应很快返回，会拉低延迟分位数
+		if record.TotalLatencyMs <= 0 || record.Status == UsageStatusError {
+			continue
+		}
+		ttfbByModel[record.Model] = append(ttfbByModel[record.Model], record.TTFBMs)
+		totalByModel[record.Model] = append(totalByModel[record.Model], record.TotalLatencyMs)
+	}
+
+	stats := make(map[string]LatencyStats, len(totalByModel))
+	for model, totals := range totalByModel {
+		ttfbs := ttfbByModel[model]
+		stats[model] = LatencyStats{
+			Count:    len(totals),
+			TTFBP50:  percentile(ttfbs, 50),
+			TTFBP95:  percentile(ttfbs, 95),
+			TotalP50: percentile(totals, 50),
+			TotalP95: percentile(totals, 95),
+		}
+	}
+	return stats
+}
+
+// percentile 使用最近排名法计算分位数
+func percentile(values []int64, p int) int64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := make([]int64, len(values))
+	copy(sorted, values)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	rank := (p*len(sorted) + 99) / 100 // ceil(p/100 * n)
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
 // Close 关闭计费服务
 func (bs *BillingService) Close() error {
+	bs.pricing.StopReloading()
 	if bs.batchWriter != nil {
 		return bs.batchWriter.Stop()
 	}
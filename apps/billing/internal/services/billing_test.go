@@ -0,0 +1,567 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestProcessResponse_RecordsLatency(t *testing.T) {
+	bs := NewBillingService(nil, false)
+	message := &ClaudeMessage{ID: "msg_1", Model: "claude-sonnet-4-20250514"}
+
+	record, err := bs.ProcessResponse(message, "user@example.com", "account-1", "", "req_1", "", RequestLatency{TTFBMs: 420, TotalMs: 3100})
+	if err != nil {
+		t.Fatalf("ProcessResponse returned error: %v", err)
+	}
+
+	if record.TTFBMs != 420 || record.TotalLatencyMs != 3100 {
+		t.Errorf("expected latency 420/3100ms, got %d/%d", record.TTFBMs, record.TotalLatencyMs)
+	}
+}
+
+func TestProcessResponse_RecordsAnthropicRequestIDSeparately(t *testing.T) {
+	bs := NewBillingService(nil, false)
+	message := &ClaudeMessage{ID: "msg_1", Model: "claude-sonnet-4-20250514"}
+
+	record, err := bs.ProcessResponse(message, "user@example.com", "account-1", "", "", "req_011CPx9b2", RequestLatency{})
+	if err != nil {
+		t.Fatalf("ProcessResponse returned error: %v", err)
+	}
+
+	if record.AnthropicRequestID != "req_011CPx9b2" {
+		t.Errorf("expected anthropic request id req_011CPx9b2, got %q", record.AnthropicRequestID)
+	}
+	if record.RequestID != "msg_1" {
+		t.Errorf("expected internal request id to fall back to the message id, got %q", record.RequestID)
+	}
+}
+
+func TestProcessResponse_FlagsExcessiveCacheWrites(t *testing.T) {
+	bs := NewBillingService(nil, false)
+	bs.SetCacheWriteAlertThreshold(100000)
+
+	over := &ClaudeMessage{ID: "msg_over", Model: "claude-sonnet-4-20250514"}
+	over.Usage.CacheCreationInputTokens = 150000
+	record, err := bs.ProcessResponse(over, "user@example.com", "account-1", "", "req_over", "", RequestLatency{})
+	if err != nil {
+		t.Fatalf("ProcessResponse returned error: %v", err)
+	}
+	if !record.CacheWriteFlagged {
+		t.Error("expected request over the cache-write threshold to be flagged")
+	}
+
+	under := &ClaudeMessage{ID: "msg_under", Model: "claude-sonnet-4-20250514"}
+	under.Usage.CacheCreationInputTokens = 100000
+	record, err = bs.ProcessResponse(under, "user@example.com", "account-1", "", "req_under", "", RequestLatency{})
+	if err != nil {
+		t.Fatalf("ProcessResponse returned error: %v", err)
+	}
+	if record.CacheWriteFlagged {
+		t.Error("expected request at the threshold not to be flagged")
+	}
+}
+
+func TestProcessResponse_CacheWriteGuardDisabledByDefault(t *testing.T) {
+	bs := NewBillingService(nil, false)
+
+	message := &ClaudeMessage{ID: "msg_1", Model: "claude-sonnet-4-20250514"}
+	message.Usage.CacheCreationInputTokens = 1000000
+	record, err := bs.ProcessResponse(message, "user@example.com", "account-1", "", "req_1", "", RequestLatency{})
+	if err != nil {
+		t.Fatalf("ProcessResponse returned error: %v", err)
+	}
+	if record.CacheWriteFlagged {
+		t.Error("expected no flag when the guard is not configured")
+	}
+}
+
+func TestRecordUsage_BillsCacheOnlyRequests(t *testing.T) {
+	bs := NewBillingService(nil, false)
+	bs.enabled = true
+	bs.batchWriter = NewBatchWriter(nil, 100, time.Hour, bs) // not started; the record stays buffered
+
+	record := &UsageRecord{ID: "cache-only", Model: "claude-sonnet-4-20250514", CacheReadTokens: 1_000_000}
+	if err := bs.RecordUsage(context.Background(), record); err != nil {
+		t.Fatalf("RecordUsage returned error: %v", err)
+	}
+
+	if record.CacheReadCost != 0.30 {
+		t.Errorf("expected cache read cost 0.30, got %v", record.CacheReadCost)
+	}
+	if record.TotalCost != record.CacheReadCost {
+		t.Errorf("expected total cost to include the cache read cost, got %v", record.TotalCost)
+	}
+}
+
+func TestProcessErrorResponse_SkipsPricing(t *testing.T) {
+	bs := NewBillingService(nil, false)
+	bs.enabled = true
+	bs.batchWriter = NewBatchWriter(nil, 100, time.Hour, bs) // not started; the record stays buffered
+
+	if err := bs.ProcessErrorResponse("user@example.com", "account-1", "", "req_1", "", 400, "invalid_request_error", RequestLatency{}); err != nil {
+		t.Fatalf("ProcessErrorResponse returned error: %v", err)
+	}
+
+	if counts := bs.pricing.GetUnknownModelCounts(); len(counts) != 0 {
+		t.Errorf("expected error records not to count as unknown models, got %v", counts)
+	}
+	if len(bs.batchWriter.buffer) != 1 || bs.batchWriter.buffer[0].Status != UsageStatusError {
+		t.Errorf("expected the error record to be buffered, got %v", bs.batchWriter.buffer)
+	}
+}
+
+func TestProcessResponse_SplitsOneHourCacheWrites(t *testing.T) {
+	bs := NewBillingService(nil, false)
+
+	message := &ClaudeMessage{ID: "msg_1", Model: "claude-sonnet-4-20250514"}
+	message.Usage.CacheCreationInputTokens = 3000
+	message.Usage.CacheCreation = CacheCreationUsage{Ephemeral5mInputTokens: 1000, Ephemeral1hInputTokens: 2000}
+	record, err := bs.ProcessResponse(message, "user@example.com", "account-1", "", "req_1", "", RequestLatency{})
+	if err != nil {
+		t.Fatalf("ProcessResponse returned error: %v", err)
+	}
+	if record.CacheWriteTokens != 3000 || record.CacheWrite1hTokens != 2000 {
+		t.Errorf("expected 3000 cache write tokens of which 2000 1-hour, got %d/%d", record.CacheWriteTokens, record.CacheWrite1hTokens)
+	}
+}
+
+func TestProcessResponse_StableRecordIDPerMessage(t *testing.T) {
+	bs := NewBillingService(nil, false)
+	message := &ClaudeMessage{ID: "msg_1", Model: "claude-sonnet-4-20250514"}
+
+	first, _ := bs.ProcessResponse(message, "user@example.com", "account-1", "", "req_1", "", RequestLatency{})
+	second, _ := bs.ProcessResponse(message, "user@example.com", "account-1", "", "req_2", "", RequestLatency{})
+	if first.ID != second.ID {
+		t.Errorf("expected the same record ID for a redelivered message, got %q and %q", first.ID, second.ID)
+	}
+
+	other, _ := bs.ProcessResponse(message, "other@example.com", "account-1", "", "req_1", "", RequestLatency{})
+	if other.ID == first.ID {
+		t.Errorf("expected different users to get different record IDs, got %q", other.ID)
+	}
+}
+
+func TestBatchWriter_DuplicateMessageBilledOnce(t *testing.T) {
+	client := newEmulatorClient(t)
+	ctx := context.Background()
+	for _, collection := range []string{"usage_records", "hourly_aggregates"} {
+		clearCollection(t, client, collection)
+	}
+
+	bs := NewBillingService(nil, false)
+	bw := NewBatchWriter(client, 100, time.Hour, nil)
+	message := &ClaudeMessage{ID: "msg_dup", Model: "claude-sonnet-4-20250514"}
+	message.Usage.InputTokens = 100
+	message.Usage.OutputTokens = 20
+
+	// Delivered twice in one flush and once more in a later flush
+	for _, deliveries := range []int{2, 1} {
+		for i := 0; i < deliveries; i++ {
+			record, err := bs.ProcessResponse(message, "dup@example.com", "acct-1", "", "", "", RequestLatency{})
+			if err != nil {
+				t.Fatalf("ProcessResponse returned error: %v", err)
+			}
+			if err := bw.Add(record); err != nil {
+				t.Fatalf("Add returned error: %v", err)
+			}
+		}
+		if err := bw.flush(); err != nil {
+			t.Fatalf("flush returned error: %v", err)
+		}
+	}
+
+	records, err := client.Collection("usage_records").Documents(ctx).GetAll()
+	if err != nil {
+		t.Fatalf("failed to list usage records: %v", err)
+	}
+	if len(records) != 1 {
+		t.Errorf("expected 1 usage record, got %d", len(records))
+	}
+
+	aggregates, err := client.Collection("hourly_aggregates").Documents(ctx).GetAll()
+	if err != nil || len(aggregates) != 1 {
+		t.Fatalf("expected 1 hourly aggregate, got %d (err %v)", len(aggregates), err)
+	}
+	if requests, _ := aggregates[0].Data()["total_requests"].(int64); requests != 1 {
+		t.Errorf("expected the aggregate to count 1 request, got %v", aggregates[0].Data()["total_requests"])
+	}
+}
+
+func TestBatchWriter_RetriesFailedCommit(t *testing.T) {
+	// Error records skip aggregation, so only the usage record writes are exercised
+	records := []*UsageRecord{
+		{ID: "rec-1", Status: UsageStatusError},
+		{ID: "rec-2", Status: UsageStatusError},
+	}
+	newWriter := func(failures int) (*BatchWriter, *int) {
+		bw := NewBatchWriter(nil, 100, time.Hour, nil)
+		bw.commitRetryDelay = time.Millisecond
+		calls := 0
+		bw.create = func(ctx context.Context, pending []*UsageRecord) ([]*UsageRecord, []*UsageRecord, []*UsageRecord) {
+			calls++
+			if calls <= failures {
+				return nil, nil, pending
+			}
+			return pending, nil, nil
+		}
+		for _, record := range records {
+			bw.Add(record)
+		}
+		return bw, &calls
+	}
+
+	bw, calls := newWriter(1)
+	if err := bw.flush(); err != nil {
+		t.Fatalf("expected the retried commit to succeed, got %v", err)
+	}
+	if *calls != 2 || bw.GetBufferSize() != 0 {
+		t.Errorf("expected 2 attempts and an empty buffer, got %d attempts and %d buffered", *calls, bw.GetBufferSize())
+	}
+
+	// Records still failing after every attempt stay buffered for the next flush
+	bw, calls = newWriter(3)
+	if err := bw.flush(); err == nil {
+		t.Fatal("expected an error once every attempt failed")
+	}
+	if *calls != 3 || bw.GetBufferSize() != len(records) {
+		t.Errorf("expected 3 attempts and the records kept, got %d attempts and %d buffered", *calls, bw.GetBufferSize())
+	}
+	if err := bw.flush(); err != nil || bw.GetBufferSize() != 0 {
+		t.Errorf("expected the next flush to write the kept records, got %v with %d buffered", err, bw.GetBufferSize())
+	}
+}
+
+func TestBatchWriter_AggregatesRetriedRecordsThatCommitted(t *testing.T) {
+	bw := NewBatchWriter(nil, 100, time.Hour, nil)
+	bw.commitRetryDelay = time.Millisecond
+	committed := map[string]bool{"dup-1": true}
+	// The first attempt commits every record but reports an error, like a deadline exceeded
+	// after the server applied the writes
+	bw.create = func(ctx context.Context, pending []*UsageRecord) ([]*UsageRecord, []*UsageRecord, []*UsageRecord) {
+		var created, existing, failed []*UsageRecord
+		for _, record := range pending {
+			if committed[record.ID] {
+				existing = append(existing, record)
+				continue
+			}
+			committed[record.ID] = true
+			failed = append(failed, record)
+		}
+		return created, existing, failed
+	}
+
+	created, failed := bw.createWithRetry(context.Background(), []*UsageRecord{{ID: "rec-1"}, {ID: "dup-1"}})
+	if len(failed) != 0 {
+		t.Fatalf("expected no failed records, got %d", len(failed))
+	}
+	if len(created) != 1 || created[0].ID != "rec-1" {
+		t.Errorf("expected only rec-1 treated as created and the redelivered dup-1 skipped, got %v", created)
+	}
+
+	// A record kept for the next flush after its last attempt reported an error is treated the same way
+	bw.commitAttempts = 1
+	if created, failed = bw.createWithRetry(context.Background(), []*UsageRecord{{ID: "rec-2"}}); len(created) != 0 || len(failed) != 1 {
+		t.Fatalf("expected rec-2 to fail its only attempt, got %d created and %d failed", len(created), len(failed))
+	}
+	created, failed = bw.createWithRetry(context.Background(), failed)
+	if len(failed) != 0 || len(created) != 1 || created[0].ID != "rec-2" {
+		t.Errorf("expected the retained rec-2 treated as created on the next flush, got %d created and %d failed", len(created), len(failed))
+	}
+	if len(bw.unconfirmed) != 0 {
+		t.Errorf("expected no unconfirmed records left, got %v", bw.unconfirmed)
+	}
+}
+
+func TestBatchWriter_FailingFlushNotRetriedOnEveryAdd(t *testing.T) {
+	bw := NewBatchWriter(nil, 1, time.Hour, nil)
+	bw.commitRetryDelay = time.Millisecond
+	calls := 0
+	bw.create = func(ctx context.Context, pending []*UsageRecord) ([]*UsageRecord, []*UsageRecord, []*UsageRecord) {
+		calls++
+		return nil, nil, pending
+	}
+
+	if err := bw.Add(&UsageRecord{ID: "rec-1", Status: UsageStatusError}); err == nil {
+		t.Fatal("expected the full buffer's flush to fail")
+	}
+	if calls != bw.commitAttempts {
+		t.Fatalf("expected %d attempts, got %d", bw.commitAttempts, calls)
+	}
+
+	// Until the backoff ends, further Adds only buffer; the ticker retries
+	for _, id := range []string{"rec-2", "rec-3"} {
+		if err := bw.Add(&UsageRecord{ID: id, Status: UsageStatusError}); err != nil {
+			t.Fatalf("expected Add to buffer during the backoff, got %v", err)
+		}
+	}
+	if calls != bw.commitAttempts || bw.GetBufferSize() != 3 {
+		t.Errorf("expected no flush during the backoff, got %d attempts and %d buffered", calls, bw.GetBufferSize())
+	}
+}
+
+func TestBatchWriter_CapsRetainedRecords(t *testing.T) {
+	bw := NewBatchWriter(nil, 100, time.Hour, nil)
+	bw.commitAttempts = 1
+	bw.SetMaxRetained(3)
+	bw.create = func(ctx context.Context, pending []*UsageRecord) ([]*UsageRecord, []*UsageRecord, []*UsageRecord) {
+		// Records keep arriving while the write is failing
+		bw.Add(&UsageRecord{ID: "late-1", Status: UsageStatusError})
+		bw.Add(&UsageRecord{ID: "late-2", Status: UsageStatusError})
+		return nil, nil, pending
+	}
+	for _, id := range []string{"rec-1", "rec-2"} {
+		bw.Add(&UsageRecord{ID: id, Status: UsageStatusError})
+	}
+
+	if err := bw.flush(); err == nil {
+		t.Fatal("expected the flush to fail")
+	}
+	if got := bw.GetBufferSize(); got != 3 {
+		t.Fatalf("expected the buffer capped at 3 records, got %d", got)
+	}
+	if bw.buffer[0].ID != "rec-1" || bw.buffer[1].ID != "rec-2" {
+		t.Errorf("expected the failed records to be retried first, got %s, %s", bw.buffer[0].ID, bw.buffer[1].ID)
+	}
+	if err := bw.Add(&UsageRecord{ID: "rec-4"}); !errors.Is(err, ErrBufferFull) {
+		t.Errorf("expected ErrBufferFull once the cap is reached, got %v", err)
+	}
+}
+
+func TestBatchWriter_AddDoesNotWaitForFlush(t *testing.T) {
+	bw := NewBatchWriter(nil, 100, time.Hour, nil)
+	writing := make(chan struct{})
+	release := make(chan struct{})
+	bw.create = func(ctx context.Context, pending []*UsageRecord) ([]*UsageRecord, []*UsageRecord, []*UsageRecord) {
+		close(writing)
+		<-release
+		return pending, nil, nil
+	}
+	bw.Add(&UsageRecord{ID: "rec-1", Status: UsageStatusError})
+
+	flushed := make(chan error)
+	go func() { flushed <- bw.flush() }()
+	<-writing
+
+	added := make(chan error)
+	go func() { added <- bw.Add(&UsageRecord{ID: "rec-2", Status: UsageStatusError}) }()
+	select {
+	case err := <-added:
+		if err != nil {
+			t.Errorf("Add returned error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Add not to wait for the running flush")
+	}
+
+	close(release)
+	if err := <-flushed; err != nil {
+		t.Fatalf("flush returned error: %v", err)
+	}
+	if bw.GetBufferSize() != 1 {
+		t.Errorf("expected the record added during the flush to stay buffered, got %d", bw.GetBufferSize())
+	}
+}
+
+func TestBatchWriter_SplitsFlushIntoCommitsOf500(t *testing.T) {
+	bw := NewBatchWriter(nil, 2000, time.Hour, nil)
+	var commits []int
+	written := map[string]bool{}
+	bw.create = func(ctx context.Context, records []*UsageRecord) ([]*UsageRecord, []*UsageRecord, []*UsageRecord) {
+		commits = append(commits, len(records))
+		for _, record := range records {
+			written[record.ID] = true
+		}
+		return records, nil, nil
+	}
+	// Error records skip aggregation, so only the usage record writes are exercised
+	for i := 0; i < 1200; i++ {
+		bw.Add(&UsageRecord{ID: fmt.Sprintf("rec-%d", i), Status: UsageStatusError})
+	}
+
+	if err := bw.flush(); err != nil {
+		t.Fatalf("flush returned error: %v", err)
+	}
+	if len(commits) != 3 || commits[0] != 500 || commits[1] != 500 || commits[2] != 200 {
+		t.Errorf("expected commits of 500, 500 and 200 records, got %v", commits)
+	}
+	if len(written) != 1200 || bw.GetBufferSize() != 0 {
+		t.Errorf("expected all 1200 records written, got %d written and %d buffered", len(written), bw.GetBufferSize())
+	}
+}
+
+func TestBatchWriter_SetFlushIntervalTakesEffectWhileRunning(t *testing.T) {
+	bw := NewBatchWriter(nil, 100, time.Hour, nil)
+	flushed := make(chan struct{}, 1)
+	bw.create = func(ctx context.Context, records []*UsageRecord) ([]*UsageRecord, []*UsageRecord, []*UsageRecord) {
+		select {
+		case flushed <- struct{}{}:
+		default:
+		}
+		return records, nil, nil
+	}
+	bw.Add(&UsageRecord{ID: "rec-1", Status: UsageStatusError})
+	bw.Start()
+	defer bw.Stop()
+
+	bw.SetFlushInterval(10 * time.Millisecond)
+	select {
+	case <-flushed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a flush on the shortened interval instead of the original hour")
+	}
+}
+
+func TestBatchWriter_StoresClientIP(t *testing.T) {
+	client := newEmulatorClient(t)
+	ctx := context.Background()
+	clearCollection(t, client, "usage_records")
+
+	bs := NewBillingService(nil, false)
+	bw := NewBatchWriter(client, 100, time.Hour, nil)
+	message := &ClaudeMessage{ID: "msg_ip", Model: "claude-sonnet-4-20250514"}
+	message.Usage.InputTokens = 10
+	record, err := bs.ProcessResponse(message, "ip@example.com", "acct-1", "198.51.100.23", "req-ip", "", RequestLatency{})
+	if err != nil {
+		t.Fatalf("ProcessResponse returned error: %v", err)
+	}
+	if err := bw.Add(record); err != nil {
+		t.Fatalf("Add returned error: %v", err)
+	}
+	if err := bw.flush(); err != nil {
+		t.Fatalf("flush returned error: %v", err)
+	}
+
+	doc, err := client.Collection("usage_records").Doc(record.ID).Get(ctx)
+	if err != nil {
+		t.Fatalf("failed to read usage record: %v", err)
+	}
+	if ip, _ := doc.Data()["client_ip"].(string); ip != "198.51.100.23" {
+		t.Errorf("expected client_ip 198.51.100.23 on the stored record, got %v", doc.Data()["client_ip"])
+	}
+}
+
+func TestBatchWriter_ErrorResponseRecordedButNotAggregated(t *testing.T) {
+	client := newEmulatorClient(t)
+	ctx := context.Background()
+	for _, collection := range []string{"usage_records", "hourly_aggregates"} {
+		clearCollection(t, client, collection)
+	}
+
+	bw := NewBatchWriter(client, 100, time.Hour, nil)
+	record := newErrorRecord("failing@example.com", "acct-1", "203.0.113.7", "req-400", "req_upstream_400", 400,
+		"invalid_request_error: messages: field required", RequestLatency{TTFBMs: 80, TotalMs: 90})
+	if err := bw.Add(record); err != nil {
+		t.Fatalf("Add returned error: %v", err)
+	}
+	if err := bw.flush(); err != nil {
+		t.Fatalf("flush returned error: %v", err)
+	}
+
+	doc, err := client.Collection("usage_records").Doc(record.ID).Get(ctx)
+	if err != nil {
+		t.Fatalf("expected the error usage record to be written: %v", err)
+	}
+	var stored UsageRecord
+	if err := doc.DataTo(&stored); err != nil {
+		t.Fatalf("failed to parse usage record: %v", err)
+	}
+	if stored.Status != UsageStatusError || stored.StatusCode != 400 || stored.ClientIP != "203.0.113.7" || stored.ErrorMessage != "invalid_request_error: messages: field required" {
+		t.Errorf("expected an error record with status and message, got %+v", stored)
+	}
+	if stored.InputTokens != 0 || stored.OutputTokens != 0 || stored.TotalCost != 0 {
+		t.Errorf("expected zero tokens and cost, got %+v", stored)
+	}
+
+	aggregates, err := client.Collection("hourly_aggregates").Documents(ctx).GetAll()
+	if err != nil || len(aggregates) != 0 {
+		t.Errorf("expected error records to stay out of aggregates, got %d (err %v)", len(aggregates), err)
+	}
+}
+
+func TestComputeLatencyPercentiles(t *testing.T) {
+	var records []UsageRecord
+	for i := int64(1); i <= 100; i++ {
+		records = append(records, UsageRecord{Model: "claude-sonnet-4-20250514", TTFBMs: i * 10, TotalLatencyMs: i * 100})
+	}
+	records = append(records,
+		UsageRecord{Model: "claude-3-5-haiku", TTFBMs: 50, TotalLatencyMs: 200},
+		UsageRecord{Model: "claude-3-5-haiku", TTFBMs: 0, TotalLatencyMs: 0}, // no latency recorded
+		UsageRecord{Model: "claude-3-5-haiku", TTFBMs: 5, TotalLatencyMs: 6, Status: UsageStatusError},
+	)
+
+	stats := computeLatencyPercentiles(records)
+
+	sonnet := stats["claude-sonnet-4-20250514"]
+	if sonnet.Count != 100 {
+		t.Errorf("expected 100 sonnet samples, got %d", sonnet.Count)
+	}
+	if sonnet.TTFBP50 != 500 || sonnet.TTFBP95 != 950 {
+		t.Errorf("unexpected sonnet TTFB percentiles: p50=%d p95=%d", sonnet.TTFBP50, sonnet.TTFBP95)
+	}
+	if sonnet.TotalP50 != 5000 || sonnet.TotalP95 != 9500 {
+		t.Errorf("unexpected sonnet total percentiles: p50=%d p95=%d", sonnet.TotalP50, sonnet.TotalP95)
+	}
+
+	haiku := stats["claude-3-5-haiku"]
+	if haiku.Count != 1 || haiku.TotalP50 != 200 || haiku.TotalP95 != 200 {
+		t.Errorf("expected records without latency and error records to be ignored, got %+v", haiku)
+	}
+}
+
+func TestGetLatencyPercentiles_RefusesInvalidRange(t *testing.T) {
+	bs := NewBillingService(nil, false)
+	start := time.Date(2025, 3, 10, 0, 0, 0, 0, time.UTC)
+
+	refused := []struct {
+		name       string
+		start, end time.Time
+	}{
+		{"empty range", start, start},
+		{"reversed range", start, start.Add(-time.Hour)},
+		{"longer than the maximum", start, start.Add(MaxLatencyRange + time.Second)},
+	}
+	for _, tc := range refused {
+		if _, err := bs.GetLatencyPercentiles(context.Background(), tc.start, tc.end); !errors.Is(err, ErrInvalidLatencyRange) {
+			t.Errorf("%s: expected ErrInvalidLatencyRange, got %v", tc.name, err)
+		}
+	}
+
+	if _, err := bs.GetLatencyPercentiles(context.Background(), start, start.Add(MaxLatencyRange)); err != nil {
+		t.Errorf("expected the maximum range to be accepted, got %v", err)
+	}
+}
+
+func TestFindUsageRecordsByAnthropicRequestID(t *testing.T) {
+	client := newEmulatorClient(t)
+	ctx := context.Background()
+	clearCollection(t, client, "usage_records")
+
+	records := []*UsageRecord{
+		{ID: "rec-1", UserID: "user@example.com", AnthropicRequestID: "req_upstream_a", Timestamp: time.Now()},
+		{ID: "rec-2", UserID: "other@example.com", AnthropicRequestID: "req_upstream_b", Timestamp: time.Now()},
+	}
+	for _, record := range records {
+		if _, err := client.Collection("usage_records").Doc(record.ID).Set(ctx, record); err != nil {
+			t.Fatalf("failed to seed record %s: %v", record.ID, err)
+		}
+	}
+
+	found, err := findUsageRecordsByAnthropicRequestID(ctx, client, "req_upstream_a")
+	if err != nil {
+		t.Fatalf("lookup returned error: %v", err)
+	}
+	if len(found) != 1 || found[0].ID != "rec-1" {
+		t.Errorf("expected rec-1, got %+v", found)
+	}
+
+	missing, err := findUsageRecordsByAnthropicRequestID(ctx, client, "req_unknown")
+	if err != nil {
+		t.Fatalf("lookup returned error: %v", err)
+	}
+	if len(missing) != 0 {
+		t.Errorf("expected no records, got %d", len(missing))
+	}
+}
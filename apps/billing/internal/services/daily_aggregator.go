@@ -0,0 +1,48 @@
+package services
+
+import (
+	"context"
+
+	"simple-relay/shared/timewindow"
+
+	"cloud.google.com/go/firestore"
+)
+
+// dailyAggregatesCollection holds one document per user per UTC day, keyed "{user}_{YYYY-MM-DD}"
+const dailyAggregatesCollection = "daily_aggregates"
+
+// DailyAggregatorService maintains daily_aggregates with the same totals as hourly_aggregates, so
+// monthly reports and limits read about 30 documents per user instead of about 744
+type DailyAggregatorService struct {
+	base *AggregationBase
+}
+
+// userDailyAggregateConfig is the user daily dimension; "day" is the UTC start of the day
+var userDailyAggregateConfig = AggregateConfig{
+	CollectionName: dailyAggregatesCollection,
+	KeyField:       "user_id",
+	Key:            userKey,
+	TimeFormat:     timewindow.DayKeyFormat,
+	TimeFieldName:  "day",
+	LogDescription: "daily aggregate",
+}
+
+// NewDailyAggregatorService creates a daily aggregator writing to db
+func NewDailyAggregatorService(db *firestore.Client) *DailyAggregatorService {
+	return &DailyAggregatorService{base: NewAggregationBase(db, nil, userDailyAggregateConfig)}
+}
+
+// AggregateRecords adds a batch of usage records to their users' daily aggregates with atomic increments
+func (das *DailyAggregatorService) AggregateRecords(ctx context.Context, records []*UsageRecord) error {
+	return das.base.AggregateRecords(ctx, records)
+}
+
+// accumulateDailyAggregate adds a record to the in-memory aggregate of its user and UTC day
+func accumulateDailyAggregate(aggregateMap map[string]*MemoryAggregate, record *UsageRecord) {
+	userDailyAggregateConfig.accumulate(aggregateMap, record)
+}
+
+// dailyAggregateUpsertData builds a daily aggregate upsert
+func dailyAggregateUpsertData(memAggregate *MemoryAggregate) map[string]interface{} {
+	return userDailyAggregateConfig.upsertData(memAggregate)
+}
@@ -0,0 +1,76 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"simple-relay/shared/timewindow"
+)
+
+func twoDayTestRecords() []*UsageRecord {
+	lateEvening := time.Date(2025, 3, 1, 23, 50, 0, 0, time.UTC)
+	return []*UsageRecord{
+		{ID: "d1", UserID: "user-a", Model: "claude-sonnet-4", Timestamp: lateEvening, InputTokens: 100, OutputTokens: 10, CacheReadTokens: 1000, TotalCost: 0.01},
+		{ID: "d2", UserID: "user-a", Model: "claude-sonnet-4", Timestamp: lateEvening.Add(5 * time.Minute), InputTokens: 200, OutputTokens: 20, CacheWriteTokens: 500, TotalCost: 0.02},
+		{ID: "d3", UserID: "user-a", Model: "claude-opus-4", Timestamp: lateEvening.Add(20 * time.Minute), InputTokens: 300, OutputTokens: 30, TotalCost: 0.05},
+	}
+}
+
+func TestAccumulateDailyAggregate_SplitsAtUTCMidnight(t *testing.T) {
+	aggregates := make(map[string]*MemoryAggregate)
+	for _, record := range twoDayTestRecords() {
+		accumulateDailyAggregate(aggregates, record)
+	}
+
+	if len(aggregates) != 2 {
+		t.Fatalf("expected 2 daily aggregates, got %d", len(aggregates))
+	}
+	first := aggregates["user-a_2025-03-01"]
+	if first == nil || first.TotalRequests != 2 || first.TotalInputTokens != 300 ||
+		first.TotalCacheReadTokens != 1000 || first.TotalCacheWriteTokens != 500 {
+		t.Errorf("unexpected first-day aggregate: %+v", first)
+	}
+	second := aggregates["user-a_2025-03-02"]
+	if second == nil || second.TotalRequests != 1 || second.ModelUsage["claude-opus-4"].RequestCount != 1 {
+		t.Errorf("unexpected second-day aggregate: %+v", second)
+	}
+
+	data := dailyAggregateUpsertData(second)
+	if day, _ := data["day"].(time.Time); !day.Equal(time.Date(2025, 3, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected day to be the UTC day start, got %v", data["day"])
+	}
+	if _, hasHour := data["hour"]; hasHour {
+		t.Errorf("daily aggregates should not carry an hour field")
+	}
+}
+
+func TestDailyAggregatorService_WritesOneDocumentPerDay(t *testing.T) {
+	client := newEmulatorClient(t)
+	ctx := context.Background()
+	clearCollection(t, client, dailyAggregatesCollection)
+
+	das := NewDailyAggregatorService(client)
+	if err := das.AggregateRecords(ctx, twoDayTestRecords()); err != nil {
+		t.Fatalf("AggregateRecords returned error: %v", err)
+	}
+
+	docs, err := client.Collection(dailyAggregatesCollection).Documents(ctx).GetAll()
+	if err != nil {
+		t.Fatalf("failed to list daily aggregates: %v", err)
+	}
+	if len(docs) != 2 {
+		t.Fatalf("expected 2 daily aggregate documents, got %d", len(docs))
+	}
+
+	doc, err := client.Collection(dailyAggregatesCollection).Doc("user-a_" + timewindow.DayKey(time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC))).Get(ctx)
+	if err != nil {
+		t.Fatalf("failed to read first-day aggregate: %v", err)
+	}
+	if requests, _ := doc.Data()["total_requests"].(int64); requests != 2 {
+		t.Errorf("expected 2 requests on the first day, got %v", doc.Data()["total_requests"])
+	}
+	if tokens, _ := doc.Data()["total_cache_write_tokens"].(int64); tokens != 500 {
+		t.Errorf("expected 500 cache write tokens on the first day, got %v", doc.Data()["total_cache_write_tokens"])
+	}
+}
@@ -0,0 +1,39 @@
+package services
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"cloud.google.com/go/firestore"
+)
+
+// newEmulatorClient returns a Firestore client for the emulator, skipping the test when it isn't running
+func newEmulatorClient(t *testing.T) *firestore.Client {
+	t.Helper()
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST not set, skipping Firestore emulator test")
+	}
+
+	client, err := firestore.NewClient(context.Background(), "test-project")
+	if err != nil {
+		t.Fatalf("failed to create Firestore client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// clearCollection deletes every document in a collection
+func clearCollection(t *testing.T, client *firestore.Client, collection string) {
+	t.Helper()
+	ctx := context.Background()
+	docs, err := client.Collection(collection).Documents(ctx).GetAll()
+	if err != nil {
+		t.Fatalf("failed to list %s: %v", collection, err)
+	}
+	for _, doc := range docs {
+		if _, err := doc.Ref.Delete(ctx); err != nil {
+			t.Fatalf("failed to delete %s/%s: %v", collection, doc.Ref.ID, err)
+		}
+	}
+}
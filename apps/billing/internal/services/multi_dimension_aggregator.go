@@ -0,0 +1,132 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"cloud.google.com/go/firestore"
+)
+
+// aggregateWrite is one aggregate document upsert produced from a batch of usage records
+type aggregateWrite struct {
+	collection string
+	docID      string
+	data       map[string]any
+}
+
+// aggregateBatch holds every aggregate dimension computed from one batch of usage records
+type aggregateBatch struct {
+	userHourly map[string]*MemoryAggregate
+	userDaily  map[string]*MemoryAggregate
+	upstream   []map[string]*MemoryAggregate // parallel to MultiDimensionAggregator.upstream
+}
+
+// MultiDimensionAggregator computes all aggregate dimensions (user hourly and daily, upstream hourly
+// and upstream minute) in a single pass over a batch and sends every upsert through one BulkWriter,
+// instead of one Set round-trip per aggregate document per dimension
+type MultiDimensionAggregator struct {
+	db       *firestore.Client
+	upstream []*AggregationBase
+
+	// commit sends the writes for one batch; tests replace it to count commits
+	commit func(ctx context.Context, writes []aggregateWrite) error
+}
+
+// NewMultiDimensionAggregator creates an aggregator writing the user hourly and daily dimensions plus the given upstream dimensions
+func NewMultiDimensionAggregator(db *firestore.Client, upstream ...*AggregationBase) *MultiDimensionAggregator {
+	mda := &MultiDimensionAggregator{
+		db:       db,
+		upstream: upstream,
+	}
+	mda.commit = mda.bulkCommit
+	return mda
+}
+
+// AggregateRecords aggregates a batch into every dimension and commits all upserts together
+func (mda *MultiDimensionAggregator) AggregateRecords(ctx context.Context, records []*UsageRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	writes := mda.accumulate(records).writes(mda.upstream)
+	if err := mda.commit(ctx, writes); err != nil {
+		return err
+	}
+
+	log.Printf("Successfully aggregated %d records into %d aggregate documents across %d dimensions in one commit",
+		len(records), len(writes), 2+len(mda.upstream))
+	return nil
+}
+
+// accumulate adds every record to every dimension in one pass
+func (mda *MultiDimensionAggregator) accumulate(records []*UsageRecord) *aggregateBatch {
+	batch := &aggregateBatch{
+		userHourly: make(map[string]*MemoryAggregate),
+		userDaily:  make(map[string]*MemoryAggregate),
+		upstream:   make([]map[string]*MemoryAggregate, len(mda.upstream)),
+	}
+	for i := range mda.upstream {
+		batch.upstream[i] = make(map[string]*MemoryAggregate)
+	}
+
+	for _, record := range records {
+		accumulateHourlyAggregate(batch.userHourly, record)
+		accumulateDailyAggregate(batch.userDaily, record)
+		for i, base := range mda.upstream {
+			base.config.accumulate(batch.upstream[i], record)
+		}
+	}
+	return batch
+}
+
+// writes converts the in-memory aggregates into document upserts
+func (batch *aggregateBatch) writes(upstream []*AggregationBase) []aggregateWrite {
+	var writes []aggregateWrite
+	for docID, aggregate := range batch.userHourly {
+		writes = append(writes, aggregateWrite{collection: "hourly_aggregates", docID: docID, data: hourlyAggregateUpsertData(aggregate)})
+	}
+	for docID, aggregate := range batch.userDaily {
+		writes = append(writes, aggregateWrite{collection: dailyAggregatesCollection, docID: docID, data: dailyAggregateUpsertData(aggregate)})
+	}
+	for i, base := range upstream {
+		for docID, aggregate := range batch.upstream[i] {
+			writes = append(writes, aggregateWrite{collection: base.config.CollectionName, docID: docID, data: base.config.upsertData(aggregate)})
+		}
+	}
+	return writes
+}
+
+// bulkCommit sends all writes through a single BulkWriter. Each document appears at most once per
+// batch because records are merged in memory first, which BulkWriter requires.
+func (mda *MultiDimensionAggregator) bulkCommit(ctx context.Context, writes []aggregateWrite) error {
+	bulkWriter := mda.db.BulkWriter(ctx)
+
+	jobs := make([]*firestore.BulkWriterJob, 0, len(writes))
+	for _, write := range writes {
+		job, err := bulkWriter.Set(mda.db.Collection(write.collection).Doc(write.docID), write.data, firestore.MergeAll)
+		if err != nil {
+			bulkWriter.End()
+			return fmt.Errorf("failed to enqueue %s/%s: %w", write.collection, write.docID, err)
+		}
+		jobs = append(jobs, job)
+	}
+	bulkWriter.End()
+
+	// Writes succeed or fail independently; report every failure but keep the successful ones
+	var firstErr error
+	failed := 0
+	for i, job := range jobs {
+		if _, err := job.Results(); err != nil {
+			log.Printf("Error upserting aggregate %s/%s: %v", writes[i].collection, writes[i].docID, err)
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d aggregate writes failed: %w", failed, len(writes), firstErr)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"simple-relay/shared/timewindow"
+)
+
+func multiDimensionTestRecords(base time.Time) []*UsageRecord {
+	return []*UsageRecord{
+		{ID: "r1", UserID: "user-a", UpstreamAccountUUID: "acct-1", Model: "claude-sonnet-4", Timestamp: base, InputTokens: 100, OutputTokens: 50, TotalCost: 0.01},
+		{ID: "r2", UserID: "user-a", UpstreamAccountUUID: "acct-1", Model: "claude-sonnet-4", Timestamp: base.Add(30 * time.Second), InputTokens: 200, OutputTokens: 10, TotalCost: 0.02},
+		{ID: "r3", UserID: "user-b", UpstreamAccountUUID: "acct-2", Model: "claude-opus-4", Timestamp: base.Add(time.Minute), InputTokens: 300, OutputTokens: 30, TotalCost: 0.05},
+		{ID: "r4", UserID: "user-b", Model: "claude-opus-4", Timestamp: base.Add(time.Hour), InputTokens: 400, OutputTokens: 40, TotalCost: 0.07},
+	}
+}
+
+func TestMultiDimensionAggregator_OneCommitForAllDimensions(t *testing.T) {
+	hourly := NewUpstreamHourlyAggregatorService(nil, nil)
+	minute := NewUpstreamMinuteAggregatorService(nil, nil)
+	mda := NewMultiDimensionAggregator(nil, hourly.base, minute.base)
+
+	var commits int
+	var committed []aggregateWrite
+	mda.commit = func(ctx context.Context, writes []aggregateWrite) error {
+		commits++
+		committed = append(committed, writes...)
+		return nil
+	}
+
+	base := time.Date(2025, 3, 1, 10, 5, 10, 0, time.UTC)
+	if err := mda.AggregateRecords(context.Background(), multiDimensionTestRecords(base)); err != nil {
+		t.Fatalf("AggregateRecords returned error: %v", err)
+	}
+
+	// 3 user hourly + 2 user daily + 2 upstream hourly + 2 upstream minute documents, previously 9 separate round-trips
+	if commits != 1 {
+		t.Errorf("expected a single commit, got %d", commits)
+	}
+	perCollection := make(map[string]int)
+	for _, write := range committed {
+		perCollection[write.collection]++
+	}
+	want := map[string]int{
+		"hourly_aggregates":                  3,
+		"daily_aggregates":                   2,
+		"upstream_account_hourly_aggregates": 2,
+		"upstream_account_minute_aggregates": 2,
+	}
+	for collection, count := range want {
+		if perCollection[collection] != count {
+			t.Errorf("expected %d writes to %s, got %d", count, collection, perCollection[collection])
+		}
+	}
+}
+
+func TestMultiDimensionAggregator_Totals(t *testing.T) {
+	hourly := NewUpstreamHourlyAggregatorService(nil, nil)
+	minute := NewUpstreamMinuteAggregatorService(nil, nil)
+	mda := NewMultiDimensionAggregator(nil, hourly.base, minute.base)
+
+	base := time.Date(2025, 3, 1, 10, 5, 10, 0, time.UTC)
+	batch := mda.accumulate(multiDimensionTestRecords(base))
+
+	userA := batch.userHourly["user-a_"+timewindow.HourKey(base)]
+	if userA == nil || userA.TotalRequests != 2 || userA.TotalInputTokens != 300 || userA.TotalOutputTokens != 60 {
+		t.Fatalf("unexpected user-a hourly aggregate: %+v", userA)
+	}
+	if userA.ModelUsage["claude-sonnet-4"].RequestCount != 2 {
+		t.Errorf("expected 2 sonnet requests for user-a, got %d", userA.ModelUsage["claude-sonnet-4"].RequestCount)
+	}
+	if userB := batch.userHourly["user-b_"+timewindow.HourKey(base.Add(time.Hour))]; userB == nil || userB.TotalRequests != 1 {
+		t.Errorf("expected user-b's next-hour record in its own aggregate, got %+v", userB)
+	}
+
+	upstreamHourly := batch.upstream[0]["acct-1_"+timewindow.HourKey(base)]
+	if upstreamHourly == nil || upstreamHourly.TotalRequests != 2 || upstreamHourly.TotalCost != 0.03 {
+		t.Errorf("unexpected acct-1 hourly aggregate: %+v", upstreamHourly)
+	}
+	upstreamMinute := batch.upstream[1]["acct-2_"+timewindow.Key(base.Add(time.Minute), timewindow.MinuteKeyFormat)]
+	if upstreamMinute == nil || upstreamMinute.TotalRequests != 1 || upstreamMinute.TotalInputTokens != 300 {
+		t.Errorf("unexpected acct-2 minute aggregate: %+v", upstreamMinute)
+	}
+	// Records without an upstream account only count toward user aggregates
+	for i, dimension := range batch.upstream {
+		requests := 0
+		for _, aggregate := range dimension {
+			requests += aggregate.TotalRequests
+		}
+		if requests != 3 {
+			t.Errorf("expected 3 upstream requests in dimension %d, got %d", i, requests)
+		}
+	}
+}
+
+func TestBatchWriter_SingleCommitFlushWritesAllDimensions(t *testing.T) {
+	client := newEmulatorClient(t)
+	ctx := context.Background()
+	collections := []string{"usage_records", "hourly_aggregates", "upstream_account_hourly_aggregates", "upstream_account_minute_aggregates"}
+	for _, collection := range collections {
+		clearCollection(t, client, collection)
+	}
+
+	bw := NewBatchWriter(client, 100, time.Hour, nil)
+	bw.SetSingleCommitAggregation(true)
+
+	base := time.Date(2025, 3, 1, 10, 5, 10, 0, time.UTC)
+	for _, record := range multiDimensionTestRecords(base) {
+		if err := bw.Add(record); err != nil {
+			t.Fatalf("Add returned error: %v", err)
+		}
+	}
+	if err := bw.flush(); err != nil {
+		t.Fatalf("flush returned error: %v", err)
+	}
+
+	doc, err := client.Collection("hourly_aggregates").Doc("user-a_" + timewindow.HourKey(base)).Get(ctx)
+	if err != nil {
+		t.Fatalf("failed to read user hourly aggregate: %v", err)
+	}
+	if requests, _ := doc.Data()["total_requests"].(int64); requests != 2 {
+		t.Errorf("expected 2 requests in user hourly aggregate, got %v", doc.Data()["total_requests"])
+	}
+
+	doc, err = client.Collection("upstream_account_minute_aggregates").Doc("acct-1_" + timewindow.Key(base, timewindow.MinuteKeyFormat)).Get(ctx)
+	if err != nil {
+		t.Fatalf("failed to read upstream minute aggregate: %v", err)
+	}
+	if tokens, _ := doc.Data()["total_input_tokens"].(int64); tokens != 300 {
+		t.Errorf("expected 300 input tokens in upstream minute aggregate, got %v", doc.Data()["total_input_tokens"])
+	}
+
+	hourlyDocs, err := client.Collection("upstream_account_hourly_aggregates").Documents(ctx).GetAll()
+	if err != nil {
+		t.Fatalf("failed to list upstream hourly aggregates: %v", err)
+	}
+	if len(hourlyDocs) != 2 {
+		t.Errorf("expected 2 upstream hourly aggregates, got %d", len(hourlyDocs))
+	}
+}
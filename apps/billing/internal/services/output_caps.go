@@ -0,0 +1,74 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OutputTokenCaps maps a model name pattern to the most output tokens a single response may produce.
+// Responses over the cap are still billed but flagged for review.
+type OutputTokenCaps map[string]int
+
+// ParseOutputTokenCaps parses "pattern=tokens" pairs such as "opus=32000,claude-3-haiku=4096".
+// A pattern matches any model whose name contains it; invalid pairs are skipped.
+func ParseOutputTokenCaps(value string) OutputTokenCaps {
+	caps := make(OutputTokenCaps)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		pattern, tokens, found := strings.Cut(part, "=")
+		limit, err := strconv.Atoi(strings.TrimSpace(tokens))
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if !found || err != nil || limit <= 0 || pattern == "" {
+			log.Printf("Ignoring invalid output token cap: %q", part)
+			continue
+		}
+		caps[pattern] = limit
+	}
+	return caps
+}
+
+// CapFor returns the cap for model; the longest matching pattern wins so specific models override families
+func (c OutputTokenCaps) CapFor(model string) (int, bool) {
+	modelKey := strings.ToLower(model)
+	bestPattern := ""
+	for pattern := range c {
+		if strings.Contains(modelKey, pattern) && len(pattern) > len(bestPattern) {
+			bestPattern = pattern
+		}
+	}
+	if bestPattern == "" {
+		return 0, false
+	}
+	return c[bestPattern], true
+}
+
+// UserThrottle temporarily blocks a user; written here and enforced by the proxy
+type UserThrottle struct {
+	UserID         string    `firestore:"user_id" json:"user_id"`
+	Reason         string    `firestore:"reason" json:"reason"`
+	ThrottledUntil time.Time `firestore:"throttled_until" json:"throttled_until"`
+	CreatedAt      time.Time `firestore:"created_at" json:"created_at"`
+}
+
+// throttleUser blocks the user in the proxy until the throttle duration has passed
+func (bs *BillingService) throttleUser(ctx context.Context, userID string, reason string) error {
+	now := time.Now()
+	throttle := UserThrottle{
+		UserID:         userID,
+		Reason:         reason,
+		ThrottledUntil: now.Add(bs.outputCapThrottle),
+		CreatedAt:      now,
+	}
+	if _, err := bs.dbService.Client().Collection("user_throttles").Doc(userID).Set(ctx, throttle); err != nil {
+		return fmt.Errorf("failed to throttle user %s: %w", userID, err)
+	}
+	log.Printf("[ALERT] Throttled user %s until %s: %s", userID, throttle.ThrottledUntil.Format(time.RFC3339), reason)
+	return nil
+}
@@ -0,0 +1,56 @@
+package services
+
+import "testing"
+
+func TestParseOutputTokenCaps(t *testing.T) {
+	caps := ParseOutputTokenCaps(" opus=32000, Claude-3-Haiku=4096,bad,sonnet=-1,=5")
+
+	if len(caps) != 2 {
+		t.Fatalf("expected 2 valid caps, got %v", caps)
+	}
+	if caps["opus"] != 32000 || caps["claude-3-haiku"] != 4096 {
+		t.Errorf("unexpected caps: %v", caps)
+	}
+}
+
+func TestOutputTokenCaps_CapFor(t *testing.T) {
+	caps := OutputTokenCaps{"opus": 32000, "claude-opus-4-1": 16000}
+
+	if limit, ok := caps.CapFor("claude-opus-4-1-20250805"); !ok || limit != 16000 {
+		t.Errorf("expected the more specific cap 16000, got %d (%v)", limit, ok)
+	}
+	if limit, ok := caps.CapFor("Claude-3-Opus-20240229"); !ok || limit != 32000 {
+		t.Errorf("expected family cap 32000, got %d (%v)", limit, ok)
+	}
+	if _, ok := caps.CapFor("claude-sonnet-4-20250514"); ok {
+		t.Error("expected no cap for an unlisted model")
+	}
+}
+
+func TestProcessResponse_FlagsOverCapOutput(t *testing.T) {
+	bs := NewBillingService(nil, false)
+	bs.SetOutputTokenCaps(OutputTokenCaps{"sonnet": 8000}, 0)
+
+	over := &ClaudeMessage{ID: "msg_over", Model: "claude-sonnet-4-20250514"}
+	over.Usage.OutputTokens = 12000
+	record, err := bs.ProcessResponse(over, "user@example.com", "account-1", "", "req_over", "", RequestLatency{})
+	if err != nil {
+		t.Fatalf("ProcessResponse returned error: %v", err)
+	}
+	if record.Status != UsageStatusFlagged {
+		t.Errorf("expected over-cap record to be flagged, got status %q", record.Status)
+	}
+	if record.OutputTokens != 12000 {
+		t.Errorf("flagged records must keep the produced usage for billing, got %d output tokens", record.OutputTokens)
+	}
+
+	under := &ClaudeMessage{ID: "msg_under", Model: "claude-sonnet-4-20250514"}
+	under.Usage.OutputTokens = 8000
+	record, err = bs.ProcessResponse(under, "user@example.com", "account-1", "", "req_under", "", RequestLatency{})
+	if err != nil {
+		t.Fatalf("ProcessResponse returned error: %v", err)
+	}
+	if record.Status != UsageStatusSuccess {
+		t.Errorf("expected record at the cap to succeed, got status %q", record.Status)
+	}
+}
@@ -3,127 +3,56 @@ package services
 import (
 	"log"
 	"strings"
+	"sync"
+	"sync/atomic"
+
+	"simple-relay/shared/pricing"
+
+	"cloud.google.com/go/firestore"
 )
 
-// ModelPricing 模型定价信息
-type ModelPricing struct {
-	InputPricePerMillion      float64 // 每百万输入token的价格
-	OutputPricePerMillion     float64 // 每百万输出token的价格
-	CacheReadPricePerMillion  float64 // 每百万缓存读取token的价格 (90% discount from input)
-	CacheWritePricePerMillion float64 // 每百万缓存写入token的价格 (25% more than input)
-}
+// ModelPricing 模型定价信息（定义在共享模块中，代理服务也使用相同的模型列表）
+type ModelPricing = pricing.ModelPricing
 
 // PricingCalculator 价格计算器
 type PricingCalculator struct {
-	// 模型定价映射
-	modelPricing map[string]ModelPricing
+	// 模型定价映射；Reload 整体替换指针，计算路径无锁读取
+	modelPricing atomic.Pointer[map[string]ModelPricing]
+
+	// model_pricing 集合的客户端及定时重新加载（见 pricing_source.go）
+	client   *firestore.Client
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+
+	// 未知模型出现次数（按小写模型名），用于发现按默认价格计费的新模型
+	unknownMu     sync.Mutex
+	unknownModels map[string]int
 }
 
 // NewPricingCalculator 创建新的价格计算器
 func NewPricingCalculator() *PricingCalculator {
-	return &PricingCalculator{
-		modelPricing: map[string]ModelPricing{
-			// Claude 3.5 系列
-			"claude-3-5-sonnet": {
-				InputPricePerMillion:      3.0,
-				OutputPricePerMillion:     15.0,
-				CacheReadPricePerMillion:  0.30, // 90% discount from input
-				CacheWritePricePerMillion: 3.75, // 25% more than input
-			},
-			"claude-3-5-sonnet-20241022": {
-				InputPricePerMillion:      3.0,
-				OutputPricePerMillion:     15.0,
-				CacheReadPricePerMillion:  0.30, // 90% discount from input
-				CacheWritePricePerMillion: 3.75, // 25% more than input
-			},
-			"claude-3-5-haiku": {
-				InputPricePerMillion:      0.80,
-				OutputPricePerMillion:     4.0,
-				CacheReadPricePerMillion:  0.08, // 90% discount from input
-				CacheWritePricePerMillion: 1.00, // 25% more than input
-			},
-			"claude-3-5-haiku-20241022": {
-				InputPricePerMillion:      0.80,
-				OutputPricePerMillion:     4.0,
-				CacheReadPricePerMillion:  0.08, // 90% discount from input
-				CacheWritePricePerMillion: 1.00, // 25% more than input
-			},
-
-			// Claude 4 系列
-			"claude-opus-4-1-20250805": {
-				InputPricePerMillion:      15.0,
-				OutputPricePerMillion:     75.0,
-				CacheReadPricePerMillion:  1.50,  // 90% discount from input
-				CacheWritePricePerMillion: 18.75, // 25% more than input
-			},
-			"claude-sonnet-4-20250514": {
-				InputPricePerMillion:      3.0,
-				OutputPricePerMillion:     15.0,
-				CacheReadPricePerMillion:  0.30, // 90% discount from input
-				CacheWritePricePerMillion: 3.75, // 25% more than input
-			},
-
-			// Claude 3 系列
-			"claude-3-opus": {
-				InputPricePerMillion:      15.0,
-				OutputPricePerMillion:     75.0,
-				CacheReadPricePerMillion:  1.50,  // 90% discount from input
-				CacheWritePricePerMillion: 18.75, // 25% more than input
-			},
-			"claude-3-opus-20240229": {
-				InputPricePerMillion:      15.0,
-				OutputPricePerMillion:     75.0,
-				CacheReadPricePerMillion:  1.50,  // 90% discount from input
-				CacheWritePricePerMillion: 18.75, // 25% more than input
-			},
-			"claude-3-sonnet": {
-				InputPricePerMillion:      3.0,
-				OutputPricePerMillion:     15.0,
-				CacheReadPricePerMillion:  0.30, // 90% discount from input
-				CacheWritePricePerMillion: 3.75, // 25% more than input
-			},
-			"claude-3-sonnet-20240229": {
-				InputPricePerMillion:      3.0,
-				OutputPricePerMillion:     15.0,
-				CacheReadPricePerMillion:  0.30, // 90% discount from input
-				CacheWritePricePerMillion: 3.75, // 25% more than input
-			},
-			"claude-3-haiku": {
-				InputPricePerMillion:      0.25,
-				OutputPricePerMillion:     1.25,
-				CacheReadPricePerMillion:  0.025,  // 90% discount from input
-				CacheWritePricePerMillion: 0.3125, // 25% more than input
-			},
-			"claude-3-haiku-20240307": {
-				InputPricePerMillion:      0.25,
-				OutputPricePerMillion:     1.25,
-				CacheReadPricePerMillion:  0.025,  // 90% discount from input
-				CacheWritePricePerMillion: 0.3125, // 25% more than input
-			},
-
-			// Claude 2 系列
-			"claude-2.1": {
-				InputPricePerMillion:      8.0,
-				OutputPricePerMillion:     24.0,
-				CacheReadPricePerMillion:  0.80, // 90% discount from input
-				CacheWritePricePerMillion: 10.0, // 25% more than input
-			},
-			"claude-2.0": {
-				InputPricePerMillion:      8.0,
-				OutputPricePerMillion:     24.0,
-				CacheReadPricePerMillion:  0.80, // 90% discount from input
-				CacheWritePricePerMillion: 10.0, // 25% more than input
-			},
-
-			// Claude Instant
-			"claude-instant-1.2": {
-				InputPricePerMillion:      0.8,
-				OutputPricePerMillion:     2.4,
-				CacheReadPricePerMillion:  0.08, // 90% discount from input
-				CacheWritePricePerMillion: 1.0,  // 25% more than input
-			},
-		},
+	pc := &PricingCalculator{unknownModels: make(map[string]int)}
+	pc.Reload(pricing.DefaultModelPricing())
+	return pc
+}
+
+// Reload 原子替换定价表；正在进行的计算继续使用旧表，之后的计算使用新表
+func (pc *PricingCalculator) Reload(table map[string]ModelPricing) {
+	// 复制并统一为小写键，调用方之后修改传入的 map 不会影响计算
+	normalized := make(map[string]ModelPricing, len(table))
+	for model, modelPricing := range table {
+		normalized[strings.ToLower(model)] = modelPricing
+	}
+	pc.modelPricing.Store(&normalized)
+}
+
+// lookup 返回模型的定价，找不到精确匹配时按模型类型匹配
+func (pc *PricingCalculator) lookup(modelKey string) ModelPricing {
+	if modelPricing, exists := (*pc.modelPricing.Load())[modelKey]; exists {
+		return modelPricing
 	}
+	// 如果找不到精确匹配，尝试基于模型类型的匹配
+	return pc.findBestMatchPricing(modelKey)
 }
 
 // Calculate 计算给定模型和token数量的成本
@@ -132,36 +61,26 @@ func (pc *PricingCalculator) Calculate(model string, inputTokens int, outputToke
 	modelKey := strings.ToLower(model)
 
 	// 获取定价信息
-	pricing, exists := pc.modelPricing[modelKey]
-	if !exists {
-		// 如果找不到精确匹配，尝试基于模型类型的匹配
-		pricing = pc.findBestMatchPricing(modelKey)
-	}
-
-	// 计算成本（价格是per million tokens）
-	inputCost = float64(inputTokens) * pricing.InputPricePerMillion / 1_000_000
-	outputCost = float64(outputTokens) * pricing.OutputPricePerMillion / 1_000_000
+	pricing := pc.lookup(modelKey)
 
-	return inputCost, outputCost
+	// 计算成本（价格是per million tokens，超过200K输入token的部分按长上下文价格）
+	return pricing.TokenCosts(inputTokens, outputTokens)
 }
 
 // CalculateWithCache 计算包括缓存token在内的成本
-func (pc *PricingCalculator) CalculateWithCache(model string, inputTokens, outputTokens, cacheReadTokens, cacheWriteTokens int) (inputCost, outputCost, cacheReadCost, cacheWriteCost float64) {
+// cacheWriteTokens 为5分钟TTL的缓存写入，cacheWrite1hTokens 为1小时TTL的缓存写入，两者分别计价后合计为 cacheWriteCost
+func (pc *PricingCalculator) CalculateWithCache(model string, inputTokens, outputTokens, cacheReadTokens, cacheWriteTokens, cacheWrite1hTokens int) (inputCost, outputCost, cacheReadCost, cacheWriteCost float64) {
 	// 转换为小写以进行不区分大小写的匹配
 	modelKey := strings.ToLower(model)
 
 	// 获取定价信息
-	pricing, exists := pc.modelPricing[modelKey]
-	if !exists {
-		// 如果找不到精确匹配，尝试基于模型类型的匹配
-		pricing = pc.findBestMatchPricing(modelKey)
-	}
+	pricing := pc.lookup(modelKey)
 
-	// 计算各项成本（价格是per million tokens）
-	inputCost = float64(inputTokens) * pricing.InputPricePerMillion / 1_000_000
-	outputCost = float64(outputTokens) * pricing.OutputPricePerMillion / 1_000_000
+	// 计算各项成本（价格是per million tokens，超过200K输入token的部分按长上下文价格）
+	inputCost, outputCost = pricing.TokenCosts(inputTokens, outputTokens)
 	cacheReadCost = float64(cacheReadTokens) * pricing.CacheReadPricePerMillion / 1_000_000
-	cacheWriteCost = float64(cacheWriteTokens) * pricing.CacheWritePricePerMillion / 1_000_000
+	cacheWriteCost = float64(cacheWriteTokens)*pricing.CacheWritePricePerMillion/1_000_000 +
+		float64(cacheWrite1hTokens)*pricing.CacheWrite1hPrice()/1_000_000
 
 	return inputCost, outputCost, cacheReadCost, cacheWriteCost
 }
@@ -173,8 +92,8 @@ func (pc *PricingCalculator) GetTotalCost(model string, inputTokens int, outputT
 }
 
 // GetTotalCostWithCache 获取包括缓存token的总成本
-func (pc *PricingCalculator) GetTotalCostWithCache(model string, inputTokens, outputTokens, cacheReadTokens, cacheWriteTokens int) float64 {
-	inputCost, outputCost, cacheReadCost, cacheWriteCost := pc.CalculateWithCache(model, inputTokens, outputTokens, cacheReadTokens, cacheWriteTokens)
+func (pc *PricingCalculator) GetTotalCostWithCache(model string, inputTokens, outputTokens, cacheReadTokens, cacheWriteTokens, cacheWrite1hTokens int) float64 {
+	inputCost, outputCost, cacheReadCost, cacheWriteCost := pc.CalculateWithCache(model, inputTokens, outputTokens, cacheReadTokens, cacheWriteTokens, cacheWrite1hTokens)
 	return inputCost + outputCost + cacheReadCost + cacheWriteCost
 }
 
@@ -207,8 +126,10 @@ func (pc *PricingCalculator) findBestMatchPricing(modelKey string) ModelPricing
 		}
 	}
 
-	// 默认定价（使用Sonnet的定价作为默认）
-	log.Printf("ERROR: Model '%s' doesn't match any known pattern (opus/sonnet/haiku), using default Sonnet pricing ($3/$15 per million tokens)", modelKey)
+	// 默认定价（使用Sonnet的定价作为默认）；每个模型只告警一次，避免日志刷屏
+	if pc.recordUnknownModel(modelKey) == 1 {
+		log.Printf("[ALERT] Unknown model: model=%s, fallback=sonnet, input_price=3.0, output_price=15.0 (doesn't match opus/sonnet/haiku; add it to model_pricing)", modelKey)
+	}
 	return ModelPricing{
 		InputPricePerMillion:      3.0,
 		OutputPricePerMillion:     15.0,
@@ -216,3 +137,22 @@ func (pc *PricingCalculator) findBestMatchPricing(modelKey string) ModelPricing
 		CacheWritePricePerMillion: 3.75, // 25% more than input
 	}
 }
+
+// recordUnknownModel 记录一次未知模型并返回该模型累计出现次数
+func (pc *PricingCalculator) recordUnknownModel(modelKey string) int {
+	pc.unknownMu.Lock()
+	defer pc.unknownMu.Unlock()
+	pc.unknownModels[modelKey]++
+	return pc.unknownModels[modelKey]
+}
+
+// GetUnknownModelCounts 返回按默认价格计费的未知模型及其出现次数（副本）
+func (pc *PricingCalculator) GetUnknownModelCounts() map[string]int {
+	pc.unknownMu.Lock()
+	defer pc.unknownMu.Unlock()
+	counts := make(map[string]int, len(pc.unknownModels))
+	for model, count := range pc.unknownModels {
+		counts[model] = count
+	}
+	return counts
+}
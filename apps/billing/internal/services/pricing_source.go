@@ -0,0 +1,72 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"simple-relay/shared/pricing"
+
+	"cloud.google.com/go/firestore"
+)
+
+// modelPricingCollection holds per-model prices keyed by model name
+const modelPricingCollection = pricing.Collection
+
+// SetPricingSource makes ReloadPricing read prices from the model_pricing collection of client
+func (pc *PricingCalculator) SetPricingSource(client *firestore.Client) {
+	pc.client = client
+}
+
+// ReloadPricing loads the model_pricing collection over the built-in defaults and swaps in the
+// result. Models missing from the collection keep their default price, so an empty collection
+// restores the defaults. On error the current table is kept.
+func (pc *PricingCalculator) ReloadPricing(ctx context.Context) error {
+	if pc.client == nil {
+		return fmt.Errorf("no pricing source configured")
+	}
+
+	table, err := pricing.Load(ctx, pc.client)
+	if err != nil {
+		return err
+	}
+	pc.Reload(table)
+	return nil
+}
+
+// StartReloading reloads prices immediately and then on every interval until StopReloading
+func (pc *PricingCalculator) StartReloading(interval time.Duration) {
+	pc.stopChan = make(chan struct{})
+	pc.wg.Add(1)
+	go pc.runReload(interval)
+}
+
+// StopReloading stops the reload loop; it is a no-op if the loop was never started
+func (pc *PricingCalculator) StopReloading() {
+	if pc.stopChan == nil {
+		return
+	}
+	close(pc.stopChan)
+	pc.wg.Wait()
+}
+
+// runReload is the reload loop; the last loaded table is kept when a reload fails
+func (pc *PricingCalculator) runReload(interval time.Duration) {
+	defer pc.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := pc.ReloadPricing(context.Background()); err != nil {
+			log.Printf("Error reloading model pricing: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-pc.stopChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package services
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPricingCalculator_ReloadPricingFromFirestore(t *testing.T) {
+	client := newEmulatorClient(t)
+	ctx := context.Background()
+	clearCollection(t, client, modelPricingCollection)
+
+	pc := NewPricingCalculator()
+	pc.SetPricingSource(client)
+
+	// Empty collection: the built-in price applies
+	if err := pc.ReloadPricing(ctx); err != nil {
+		t.Fatalf("ReloadPricing returned error: %v", err)
+	}
+	if cost := pc.GetTotalCost(reloadTestModel, 1_000_000, 1_000_000); cost != 18.0 {
+		t.Errorf("expected default cost 18.0 with an empty collection, got %v", cost)
+	}
+
+	doc := client.Collection(modelPricingCollection).Doc(reloadTestModel)
+	if _, err := doc.Set(ctx, ModelPricing{InputPricePerMillion: 6.0, OutputPricePerMillion: 30.0}); err != nil {
+		t.Fatalf("failed to seed price: %v", err)
+	}
+	if err := pc.ReloadPricing(ctx); err != nil {
+		t.Fatalf("ReloadPricing returned error: %v", err)
+	}
+	if cost := pc.GetTotalCost(reloadTestModel, 1_000_000, 1_000_000); cost != 36.0 {
+		t.Errorf("expected reloaded cost 36.0, got %v", cost)
+	}
+
+	// A price change is picked up by the next reload
+	if _, err := doc.Set(ctx, ModelPricing{InputPricePerMillion: 1.0, OutputPricePerMillion: 5.0}); err != nil {
+		t.Fatalf("failed to update price: %v", err)
+	}
+	if err := pc.ReloadPricing(ctx); err != nil {
+		t.Fatalf("ReloadPricing returned error: %v", err)
+	}
+	if cost := pc.GetTotalCost(reloadTestModel, 1_000_000, 1_000_000); cost != 6.0 {
+		t.Errorf("expected changed cost 6.0 after reload, got %v", cost)
+	}
+}
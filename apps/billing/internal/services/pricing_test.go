@@ -0,0 +1,211 @@
+package services
+
+import (
+	"bytes"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const reloadTestModel = "claude-sonnet-4-20250514"
+
+// reloadTables returns two pricing tables that give distinguishable costs for reloadTestModel
+func reloadTables() (map[string]ModelPricing, map[string]ModelPricing) {
+	a := map[string]ModelPricing{reloadTestModel: {InputPricePerMillion: 3.0, OutputPricePerMillion: 15.0}}
+	b := map[string]ModelPricing{reloadTestModel: {InputPricePerMillion: 6.0, OutputPricePerMillion: 30.0}}
+	return a, b
+}
+
+func TestPricingCalculator_Reload(t *testing.T) {
+	pc := NewPricingCalculator()
+	table := map[string]ModelPricing{"Claude-Custom-1": {InputPricePerMillion: 1.0, OutputPricePerMillion: 2.0}}
+	pc.Reload(table)
+
+	// Later changes to the caller's map must not leak into the active table
+	table["Claude-Custom-1"] = ModelPricing{InputPricePerMillion: 100.0}
+
+	inputCost, outputCost := pc.Calculate("claude-custom-1", 1_000_000, 1_000_000)
+	if inputCost != 1.0 || outputCost != 2.0 {
+		t.Errorf("expected reloaded costs 1.0/2.0, got %v/%v", inputCost, outputCost)
+	}
+}
+
+func TestCalculateWithCache_LongContextTier(t *testing.T) {
+	pc := NewPricingCalculator()
+	pc.Reload(map[string]ModelPricing{
+		"tiered-model": {
+			InputPricePerMillion:     3.0,
+			OutputPricePerMillion:    15.0,
+			CacheReadPricePerMillion: 0.30,
+			InputPriceAbove200K:      6.0,
+			OutputPriceAbove200K:     22.50,
+		},
+		"flat-model": {InputPricePerMillion: 3.0, OutputPricePerMillion: 15.0},
+	})
+
+	// 200K tokens at $3 plus 50K at $6; output of a long-context request at $22.50
+	inputCost, outputCost, cacheReadCost, _ := pc.CalculateWithCache("tiered-model", 250_000, 10_000, 100_000, 0, 0)
+	if math.Abs(inputCost-0.90) > 1e-9 {
+		t.Errorf("expected blended input cost 0.90, got %v", inputCost)
+	}
+	if math.Abs(outputCost-0.225) > 1e-9 {
+		t.Errorf("expected long-context output cost 0.225, got %v", outputCost)
+	}
+	if math.Abs(cacheReadCost-0.03) > 1e-9 {
+		t.Errorf("expected cache read cost unaffected by the tier, got %v", cacheReadCost)
+	}
+
+	// At the boundary the base rates apply
+	inputCost, outputCost, _, _ = pc.CalculateWithCache("tiered-model", 200_000, 10_000, 0, 0, 0)
+	if math.Abs(inputCost-0.60) > 1e-9 || math.Abs(outputCost-0.15) > 1e-9 {
+		t.Errorf("expected base costs 0.60/0.15 at the threshold, got %v/%v", inputCost, outputCost)
+	}
+
+	// Models without a tier are priced as before
+	inputCost, outputCost, _, _ = pc.CalculateWithCache("flat-model", 250_000, 10_000, 0, 0, 0)
+	if math.Abs(inputCost-0.75) > 1e-9 || math.Abs(outputCost-0.15) > 1e-9 {
+		t.Errorf("expected flat costs 0.75/0.15, got %v/%v", inputCost, outputCost)
+	}
+}
+
+func TestCalculateWithCache_OneHourCacheWrites(t *testing.T) {
+	pc := NewPricingCalculator()
+	pc.Reload(map[string]ModelPricing{
+		"explicit-model": {InputPricePerMillion: 3.0, CacheWritePricePerMillion: 3.75, CacheWrite1hPricePerMillion: 5.0},
+		"default-model":  {InputPricePerMillion: 3.0, CacheWritePricePerMillion: 3.75},
+	})
+
+	// 1M 5-minute writes at $3.75 plus 1M 1-hour writes at the configured $5
+	_, _, _, cacheWriteCost := pc.CalculateWithCache("explicit-model", 0, 0, 0, 1_000_000, 1_000_000)
+	if math.Abs(cacheWriteCost-8.75) > 1e-9 {
+		t.Errorf("expected cache write cost 8.75, got %v", cacheWriteCost)
+	}
+
+	// Without a 1-hour rate, 1-hour writes cost twice the input price
+	_, _, _, cacheWriteCost = pc.CalculateWithCache("default-model", 0, 0, 0, 0, 1_000_000)
+	if math.Abs(cacheWriteCost-6.0) > 1e-9 {
+		t.Errorf("expected default 1-hour cache write cost 6.0, got %v", cacheWriteCost)
+	}
+}
+
+func TestPricingCalculator_CountsUnknownModelsAndLogsOnce(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	pc := NewPricingCalculator()
+	pc.Calculate("Claude-Mystery-5", 1000, 1000)
+	pc.Calculate("claude-mystery-5", 1000, 1000)
+	pc.Calculate(reloadTestModel, 1000, 1000)
+
+	counts := pc.GetUnknownModelCounts()
+	if len(counts) != 1 || counts["claude-mystery-5"] != 2 {
+		t.Errorf("expected claude-mystery-5 counted twice, got %v", counts)
+	}
+	if lines := strings.Count(logs.String(), "Unknown model"); lines != 1 {
+		t.Errorf("expected one alert log line, got %d:\n%s", lines, logs.String())
+	}
+}
+
+// TestPricingCalculator_ConcurrentReload hammers Calculate while Reload swaps tables; run with -race.
+// Every result must come entirely from one table, never a mix of the two.
+func TestPricingCalculator_ConcurrentReload(t *testing.T) {
+	pc := NewPricingCalculator()
+	a, b := reloadTables()
+	pc.Reload(a)
+
+	const readers = 32
+	const iterations = 2000
+
+	stop := make(chan struct{})
+	var reloader sync.WaitGroup
+	reloader.Add(1)
+	go func() {
+		defer reloader.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if i%2 == 0 {
+				pc.Reload(b)
+			} else {
+				pc.Reload(a)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan string, readers)
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				inputCost, outputCost := pc.Calculate(reloadTestModel, 1_000_000, 1_000_000)
+				fromA := inputCost == 3.0 && outputCost == 15.0
+				fromB := inputCost == 6.0 && outputCost == 30.0
+				if !fromA && !fromB {
+					errs <- "torn pricing read"
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(stop)
+	reloader.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkPricingCalculator_Calculate(b *testing.B) {
+	pc := NewPricingCalculator()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			pc.CalculateWithCache(reloadTestModel, 1200, 800, 5000, 300, 0)
+		}
+	})
+}
+
+func BenchmarkPricingCalculator_CalculateDuringReload(b *testing.B) {
+	pc := NewPricingCalculator()
+	tableA, tableB := reloadTables()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if i%2 == 0 {
+				pc.Reload(tableA)
+			} else {
+				pc.Reload(tableB)
+			}
+		}
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			pc.CalculateWithCache(reloadTestModel, 1200, 800, 5000, 300, 0)
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
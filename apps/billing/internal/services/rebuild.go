@@ -0,0 +1,206 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"simple-relay/shared/timewindow"
+
+	"cloud.google.com/go/firestore"
+)
+
+// ErrRebuildInProgress is returned when a rebuild is requested while another one is running
+var ErrRebuildInProgress = errors.New("an aggregate rebuild is already in progress")
+
+// ErrInvalidRebuildRange is returned for ranges that cannot be rebuilt exactly
+var ErrInvalidRebuildRange = errors.New("invalid rebuild range")
+
+// rebuildDimensions are the aggregates recomputed from usage_records
+var rebuildDimensions = []AggregateConfig{userHourlyAggregateConfig, userDailyAggregateConfig, upstreamHourlyAggregateConfig}
+
+// rebuildPageSize is the number of usage records read per query while rebuilding
+const rebuildPageSize = 1000
+
+// RebuildStats summarizes one aggregate rebuild
+type RebuildStats struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Records int       `json:"records"` // Billable usage records read
+	Written int       `json:"written"` // Aggregate documents overwritten
+	Deleted int       `json:"deleted"` // Aggregate documents in the range with no remaining records
+}
+
+// AggregateRebuilder recomputes user hourly and daily and upstream account hourly aggregates from the raw
+// usage records, for repairing aggregates written by buggy aggregation logic
+type AggregateRebuilder struct {
+	client    *firestore.Client
+	retention time.Duration
+	pageSize  int
+	now       func() time.Time
+	running   sync.Mutex
+}
+
+// NewAggregateRebuilder creates a rebuilder; retentionDays must match USAGE_RECORDS_RETENTION_DAYS
+// so that ranges whose records were already purged are refused (0 means records are kept forever)
+func NewAggregateRebuilder(client *firestore.Client, retentionDays int) *AggregateRebuilder {
+	return &AggregateRebuilder{
+		client:    client,
+		retention: time.Duration(retentionDays) * 24 * time.Hour,
+		pageSize:  rebuildPageSize,
+		now:       time.Now,
+	}
+}
+
+// RebuildAggregates recomputes the rebuildDimensions aggregates of every UTC day touched by [start, end)
+// from usage_records, overwriting the stored documents rather than incrementing them, and deletes
+// aggregate documents in the range that no longer have any records. Running it again over the same
+// range produces the same documents.
+func (ar *AggregateRebuilder) RebuildAggregates(ctx context.Context, start, end time.Time) (*RebuildStats, error) {
+	if !ar.running.TryLock() {
+		return nil, ErrRebuildInProgress
+	}
+	defer ar.running.Unlock()
+
+	start, end, err := ar.rebuildRange(start, end)
+	if err != nil {
+		return nil, err
+	}
+	stats := &RebuildStats{Start: start, End: end}
+
+	// Records are accumulated page by page, so only the aggregates are held in memory
+	aggregateMaps := make([]map[string]*MemoryAggregate, len(rebuildDimensions))
+	for i := range aggregateMaps {
+		aggregateMaps[i] = make(map[string]*MemoryAggregate)
+	}
+	err = ar.forEachRecord(ctx, start, end, func(record *UsageRecord) {
+		stats.Records++
+		for i, config := range rebuildDimensions {
+			config.accumulate(aggregateMaps[i], record)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bulkWriter := ar.client.BulkWriter(ctx)
+	var jobs []*firestore.BulkWriterJob
+	now := ar.now()
+	for i, config := range rebuildDimensions {
+		aggregateMap := aggregateMaps[i]
+
+		// Documents in the range that the records no longer account for
+		existing, err := ar.client.Collection(config.CollectionName).
+			Where(config.TimeFieldName, ">=", start).
+			Where(config.TimeFieldName, "<", end).
+			Documents(ctx).GetAll()
+		if err != nil {
+			bulkWriter.End()
+			return nil, fmt.Errorf("failed to query existing %ss: %w", config.LogDescription, err)
+		}
+		for _, doc := range existing {
+			if _, ok := aggregateMap[doc.Ref.ID]; ok {
+				continue
+			}
+			job, err := bulkWriter.Delete(doc.Ref)
+			if err != nil {
+				bulkWriter.End()
+				return nil, fmt.Errorf("failed to queue %s %s deletion: %w", config.LogDescription, doc.Ref.ID, err)
+			}
+			jobs = append(jobs, job)
+			stats.Deleted++
+		}
+
+		for docID, memAggregate := range aggregateMap {
+			docRef := ar.client.Collection(config.CollectionName).Doc(docID)
+			job, err := bulkWriter.Set(docRef, config.snapshotData(memAggregate, now))
+			if err != nil {
+				bulkWriter.End()
+				return nil, fmt.Errorf("failed to queue %s %s: %w", config.LogDescription, docID, err)
+			}
+			jobs = append(jobs, job)
+			stats.Written++
+		}
+	}
+	bulkWriter.End()
+
+	failed := 0
+	for _, job := range jobs {
+		if _, err := job.Results(); err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return nil, fmt.Errorf("%d of %d aggregate writes failed; rerun the rebuild for the same range", failed, len(jobs))
+	}
+
+	log.Printf("Rebuilt aggregates for %s to %s from %d usage records: %d documents written, %d deleted",
+		start.Format(time.RFC3339), end.Format(time.RFC3339), stats.Records, stats.Written, stats.Deleted)
+	return stats, nil
+}
+
+// forEachRecord calls fn with every billable usage record in [start, end), reading pageSize records per query
+func (ar *AggregateRebuilder) forEachRecord(ctx context.Context, start, end time.Time, fn func(*UsageRecord)) error {
+	query := ar.client.Collection("usage_records").
+		Where("timestamp", ">=", start).
+		Where("timestamp", "<", end).
+		OrderBy("timestamp", firestore.Asc).
+		OrderBy(firestore.DocumentID, firestore.Asc).
+		Limit(ar.pageSize)
+
+	var last *firestore.DocumentSnapshot
+	for {
+		page := query
+		if last != nil {
+			page = query.StartAfter(last)
+		}
+		docs, err := page.Documents(ctx).GetAll()
+		if err != nil {
+			return fmt.Errorf("failed to query usage records: %w", err)
+		}
+		for _, doc := range docs {
+			var record UsageRecord
+			if err := doc.DataTo(&record); err != nil {
+				return fmt.Errorf("failed to parse usage record %s: %w", doc.Ref.ID, err)
+			}
+			if record.Status != UsageStatusError {
+				fn(&record)
+			}
+		}
+		if len(docs) < ar.pageSize {
+			return nil
+		}
+		last = docs[len(docs)-1]
+	}
+}
+
+// rebuildRange widens [start, end) to whole UTC days, since daily aggregates can only be rebuilt
+// from all of their records, and refuses ranges that cannot be rebuilt exactly: days still receiving
+// live increments and days whose usage records may have been purged by retention
+func (ar *AggregateRebuilder) rebuildRange(start, end time.Time) (time.Time, time.Time, error) {
+	if !start.Before(end) {
+		return time.Time{}, time.Time{}, fmt.Errorf("%w: start %s must be before end %s", ErrInvalidRebuildRange,
+			start.Format(time.RFC3339), end.Format(time.RFC3339))
+	}
+
+	start = timewindow.Day(start).Start
+	if lastDay := timewindow.Day(end); !end.Equal(lastDay.Start) {
+		end = lastDay.End
+	}
+
+	now := ar.now()
+	if today := timewindow.Day(now).Start; end.After(today) {
+		return time.Time{}, time.Time{}, fmt.Errorf("%w: must end by %s; the current day is still being aggregated", ErrInvalidRebuildRange,
+			today.Format(time.RFC3339))
+	}
+	if ar.retention > 0 {
+		if cutoff := now.Add(-ar.retention); start.Before(cutoff) {
+			return time.Time{}, time.Time{}, fmt.Errorf("%w: must start after %s; older usage records are purged by retention", ErrInvalidRebuildRange,
+				cutoff.Format(time.RFC3339))
+		}
+	}
+	return start, end, nil
+}
@@ -0,0 +1,161 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRebuildRange(t *testing.T) {
+	now := time.Date(2025, 3, 20, 15, 0, 0, 0, time.UTC)
+	rebuilder := NewAggregateRebuilder(nil, 30)
+	rebuilder.now = func() time.Time { return now }
+
+	start, end, err := rebuilder.rebuildRange(time.Date(2025, 3, 10, 9, 30, 0, 0, time.UTC), time.Date(2025, 3, 11, 2, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("rebuildRange returned error: %v", err)
+	}
+	if want := time.Date(2025, 3, 10, 0, 0, 0, 0, time.UTC); !start.Equal(want) {
+		t.Errorf("expected start widened to %s, got %s", want, start)
+	}
+	if want := time.Date(2025, 3, 12, 0, 0, 0, 0, time.UTC); !end.Equal(want) {
+		t.Errorf("expected end widened to %s, got %s", want, end)
+	}
+
+	// An end already on a day boundary is kept
+	if _, end, _ := rebuilder.rebuildRange(time.Date(2025, 3, 10, 0, 0, 0, 0, time.UTC), time.Date(2025, 3, 11, 0, 0, 0, 0, time.UTC)); !end.Equal(time.Date(2025, 3, 11, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected a day-aligned end to be kept, got %s", end)
+	}
+
+	refused := []struct {
+		name       string
+		start, end time.Time
+	}{
+		{"empty range", now.Add(-48 * time.Hour), now.Add(-48 * time.Hour)},
+		{"reversed range", now.Add(-24 * time.Hour), now.Add(-48 * time.Hour)},
+		{"includes the current day", now.Add(-48 * time.Hour), now.Add(-time.Hour)},
+		{"records purged by retention", now.AddDate(0, 0, -40), now.AddDate(0, 0, -20)},
+	}
+	for _, tc := range refused {
+		if _, _, err := rebuilder.rebuildRange(tc.start, tc.end); !errors.Is(err, ErrInvalidRebuildRange) {
+			t.Errorf("%s: expected ErrInvalidRebuildRange, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestRebuildAggregates_RefusesConcurrentRebuild(t *testing.T) {
+	rebuilder := NewAggregateRebuilder(nil, 0)
+	rebuilder.running.Lock()
+	defer rebuilder.running.Unlock()
+
+	if _, err := rebuilder.RebuildAggregates(context.Background(), time.Time{}, time.Time{}); !errors.Is(err, ErrRebuildInProgress) {
+		t.Fatalf("expected ErrRebuildInProgress, got %v", err)
+	}
+}
+
+func TestRebuildAggregates_RecomputesFromUsageRecords(t *testing.T) {
+	client := newEmulatorClient(t)
+	ctx := context.Background()
+	for _, collection := range []string{"usage_records", "hourly_aggregates", dailyAggregatesCollection, upstreamHourlyAggregateConfig.CollectionName} {
+		clearCollection(t, client, collection)
+	}
+
+	day := time.Date(2025, 3, 10, 0, 0, 0, 0, time.UTC)
+	records := []*UsageRecord{
+		{ID: "r1", UserID: "alice", UpstreamAccountUUID: "account-a", Model: "claude-sonnet", InputTokens: 100, OutputTokens: 10, CacheReadTokens: 50, CacheReadCost: 0.01, TotalCost: 0.10, Status: UsageStatusSuccess, Timestamp: day.Add(9*time.Hour + 5*time.Minute)},
+		{ID: "r2", UserID: "alice", UpstreamAccountUUID: "account-a", Model: "claude-opus", InputTokens: 200, OutputTokens: 20, CacheWriteTokens: 30, CacheWriteCost: 0.02, TotalCost: 0.30, Status: UsageStatusSuccess, Timestamp: day.Add(9*time.Hour + 40*time.Minute)},
+		{ID: "r3", UserID: "alice", Model: "claude-sonnet", InputTokens: 300, OutputTokens: 30, TotalCost: 0.20, Status: UsageStatusFlagged, Timestamp: day.Add(14 * time.Hour)},
+		{ID: "r4", UserID: "bob", UpstreamAccountUUID: "account-b", Model: "claude-sonnet", InputTokens: 400, OutputTokens: 40, TotalCost: 0.40, Status: UsageStatusSuccess, Timestamp: day.Add(9 * time.Hour)},
+		{ID: "r5", UserID: "bob", Model: "claude-sonnet", Status: UsageStatusError, StatusCode: 529, Timestamp: day.Add(9 * time.Hour)},
+		{ID: "outside", UserID: "alice", Model: "claude-sonnet", InputTokens: 999, TotalCost: 9.99, Status: UsageStatusSuccess, Timestamp: day.Add(-time.Minute)},
+	}
+	for _, record := range records {
+		if _, err := client.Collection("usage_records").Doc(record.ID).Set(ctx, record); err != nil {
+			t.Fatalf("failed to seed record %s: %v", record.ID, err)
+		}
+	}
+
+	// A double-counted aggregate and one for a user whose records were deleted
+	if _, err := client.Collection("hourly_aggregates").Doc("alice_2025-03-10-09").Set(ctx, map[string]any{
+		"user_id": "alice", "hour": day.Add(9 * time.Hour), "total_requests": 4, "total_cost": 0.80,
+		"model_usage": map[string]any{"claude-haiku": map[string]any{"request_count": 4}},
+	}); err != nil {
+		t.Fatalf("failed to seed hourly aggregate: %v", err)
+	}
+	if _, err := client.Collection("hourly_aggregates").Doc("carol_2025-03-10-11").Set(ctx, map[string]any{
+		"user_id": "carol", "hour": day.Add(11 * time.Hour), "total_requests": 1,
+	}); err != nil {
+		t.Fatalf("failed to seed stale hourly aggregate: %v", err)
+	}
+
+	rebuilder := NewAggregateRebuilder(client, 0)
+	rebuilder.now = func() time.Time { return day.Add(72 * time.Hour) }
+	rebuilder.pageSize = 2 // Force multiple pages
+
+	// Running twice must give the same result
+	for run := 1; run <= 2; run++ {
+		stats, err := rebuilder.RebuildAggregates(ctx, day.Add(9*time.Hour), day.Add(10*time.Hour))
+		if err != nil {
+			t.Fatalf("run %d: RebuildAggregates returned error: %v", run, err)
+		}
+		if stats.Records != 4 || stats.Written != 7 {
+			t.Errorf("run %d: expected 4 records into 7 documents, got %+v", run, stats)
+		}
+
+		var aliceHour HourlyAggregate
+		doc, err := client.Collection("hourly_aggregates").Doc("alice_2025-03-10-09").Get(ctx)
+		if err != nil {
+			t.Fatalf("run %d: failed to read alice's hourly aggregate: %v", run, err)
+		}
+		if err := doc.DataTo(&aliceHour); err != nil {
+			t.Fatalf("run %d: failed to parse alice's hourly aggregate: %v", run, err)
+		}
+		if aliceHour.TotalRequests != 2 || aliceHour.TotalInputTokens != 300 || aliceHour.TotalOutputTokens != 30 ||
+			aliceHour.TotalCacheReadTokens != 50 || aliceHour.TotalCacheWriteTokens != 30 || !approxEqual(aliceHour.TotalCost, 0.40) ||
+			!approxEqual(aliceHour.TotalPoints, 4.0) || !approxEqual(aliceHour.TotalCacheReadCost, 0.01) || !approxEqual(aliceHour.TotalCacheWriteCost, 0.02) {
+			t.Errorf("run %d: unexpected hourly totals: %+v", run, aliceHour)
+		}
+		modelUsage, _ := doc.Data()["model_usage"].(map[string]any)
+		if _, stale := modelUsage["claude-haiku"]; stale || len(modelUsage) != 2 {
+			t.Errorf("run %d: expected only the rebuilt models in model_usage, got %v", run, modelUsage)
+		}
+		if opus, _ := modelUsage["claude-opus"].(map[string]any); opus["request_count"] != int64(1) {
+			t.Errorf("run %d: unexpected claude-opus usage: %v", run, modelUsage["claude-opus"])
+		}
+
+		var aliceDay HourlyAggregate
+		doc, err = client.Collection(dailyAggregatesCollection).Doc("alice_2025-03-10").Get(ctx)
+		if err != nil {
+			t.Fatalf("run %d: failed to read alice's daily aggregate: %v", run, err)
+		}
+		if err := doc.DataTo(&aliceDay); err != nil {
+			t.Fatalf("run %d: failed to parse alice's daily aggregate: %v", run, err)
+		}
+		if aliceDay.TotalRequests != 3 || aliceDay.TotalInputTokens != 600 || !approxEqual(aliceDay.TotalCost, 0.60) {
+			t.Errorf("run %d: unexpected daily totals: %+v", run, aliceDay)
+		}
+
+		var accountHour UpstreamAccountHourlyAggregate
+		doc, err = client.Collection(upstreamHourlyAggregateConfig.CollectionName).Doc("account-a_2025-03-10-09").Get(ctx)
+		if err != nil {
+			t.Fatalf("run %d: failed to read account-a's hourly aggregate: %v", run, err)
+		}
+		if err := doc.DataTo(&accountHour); err != nil {
+			t.Fatalf("run %d: failed to parse account-a's hourly aggregate: %v", run, err)
+		}
+		if accountHour.TotalRequests != 2 || !approxEqual(accountHour.TotalCost, 0.40) ||
+			!approxEqual(accountHour.TotalCacheReadCost, 0.01) || !approxEqual(accountHour.TotalCacheWriteCost, 0.02) {
+			t.Errorf("run %d: unexpected upstream hourly totals: %+v", run, accountHour)
+		}
+
+		if _, err := client.Collection("hourly_aggregates").Doc("carol_2025-03-10-11").Get(ctx); err == nil {
+			t.Errorf("run %d: expected the aggregate without records to be deleted", run)
+		}
+	}
+}
+
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
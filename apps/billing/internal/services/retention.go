@@ -0,0 +1,111 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// retentionPageSize is the number of records deleted per batch (Firestore allows at most 500 writes per batch)
+const retentionPageSize = 500
+
+// RetentionService periodically deletes usage records older than the retention window.
+// Hourly and upstream aggregates are kept and remain the source for long-term reporting.
+// Every instance runs the job; deleting a record another instance already deleted is a no-op, so
+// concurrent purges are safe.
+type RetentionService struct {
+	client     *firestore.Client
+	collection string
+	retention  time.Duration
+	interval   time.Duration
+	pageSize   int
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+// NewRetentionService creates a retention job that keeps retentionDays of usage records
+func NewRetentionService(client *firestore.Client, retentionDays int, interval time.Duration) *RetentionService {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &RetentionService{
+		client:     client,
+		collection: "usage_records",
+		retention:  time.Duration(retentionDays) * 24 * time.Hour,
+		interval:   interval,
+		pageSize:   retentionPageSize,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// Start runs the purge immediately and then on every interval
+func (rs *RetentionService) Start() {
+	rs.wg.Add(1)
+	go rs.run()
+}
+
+// Stop cancels an in-progress purge and waits for the retention job to exit. Batches already
+// committed stay deleted; the next run picks up the remaining records.
+func (rs *RetentionService) Stop() {
+	rs.cancel()
+	rs.wg.Wait()
+}
+
+// run is the main loop of the retention job
+func (rs *RetentionService) run() {
+	defer rs.wg.Done()
+
+	ticker := time.NewTicker(rs.interval)
+	defer ticker.Stop()
+
+	for {
+		if deleted, err := rs.PurgeExpiredRecords(rs.ctx); err != nil && rs.ctx.Err() == nil {
+			log.Printf("Error purging expired usage records: %v", err)
+		} else if deleted > 0 {
+			log.Printf("Purged %d usage records older than %s", deleted, rs.retention)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-rs.ctx.Done():
+			return
+		}
+	}
+}
+
+// PurgeExpiredRecords deletes usage records older than the retention window in paginated batches
+// Returns the number of deleted records
+func (rs *RetentionService) PurgeExpiredRecords(ctx context.Context) (int, error) {
+	cutoff := time.Now().Add(-rs.retention)
+	deleted := 0
+
+	for {
+		docs, err := rs.client.Collection(rs.collection).
+			Where("timestamp", "<", cutoff).
+			Limit(rs.pageSize).
+			Documents(ctx).GetAll()
+		if err != nil {
+			return deleted, fmt.Errorf("failed to query expired usage records: %w", err)
+		}
+		if len(docs) == 0 {
+			return deleted, nil
+		}
+
+		batch := rs.client.Batch()
+		for _, doc := range docs {
+			batch.Delete(doc.Ref)
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return deleted, fmt.Errorf("failed to delete expired usage records: %w", err)
+		}
+		deleted += len(docs)
+
+		if len(docs) < rs.pageSize {
+			return deleted, nil
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetentionService_PurgeExpiredRecords(t *testing.T) {
+	client := newEmulatorClient(t)
+	ctx := context.Background()
+	clearCollection(t, client, "usage_records")
+
+	records := []*UsageRecord{
+		{ID: "old-1", UserID: "user@example.com", Timestamp: time.Now().Add(-100 * 24 * time.Hour)},
+		{ID: "old-2", UserID: "user@example.com", Timestamp: time.Now().Add(-31 * 24 * time.Hour)},
+		{ID: "recent", UserID: "user@example.com", Timestamp: time.Now().Add(-1 * time.Hour)},
+	}
+	for _, record := range records {
+		if _, err := client.Collection("usage_records").Doc(record.ID).Set(ctx, record); err != nil {
+			t.Fatalf("failed to seed record %s: %v", record.ID, err)
+		}
+	}
+
+	retention := NewRetentionService(client, 30, time.Hour)
+	retention.pageSize = 1 // Force multiple pages
+
+	deleted, err := retention.PurgeExpiredRecords(ctx)
+	if err != nil {
+		t.Fatalf("PurgeExpiredRecords returned error: %v", err)
+	}
+	if deleted != 2 {
+		t.Errorf("expected 2 deleted records, got %d", deleted)
+	}
+
+	docs, err := client.Collection("usage_records").Documents(ctx).GetAll()
+	if err != nil {
+		t.Fatalf("failed to list remaining records: %v", err)
+	}
+	if len(docs) != 1 || docs[0].Ref.ID != "recent" {
+		t.Errorf("expected only the recent record to remain, got %d records", len(docs))
+	}
+}
+
+func TestRetentionService_ConcurrentPurges(t *testing.T) {
+	client := newEmulatorClient(t)
+	ctx := context.Background()
+	clearCollection(t, client, "usage_records")
+
+	for i := 0; i < 20; i++ {
+		record := &UsageRecord{ID: fmt.Sprintf("old-%d", i), UserID: "user@example.com", Timestamp: time.Now().Add(-100 * 24 * time.Hour)}
+		if _, err := client.Collection("usage_records").Doc(record.ID).Set(ctx, record); err != nil {
+			t.Fatalf("failed to seed record %s: %v", record.ID, err)
+		}
+	}
+	recent := &UsageRecord{ID: "recent", UserID: "user@example.com", Timestamp: time.Now().Add(-time.Hour)}
+	if _, err := client.Collection("usage_records").Doc(recent.ID).Set(ctx, recent); err != nil {
+		t.Fatalf("failed to seed recent record: %v", err)
+	}
+
+	// Instances purging at the same time may both delete a record; neither may fail
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		retention := NewRetentionService(client, 90, time.Hour)
+		retention.pageSize = 5
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := retention.PurgeExpiredRecords(ctx); err != nil {
+				t.Errorf("PurgeExpiredRecords returned error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	docs, err := client.Collection("usage_records").Documents(ctx).GetAll()
+	if err != nil {
+		t.Fatalf("failed to list remaining records: %v", err)
+	}
+	if len(docs) != 1 || docs[0].Ref.ID != "recent" {
+		t.Errorf("expected only the recent record to remain, got %d records", len(docs))
+	}
+}
+
+func TestRetentionService_StopCancelsPurge(t *testing.T) {
+	client := newEmulatorClient(t)
+	retention := NewRetentionService(client, 30, time.Hour)
+	retention.Start()
+	retention.Stop()
+
+	// A purge still running on the service context is cut short instead of outliving Stop
+	if _, err := retention.PurgeExpiredRecords(retention.ctx); err == nil || !errors.Is(retention.ctx.Err(), context.Canceled) {
+		t.Errorf("expected the purge to be canceled after Stop, got %v", err)
+	}
+}
@@ -4,24 +4,30 @@ import (
 	"context"
 	"time"
 
+	"simple-relay/shared/timewindow"
+
 	"cloud.google.com/go/firestore"
 )
 
 // UpstreamHourlyAggregatorService handles hourly aggregation for upstream OAuth accounts
 type UpstreamHourlyAggregatorService struct {
-	base *UpstreamAggregationBase
+	base *AggregationBase
+}
+
+// upstreamHourlyAggregateConfig is the upstream account hourly dimension
+var upstreamHourlyAggregateConfig = AggregateConfig{
+	CollectionName: "upstream_account_hourly_aggregates",
+	KeyField:       "upstream_account_uuid",
+	Key:            upstreamAccountKey,
+	TimeFormat:     timewindow.HourKeyFormat,
+	TimeFieldName:  "hour",
+	LogDescription: "upstream account hourly aggregate",
 }
 
 // NewUpstreamHourlyAggregatorService creates a new upstream hourly aggregator service
 func NewUpstreamHourlyAggregatorService(db *firestore.Client, billingService *BillingService) *UpstreamHourlyAggregatorService {
-	config := UpstreamAggregateConfig{
-		CollectionName:  "upstream_account_hourly_aggregates",
-		TimeFormat:      "2006-01-02T15",
-		TimeFieldName:   "hour",
-		LogDescription:  "hourly aggregate",
-	}
 	return &UpstreamHourlyAggregatorService{
-		base: NewUpstreamAggregationBase(db, billingService, config),
+		base: NewAggregationBase(db, billingService, upstreamHourlyAggregateConfig),
 	}
 }
 
@@ -34,6 +40,8 @@ type UpstreamAccountHourlyAggregate struct {
 	TotalOutputTokens    int                   `firestore:"total_output_tokens" json:"total_output_tokens"`
 	TotalCacheReadTokens int                   `firestore:"total_cache_read_tokens" json:"total_cache_read_tokens"`
 	TotalCacheWriteTokens int                  `firestore:"total_cache_write_tokens" json:"total_cache_write_tokens"`
+	TotalCacheReadCost   float64               `firestore:"total_cache_read_cost" json:"total_cache_read_cost"`
+	TotalCacheWriteCost  float64               `firestore:"total_cache_write_cost" json:"total_cache_write_cost"`
 	TotalCost            float64               `firestore:"total_cost" json:"total_cost"`
 	TotalPoints          float64               `firestore:"total_points" json:"total_points"`
 	ModelUsage           map[string]ModelStats `firestore:"-" json:"model_usage"`
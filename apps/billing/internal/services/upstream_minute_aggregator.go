@@ -4,24 +4,28 @@ import (
 	"context"
 	"time"
 
+	"simple-relay/shared/timewindow"
+
 	"cloud.google.com/go/firestore"
 )
 
 // UpstreamMinuteAggregatorService handles minute-level aggregation for upstream OAuth accounts
 type UpstreamMinuteAggregatorService struct {
-	base *UpstreamAggregationBase
+	base *AggregationBase
 }
 
 // NewUpstreamMinuteAggregatorService creates a new upstream minute aggregator service
 func NewUpstreamMinuteAggregatorService(db *firestore.Client, billingService *BillingService) *UpstreamMinuteAggregatorService {
-	config := UpstreamAggregateConfig{
-		CollectionName:  "upstream_account_minute_aggregates",
-		TimeFormat:      "2006-01-02T15:04",
-		TimeFieldName:   "minute",
-		LogDescription:  "minute aggregate",
+	config := AggregateConfig{
+		CollectionName: "upstream_account_minute_aggregates",
+		KeyField:       "upstream_account_uuid",
+		Key:            upstreamAccountKey,
+		TimeFormat:     timewindow.MinuteKeyFormat,
+		TimeFieldName:  "minute",
+		LogDescription: "upstream account minute aggregate",
 	}
 	return &UpstreamMinuteAggregatorService{
-		base: NewUpstreamAggregationBase(db, billingService, config),
+		base: NewAggregationBase(db, billingService, config),
 	}
 }
 
@@ -34,6 +38,8 @@ type UpstreamAccountMinuteAggregate struct {
 	TotalOutputTokens    int                   `firestore:"total_output_tokens" json:"total_output_tokens"`
 	TotalCacheReadTokens int                   `firestore:"total_cache_read_tokens" json:"total_cache_read_tokens"`
 	TotalCacheWriteTokens int                  `firestore:"total_cache_write_tokens" json:"total_cache_write_tokens"`
+	TotalCacheReadCost   float64               `firestore:"total_cache_read_cost" json:"total_cache_read_cost"`
+	TotalCacheWriteCost  float64               `firestore:"total_cache_write_cost" json:"total_cache_write_cost"`
 	TotalCost            float64               `firestore:"total_cost" json:"total_cost"`
 	TotalPoints          float64               `firestore:"total_points" json:"total_points"`
 	ModelUsage           map[string]ModelStats `firestore:"-" json:"model_usage"`
@@ -0,0 +1,116 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// UpstreamAccountUsage is one upstream account's summed hourly aggregates over a time range
+type UpstreamAccountUsage struct {
+	UpstreamAccountUUID   string  `json:"upstream_account_uuid"`
+	TotalRequests         int     `json:"total_requests"`
+	TotalInputTokens      int     `json:"total_input_tokens"`
+	TotalOutputTokens     int     `json:"total_output_tokens"`
+	TotalCacheReadTokens  int     `json:"total_cache_read_tokens"`
+	TotalCacheWriteTokens int     `json:"total_cache_write_tokens"`
+	TotalCost             float64 `json:"total_cost"`
+	TotalPoints           float64 `json:"total_points"`
+}
+
+// add sums one hourly aggregate into the usage totals
+func (u *UpstreamAccountUsage) add(hourly *UpstreamAccountHourlyAggregate) {
+	u.TotalRequests += hourly.TotalRequests
+	u.TotalInputTokens += hourly.TotalInputTokens
+	u.TotalOutputTokens += hourly.TotalOutputTokens
+	u.TotalCacheReadTokens += hourly.TotalCacheReadTokens
+	u.TotalCacheWriteTokens += hourly.TotalCacheWriteTokens
+	u.TotalCost += hourly.TotalCost
+	u.TotalPoints += hourly.TotalPoints
+}
+
+// GetUpstreamAccountUsage sums an account's hourly aggregates for hours in [start, end)
+func (uhas *UpstreamHourlyAggregatorService) GetUpstreamAccountUsage(ctx context.Context, accountUUID string, start, end time.Time) (*UpstreamAccountUsage, error) {
+	query := uhas.collection().
+		Where("upstream_account_uuid", "==", accountUUID).
+		Where("hour", ">=", start).
+		Where("hour", "<", end)
+
+	totals, err := uhas.sumAggregates(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if usage, exists := totals[accountUUID]; exists {
+		return usage, nil
+	}
+	return &UpstreamAccountUsage{UpstreamAccountUUID: accountUUID}, nil
+}
+
+// GetTopUpstreamAccounts returns the accounts that used the most points in hours [start, end),
+// highest first. limit <= 0 returns every account.
+func (uhas *UpstreamHourlyAggregatorService) GetTopUpstreamAccounts(ctx context.Context, start, end time.Time, limit int) ([]*UpstreamAccountUsage, error) {
+	query := uhas.collection().
+		Where("hour", ">=", start).
+		Where("hour", "<", end)
+
+	totals, err := uhas.sumAggregates(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return rankUpstreamUsage(totals, limit), nil
+}
+
+// collection returns the hourly aggregates collection this service writes
+func (uhas *UpstreamHourlyAggregatorService) collection() *firestore.CollectionRef {
+	return uhas.base.db.Collection(uhas.base.config.CollectionName)
+}
+
+// sumAggregates runs query and sums the matching hourly aggregates by account
+func (uhas *UpstreamHourlyAggregatorService) sumAggregates(ctx context.Context, query firestore.Query) (map[string]*UpstreamAccountUsage, error) {
+	docs, err := query.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query upstream hourly aggregates: %w", err)
+	}
+
+	totals := make(map[string]*UpstreamAccountUsage)
+	for _, doc := range docs {
+		var hourly UpstreamAccountHourlyAggregate
+		if err := doc.DataTo(&hourly); err != nil {
+			log.Printf("Error parsing upstream hourly aggregate %s: %v", doc.Ref.ID, err)
+			continue
+		}
+		usage, exists := totals[hourly.UpstreamAccountUUID]
+		if !exists {
+			usage = &UpstreamAccountUsage{UpstreamAccountUUID: hourly.UpstreamAccountUUID}
+			totals[hourly.UpstreamAccountUUID] = usage
+		}
+		usage.add(&hourly)
+	}
+	return totals, nil
+}
+
+// rankUpstreamUsage sorts accounts by points used, highest first, breaking ties by cost and then
+// account UUID so the order is stable, and keeps the first limit entries when limit > 0
+func rankUpstreamUsage(totals map[string]*UpstreamAccountUsage, limit int) []*UpstreamAccountUsage {
+	ranked := make([]*UpstreamAccountUsage, 0, len(totals))
+	for _, usage := range totals {
+		ranked = append(ranked, usage)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].TotalPoints != ranked[j].TotalPoints {
+			return ranked[i].TotalPoints > ranked[j].TotalPoints
+		}
+		if ranked[i].TotalCost != ranked[j].TotalCost {
+			return ranked[i].TotalCost > ranked[j].TotalCost
+		}
+		return ranked[i].UpstreamAccountUUID < ranked[j].UpstreamAccountUUID
+	})
+	if limit > 0 && len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	return ranked
+}
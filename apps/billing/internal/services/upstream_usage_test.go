@@ -0,0 +1,80 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRankUpstreamUsage_OrdersByPointsAndLimits(t *testing.T) {
+	totals := map[string]*UpstreamAccountUsage{
+		"acct-low":  {UpstreamAccountUUID: "acct-low", TotalPoints: 5},
+		"acct-high": {UpstreamAccountUUID: "acct-high", TotalPoints: 50},
+		"acct-b":    {UpstreamAccountUUID: "acct-b", TotalPoints: 20},
+		"acct-a":    {UpstreamAccountUUID: "acct-a", TotalPoints: 20},
+	}
+
+	ranked := rankUpstreamUsage(totals, 0)
+	want := []string{"acct-high", "acct-a", "acct-b", "acct-low"}
+	if len(ranked) != len(want) {
+		t.Fatalf("expected %d accounts, got %d", len(want), len(ranked))
+	}
+	for i, uuid := range want {
+		if ranked[i].UpstreamAccountUUID != uuid {
+			t.Errorf("position %d: expected %s, got %s", i, uuid, ranked[i].UpstreamAccountUUID)
+		}
+	}
+
+	if top := rankUpstreamUsage(totals, 2); len(top) != 2 || top[0].UpstreamAccountUUID != "acct-high" {
+		t.Errorf("expected the top 2 accounts led by acct-high, got %+v", top)
+	}
+}
+
+func TestUpstreamHourlyAggregator_GetTopUpstreamAccounts(t *testing.T) {
+	client := newEmulatorClient(t)
+	ctx := context.Background()
+	clearCollection(t, client, "upstream_account_hourly_aggregates")
+
+	uhas := NewUpstreamHourlyAggregatorService(client, nil)
+	base := time.Date(2025, 3, 1, 10, 5, 0, 0, time.UTC)
+	records := []*UsageRecord{
+		{ID: "u1", UpstreamAccountUUID: "acct-light", Model: "claude-sonnet-4", Timestamp: base, InputTokens: 100, TotalCost: 0.1},
+		{ID: "u2", UpstreamAccountUUID: "acct-heavy", Model: "claude-opus-4", Timestamp: base, InputTokens: 1000, TotalCost: 1.0},
+		{ID: "u3", UpstreamAccountUUID: "acct-heavy", Model: "claude-opus-4", Timestamp: base.Add(time.Hour), InputTokens: 2000, TotalCost: 2.0},
+		// Outside the queried range
+		{ID: "u4", UpstreamAccountUUID: "acct-light", Model: "claude-opus-4", Timestamp: base.Add(5 * time.Hour), InputTokens: 9000, TotalCost: 9.0},
+	}
+	if err := uhas.AggregateRecords(ctx, records); err != nil {
+		t.Fatalf("AggregateRecords returned error: %v", err)
+	}
+
+	start := base.Truncate(time.Hour)
+	end := start.Add(2 * time.Hour)
+
+	top, err := uhas.GetTopUpstreamAccounts(ctx, start, end, 10)
+	if err != nil {
+		t.Fatalf("GetTopUpstreamAccounts returned error: %v", err)
+	}
+	if len(top) != 2 || top[0].UpstreamAccountUUID != "acct-heavy" || top[1].UpstreamAccountUUID != "acct-light" {
+		t.Fatalf("expected acct-heavy then acct-light, got %+v", top)
+	}
+	if top[0].TotalRequests != 2 || top[0].TotalInputTokens != 3000 {
+		t.Errorf("expected acct-heavy to sum 2 requests and 3000 input tokens, got %+v", top[0])
+	}
+
+	usage, err := uhas.GetUpstreamAccountUsage(ctx, "acct-light", start, end)
+	if err != nil {
+		t.Fatalf("GetUpstreamAccountUsage returned error: %v", err)
+	}
+	if usage.TotalRequests != 1 || usage.TotalInputTokens != 100 {
+		t.Errorf("expected acct-light to exclude usage outside the range, got %+v", usage)
+	}
+
+	usage, err = uhas.GetUpstreamAccountUsage(ctx, "acct-unused", start, end)
+	if err != nil {
+		t.Fatalf("GetUpstreamAccountUsage returned error: %v", err)
+	}
+	if usage.UpstreamAccountUUID != "acct-unused" || usage.TotalRequests != 0 {
+		t.Errorf("expected empty usage for an account without aggregates, got %+v", usage)
+	}
+}
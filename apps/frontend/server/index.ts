@@ -270,18 +270,18 @@ app.post('/api/api-keys', requireAuth, async (req, res) => {
   }
 });
 
-app.delete('/api/api-keys/:key', requireAuth, async (req, res) => {
+app.delete('/api/api-keys/:id', requireAuth, async (req, res) => {
   try {
     const email = req.signedCookies.user_email;
-    const apiKey = req.params.key;
+    const id = req.params.id;
     
     // Verify the API key belongs to the user
-    const binding = await ApiKeyDatabase.findByApiKey(apiKey);
+    const binding = await ApiKeyDatabase.findById(id);
     if (!binding || binding.user_email !== email) {
       return res.status(404).json({ error: 'API key not found' });
     }
     
-    await ApiKeyDatabase.deleteApiKey(apiKey);
+    await ApiKeyDatabase.deleteById(id);
     res.json({ message: 'API key deleted successfully' });
   } catch (error) {
     console.error('Error deleting API key:', error);
@@ -346,11 +346,14 @@ app.get('/api/points-limit', requireAuth, async (req, res) => {
     const todayUsage = await UsageDatabase.findByUserEmailAndTimeRange(email, windowStart, windowEnd);
     const usedToday = todayUsage.reduce((sum: number, usage: HourlyUsage) => sum + usage.TotalPoints, 0);
     
-    const dailyLimit = pointsLimit?.pointsLimit || 0;
-    const remaining = dailyLimit - usedToday;
+    // Unlimited users have no limit to count down from
+    const unlimited = pointsLimit?.unlimited === true;
+    const dailyLimit = unlimited ? 0 : pointsLimit?.pointsLimit || 0;
+    const remaining = unlimited ? 0 : dailyLimit - usedToday;
     
     res.json({
       pointsLimit: dailyLimit,
+      unlimited: unlimited,
       usedToday: usedToday,
       remaining: remaining,
       updateTime: pointsLimit?.updateTime || null,
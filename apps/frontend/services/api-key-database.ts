@@ -1,11 +1,26 @@
-import { Firestore } from '@google-cloud/firestore';
+import { createHash } from 'crypto';
+import { DocumentData, Firestore } from '@google-cloud/firestore';
 
 export interface ApiKeyBinding {
-  api_key: string;                  // Primary key - document ID
+  id: string;                       // Primary key - document ID, hashApiKey(api_key)
+  api_key?: string;                 // Raw key; only returned when the key is created, never stored
+  key_preview: string;              // Masked key shown in key lists
   user_email: string;               // User's email address
+  enabled?: boolean;                // Per-key enable flag; missing means enabled
   created_at: Date;                 // When the binding was created
 }
 
+// hashApiKey returns the hex SHA-256 of a raw API key, the binding's document ID, so a leaked
+// database export doesn't contain usable keys. Must match HashApiKey in the backend.
+export function hashApiKey(apiKey: string): string {
+  return createHash('sha256').update(apiKey).digest('hex');
+}
+
+// maskApiKey keeps the first 7 and last 4 characters of a key
+export function maskApiKey(apiKey: string): string {
+  return apiKey.slice(0, 7) + '*'.repeat(Math.max(0, apiKey.length - 11)) + apiKey.slice(-4);
+}
+
 class FirestoreApiKeyDatabase {
   private db: Firestore;
   private collection = 'api_key_bindings';
@@ -24,9 +39,13 @@ class FirestoreApiKeyDatabase {
     });
   }
 
-  async create(binding: Omit<ApiKeyBinding, 'created_at'>): Promise<ApiKeyBinding> {
+  async create(binding: { api_key: string; user_email: string }): Promise<ApiKeyBinding> {
     const newBinding: ApiKeyBinding = {
-      ...binding,
+      id: hashApiKey(binding.api_key),
+      api_key: binding.api_key,
+      key_preview: maskApiKey(binding.api_key),
+      user_email: binding.user_email,
+      enabled: true,
       created_at: new Date(),
     };
     
@@ -41,10 +60,12 @@ class FirestoreApiKeyDatabase {
         throw new Error('User already has maximum of 3 API keys');
       }
       
-      // Create the new API key
-      const docRef = this.db.collection(this.collection).doc(binding.api_key);
+      // Create the new API key under its hash; the raw key is only returned to the caller
+      const docRef = this.db.collection(this.collection).doc(newBinding.id);
       transaction.set(docRef, {
+        key_preview: newBinding.key_preview,
         user_email: newBinding.user_email,
+        enabled: true,
         created_at: newBinding.created_at.toISOString(),
       });
       
@@ -53,19 +74,19 @@ class FirestoreApiKeyDatabase {
   }
 
   async findByApiKey(apiKey: string): Promise<ApiKeyBinding | null> {
-    const docRef = this.db.collection(this.collection).doc(apiKey);
+    return this.findById(hashApiKey(apiKey));
+  }
+
+  // findById reads a binding by its document ID, as listed by findByUserEmail
+  async findById(id: string): Promise<ApiKeyBinding | null> {
+    const docRef = this.db.collection(this.collection).doc(id);
     const doc = await docRef.get();
     
     if (!doc.exists) {
       return null;
     }
     
-    const data = doc.data()!;
-    return {
-      api_key: apiKey,
-      user_email: data.user_email,
-      created_at: new Date(data.created_at),
-    };
+    return this.toBinding(doc.id, doc.data()!);
   }
 
   async findByUserEmail(userEmail: string): Promise<ApiKeyBinding[]> {
@@ -73,20 +94,24 @@ class FirestoreApiKeyDatabase {
       .where('user_email', '==', userEmail);
     
     const snapshot = await query.get();
-    return snapshot.docs.map(doc => {
-      const data = doc.data();
-      return {
-        api_key: doc.id,
-        user_email: data.user_email,
-        created_at: new Date(data.created_at),
-      };
-    });
+    return snapshot.docs.map(doc => this.toBinding(doc.id, doc.data()));
   }
 
-  async deleteApiKey(apiKey: string): Promise<void> {
-    const docRef = this.db.collection(this.collection).doc(apiKey);
+  async deleteById(id: string): Promise<void> {
+    const docRef = this.db.collection(this.collection).doc(id);
     await docRef.delete();
   }
+
+  private toBinding(id: string, data: DocumentData): ApiKeyBinding {
+    return {
+      id,
+      // Bindings not yet migrated by scripts/migrate-api-key-hashes.sh are keyed by the raw key
+      key_preview: data.key_preview || maskApiKey(id),
+      user_email: data.user_email,
+      enabled: data.enabled !== false,
+      created_at: new Date(data.created_at),
+    };
+  }
 }
 
 export const ApiKeyDatabase = new FirestoreApiKeyDatabase();
\ No newline at end of file
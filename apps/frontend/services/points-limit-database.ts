@@ -3,6 +3,7 @@ import { Firestore } from '@google-cloud/firestore';
 export interface DailyPointsLimit {
   userId: string;           // Primary key - user email or user ID
   pointsLimit: number;      // Daily points limit 
+  unlimited: boolean;       // No daily limit; pointsLimit is ignored
   updateTime: Date;         // When the limit was last updated
 }
 
@@ -36,14 +37,16 @@ class FirestorePointsLimitDatabase {
     return {
       userId: data.userId,
       pointsLimit: data.pointsLimit,
+      unlimited: data.unlimited === true,
       updateTime: new Date(data.updateTime),
     };
   }
 
-  async setPointsLimit(userId: string, pointsLimit: number): Promise<DailyPointsLimit> {
+  async setPointsLimit(userId: string, pointsLimit: number, unlimited = false): Promise<DailyPointsLimit> {
     const newLimit: DailyPointsLimit = {
       userId,
       pointsLimit,
+      unlimited,
       updateTime: new Date(),
     };
     
@@ -51,6 +54,7 @@ class FirestorePointsLimitDatabase {
     await docRef.set({
       userId: newLimit.userId,
       pointsLimit: newLimit.pointsLimit,
+      unlimited: newLimit.unlimited,
       updateTime: newLimit.updateTime.toISOString(),
     });
     
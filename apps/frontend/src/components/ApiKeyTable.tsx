@@ -6,7 +6,8 @@ import Loading from './Loading';
 import UsageGuide from './UsageGuide';
 
 interface ApiKey {
-  api_key: string;
+  id: string;
+  key_preview: string;
   user_email: string;
   created_at: string;
 }
@@ -22,7 +23,9 @@ export default function ApiKeyTable({ userEmail: _userEmail, onMessage }: ApiKey
   const [apiEnabled, setApiEnabled] = useState(true);
   const [loading, setLoading] = useState(true);
   const [creating, setCreating] = useState(false);
-  const [deleteModal, setDeleteModal] = useState<{ show: boolean; apiKey: string }>({ show: false, apiKey: '' });
+  const [deleteModal, setDeleteModal] = useState<{ show: boolean; id: string; preview: string }>({ show: false, id: '', preview: '' });
+  // Raw keys created in this session by binding ID; the server only stores their hash
+  const [createdKeys, setCreatedKeys] = useState<Record<string, string>>({});
   const [deleting, setDeleting] = useState(false);
   const [copiedCommand, setCopiedCommand] = useState<string | null>(null);
   const [usageGuideModal, setUsageGuideModal] = useState(false);
@@ -66,6 +69,8 @@ export default function ApiKeyTable({ userEmail: _userEmail, onMessage }: ApiKey
       });
 
       if (response.ok) {
+        const created = await response.json();
+        setCreatedKeys((keys) => ({ ...keys, [created.id]: created.api_key }));
         onMessage(t('apiKeys.messages.created'));
         await loadApiKeys();
       } else {
@@ -79,12 +84,12 @@ export default function ApiKeyTable({ userEmail: _userEmail, onMessage }: ApiKey
     }
   };
 
-  const showDeleteModal = (apiKey: string) => {
-    setDeleteModal({ show: true, apiKey });
+  const showDeleteModal = (key: ApiKey) => {
+    setDeleteModal({ show: true, id: key.id, preview: key.key_preview });
   };
 
   const hideDeleteModal = () => {
-    setDeleteModal({ show: false, apiKey: '' });
+    setDeleteModal({ show: false, id: '', preview: '' });
   };
 
   const showUsageGuide = () => {
@@ -100,7 +105,7 @@ export default function ApiKeyTable({ userEmail: _userEmail, onMessage }: ApiKey
     
     setDeleting(true);
     try {
-      const response = await fetch(`/api/api-keys/${deleteModal.apiKey}`, {
+      const response = await fetch(`/api/api-keys/${deleteModal.id}`, {
         method: 'DELETE',
         credentials: 'include'
       });
@@ -127,13 +132,6 @@ export default function ApiKeyTable({ userEmail: _userEmail, onMessage }: ApiKey
     return backendUrl;
   };
 
-  const maskApiKey = (apiKey: string) => {
-    const firstPart = apiKey.slice(0, 7);
-    const lastPart = apiKey.slice(-4);
-    const middleLength = apiKey.length - 11; // total length - first 7 - last 4
-    return firstPart + '*'.repeat(middleLength) + lastPart;
-  };
-
   const copyCommand = async (apiKey: string) => {
     try {
       await navigator.clipboard.writeText(apiKey);
@@ -213,23 +211,23 @@ export default function ApiKeyTable({ userEmail: _userEmail, onMessage }: ApiKey
       ) : (
         <div className="key-list">
           {apiKeys.map((key) => (
-            <div key={key.api_key} className="key-item">
+            <div key={key.id} className="key-item">
               <div className="key-info">
                 <span className="key-date">
                   {t('apiKeys.created', { date: new Date(key.created_at).toLocaleDateString() })}
                 </span>
                 <div className="key-command-row">
                   <div className="key-display">
-                    <code>{maskApiKey(key.api_key)}</code>
+                    <code>{key.key_preview}</code>
                   </div>
                   <div className="key-buttons">
                     <button 
                       className="copy-key-button"
-                      onClick={() => copyCommand(key.api_key)}
-                      disabled={copiedCommand === key.api_key || !apiEnabled}
-                      title={t('apiKeys.copy')}
+                      onClick={() => copyCommand(createdKeys[key.id])}
+                      disabled={!createdKeys[key.id] || copiedCommand === createdKeys[key.id] || !apiEnabled}
+                      title={createdKeys[key.id] ? t('apiKeys.copy') : t('apiKeys.copyUnavailable')}
                     >
-                      {copiedCommand === key.api_key ? (
+                      {copiedCommand === createdKeys[key.id] ? (
                         <svg width="16" height="16" viewBox="0 0 24 24" fill="none" xmlns="http://www.w3.org/2000/svg">
                           <path d="M20 6L9 17l-5-5" stroke="currentColor" strokeWidth="2" strokeLinecap="round" strokeLinejoin="round"/>
                         </svg>
@@ -242,7 +240,7 @@ export default function ApiKeyTable({ userEmail: _userEmail, onMessage }: ApiKey
                     </button>
                     <button 
                       className="delete-button"
-                      onClick={() => showDeleteModal(key.api_key)}
+                      onClick={() => showDeleteModal(key)}
                       title={t('apiKeys.delete')}
                     >
                       <svg width="16" height="16" viewBox="0 0 24 24" fill="none" xmlns="http://www.w3.org/2000/svg">
@@ -262,7 +260,7 @@ export default function ApiKeyTable({ userEmail: _userEmail, onMessage }: ApiKey
           <div className="modal-content" onClick={(e) => e.stopPropagation()}>
             <h3>{t('apiKeys.deleteTitle')}</h3>
             <p>{t('apiKeys.deleteMessage')}</p>
-            <p className="api-key-preview">{maskApiKey(deleteModal.apiKey)}</p>
+            <p className="api-key-preview">{deleteModal.preview}</p>
             <div className="modal-actions">
               <button className="cancel-button" onClick={hideDeleteModal} disabled={deleting}>
                 {t('apiKeys.cancel')}
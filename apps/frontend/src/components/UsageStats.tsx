@@ -33,6 +33,7 @@ interface GroupedUsage {
 
 interface PointsLimitInfo {
   pointsLimit: number;
+  unlimited: boolean;
   usedToday: number;
   remaining: number;
   updateTime: string | null;
@@ -189,33 +190,46 @@ export default function UsageStats({ userEmail, onMessage }: UsageStatsProps) {
             <tbody>
               <tr className="day-row">
                 <td style={{ padding: '12px', verticalAlign: 'middle', width: '100%' }}>
-                  {/* Stats */}
-                  <div style={{ display: 'flex', justifyContent: 'space-between', fontSize: '14px', color: '#333', marginBottom: '8px' }}>
-                    <span>
-                      {Math.round(pointsLimitInfo.pointsLimit)} {t('usage.points', 'Points')}
-                    </span>
-                    <span style={{ color: pointsLimitInfo.remaining < 0 ? '#dc3545' : (pointsLimitInfo.remaining / pointsLimitInfo.pointsLimit < 0.2) ? '#dc3545' : '#28a745', fontWeight: '600' }}>
-                      {pointsLimitInfo.remaining >= 0 ? `${Math.round(pointsLimitInfo.remaining)} ${t('usage.remaining', 'remaining')}` : `${Math.round(pointsLimitInfo.remaining)}`}
-                    </span>
-                  </div>
-                  
-                  {/* Progress Bar Container */}
-                  <div style={{ 
-                    width: '100%', 
-                    height: '12px', 
-                    backgroundColor: 'white', 
-                    overflow: 'hidden',
-                    border: '0.5px solid #6c757d'
-                  }}>
-                    {/* Progress Bar Fill - shows remaining */}
-                    <div style={{
-                      width: `${Math.max(0, Math.min(100, (pointsLimitInfo.remaining / pointsLimitInfo.pointsLimit) * 100))}%`,
-                      height: '100%',
-                      backgroundColor: pointsLimitInfo.remaining < 0 ? '#dc3545' : (pointsLimitInfo.remaining / pointsLimitInfo.pointsLimit < 0.2) ? '#dc3545' : '#28a745',
-                      transition: 'width 0.3s ease'
-                    }}>
+                  {pointsLimitInfo.unlimited ? (
+                    <div style={{ display: 'flex', justifyContent: 'space-between', fontSize: '14px', color: '#333' }}>
+                      <span style={{ color: '#28a745', fontWeight: '600' }}>
+                        {t('usage.unlimited', 'Unlimited')}
+                      </span>
+                      <span>
+                        {Math.round(pointsLimitInfo.usedToday)} {t('usage.points', 'Points')} {t('usage.usedToday', 'Used Today')}
+                      </span>
                     </div>
-                  </div>
+                  ) : (
+                    <>
+                      {/* Stats */}
+                      <div style={{ display: 'flex', justifyContent: 'space-between', fontSize: '14px', color: '#333', marginBottom: '8px' }}>
+                        <span>
+                          {Math.round(pointsLimitInfo.pointsLimit)} {t('usage.points', 'Points')}
+                        </span>
+                        <span style={{ color: pointsLimitInfo.remaining < 0 ? '#dc3545' : (pointsLimitInfo.remaining / pointsLimitInfo.pointsLimit < 0.2) ? '#dc3545' : '#28a745', fontWeight: '600' }}>
+                          {pointsLimitInfo.remaining >= 0 ? `${Math.round(pointsLimitInfo.remaining)} ${t('usage.remaining', 'remaining')}` : `${Math.round(pointsLimitInfo.remaining)}`}
+                        </span>
+                      </div>
+                      
+                      {/* Progress Bar Container */}
+                      <div style={{ 
+                        width: '100%', 
+                        height: '12px', 
+                        backgroundColor: 'white', 
+                        overflow: 'hidden',
+                        border: '0.5px solid #6c757d'
+                      }}>
+                        {/* Progress Bar Fill - shows remaining */}
+                        <div style={{
+                          width: `${Math.max(0, Math.min(100, (pointsLimitInfo.remaining / pointsLimitInfo.pointsLimit) * 100))}%`,
+                          height: '100%',
+                          backgroundColor: pointsLimitInfo.remaining < 0 ? '#dc3545' : (pointsLimitInfo.remaining / pointsLimitInfo.pointsLimit < 0.2) ? '#dc3545' : '#28a745',
+                          transition: 'width 0.3s ease'
+                        }}>
+                        </div>
+                      </div>
+                    </>
+                  )}
                 </td>
               </tr>
             </tbody>
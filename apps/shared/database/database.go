@@ -36,6 +36,14 @@ func (s *Service) Close() error {
 	return s.client.Close()
 }
 
+// Ping checks that Firestore is reachable and the credentials work, using a single-document query
+func (s *Service) Ping(ctx context.Context) error {
+	if _, err := s.client.Collection("health").Limit(1).Documents(ctx).GetAll(); err != nil {
+		return fmt.Errorf("firestore ping: %w", err)
+	}
+	return nil
+}
+
 func (s *Service) Client() *firestore.Client {
 	return s.client
 }
\ No newline at end of file
@@ -0,0 +1,21 @@
+package database
+
+// Number coerces a numeric Firestore field value to float64. Firestore returns integers (including
+// integer firestore.Increment results) as int64 and doubles as float64, and a field written by
+// different services can hold either; other Go integer and float types are accepted for values that
+// never went through Firestore. ok is false for missing and non-numeric values.
+func Number(value interface{}) (number float64, ok bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	}
+	return 0, false
+}
@@ -0,0 +1,28 @@
+package database
+
+import "testing"
+
+func TestNumber(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  interface{}
+		want   float64
+		wantOK bool
+	}{
+		{"int64 from an integer write or increment", int64(42), 42, true},
+		{"float64 from a double write or increment", 12.5, 12.5, true},
+		{"int", 7, 7, true},
+		{"int32", int32(3), 3, true},
+		{"float32", float32(1.5), 1.5, true},
+		{"missing", nil, 0, false},
+		{"string", "42", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Number(tt.value)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("Number(%v) = %v, %v; want %v, %v", tt.value, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package pricing
+
+// ModelPricing holds per-million-token prices for a model
+type ModelPricing struct {
+	InputPricePerMillion      float64 `firestore:"input_price_per_million" json:"input_price_per_million"`
+	OutputPricePerMillion     float64 `firestore:"output_price_per_million" json:"output_price_per_million"`
+	CacheReadPricePerMillion  float64 `firestore:"cache_read_price_per_million" json:"cache_read_price_per_million"`   // 90% discount from input
+	CacheWritePricePerMillion float64 `firestore:"cache_write_price_per_million" json:"cache_write_price_per_million"` // 25% more than input
+	// 1-hour TTL cache writes; 0 means DefaultCacheWrite1hMultiplier times the input price
+	CacheWrite1hPricePerMillion float64 `firestore:"cache_write_1h_price_per_million,omitempty" json:"cache_write_1h_price_per_million,omitempty"`
+
+	// Per-million prices once input exceeds LongContextThreshold; 0 means the model has no long-context tier
+	InputPriceAbove200K  float64 `firestore:"input_price_above_200k_per_million,omitempty" json:"input_price_above_200k_per_million,omitempty"`
+	OutputPriceAbove200K float64 `firestore:"output_price_above_200k_per_million,omitempty" json:"output_price_above_200k_per_million,omitempty"`
+}
+
+// DefaultCacheWrite1hMultiplier prices 1-hour cache writes relative to input when no rate is set
+const DefaultCacheWrite1hMultiplier = 2.0
+
+// CacheWrite1hPrice returns the per-million price of 1-hour TTL cache writes
+func (p ModelPricing) CacheWrite1hPrice() float64 {
+	if p.CacheWrite1hPricePerMillion > 0 {
+		return p.CacheWrite1hPricePerMillion
+	}
+	return p.InputPricePerMillion * DefaultCacheWrite1hMultiplier
+}
+
+// LongContextThreshold is the input token count above which long-context prices apply
+const LongContextThreshold = 200_000
+
+// TokenCosts returns the input and output cost of a request. With a long-context tier, input tokens
+// beyond LongContextThreshold are priced at InputPriceAbove200K, and the output of such a request at
+// OutputPriceAbove200K.
+func (p ModelPricing) TokenCosts(inputTokens int, outputTokens int) (inputCost float64, outputCost float64) {
+	baseInput := inputTokens
+	if p.InputPriceAbove200K > 0 && inputTokens > LongContextThreshold {
+		baseInput = LongContextThreshold
+		inputCost = float64(inputTokens-LongContextThreshold) * p.InputPriceAbove200K / 1_000_000
+	}
+	inputCost += float64(baseInput) * p.InputPricePerMillion / 1_000_000
+
+	outputPrice := p.OutputPricePerMillion
+	if p.OutputPriceAbove200K > 0 && inputTokens > LongContextThreshold {
+		outputPrice = p.OutputPriceAbove200K
+	}
+	outputCost = float64(outputTokens) * outputPrice / 1_000_000
+	return inputCost, outputCost
+}
+
+// DefaultModelPricing returns the built-in price table keyed by lowercase model name.
+// Both the proxy (model validation) and the billing service (cost calculation) use these keys.
+func DefaultModelPricing() map[string]ModelPricing {
+	return map[string]ModelPricing{
+		// Claude 3.5 series
+		"claude-3-5-sonnet": {
+			InputPricePerMillion:      3.0,
+			OutputPricePerMillion:     15.0,
+			CacheReadPricePerMillion:  0.30, // 90% discount from input
+			CacheWritePricePerMillion: 3.75, // 25% more than input
+		},
+		"claude-3-5-sonnet-20241022": {
+			InputPricePerMillion:      3.0,
+			OutputPricePerMillion:     15.0,
+			CacheReadPricePerMillion:  0.30, // 90% discount from input
+			CacheWritePricePerMillion: 3.75, // 25% more than input
+		},
+		"claude-3-5-haiku": {
+			InputPricePerMillion:      0.80,
+			OutputPricePerMillion:     4.0,
+			CacheReadPricePerMillion:  0.08, // 90% discount from input
+			CacheWritePricePerMillion: 1.00, // 25% more than input
+		},
+		"claude-3-5-haiku-20241022": {
+			InputPricePerMillion:      0.80,
+			OutputPricePerMillion:     4.0,
+			CacheReadPricePerMillion:  0.08, // 90% discount from input
+			CacheWritePricePerMillion: 1.00, // 25% more than input
+		},
+
+		// Claude 4 series
+		"claude-opus-4-1-20250805": {
+			InputPricePerMillion:      15.0,
+			OutputPricePerMillion:     75.0,
+			CacheReadPricePerMillion:  1.50,  // 90% discount from input
+			CacheWritePricePerMillion: 18.75, // 25% more than input
+		},
+		"claude-sonnet-4-20250514": {
+			InputPricePerMillion:      3.0,
+			OutputPricePerMillion:     15.0,
+			CacheReadPricePerMillion:  0.30, // 90% discount from input
+			CacheWritePricePerMillion: 3.75, // 25% more than input
+		},
+
+		// Claude 3 series
+		"claude-3-opus": {
+			InputPricePerMillion:      15.0,
+			OutputPricePerMillion:     75.0,
+			CacheReadPricePerMillion:  1.50,  // 90% discount from input
+			CacheWritePricePerMillion: 18.75, // 25% more than input
+		},
+		"claude-3-opus-20240229": {
+			InputPricePerMillion:      15.0,
+			OutputPricePerMillion:     75.0,
+			CacheReadPricePerMillion:  1.50,  // 90% discount from input
+			CacheWritePricePerMillion: 18.75, // 25% more than input
+		},
+		"claude-3-sonnet": {
+			InputPricePerMillion:      3.0,
+			OutputPricePerMillion:     15.0,
+			CacheReadPricePerMillion:  0.30, // 90% discount from input
+			CacheWritePricePerMillion: 3.75, // 25% more than input
+		},
+		"claude-3-sonnet-20240229": {
+			InputPricePerMillion:      3.0,
+			OutputPricePerMillion:     15.0,
+			CacheReadPricePerMillion:  0.30, // 90% discount from input
+			CacheWritePricePerMillion: 3.75, // 25% more than input
+		},
+		"claude-3-haiku": {
+			InputPricePerMillion:      0.25,
+			OutputPricePerMillion:     1.25,
+			CacheReadPricePerMillion:  0.025,  // 90% discount from input
+			CacheWritePricePerMillion: 0.3125, // 25% more than input
+		},
+		"claude-3-haiku-20240307": {
+			InputPricePerMillion:      0.25,
+			OutputPricePerMillion:     1.25,
+			CacheReadPricePerMillion:  0.025,  // 90% discount from input
+			CacheWritePricePerMillion: 0.3125, // 25% more than input
+		},
+
+		// Claude 2 series
+		"claude-2.1": {
+			InputPricePerMillion:      8.0,
+			OutputPricePerMillion:     24.0,
+			CacheReadPricePerMillion:  0.80, // 90% discount from input
+			CacheWritePricePerMillion: 10.0, // 25% more than input
+		},
+		"claude-2.0": {
+			InputPricePerMillion:      8.0,
+			OutputPricePerMillion:     24.0,
+			CacheReadPricePerMillion:  0.80, // 90% discount from input
+			CacheWritePricePerMillion: 10.0, // 25% more than input
+		},
+
+		// Claude Instant
+		"claude-instant-1.2": {
+			InputPricePerMillion:      0.8,
+			OutputPricePerMillion:     2.4,
+			CacheReadPricePerMillion:  0.08, // 90% discount from input
+			CacheWritePricePerMillion: 1.0,  // 25% more than input
+		},
+	}
+}
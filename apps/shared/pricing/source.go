@@ -0,0 +1,51 @@
+package pricing
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+)
+
+// Collection holds per-model prices keyed by model name, so prices can be added or changed without
+// a redeploy. The proxy (model validation) and the billing service (cost calculation) both load it.
+const Collection = "model_pricing"
+
+// Load reads the model_pricing collection and returns it merged over the built-in defaults.
+// Models missing from the collection keep their default price.
+func Load(ctx context.Context, client *firestore.Client) (map[string]ModelPricing, error) {
+	docs, err := client.Collection(Collection).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", Collection, err)
+	}
+
+	overrides := make(map[string]ModelPricing, len(docs))
+	for _, doc := range docs {
+		var modelPricing ModelPricing
+		if err := doc.DataTo(&modelPricing); err != nil {
+			log.Printf("Skipping invalid %s document %s: %v", Collection, doc.Ref.ID, err)
+			continue
+		}
+		overrides[doc.Ref.ID] = modelPricing
+	}
+	return Merge(DefaultModelPricing(), overrides), nil
+}
+
+// Merge returns defaults with overrides applied by lowercase model name. Overrides without an input
+// or output price are skipped, since a misspelled field would otherwise make a model free.
+func Merge(defaults map[string]ModelPricing, overrides map[string]ModelPricing) map[string]ModelPricing {
+	table := make(map[string]ModelPricing, len(defaults)+len(overrides))
+	for model, modelPricing := range defaults {
+		table[strings.ToLower(model)] = modelPricing
+	}
+	for model, modelPricing := range overrides {
+		if modelPricing.InputPricePerMillion <= 0 || modelPricing.OutputPricePerMillion <= 0 {
+			log.Printf("Skipping %s entry %s without input and output prices", Collection, model)
+			continue
+		}
+		table[strings.ToLower(model)] = modelPricing
+	}
+	return table
+}
@@ -0,0 +1,25 @@
+package pricing
+
+import "testing"
+
+func TestMerge_OverridesDefaultsAndSkipsUnpriced(t *testing.T) {
+	table := Merge(DefaultModelPricing(), map[string]ModelPricing{
+		"Claude-New-Model":         {InputPricePerMillion: 2.0, OutputPricePerMillion: 10.0},
+		"claude-sonnet-4-20250514": {InputPricePerMillion: 4.0, OutputPricePerMillion: 20.0},
+		"claude-3-5-haiku":         {InputPricePerMillion: 1.0},     // missing output price
+		"claude-3-haiku-x1":        {CacheReadPricePerMillion: 5.0}, // misspelled fields read as zero
+	})
+
+	if got := table["claude-new-model"]; got.InputPricePerMillion != 2.0 {
+		t.Errorf("expected new model to be added under its lowercase name, got %+v", got)
+	}
+	if got := table["claude-sonnet-4-20250514"]; got.InputPricePerMillion != 4.0 {
+		t.Errorf("expected override to replace the default price, got %+v", got)
+	}
+	if got := table["claude-3-5-haiku"]; got != DefaultModelPricing()["claude-3-5-haiku"] {
+		t.Errorf("expected unpriced override to keep the default, got %+v", got)
+	}
+	if _, exists := table["claude-3-haiku-x1"]; exists {
+		t.Errorf("expected unpriced new model to be skipped")
+	}
+}
@@ -0,0 +1,125 @@
+package timewindow
+
+import "time"
+
+const (
+	// HourKeyFormat is the layout used for hourly aggregate keys
+	HourKeyFormat = "2006-01-02T15"
+	// MinuteKeyFormat is the layout used for minute aggregate keys
+	MinuteKeyFormat = "2006-01-02T15:04"
+	// DayKeyFormat is the layout used for daily aggregate keys
+	DayKeyFormat = "2006-01-02"
+	// DefaultDailyResetHour is the UTC hour at which daily limits reset (8pm UTC = 4am UTC+8)
+	DefaultDailyResetHour = 20
+)
+
+// Window is a half-open time range [Start, End) in UTC
+type Window struct {
+	Start time.Time
+	End   time.Time
+}
+
+// Contains reports whether t falls within the window
+func (w Window) Contains(t time.Time) bool {
+	return !t.Before(w.Start) && t.Before(w.End)
+}
+
+// Minute returns the UTC minute containing t
+func Minute(t time.Time) Window {
+	start := t.UTC().Truncate(time.Minute)
+	return Window{Start: start, End: start.Add(time.Minute)}
+}
+
+// Hour returns the UTC hour containing t
+func Hour(t time.Time) Window {
+	start := t.UTC().Truncate(time.Hour)
+	return Window{Start: start, End: start.Add(time.Hour)}
+}
+
+// Day returns the UTC calendar day containing t
+func Day(t time.Time) Window {
+	u := t.UTC()
+	start := time.Date(u.Year(), u.Month(), u.Day(), 0, 0, 0, 0, time.UTC)
+	return Window{Start: start, End: start.AddDate(0, 0, 1)}
+}
+
+// Month returns the UTC calendar month containing t
+func Month(t time.Time) Window {
+	u := t.UTC()
+	return MonthOf(u.Year(), u.Month())
+}
+
+// MonthOf returns the UTC calendar month for the given year and month
+func MonthOf(year int, month time.Month) Window {
+	start := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	return Window{Start: start, End: start.AddDate(0, 1, 0)}
+}
+
+// DailyReset returns the 24-hour window containing t that starts at resetHour UTC
+func DailyReset(t time.Time, resetHour int) Window {
+	u := t.UTC()
+	start := time.Date(u.Year(), u.Month(), u.Day(), resetHour, 0, 0, 0, time.UTC)
+	if u.Hour() < resetHour {
+		start = start.AddDate(0, 0, -1)
+	}
+	return Window{Start: start, End: start.Add(24 * time.Hour)}
+}
+
+// CurrentDailyReset returns the daily limit window for the current time using the default reset hour
+func CurrentDailyReset() Window {
+	return DailyReset(time.Now(), DefaultDailyResetHour)
+}
+
+// SplitDays splits w for reads that combine daily and hourly rollups. Days are the UTC days whose daily
+// rollup holds only usage inside w: days fully inside w, plus a trailing day that extends past w.End
+// when no usage can exist after dataEnd <= w.End (the rest of that day is in the future).
+// Rest are the remaining contiguous ranges of w, to be read from hourly buckets.
+func SplitDays(w Window, dataEnd time.Time) (days []Window, rest []Window) {
+	for day := Day(w.Start); day.Start.Before(w.End); day = Day(day.End) {
+		startsInside := !day.Start.Before(w.Start)
+		endsInside := !day.End.After(w.End) || !dataEnd.After(w.End)
+		if startsInside && endsInside {
+			days = append(days, day)
+			continue
+		}
+
+		overlap := Window{Start: day.Start, End: day.End}
+		if overlap.Start.Before(w.Start) {
+			overlap.Start = w.Start
+		}
+		if overlap.End.After(w.End) {
+			overlap.End = w.End
+		}
+		if n := len(rest); n > 0 && rest[n-1].End.Equal(overlap.Start) {
+			rest[n-1].End = overlap.End
+			continue
+		}
+		rest = append(rest, overlap)
+	}
+	return days, rest
+}
+
+// Key formats t in UTC using layout, for use as an aggregate bucket key
+func Key(t time.Time, layout string) string {
+	return t.UTC().Format(layout)
+}
+
+// ParseKey parses a bucket key produced by Key back into a UTC time
+func ParseKey(key string, layout string) (time.Time, error) {
+	return time.ParseInLocation(layout, key, time.UTC)
+}
+
+// HourKey returns the hourly bucket key for t
+func HourKey(t time.Time) string {
+	return Key(t, HourKeyFormat)
+}
+
+// MinuteKey returns the minute bucket key for t
+func MinuteKey(t time.Time) string {
+	return Key(t, MinuteKeyFormat)
+}
+
+// DayKey returns the UTC daily bucket key for t
+func DayKey(t time.Time) string {
+	return Key(t, DayKeyFormat)
+}
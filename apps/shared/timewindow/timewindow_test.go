@@ -0,0 +1,147 @@
+package timewindow
+
+import (
+	"testing"
+	"time"
+)
+
+func date(year int, month time.Month, day, hour, min, sec int) time.Time {
+	return time.Date(year, month, day, hour, min, sec, 0, time.UTC)
+}
+
+func assertWindow(t *testing.T, got Window, wantStart, wantEnd time.Time) {
+	t.Helper()
+	if !got.Start.Equal(wantStart) || !got.End.Equal(wantEnd) {
+		t.Errorf("window = [%s, %s), want [%s, %s)", got.Start, got.End, wantStart, wantEnd)
+	}
+}
+
+func TestMinute(t *testing.T) {
+	assertWindow(t, Minute(date(2024, 3, 10, 14, 59, 59)), date(2024, 3, 10, 14, 59, 0), date(2024, 3, 10, 15, 0, 0))
+	assertWindow(t, Minute(date(2024, 12, 31, 23, 59, 30)), date(2024, 12, 31, 23, 59, 0), date(2025, 1, 1, 0, 0, 0))
+}
+
+func TestHour(t *testing.T) {
+	assertWindow(t, Hour(date(2024, 3, 10, 14, 0, 0)), date(2024, 3, 10, 14, 0, 0), date(2024, 3, 10, 15, 0, 0))
+	assertWindow(t, Hour(date(2024, 1, 31, 23, 30, 0)), date(2024, 1, 31, 23, 0, 0), date(2024, 2, 1, 0, 0, 0))
+}
+
+func TestDay(t *testing.T) {
+	assertWindow(t, Day(date(2024, 2, 29, 12, 0, 0)), date(2024, 2, 29, 0, 0, 0), date(2024, 3, 1, 0, 0, 0))
+	assertWindow(t, Day(date(2023, 12, 31, 0, 0, 0)), date(2023, 12, 31, 0, 0, 0), date(2024, 1, 1, 0, 0, 0))
+}
+
+func TestMonth(t *testing.T) {
+	tests := []struct {
+		name      string
+		at        time.Time
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{"leap february", date(2024, 2, 15, 0, 0, 0), date(2024, 2, 1, 0, 0, 0), date(2024, 3, 1, 0, 0, 0)},
+		{"non-leap february", date(2023, 2, 28, 23, 59, 59), date(2023, 2, 1, 0, 0, 0), date(2023, 3, 1, 0, 0, 0)},
+		{"december rolls into next year", date(2024, 12, 31, 23, 0, 0), date(2024, 12, 1, 0, 0, 0), date(2025, 1, 1, 0, 0, 0)},
+		{"first instant of month", date(2024, 5, 1, 0, 0, 0), date(2024, 5, 1, 0, 0, 0), date(2024, 6, 1, 0, 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertWindow(t, Month(tt.at), tt.wantStart, tt.wantEnd)
+		})
+	}
+
+	assertWindow(t, MonthOf(2024, time.December), date(2024, 12, 1, 0, 0, 0), date(2025, 1, 1, 0, 0, 0))
+}
+
+func TestDailyReset(t *testing.T) {
+	tests := []struct {
+		name      string
+		at        time.Time
+		resetHour int
+		wantStart time.Time
+	}{
+		{"before reset uses previous day", date(2024, 3, 10, 19, 59, 59), 20, date(2024, 3, 9, 20, 0, 0)},
+		{"exactly at reset starts new window", date(2024, 3, 10, 20, 0, 0), 20, date(2024, 3, 10, 20, 0, 0)},
+		{"after reset", date(2024, 3, 10, 23, 0, 0), 20, date(2024, 3, 10, 20, 0, 0)},
+		{"before reset on first of month", date(2024, 3, 1, 5, 0, 0), 20, date(2024, 2, 29, 20, 0, 0)},
+		{"before reset on new year", date(2025, 1, 1, 0, 30, 0), 20, date(2024, 12, 31, 20, 0, 0)},
+		{"midnight reset behaves like calendar day", date(2024, 3, 10, 0, 0, 0), 0, date(2024, 3, 10, 0, 0, 0)},
+		{"custom morning reset", date(2024, 3, 10, 5, 0, 0), 6, date(2024, 3, 9, 6, 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertWindow(t, DailyReset(tt.at, tt.resetHour), tt.wantStart, tt.wantStart.Add(24*time.Hour))
+		})
+	}
+}
+
+func TestDailyReset_NormalizesToUTC(t *testing.T) {
+	// 03:00 at UTC+8 is 19:00 UTC on the previous day, before the 8pm reset
+	shanghai := time.FixedZone("UTC+8", 8*60*60)
+	at := time.Date(2024, 3, 11, 3, 0, 0, 0, shanghai)
+
+	assertWindow(t, DailyReset(at, 20), date(2024, 3, 9, 20, 0, 0), date(2024, 3, 10, 20, 0, 0))
+}
+
+func TestWindowContains(t *testing.T) {
+	w := Hour(date(2024, 3, 10, 14, 30, 0))
+	if !w.Contains(w.Start) {
+		t.Error("window should contain its start")
+	}
+	if w.Contains(w.End) {
+		t.Error("window should not contain its end")
+	}
+}
+
+func TestKeys(t *testing.T) {
+	at := time.Date(2024, 3, 11, 3, 7, 0, 0, time.FixedZone("UTC+8", 8*60*60))
+
+	if got := HourKey(at); got != "2024-03-10T19" {
+		t.Errorf("HourKey = %q, want 2024-03-10T19", got)
+	}
+	if got := MinuteKey(at); got != "2024-03-10T19:07" {
+		t.Errorf("MinuteKey = %q, want 2024-03-10T19:07", got)
+	}
+
+	parsed, err := ParseKey(HourKey(at), HourKeyFormat)
+	if err != nil {
+		t.Fatalf("ParseKey returned error: %v", err)
+	}
+	if !parsed.Equal(Hour(at).Start) {
+		t.Errorf("ParseKey = %s, want %s", parsed, Hour(at).Start)
+	}
+	if parsed.Location() != time.UTC {
+		t.Errorf("ParseKey location = %s, want UTC", parsed.Location())
+	}
+}
+
+func TestSplitDays_DailyResetWindow(t *testing.T) {
+	w := DailyReset(date(2024, 3, 11, 9, 0, 0), DefaultDailyResetHour)
+
+	// Mid-window: the current UTC day has no usage after now, so its daily rollup covers it
+	days, rest := SplitDays(w, date(2024, 3, 11, 9, 0, 0))
+	if len(days) != 1 || len(rest) != 1 {
+		t.Fatalf("expected 1 day and 1 hourly range, got %d and %d", len(days), len(rest))
+	}
+	assertWindow(t, days[0], date(2024, 3, 11, 0, 0, 0), date(2024, 3, 12, 0, 0, 0))
+	assertWindow(t, rest[0], date(2024, 3, 10, 20, 0, 0), date(2024, 3, 11, 0, 0, 0))
+
+	// Reading a past window: the day's rollup includes usage after the window ends, so use hours
+	days, rest = SplitDays(w, date(2024, 3, 12, 9, 0, 0))
+	if len(days) != 0 || len(rest) != 1 {
+		t.Fatalf("expected no days and 1 hourly range, got %d and %d", len(days), len(rest))
+	}
+	assertWindow(t, rest[0], w.Start, w.End)
+}
+
+func TestSplitDays_MultiDayWindow(t *testing.T) {
+	w := Window{Start: date(2024, 3, 10, 20, 0, 0), End: date(2024, 3, 13, 6, 0, 0)}
+
+	days, rest := SplitDays(w, date(2024, 3, 20, 0, 0, 0))
+	if len(days) != 2 || len(rest) != 2 {
+		t.Fatalf("expected 2 days and 2 hourly ranges, got %d and %d", len(days), len(rest))
+	}
+	assertWindow(t, days[0], date(2024, 3, 11, 0, 0, 0), date(2024, 3, 12, 0, 0, 0))
+	assertWindow(t, days[1], date(2024, 3, 12, 0, 0, 0), date(2024, 3, 13, 0, 0, 0))
+	assertWindow(t, rest[0], date(2024, 3, 10, 20, 0, 0), date(2024, 3, 11, 0, 0, 0))
+	assertWindow(t, rest[1], date(2024, 3, 13, 0, 0, 0), date(2024, 3, 13, 6, 0, 0))
+}
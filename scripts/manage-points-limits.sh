@@ -20,7 +20,7 @@ show_usage() {
     echo "Usage: $0 [command] [options]"
     echo ""
     echo "Commands:"
-    echo "  set USER_EMAIL POINTS_LIMIT    Set points limit for user"
+    echo "  set USER_EMAIL POINTS_LIMIT    Set points limit for user (\"unlimited\" removes the limit)"
     echo "  get USER_EMAIL                 Get points limit for user"
     echo "  list                          List all points limits"
     echo ""
@@ -30,6 +30,7 @@ show_usage() {
     echo ""
     echo "Examples:"
     echo "  $0 set user@example.com 1000 -p my-project -d my-database"
+    echo "  $0 set user@example.com unlimited -p my-project -d my-database"
     echo "  $0 get user@example.com -p my-project -d my-database"
     echo "  $0 list -p my-project -d my-database"
 }
@@ -111,12 +112,20 @@ case "$COMMAND" in
     set)
         echo "📝 Setting daily points limit: $USER_ID = $POINTS_LIMIT points"
         
+        # "unlimited" is stored as an explicit flag; the points value is then ignored
+        UNLIMITED=false
+        if [[ "$POINTS_LIMIT" == "unlimited" ]]; then
+          UNLIMITED=true
+          POINTS_LIMIT=0
+        fi
+        
         # Create document data
         DOC_DATA=$(cat <<EOF
 {
   "fields": {
     "userId": {"stringValue": "$USER_ID"},
     "pointsLimit": {"integerValue": "$POINTS_LIMIT"},
+    "unlimited": {"booleanValue": $UNLIMITED},
     "updateTime": {"stringValue": "$(date -u +"%Y-%m-%dT%H:%M:%S.000Z")"}
   }
 }
@@ -156,7 +165,7 @@ EOF
             exit 1
           fi
         else
-          POINTS_LIMIT=$(echo "$RESULT" | jq -r '.fields.pointsLimit.integerValue')
+          POINTS_LIMIT=$(echo "$RESULT" | jq -r 'if .fields.unlimited.booleanValue then "unlimited" else .fields.pointsLimit.integerValue end')
           UPDATE_TIME=$(echo "$RESULT" | jq -r '.fields.updateTime.stringValue')
           echo ""
           echo "📊 Points limit for $USER_ID:"
@@ -187,7 +196,7 @@ EOF
           
           echo "$RESULT" | jq -r '.documents[] | [
             .fields.userId.stringValue,
-            .fields.pointsLimit.integerValue,
+            (if .fields.unlimited.booleanValue then "unlimited" else .fields.pointsLimit.integerValue end),
             .fields.updateTime.stringValue
           ] | @tsv' | while IFS=$'\t' read -r user_id points_limit update_time; do
             printf "%-30s %-15s %-25s\n" "$user_id" "$points_limit" "$update_time"
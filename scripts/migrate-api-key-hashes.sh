@@ -0,0 +1,139 @@
+#!/bin/bash
+
+# API Key Hash Migration Script for Firestore
+# Rewrites api_key_bindings documents keyed by the plaintext API key under sha256_hex(api_key),
+# the document ID the frontend writes and the backend looks up, then deletes the plaintext documents.
+# Once it reports no remaining plaintext bindings, set DISABLE_PLAINTEXT_API_KEYS=true on the backend.
+
+set -e  # Exit on any error
+
+# Default values
+PROJECT_ID=""
+DATABASE=""
+DRY_RUN=false
+
+# Function to show usage
+show_usage() {
+    echo "API Key Hash Migration Script"
+    echo ""
+    echo "Usage: $0 [options]"
+    echo ""
+    echo "Options:"
+    echo "  -p, --project PROJECT_ID       GCP Project ID (required)"
+    echo "  -d, --database DATABASE        Database name (required)"
+    echo "  -n, --dry-run                  List plaintext bindings without changing them"
+    echo "  -h, --help                     Show this help message"
+    echo ""
+    echo "Examples:"
+    echo "  $0 -p simple-relay-468808 -d simple-relay-db-staging -n"
+    echo "  $0 -p simple-relay-468808 -d simple-relay-db-staging"
+    exit 0
+}
+
+# Parse command line arguments
+while [[ $# -gt 0 ]]; do
+    case $1 in
+        -p|--project)
+            PROJECT_ID="$2"
+            shift 2
+            ;;
+        -d|--database)
+            DATABASE="$2"
+            shift 2
+            ;;
+        -n|--dry-run)
+            DRY_RUN=true
+            shift
+            ;;
+        -h|--help)
+            show_usage
+            ;;
+        *)
+            echo "Unknown option: $1"
+            show_usage
+            ;;
+    esac
+done
+
+# Validate required parameters
+if [[ -z "$PROJECT_ID" || -z "$DATABASE" ]]; then
+    echo "❌ Error: PROJECT_ID and DATABASE are required"
+    show_usage
+fi
+
+echo "🚀 API Key Hash Migration"
+echo "Project ID: $PROJECT_ID"
+echo "Database: $DATABASE"
+[[ "$DRY_RUN" == true ]] && echo "Mode: dry run"
+echo ""
+
+# Get access token
+echo "🔑 Getting access token..."
+ACCESS_TOKEN=$(gcloud auth print-access-token)
+
+COLLECTION_URL="https://firestore.googleapis.com/v1/projects/$PROJECT_ID/databases/$DATABASE/documents/api_key_bindings"
+
+# Collect every binding, following page tokens
+DOCUMENTS="[]"
+PAGE_TOKEN=""
+while true; do
+    RESULT=$(curl -s -H "Authorization: Bearer $ACCESS_TOKEN" \
+        "$COLLECTION_URL?pageSize=300${PAGE_TOKEN:+&pageToken=$PAGE_TOKEN}")
+    if [[ $(echo "$RESULT" | jq -r '.error.code // "null"') != "null" ]]; then
+        echo "❌ Error: $(echo "$RESULT" | jq -r '.error.message')"
+        exit 1
+    fi
+    DOCUMENTS=$(jq -s '.[0] + (.[1].documents // [])' <(echo "$DOCUMENTS") <(echo "$RESULT"))
+    PAGE_TOKEN=$(echo "$RESULT" | jq -r '.nextPageToken // ""')
+    [[ -z "$PAGE_TOKEN" ]] && break
+done
+
+# Hashed bindings are 64 lowercase hex characters; everything else is keyed by the plaintext key
+PLAINTEXT=$(echo "$DOCUMENTS" | jq -c '.[] | select(.name | split("/") | .[-1] | test("^[0-9a-f]{64}$") | not)')
+if [[ -z "$PLAINTEXT" ]]; then
+    echo "✅ No plaintext bindings left; DISABLE_PLAINTEXT_API_KEYS=true is safe"
+    exit 0
+fi
+echo "🔍 Found $(echo "$PLAINTEXT" | wc -l) plaintext binding(s)"
+
+MIGRATED=0
+FAILED=0
+while read -r doc; do
+    api_key=$(echo "$doc" | jq -r '.name | split("/") | .[-1]')
+    hashed=$(printf '%s' "$api_key" | sha256sum | cut -d' ' -f1)
+    preview="${api_key:0:7}$(printf '%*s' $((${#api_key} - 11)) '' | tr ' ' '*')${api_key: -4}"
+    echo "   🔁 ${api_key:0:10}... -> ${hashed:0:12}..."
+    [[ "$DRY_RUN" == true ]] && continue
+
+    # Copy the fields under the hashed ID, refusing to overwrite a binding already migrated
+    fields=$(echo "$doc" | jq -c --arg preview "$preview" '{fields: (.fields + {key_preview: {stringValue: $preview}})}')
+    RESULT=$(curl -s -X PATCH \
+        -H "Authorization: Bearer $ACCESS_TOKEN" \
+        -H "Content-Type: application/json" \
+        -d "$fields" \
+        "$COLLECTION_URL/$hashed?currentDocument.exists=false")
+    status=$(echo "$RESULT" | jq -r '.error.status // "OK"')
+    if [[ "$status" != "OK" && "$status" != "FAILED_PRECONDITION" && "$status" != "ALREADY_EXISTS" ]]; then
+        echo "   ❌ Failed to copy ${api_key:0:10}...: $(echo "$RESULT" | jq -r '.error.message')"
+        FAILED=$((FAILED + 1))
+        continue
+    fi
+
+    RESULT=$(curl -s -X DELETE -H "Authorization: Bearer $ACCESS_TOKEN" "$COLLECTION_URL/$api_key")
+    if [[ $(echo "$RESULT" | jq -r '.error.code // "null"') != "null" ]]; then
+        echo "   ❌ Copied but failed to delete ${api_key:0:10}...: $(echo "$RESULT" | jq -r '.error.message')"
+        FAILED=$((FAILED + 1))
+        continue
+    fi
+    MIGRATED=$((MIGRATED + 1))
+done <<< "$PLAINTEXT"
+
+echo ""
+if [[ "$DRY_RUN" == true ]]; then
+    echo "✅ Dry run complete; rerun without -n to migrate"
+elif [[ $FAILED -gt 0 ]]; then
+    echo "❌ Migrated $MIGRATED binding(s), $FAILED failed; rerun to retry"
+    exit 1
+else
+    echo "✅ Migrated $MIGRATED binding(s); DISABLE_PLAINTEXT_API_KEYS=true is now safe"
+fi
@@ -161,9 +161,13 @@ while read -r doc; do
     input_tokens=$(echo "$doc" | jq -r '.fields.input_tokens.integerValue // 0' 2>/dev/null)
     output_tokens=$(echo "$doc" | jq -r '.fields.output_tokens.integerValue // 0' 2>/dev/null)
     total_cost=$(echo "$doc" | jq -r '.fields.total_cost.doubleValue // 0' 2>/dev/null)
+    status=$(echo "$doc" | jq -r '.fields.status.stringValue // empty' 2>/dev/null)
     
     [[ -z "$user_id" || -z "$timestamp" ]] && continue
     
+    # Error responses are recorded with zero usage but never aggregated
+    [[ "$status" == "error" ]] && continue
+    
     # Apply user filter
     [[ -n "$USER_EMAIL" && "$user_id" != "$USER_EMAIL" ]] && continue
     
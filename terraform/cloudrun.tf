@@ -87,14 +87,14 @@ resource "google_cloud_run_v2_service" "simple_relay" {
         startup_cpu_boost = true
       }
 
-      # Health checks
+      # Health checks; startup waits for Firestore via /ready, liveness stays on the cheap /health
       startup_probe {
         initial_delay_seconds = 10
         timeout_seconds = 5
         period_seconds = 10
         failure_threshold = 30
         http_get {
-          path = "/health"
+          path = "/ready"
           port = 8080
         }
       }
@@ -181,14 +181,14 @@ resource "google_cloud_run_v2_service" "simple_billing" {
         startup_cpu_boost = true
       }
 
-      # Health checks
+      # Health checks; startup waits for Firestore via /ready, liveness stays on the cheap /health
       startup_probe {
         initial_delay_seconds = 10
         timeout_seconds = 5
         period_seconds = 10
         failure_threshold = 30
         http_get {
-          path = "/health"
+          path = "/ready"
           port = 8081
         }
       }
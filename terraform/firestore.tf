@@ -59,6 +59,23 @@ resource "google_firestore_index" "hourly_aggregates_user_hour_desc" {
   }
 }
 
+# Firestore Index for daily_aggregates collection - for daily limit windowed reads
+resource "google_firestore_index" "daily_aggregates_user_day_asc" {
+  project    = var.project_id
+  database   = google_firestore_database.oauth_database.name
+  collection = "daily_aggregates"
+
+  fields {
+    field_path = "user_id"
+    order      = "ASCENDING"
+  }
+
+  fields {
+    field_path = "day"
+    order      = "ASCENDING"
+  }
+}
+
 # Firestore Index for usage_records collection - by model
 resource "google_firestore_index" "usage_records_model_timestamp" {
   project    = var.project_id